@@ -0,0 +1,218 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/hex"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// AdminComponent labels the Job bootstrapping the admin account.
+	AdminComponent = "admin"
+
+	// AdminBootstrapContainer is the admin bootstrap Job container whose
+	// termination message holds AdminAccountReplaced or AdminAccountKept.
+	AdminBootstrapContainer = "bootstrap"
+
+	// AdminAccountReplaced and AdminAccountKept report whether the admin
+	// bootstrap Job replaced the default admin account or found it
+	// already replaced and kept the existing admins.
+	AdminAccountReplaced = "replaced"
+	AdminAccountKept     = "kept"
+
+	// unexposedComponent labels no pods. The Service selects it to route
+	// nowhere while the default admin account can still be logged into.
+	unexposedComponent = "unexposed"
+
+	// AdminEmailKey, AdminPasswordKey and AdminPasswordHashKey are the keys
+	// of the admin Secret.
+	AdminEmailKey        = "email"
+	AdminPasswordKey     = "password"
+	AdminPasswordHashKey = "password-hash"
+
+	// defaultAdminEmail is the email of the admin account BookStack
+	// creates on first boot, with the password "password".
+	defaultAdminEmail = "admin@admin.com"
+	// defaultAdminName is the name of the bootstrapped admin account.
+	defaultAdminName = "Admin"
+)
+
+// AdminSpec configures the admin account bootstrapped on first boot in
+// place of BookStack's default admin@admin.com account.
+type AdminSpec struct {
+	// Email is the email the admin logs in with. Defaults to
+	// admin@admin.com.
+	// +optional
+	Email string `json:"email,omitempty"`
+
+	// Name is the display name of the admin. Defaults to Admin.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// PasswordSecretRef selects the admin password. A password is
+	// generated and stored in the <name>-admin Secret when unset.
+	// +optional
+	PasswordSecretRef *corev1.SecretKeySelector `json:"passwordSecretRef,omitempty"`
+}
+
+// AdminEmail returns the email of the bootstrapped admin account.
+func (b *BookStack) AdminEmail() string {
+	if b.Spec.Admin == nil {
+		return defaultAdminEmail
+	}
+
+	return valueOrDefault(b.Spec.Admin.Email, defaultAdminEmail)
+}
+
+// adminName returns the name of the bootstrapped admin account.
+func (b *BookStack) adminName() string {
+	if b.Spec.Admin == nil {
+		return defaultAdminName
+	}
+
+	return valueOrDefault(b.Spec.Admin.Name, defaultAdminName)
+}
+
+// AdminBootstrapped returns true once the default admin account has been
+// replaced with the one in spec.admin, or found already replaced.
+func (b *BookStack) AdminBootstrapped() bool {
+	return meta.IsStatusConditionTrue(b.Status.Conditions, ConditionAdminBootstrapped)
+}
+
+// AdminAdopted returns true if the instance was already serving before the
+// operator bootstrapped admin accounts, in which case it stays exposed
+// while its admin account is bootstrapped.
+func (b *BookStack) AdminAdopted() bool {
+	return b.Status.AdminAdopted
+}
+
+// AdminPasswordSecretRef returns the Secret key holding the admin
+// password, or nil if the operator generates it.
+func (b *BookStack) AdminPasswordSecretRef() *corev1.SecretKeySelector {
+	if b.Spec.Admin == nil {
+		return nil
+	}
+
+	return b.Spec.Admin.PasswordSecretRef
+}
+
+// GetAdminSecretName returns the name of the Secret holding the admin
+// email, the bcrypt hash of its password and, when generated, the
+// password itself.
+func (b *BookStack) GetAdminSecretName() string {
+	return b.GetName() + "-admin"
+}
+
+// NewAdminSecret returns the admin Secret. password is only stored when
+// it was generated by the operator.
+func (b *BookStack) NewAdminSecret(password, hash string) corev1.Secret {
+	data := map[string][]byte{
+		AdminEmailKey:        []byte(b.AdminEmail()),
+		AdminPasswordHashKey: []byte(hash),
+	}
+
+	if b.AdminPasswordSecretRef() == nil {
+		data[AdminPasswordKey] = []byte(password)
+	}
+
+	return corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.GetAdminSecretName(),
+			Namespace: b.GetNamespace(),
+			Labels:    labelsForComponent(*b, AdminComponent),
+		},
+		Data: data,
+	}
+}
+
+// NewAdminBootstrapJob returns the Job replacing the default admin account
+// with the configured one, once BookStack has created it.
+func (b *BookStack) NewAdminBootstrapJob() batchv1.Job {
+	var backoffLimit int32 = 3
+	return batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.GetName() + "-admin-bootstrap",
+			Namespace: b.GetNamespace(),
+			Labels:    labelsForComponent(*b, AdminComponent),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labelsForComponent(*b, AdminComponent),
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy:   corev1.RestartPolicyNever,
+					SecurityContext: b.podSecurityContext(),
+					Containers: []corev1.Container{
+						{
+							Name:            AdminBootstrapContainer,
+							Image:           b.dbImage(),
+							Command:         []string{"sh", "-c", adminBootstrapScript},
+							SecurityContext: b.dbSecurityContext(),
+							// the email and name are hex encoded so that they
+							// can be used in SQL without escaping.
+							Env: append(b.dbClientEnv(),
+								corev1.EnvVar{Name: "DEFAULT_EMAIL", Value: defaultAdminEmail},
+								corev1.EnvVar{Name: "ADMIN_EMAIL_HEX", Value: hex.EncodeToString([]byte(b.AdminEmail()))},
+								corev1.EnvVar{Name: "ADMIN_NAME_HEX", Value: hex.EncodeToString([]byte(b.adminName()))},
+								secretEnv("ADMIN_PASSWORD_HASH", b.GetAdminSecretName(), AdminPasswordHashKey),
+							),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// adminBootstrapScript waits for BookStack to create its default admin
+// account and replaces its email, name and password. When the default
+// account is gone, e.g. an admin changed its email in BookStack, it
+// succeeds without changes as long as a user holds the admin role. Its
+// termination message reports which it did.
+const adminBootstrapScript = `set -eu
+client=mariadb
+command -v "$client" >/dev/null 2>&1 || client=mysql
+db() { "$client" --host="$DB_HOST" --user="$MYSQL_USER" --skip-column-names -e "$1" "$MYSQL_DATABASE"; }
+email="CONVERT(X'$ADMIN_EMAIL_HEX' USING utf8mb4)"
+name="CONVERT(X'$ADMIN_NAME_HEX' USING utf8mb4)"
+i=0
+until db "SELECT 1 FROM users LIMIT 1;" >/dev/null 2>&1; do
+  i=$((i + 1))
+  if [ "$i" -ge 60 ]; then
+    echo "BookStack has not created its users table" >&2
+    exit 1
+  fi
+  sleep 5
+done
+if [ "$(db "SELECT COUNT(*) FROM users WHERE email = '$DEFAULT_EMAIL';")" != 0 ]; then
+  db "UPDATE users SET email = $email, name = $name, password = '$ADMIN_PASSWORD_HASH', email_confirmed = 1 WHERE email = '$DEFAULT_EMAIL';"
+  echo replaced > /dev/termination-log
+  exit 0
+fi
+if [ "$(db "SELECT COUNT(*) FROM role_user JOIN roles ON roles.id = role_user.role_id WHERE roles.system_name = 'admin';")" = 0 ]; then
+  echo "neither the default admin account nor another admin was found" >&2
+  exit 1
+fi
+echo kept > /dev/termination-log
+`
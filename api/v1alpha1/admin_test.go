@@ -0,0 +1,101 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminBootstrapScript(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaults    string
+		admins      string
+		want        string
+		wantUpdated bool
+		wantErr     bool
+	}{
+		{name: "replaces the default account", defaults: "1", admins: "1", want: AdminAccountReplaced, wantUpdated: true},
+		{name: "keeps the admins of a replaced account", defaults: "0", admins: "2", want: AdminAccountKept},
+		{name: "fails without any admin", defaults: "0", admins: "0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, filepath.Join(dir, "mariadb"), mariadbStandIn, 0o755)
+
+			result := filepath.Join(dir, "termination-log")
+			queries := filepath.Join(dir, "queries")
+			script := strings.ReplaceAll(adminBootstrapScript, "/dev/termination-log", result)
+
+			cmd := exec.Command("sh", "-c", script)
+			cmd.Env = append(os.Environ(),
+				"PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"),
+				"DB_HOST=wiki-db",
+				"MYSQL_USER=bookstack",
+				"MYSQL_DATABASE=bookstackapp",
+				"DEFAULT_EMAIL="+defaultAdminEmail,
+				"ADMIN_EMAIL_HEX=61",
+				"ADMIN_NAME_HEX=61",
+				"ADMIN_PASSWORD_HASH=hash",
+				"DEFAULT_ACCOUNTS="+tt.defaults,
+				"ADMINS="+tt.admins,
+				"QUERY_LOG="+queries,
+			)
+
+			out, err := cmd.CombinedOutput()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("adminBootstrapScript error = %v, wantErr %v\n%s", err, tt.wantErr, out)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			message, err := os.ReadFile(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(string(message)); got != tt.want {
+				t.Errorf("result = %q, want %q", got, tt.want)
+			}
+
+			if _, err := os.Stat(queries); (err == nil) != tt.wantUpdated {
+				t.Errorf("updated = %v, want %v", err == nil, tt.wantUpdated)
+			}
+		})
+	}
+}
+
+// mariadbStandIn answers the queries of adminBootstrapScript from
+// DEFAULT_ACCOUNTS and ADMINS, and logs updates to QUERY_LOG.
+const mariadbStandIn = `#!/bin/sh
+while [ $# -gt 0 ]; do
+  case "$1" in -e) query="$2"; shift ;; esac
+  shift
+done
+case "$query" in
+  UPDATE*) echo "$query" >> "$QUERY_LOG" ;;
+  *role_user*) echo "$ADMINS" ;;
+  *"COUNT(*) FROM users"*) echo "$DEFAULT_ACCOUNTS" ;;
+esac
+`
@@ -0,0 +1,192 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// APITokenComponent labels the Secret and Jobs of the operator's API
+	// token.
+	APITokenComponent = "api-token"
+
+	// APITokenIDKey and APITokenSecretKey are the keys of the API token
+	// Secret holding the active token.
+	APITokenIDKey     = "token-id"
+	APITokenSecretKey = "token-secret"
+
+	// PendingAPITokenIDKey, PendingAPITokenSecretKey and
+	// PendingAPITokenSecretHashKey hold a new token while the Job
+	// registering it in BookStack runs.
+	PendingAPITokenIDKey         = "pending-token-id"
+	PendingAPITokenSecretKey     = "pending-token-secret"
+	PendingAPITokenSecretHashKey = "pending-token-secret-hash"
+
+	// apiUserEmail and apiUserName identify the service user owning the
+	// operator's API tokens.
+	apiUserEmail = "bookstack-operator@localhost"
+	apiUserName  = "BookStack Operator"
+	// apiTokenName names the operator's API tokens in BookStack.
+	apiTokenName = "bookstack-operator"
+
+	// defaultAPITokenRotationInterval is how often the API token is
+	// rotated when spec.apiToken.rotationInterval is unset.
+	defaultAPITokenRotationInterval = 30 * 24 * time.Hour
+)
+
+// APITokenSpec configures the API token the operator uses to manage the
+// instance through the BookStack API.
+type APITokenSpec struct {
+	// RotationInterval is how often the token is replaced by a new one.
+	// Tokens expire after twice the interval. Defaults to 720h.
+	// +optional
+	RotationInterval *metav1.Duration `json:"rotationInterval,omitempty"`
+}
+
+// APITokenStatus reports the operator's API token.
+type APITokenStatus struct {
+	// SecretName is the name of the Secret holding the token ID and
+	// secret.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+
+	// TokenID is the ID of the active token.
+	// +optional
+	TokenID string `json:"tokenID,omitempty"`
+
+	// LastRotationTime is when the active token was registered.
+	// +optional
+	LastRotationTime *metav1.Time `json:"lastRotationTime,omitempty"`
+
+	// ExpirationTime is when the active token expires in BookStack.
+	// +optional
+	ExpirationTime *metav1.Time `json:"expirationTime,omitempty"`
+}
+
+// APITokenRotationInterval returns how often the API token is rotated.
+func (b *BookStack) APITokenRotationInterval() time.Duration {
+	if b.Spec.APIToken == nil || b.Spec.APIToken.RotationInterval == nil {
+		return defaultAPITokenRotationInterval
+	}
+
+	return b.Spec.APIToken.RotationInterval.Duration
+}
+
+// GetAPITokenSecretName returns the name of the Secret holding the
+// operator's API token.
+func (b *BookStack) GetAPITokenSecretName() string {
+	return b.GetName() + "-api-token"
+}
+
+// APIURL returns the in-cluster URL of the BookStack API.
+func (b *BookStack) APIURL() string {
+	return fmt.Sprintf("http://%s.%s.svc", b.GetServiceName(), b.GetNamespace())
+}
+
+// NewAPITokenSecret returns the API token Secret holding data.
+func (b *BookStack) NewAPITokenSecret(data map[string][]byte) corev1.Secret {
+	return corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.GetAPITokenSecretName(),
+			Namespace: b.GetNamespace(),
+			Labels:    labelsForComponent(*b, APITokenComponent),
+		},
+		Data: data,
+	}
+}
+
+// GetAPITokenJobName returns the name of the Job registering the token
+// with the ID.
+func (b *BookStack) GetAPITokenJobName(tokenID string) string {
+	return fmt.Sprintf("%s-api-token-%s", b.GetName(), strings.ToLower(tokenID[:8]))
+}
+
+// NewAPITokenJob returns the Job registering the pending token with the ID
+// in BookStack, owned by the operator's service user and expiring at
+// expiration. Expired operator tokens are removed.
+func (b *BookStack) NewAPITokenJob(tokenID string, expiration time.Time) batchv1.Job {
+	var backoffLimit int32 = 3
+	return batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.GetAPITokenJobName(tokenID),
+			Namespace: b.GetNamespace(),
+			Labels:    labelsForComponent(*b, APITokenComponent),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labelsForComponent(*b, APITokenComponent),
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy:   corev1.RestartPolicyNever,
+					SecurityContext: b.podSecurityContext(),
+					Containers: []corev1.Container{
+						{
+							Name:            "register",
+							Image:           b.dbImage(),
+							Command:         []string{"sh", "-c", apiTokenScript},
+							SecurityContext: b.dbSecurityContext(),
+							Env: append(b.dbClientEnv(),
+								corev1.EnvVar{Name: "API_USER_EMAIL", Value: apiUserEmail},
+								corev1.EnvVar{Name: "API_USER_NAME", Value: apiUserName},
+								corev1.EnvVar{Name: "TOKEN_NAME", Value: apiTokenName},
+								corev1.EnvVar{Name: "TOKEN_ID", Value: tokenID},
+								corev1.EnvVar{Name: "EXPIRES_AT", Value: expiration.UTC().Format("2006-01-02")},
+								secretEnv("TOKEN_SECRET_HASH", b.GetAPITokenSecretName(), PendingAPITokenSecretHashKey),
+							),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// apiTokenScript waits for BookStack's tables, creates the operator's
+// service user with the admin role if missing, and registers the token.
+// The token ID and secret hash are generated by the operator, so they can
+// be used in SQL without escaping.
+const apiTokenScript = `set -eu
+client=mariadb
+command -v "$client" >/dev/null 2>&1 || client=mysql
+db() { "$client" --host="$DB_HOST" --user="$MYSQL_USER" --skip-column-names -e "$1" "$MYSQL_DATABASE"; }
+i=0
+until db "SELECT 1 FROM api_tokens LIMIT 1;" >/dev/null 2>&1; do
+  i=$((i + 1))
+  if [ "$i" -ge 60 ]; then
+    echo "BookStack has not created its api_tokens table" >&2
+    exit 1
+  fi
+  sleep 5
+done
+user_id=$(db "SELECT id FROM users WHERE email = '$API_USER_EMAIL';")
+if [ -z "$user_id" ]; then
+  db "INSERT INTO users (name, email, password, email_confirmed, slug, external_auth_id, created_at, updated_at) VALUES ('$API_USER_NAME', '$API_USER_EMAIL', '', 1, '$TOKEN_NAME', '', NOW(), NOW());"
+  user_id=$(db "SELECT id FROM users WHERE email = '$API_USER_EMAIL';")
+fi
+db "INSERT INTO role_user (user_id, role_id) SELECT $user_id, id FROM roles WHERE system_name = 'admin' AND NOT EXISTS (SELECT 1 FROM role_user WHERE user_id = $user_id AND role_id = roles.id);"
+db "DELETE FROM api_tokens WHERE user_id = $user_id AND (token_id = '$TOKEN_ID' OR expires_at < CURDATE());"
+db "INSERT INTO api_tokens (name, token_id, secret, user_id, expires_at, created_at, updated_at) VALUES ('$TOKEN_NAME', '$TOKEN_ID', '$TOKEN_SECRET_HASH', $user_id, '$EXPIRES_AT', NOW(), NOW());"
+`
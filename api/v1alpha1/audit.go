@@ -0,0 +1,153 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"errors"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultAuditPollInterval is how often the audit log is polled when
+// spec.auditForwarding.interval is unset.
+const defaultAuditPollInterval = time.Minute
+
+// minAuditPollInterval is the shortest interval the audit log is polled
+// at, so that a zero or tiny interval cannot stop or flood forwarding.
+const minAuditPollInterval = 10 * time.Second
+
+// AuditSinkType selects where audit log events are forwarded.
+// +kubebuilder:validation:Enum=Stdout;Syslog;Webhook
+type AuditSinkType string
+
+const (
+	// AuditSinkStdout writes the events to the operator's standard output.
+	AuditSinkStdout AuditSinkType = "Stdout"
+	// AuditSinkSyslog sends the events to a syslog endpoint.
+	AuditSinkSyslog AuditSinkType = "Syslog"
+	// AuditSinkWebhook posts the events to an HTTP endpoint.
+	AuditSinkWebhook AuditSinkType = "Webhook"
+)
+
+// AuditForwardingSpec forwards the BookStack audit log to a log sink, as
+// one JSON line per event.
+type AuditForwardingSpec struct {
+	// Sink selects where events are forwarded. The Syslog and Webhook
+	// sinks are configured in syslog and webhook.
+	Sink AuditSinkType `json:"sink"`
+
+	// Syslog is the syslog endpoint events are sent to.
+	// +optional
+	Syslog *SyslogSink `json:"syslog,omitempty"`
+
+	// Webhook is the HTTP endpoint events are posted to.
+	// +optional
+	Webhook *WebhookSink `json:"webhook,omitempty"`
+
+	// Interval is how often the audit log is polled for new events.
+	// Defaults to 1m; intervals shorter than 10s are raised to 10s.
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+}
+
+// SyslogSink is a syslog endpoint receiving RFC 5424 messages.
+type SyslogSink struct {
+	// Address is the host and port of the endpoint, e.g.
+	// rsyslog.logging.svc:514.
+	// +kubebuilder:validation:MinLength=1
+	Address string `json:"address"`
+
+	// Protocol is the transport messages are sent over.
+	// +kubebuilder:validation:Enum=udp;tcp
+	// +kubebuilder:default=udp
+	// +optional
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// WebhookSink is an HTTP endpoint receiving batches of events as
+// newline-delimited JSON.
+type WebhookSink struct {
+	// URL the events are posted to.
+	// +kubebuilder:validation:Pattern=`^https?://`
+	URL string `json:"url"`
+
+	// HeadersSecretRef references a Secret in the BookStack namespace
+	// whose keys and values are sent as request headers, e.g. an
+	// Authorization header.
+	// +optional
+	HeadersSecretRef *corev1.LocalObjectReference `json:"headersSecretRef,omitempty"`
+}
+
+// AuditForwardingStatus reports the progress of audit log forwarding.
+type AuditForwardingStatus struct {
+	// LastEventID is the ID of the last event forwarded. Forwarding
+	// resumes after it.
+	// +optional
+	LastEventID int `json:"lastEventID,omitempty"`
+
+	// LastEventType is the activity of the last event forwarded, e.g.
+	// page_update.
+	// +optional
+	LastEventType string `json:"lastEventType,omitempty"`
+
+	// LastEventTime is when the last event forwarded happened.
+	// +optional
+	LastEventTime *metav1.Time `json:"lastEventTime,omitempty"`
+
+	// LastForwardTime is when events were last forwarded.
+	// +optional
+	LastForwardTime *metav1.Time `json:"lastForwardTime,omitempty"`
+}
+
+// AuditPollInterval returns how often the audit log is polled.
+func (b *BookStack) AuditPollInterval() time.Duration {
+	if b.Spec.AuditForwarding == nil || b.Spec.AuditForwarding.Interval == nil {
+		return defaultAuditPollInterval
+	}
+
+	if interval := b.Spec.AuditForwarding.Interval.Duration; interval > minAuditPollInterval {
+		return interval
+	}
+
+	return minAuditPollInterval
+}
+
+// AuditCursor returns the ID of the last event forwarded, or 0 if none
+// was.
+func (b *BookStack) AuditCursor() int {
+	if b.Status.AuditForwarding == nil {
+		return 0
+	}
+
+	return b.Status.AuditForwarding.LastEventID
+}
+
+// ValidateAuditSink returns an error if the selected sink is not
+// configured.
+func (b *BookStack) ValidateAuditSink() error {
+	forwarding := b.Spec.AuditForwarding
+	switch {
+	case forwarding.Sink == AuditSinkSyslog && forwarding.Syslog == nil:
+		return errors.New("syslog must be set for the Syslog sink")
+	case forwarding.Sink == AuditSinkWebhook && forwarding.Webhook == nil:
+		return errors.New("webhook must be set for the Webhook sink")
+	}
+
+	return nil
+}
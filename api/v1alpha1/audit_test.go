@@ -0,0 +1,47 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAuditPollInterval(t *testing.T) {
+	tests := []struct {
+		name       string
+		forwarding *AuditForwardingSpec
+		want       time.Duration
+	}{
+		{name: "disabled", want: time.Minute},
+		{name: "unset", forwarding: &AuditForwardingSpec{}, want: time.Minute},
+		{name: "zero", forwarding: &AuditForwardingSpec{Interval: &metav1.Duration{}}, want: 10 * time.Second},
+		{name: "too short", forwarding: &AuditForwardingSpec{Interval: &metav1.Duration{Duration: time.Second}}, want: 10 * time.Second},
+		{name: "set", forwarding: &AuditForwardingSpec{Interval: &metav1.Duration{Duration: 30 * time.Second}}, want: 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &BookStack{Spec: BookStackSpec{AuditForwarding: tt.forwarding}}
+			if got := b.AuditPollInterval(); got != tt.want {
+				t.Errorf("AuditPollInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,564 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// ldapCAVolumeName is the name of the volume holding the LDAP CA bundle.
+	ldapCAVolumeName = "ldap-ca"
+	// ldapCAMountPath is where the LDAP CA bundle is mounted in the app container.
+	ldapCAMountPath = "/etc/bookstack/ldap"
+	// ldapCAFileName is the file name of the LDAP CA bundle within ldapCAMountPath.
+	ldapCAFileName = "ca.crt"
+)
+
+// AuthSpec configures how users authenticate to BookStack. At most one
+// authentication method may be configured.
+// +kubebuilder:validation:MaxProperties=1
+type AuthSpec struct {
+	// LDAP configures BookStack to authenticate users against an LDAP
+	// directory (AUTH_METHOD=ldap).
+	// +optional
+	LDAP *LDAPAuthSpec `json:"ldap,omitempty"`
+
+	// OIDC configures BookStack to authenticate users against an OpenID
+	// Connect provider (AUTH_METHOD=oidc).
+	// +optional
+	OIDC *OIDCAuthSpec `json:"oidc,omitempty"`
+
+	// SAML2 configures BookStack to authenticate users against a SAML2
+	// identity provider (AUTH_METHOD=saml2).
+	// +optional
+	SAML2 *SAML2AuthSpec `json:"saml2,omitempty"`
+}
+
+// LDAPAuthSpec holds the LDAP_* settings passed to BookStack.
+type LDAPAuthSpec struct {
+	// Server is the LDAP server to connect to, including the scheme and
+	// port, e.g. ldaps://ldap.example.com:636.
+	// +kubebuilder:validation:MinLength=1
+	Server string `json:"server"`
+
+	// BaseDN is the base DN under which users are searched for.
+	// +kubebuilder:validation:MinLength=1
+	BaseDN string `json:"baseDN"`
+
+	// BindDN is the DN used to bind to the directory when searching
+	// for users. Anonymous binding is used when this is empty.
+	// +optional
+	BindDN string `json:"bindDN,omitempty"`
+
+	// BindPasswordSecretRef references the key of a Secret in the
+	// BookStack namespace containing the password for BindDN.
+	// +optional
+	BindPasswordSecretRef *corev1.SecretKeySelector `json:"bindPasswordSecretRef,omitempty"`
+
+	// UserFilter is the search filter used to find a user. ${user} is
+	// replaced with the username provided at login.
+	// +kubebuilder:default="(&(uid=${user}))"
+	// +optional
+	UserFilter string `json:"userFilter,omitempty"`
+
+	// Version is the LDAP protocol version.
+	// +kubebuilder:default=3
+	// +optional
+	Version int `json:"version,omitempty"`
+
+	// StartTLS upgrades the connection using StartTLS.
+	// +optional
+	StartTLS bool `json:"startTLS,omitempty"`
+
+	// TLSInsecure disables verification of the LDAP server certificate.
+	// +optional
+	TLSInsecure bool `json:"tlsInsecure,omitempty"`
+
+	// CASecretRef references the key of a Secret in the BookStack
+	// namespace containing the PEM encoded CA bundle used to verify
+	// the LDAP server certificate.
+	// +optional
+	CASecretRef *corev1.SecretKeySelector `json:"caSecretRef,omitempty"`
+
+	// Attributes maps BookStack user fields to LDAP attributes.
+	// +optional
+	Attributes LDAPAttributes `json:"attributes,omitempty"`
+
+	// GroupSync, when set, syncs LDAP group membership to BookStack roles.
+	// +optional
+	GroupSync *LDAPGroupSync `json:"groupSync,omitempty"`
+}
+
+// LDAPAttributes maps BookStack user fields to LDAP attributes.
+type LDAPAttributes struct {
+	// ID is the attribute used as the unique user identifier.
+	// +kubebuilder:default=uid
+	// +optional
+	ID string `json:"id,omitempty"`
+
+	// Email is the attribute holding the user's email address.
+	// +kubebuilder:default=mail
+	// +optional
+	Email string `json:"email,omitempty"`
+
+	// DisplayName is the attribute holding the user's display name.
+	// +kubebuilder:default=cn
+	// +optional
+	DisplayName string `json:"displayName,omitempty"`
+
+	// Thumbnail is the attribute holding the user's avatar, if any.
+	// +optional
+	Thumbnail string `json:"thumbnail,omitempty"`
+}
+
+// LDAPGroupSync configures syncing of LDAP groups to BookStack roles.
+type LDAPGroupSync struct {
+	// GroupAttribute is the user attribute listing the groups the
+	// user is a member of.
+	// +kubebuilder:default=memberOf
+	// +optional
+	GroupAttribute string `json:"groupAttribute,omitempty"`
+
+	// RemoveFromGroups removes users from BookStack roles that do not
+	// match their LDAP groups.
+	// +optional
+	RemoveFromGroups bool `json:"removeFromGroups,omitempty"`
+}
+
+// OIDCAuthSpec holds the OIDC_* settings passed to BookStack.
+type OIDCAuthSpec struct {
+	// DisplayName is the name of the provider shown on the login button.
+	// +kubebuilder:default=SSO
+	// +optional
+	DisplayName string `json:"displayName,omitempty"`
+
+	// Issuer is the issuer URL of the OpenID Connect provider.
+	// +kubebuilder:validation:MinLength=1
+	Issuer string `json:"issuer"`
+
+	// ClientID is the OAuth client ID registered with the provider.
+	// +kubebuilder:validation:MinLength=1
+	ClientID string `json:"clientID"`
+
+	// ClientSecretRef references the key of a Secret in the BookStack
+	// namespace containing the OAuth client secret.
+	ClientSecretRef corev1.SecretKeySelector `json:"clientSecretRef"`
+
+	// AutoDiscovery discovers the provider endpoints and keys from the
+	// issuer's well-known configuration. When disabled, AuthEndpoint,
+	// TokenEndpoint and PublicKey must be set.
+	// +kubebuilder:default=true
+	// +optional
+	AutoDiscovery *bool `json:"autoDiscovery,omitempty"`
+
+	// AuthEndpoint is the provider's authorization endpoint.
+	// +optional
+	AuthEndpoint string `json:"authEndpoint,omitempty"`
+
+	// TokenEndpoint is the provider's token endpoint.
+	// +optional
+	TokenEndpoint string `json:"tokenEndpoint,omitempty"`
+
+	// PublicKey is the PEM encoded public key used to verify tokens.
+	// +optional
+	PublicKey string `json:"publicKey,omitempty"`
+
+	// DisplayNameClaims lists the claims joined to form the user's
+	// display name.
+	// +optional
+	DisplayNameClaims []string `json:"displayNameClaims,omitempty"`
+
+	// ExternalIDClaim is the claim used as the unique user identifier.
+	// +optional
+	ExternalIDClaim string `json:"externalIDClaim,omitempty"`
+
+	// AdditionalScopes lists scopes requested in addition to openid,
+	// profile and email.
+	// +optional
+	AdditionalScopes []string `json:"additionalScopes,omitempty"`
+
+	// GroupSync, when set, syncs the user's groups claim to BookStack
+	// roles.
+	// +optional
+	GroupSync *OIDCGroupSync `json:"groupSync,omitempty"`
+}
+
+// OIDCGroupSync configures syncing of OIDC groups to BookStack roles.
+type OIDCGroupSync struct {
+	// GroupsClaim is the claim listing the groups the user is a member of.
+	// +kubebuilder:default=groups
+	// +optional
+	GroupsClaim string `json:"groupsClaim,omitempty"`
+
+	// RemoveFromGroups removes users from BookStack roles that do not
+	// match their groups claim.
+	// +optional
+	RemoveFromGroups bool `json:"removeFromGroups,omitempty"`
+}
+
+// SAML2AuthSpec holds the SAML2_* settings passed to BookStack.
+type SAML2AuthSpec struct {
+	// DisplayName is the name of the provider shown on the login button.
+	// +kubebuilder:default=SSO
+	// +optional
+	DisplayName string `json:"displayName,omitempty"`
+
+	// IDPMetadataURL is the URL of the identity provider's metadata,
+	// which BookStack loads automatically. Exactly one of IDPMetadataURL
+	// and IDPMetadata must be set.
+	// +optional
+	IDPMetadataURL string `json:"idpMetadataURL,omitempty"`
+
+	// IDPMetadata is the identity provider's metadata XML. The entity ID,
+	// single sign-on and logout URLs, and signing certificate are read
+	// from it.
+	// +optional
+	IDPMetadata string `json:"idpMetadata,omitempty"`
+
+	// Attributes maps BookStack user fields to SAML2 attributes.
+	// +optional
+	Attributes SAML2Attributes `json:"attributes,omitempty"`
+
+	// SigningCertSecretRef references a kubernetes.io/tls Secret in the
+	// BookStack namespace holding the certificate and key BookStack uses
+	// to sign requests to the identity provider.
+	// +optional
+	SigningCertSecretRef *corev1.LocalObjectReference `json:"signingCertSecretRef,omitempty"`
+
+	// GroupSync, when set, syncs the user's group attribute to BookStack
+	// roles.
+	// +optional
+	GroupSync *SAML2GroupSync `json:"groupSync,omitempty"`
+}
+
+// SAML2Attributes maps BookStack user fields to SAML2 attributes.
+type SAML2Attributes struct {
+	// Email is the attribute holding the user's email address.
+	// +kubebuilder:default=email
+	// +optional
+	Email string `json:"email,omitempty"`
+
+	// ExternalID is the attribute used as the unique user identifier.
+	// +kubebuilder:default=uid
+	// +optional
+	ExternalID string `json:"externalID,omitempty"`
+
+	// DisplayName lists the attributes joined to form the user's display
+	// name.
+	// +optional
+	DisplayName []string `json:"displayName,omitempty"`
+}
+
+// SAML2GroupSync configures syncing of SAML2 groups to BookStack roles.
+type SAML2GroupSync struct {
+	// GroupAttribute is the attribute listing the groups the user is a
+	// member of.
+	// +kubebuilder:default=group
+	// +optional
+	GroupAttribute string `json:"groupAttribute,omitempty"`
+
+	// RemoveFromGroups removes users from BookStack roles that do not
+	// match their SAML2 groups.
+	// +optional
+	RemoveFromGroups bool `json:"removeFromGroups,omitempty"`
+}
+
+// ValidateAuth checks that the auth configuration can be rendered for
+// BookStack.
+func (b *BookStack) ValidateAuth() error {
+	auth := b.Spec.Auth
+	if auth == nil {
+		return nil
+	}
+
+	configured := 0
+	for _, set := range []bool{auth.LDAP != nil, auth.OIDC != nil, auth.SAML2 != nil} {
+		if set {
+			configured++
+		}
+	}
+
+	if configured > 1 {
+		return errors.New("only one of auth.ldap, auth.oidc and auth.saml2 may be configured")
+	}
+
+	if oidc := auth.OIDC; oidc != nil && oidc.AutoDiscovery != nil && !*oidc.AutoDiscovery {
+		if oidc.AuthEndpoint == "" || oidc.TokenEndpoint == "" || oidc.PublicKey == "" {
+			return errors.New("auth.oidc requires authEndpoint, tokenEndpoint and publicKey when autoDiscovery is disabled")
+		}
+	}
+
+	if saml := auth.SAML2; saml != nil {
+		if (saml.IDPMetadataURL == "") == (saml.IDPMetadata == "") {
+			return errors.New("exactly one of auth.saml2.idpMetadataURL and auth.saml2.idpMetadata must be set")
+		}
+
+		if saml.IDPMetadata != "" {
+			if _, err := parseSAMLMetadata(saml.IDPMetadata); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// authMethod returns the value for BookStack's AUTH_METHOD setting.
+func (b *BookStack) authMethod() string {
+	switch {
+	case b.Spec.Auth == nil:
+		return "standard"
+	case b.Spec.Auth.LDAP != nil:
+		return "ldap"
+	case b.Spec.Auth.OIDC != nil:
+		return "oidc"
+	case b.Spec.Auth.SAML2 != nil:
+		return "saml2"
+	}
+
+	return "standard"
+}
+
+// authConfig returns the non-sensitive settings for the configured auth
+// method.
+func (b *BookStack) authConfig() map[string]string {
+	switch b.authMethod() {
+	case "ldap":
+		return b.ldapConfig()
+	case "oidc":
+		return b.oidcConfig()
+	case "saml2":
+		return b.saml2Config()
+	}
+
+	return nil
+}
+
+// ldapConfig returns the non-sensitive LDAP_* settings for the instance,
+// or nil if LDAP authentication is not configured.
+func (b *BookStack) ldapConfig() map[string]string {
+	if b.Spec.Auth == nil || b.Spec.Auth.LDAP == nil {
+		return nil
+	}
+
+	ldap := b.Spec.Auth.LDAP
+	cfg := map[string]string{
+		"LDAP_SERVER":       ldap.Server,
+		"LDAP_BASE_DN":      ldap.BaseDN,
+		"LDAP_DN":           "false", // anonymous bind
+		"LDAP_USER_FILTER":  valueOrDefault(ldap.UserFilter, "(&(uid=${user}))"),
+		"LDAP_VERSION":      "3",
+		"LDAP_START_TLS":    strconv.FormatBool(ldap.StartTLS),
+		"LDAP_TLS_INSECURE": strconv.FormatBool(ldap.TLSInsecure),
+
+		"LDAP_ID_ATTRIBUTE":           valueOrDefault(ldap.Attributes.ID, "uid"),
+		"LDAP_EMAIL_ATTRIBUTE":        valueOrDefault(ldap.Attributes.Email, "mail"),
+		"LDAP_DISPLAY_NAME_ATTRIBUTE": valueOrDefault(ldap.Attributes.DisplayName, "cn"),
+		"LDAP_USER_TO_GROUPS":         strconv.FormatBool(ldap.GroupSync != nil),
+	}
+
+	if ldap.BindDN != "" {
+		cfg["LDAP_DN"] = ldap.BindDN
+	}
+
+	if ldap.Version != 0 {
+		cfg["LDAP_VERSION"] = strconv.Itoa(ldap.Version)
+	}
+
+	if ldap.Attributes.Thumbnail != "" {
+		cfg["LDAP_THUMBNAIL_ATTRIBUTE"] = ldap.Attributes.Thumbnail
+	}
+
+	if ldap.CASecretRef != nil {
+		cfg["LDAP_TLS_CA_CERT"] = ldapCAMountPath + "/" + ldapCAFileName
+	}
+
+	if ldap.GroupSync != nil {
+		cfg["LDAP_GROUP_ATTRIBUTE"] = valueOrDefault(ldap.GroupSync.GroupAttribute, "memberOf")
+		cfg["LDAP_REMOVE_FROM_GROUPS"] = strconv.FormatBool(ldap.GroupSync.RemoveFromGroups)
+	}
+
+	return cfg
+}
+
+// oidcConfig returns the non-sensitive OIDC_* settings for the instance,
+// or nil if OIDC authentication is not configured.
+func (b *BookStack) oidcConfig() map[string]string {
+	if b.Spec.Auth == nil || b.Spec.Auth.OIDC == nil {
+		return nil
+	}
+
+	oidc := b.Spec.Auth.OIDC
+	discover := oidc.AutoDiscovery == nil || *oidc.AutoDiscovery
+	cfg := map[string]string{
+		"OIDC_NAME":                valueOrDefault(oidc.DisplayName, "SSO"),
+		"OIDC_ISSUER":              oidc.Issuer,
+		"OIDC_CLIENT_ID":           oidc.ClientID,
+		"OIDC_ISSUER_DISCOVER":     strconv.FormatBool(discover),
+		"OIDC_DISPLAY_NAME_CLAIMS": "name",
+		"OIDC_USER_TO_GROUPS":      strconv.FormatBool(oidc.GroupSync != nil),
+	}
+
+	if !discover {
+		cfg["OIDC_AUTH_ENDPOINT"] = oidc.AuthEndpoint
+		cfg["OIDC_TOKEN_ENDPOINT"] = oidc.TokenEndpoint
+		cfg["OIDC_PUBLIC_KEY"] = oidc.PublicKey
+	}
+
+	if len(oidc.DisplayNameClaims) > 0 {
+		cfg["OIDC_DISPLAY_NAME_CLAIMS"] = strings.Join(oidc.DisplayNameClaims, "|")
+	}
+
+	if oidc.ExternalIDClaim != "" {
+		cfg["OIDC_EXTERNAL_ID_CLAIM"] = oidc.ExternalIDClaim
+	}
+
+	if len(oidc.AdditionalScopes) > 0 {
+		cfg["OIDC_ADDITIONAL_SCOPES"] = strings.Join(oidc.AdditionalScopes, ",")
+	}
+
+	if oidc.GroupSync != nil {
+		cfg["OIDC_GROUPS_CLAIM"] = valueOrDefault(oidc.GroupSync.GroupsClaim, "groups")
+		cfg["OIDC_REMOVE_FROM_GROUPS"] = strconv.FormatBool(oidc.GroupSync.RemoveFromGroups)
+	}
+
+	return cfg
+}
+
+// saml2Config returns the non-sensitive SAML2_* settings for the instance,
+// or nil if SAML2 authentication is not configured.
+func (b *BookStack) saml2Config() map[string]string {
+	if b.Spec.Auth == nil || b.Spec.Auth.SAML2 == nil {
+		return nil
+	}
+
+	saml := b.Spec.Auth.SAML2
+	cfg := map[string]string{
+		"SAML2_NAME":                    valueOrDefault(saml.DisplayName, "SSO"),
+		"SAML2_EMAIL_ATTRIBUTE":         valueOrDefault(saml.Attributes.Email, "email"),
+		"SAML2_EXTERNAL_ID_ATTRIBUTE":   valueOrDefault(saml.Attributes.ExternalID, "uid"),
+		"SAML2_DISPLAY_NAME_ATTRIBUTES": "username",
+		"SAML2_USER_TO_GROUPS":          strconv.FormatBool(saml.GroupSync != nil),
+	}
+
+	if saml.IDPMetadataURL != "" {
+		cfg["SAML2_IDP_ENTITYID"] = saml.IDPMetadataURL
+		cfg["SAML2_AUTOLOAD_METADATA"] = "true"
+	}
+
+	if saml.IDPMetadata != "" {
+		// invalid metadata is reported by ValidateAuth.
+		if idp, err := parseSAMLMetadata(saml.IDPMetadata); err == nil {
+			cfg["SAML2_IDP_ENTITYID"] = idp.EntityID
+			cfg["SAML2_AUTOLOAD_METADATA"] = "false"
+			cfg["SAML2_IDP_SSO"] = idp.SSOURL
+			cfg["SAML2_IDP_SLO"] = idp.SLOURL
+			cfg["SAML2_IDP_x509"] = idp.Certificate
+		}
+	}
+
+	if len(saml.Attributes.DisplayName) > 0 {
+		cfg["SAML2_DISPLAY_NAME_ATTRIBUTES"] = strings.Join(saml.Attributes.DisplayName, "|")
+	}
+
+	if saml.GroupSync != nil {
+		cfg["SAML2_GROUP_ATTRIBUTE"] = valueOrDefault(saml.GroupSync.GroupAttribute, "group")
+		cfg["SAML2_REMOVE_FROM_GROUPS"] = strconv.FormatBool(saml.GroupSync.RemoveFromGroups)
+	}
+
+	return cfg
+}
+
+// AppSecretHashAnnotation is set on the app pods to a hash of the app
+// Secret, so that they restart when it changes, e.g. when a credential the
+// auth settings reference is rotated.
+const AppSecretHashAnnotation = "tools.opdev.io/app-secret-hash"
+
+// AuthSecretRefs returns the Secret keys that hold sensitive auth
+// settings, indexed by the app setting they populate.
+func (b *BookStack) AuthSecretRefs() map[string]corev1.SecretKeySelector {
+	refs := map[string]corev1.SecretKeySelector{}
+	if b.Spec.Auth == nil {
+		return refs
+	}
+
+	if ldap := b.Spec.Auth.LDAP; ldap != nil && ldap.BindPasswordSecretRef != nil {
+		refs["LDAP_PASS"] = *ldap.BindPasswordSecretRef
+	}
+
+	if oidc := b.Spec.Auth.OIDC; oidc != nil {
+		refs["OIDC_CLIENT_SECRET"] = oidc.ClientSecretRef
+	}
+
+	if saml := b.Spec.Auth.SAML2; saml != nil && saml.SigningCertSecretRef != nil {
+		refs["SAML2_SP_x509"] = corev1.SecretKeySelector{
+			LocalObjectReference: *saml.SigningCertSecretRef,
+			Key:                  corev1.TLSCertKey,
+		}
+		refs["SAML2_SP_x509_KEY"] = corev1.SecretKeySelector{
+			LocalObjectReference: *saml.SigningCertSecretRef,
+			Key:                  corev1.TLSPrivateKeyKey,
+		}
+	}
+
+	return refs
+}
+
+// authVolumes returns the volumes required by the configured auth method.
+func (b *BookStack) authVolumes() []corev1.Volume {
+	if b.Spec.Auth == nil || b.Spec.Auth.LDAP == nil || b.Spec.Auth.LDAP.CASecretRef == nil {
+		return nil
+	}
+
+	ca := b.Spec.Auth.LDAP.CASecretRef
+	return []corev1.Volume{
+		{
+			Name: ldapCAVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: ca.Name,
+					Items: []corev1.KeyToPath{
+						{
+							Key:  ca.Key,
+							Path: ldapCAFileName,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// authVolumeMounts returns the app container mounts for authVolumes.
+func (b *BookStack) authVolumeMounts() []corev1.VolumeMount {
+	if b.Spec.Auth == nil || b.Spec.Auth.LDAP == nil || b.Spec.Auth.LDAP.CASecretRef == nil {
+		return nil
+	}
+
+	return []corev1.VolumeMount{
+		{
+			Name:      ldapCAVolumeName,
+			MountPath: ldapCAMountPath,
+			ReadOnly:  true,
+		},
+	}
+}
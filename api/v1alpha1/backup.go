@@ -0,0 +1,482 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// DefaultArchiveImage provides tar, gzip and openssl to package backups.
+	DefaultArchiveImage = "docker.io/alpine/openssl:latest"
+	// DefaultS3ClientImage provides the mc client used to upload backups.
+	DefaultS3ClientImage = "docker.io/minio/mc:latest"
+
+	// BackupComponent labels the Jobs that back up an instance.
+	BackupComponent = "backup"
+	// BackupResultContainer is the backup Job container whose termination
+	// message holds the BackupResult.
+	BackupResultContainer = "upload"
+)
+
+// BackupCompression selects how backup archives are compressed.
+// +kubebuilder:validation:Enum=gzip;none
+type BackupCompression string
+
+const (
+	BackupCompressionGzip BackupCompression = "gzip"
+	BackupCompressionNone BackupCompression = "none"
+)
+
+// BackupSpec schedules backups of the database and the app volume.
+type BackupSpec struct {
+	// Schedule is the Cron schedule on which backups are taken.
+	// +kubebuilder:validation:MinLength=1
+	Schedule string `json:"schedule"`
+
+	// Retention is the number of backups kept in the target. Older
+	// backups are deleted once a new backup is uploaded.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=7
+	// +optional
+	Retention int32 `json:"retention,omitempty"`
+
+	// S3 is the S3-compatible bucket backups are uploaded to.
+	S3 S3Target `json:"s3"`
+
+	// Compression selects how backup archives are compressed.
+	// +kubebuilder:default=gzip
+	// +optional
+	Compression BackupCompression `json:"compression,omitempty"`
+
+	// EncryptionKeySecretRef references the key of a Secret holding the
+	// passphrase used to encrypt backup archives with AES-256. Archives
+	// are not encrypted when unset.
+	// +optional
+	EncryptionKeySecretRef *corev1.SecretKeySelector `json:"encryptionKeySecretRef,omitempty"`
+}
+
+// S3Target is a location in an S3-compatible object store.
+type S3Target struct {
+	// Endpoint is the URL of the object store, e.g.
+	// https://s3.us-east-1.amazonaws.com or http://minio.minio:9000.
+	// +kubebuilder:validation:MinLength=1
+	Endpoint string `json:"endpoint"`
+
+	// Bucket is the bucket archives are stored in.
+	// +kubebuilder:validation:MinLength=1
+	Bucket string `json:"bucket"`
+
+	// Prefix is prepended to the name of stored archives.
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+
+	// CredentialsSecretRef references a Secret in the BookStack namespace
+	// holding the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY keys.
+	CredentialsSecretRef corev1.LocalObjectReference `json:"credentialsSecretRef"`
+
+	// Insecure skips verification of the object store's certificate.
+	// +optional
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// BackupStatus reports the outcome of scheduled backups.
+type BackupStatus struct {
+	// LastSuccessfulBackupTime is when the last successful backup completed.
+	// +optional
+	LastSuccessfulBackupTime *metav1.Time `json:"lastSuccessfulBackupTime,omitempty"`
+
+	// LastBackupSizeBytes is the size of the last successful backup archive.
+	// +optional
+	LastBackupSizeBytes int64 `json:"lastBackupSizeBytes,omitempty"`
+
+	// LastBackupLocation is the URL of the last successful backup archive.
+	// +optional
+	LastBackupLocation string `json:"lastBackupLocation,omitempty"`
+
+	// LastFailedBackupTime is when the last failed backup failed.
+	// +optional
+	LastFailedBackupTime *metav1.Time `json:"lastFailedBackupTime,omitempty"`
+
+	// LastFailureMessage describes why the last failed backup failed, or
+	// why the result of the last successful one could not be read.
+	// +optional
+	LastFailureMessage string `json:"lastFailureMessage,omitempty"`
+}
+
+// BackupResult is written by backup Jobs as the termination message of
+// the BackupResultContainer.
+type BackupResult struct {
+	Location  string `json:"location"`
+	SizeBytes int64  `json:"size"`
+}
+
+// ParseBackupResult parses the termination message of a backup Job.
+func ParseBackupResult(message string) (BackupResult, error) {
+	var result BackupResult
+	if err := json.Unmarshal([]byte(message), &result); err != nil {
+		return result, fmt.Errorf("unable to parse backup result %q: %w", message, err)
+	}
+
+	return result, nil
+}
+
+// backupOptions configures the pod built by backupPodSpec.
+type backupOptions struct {
+	// namePrefix is prepended to the timestamp in archive names.
+	namePrefix    string
+	s3            *S3Target
+	pvc           *PVCTarget
+	compression   BackupCompression
+	encryptionKey *corev1.SecretKeySelector
+	retention     int32
+}
+
+// GetBackupCronJobName returns the name of the scheduled backup CronJob.
+func (b *BookStack) GetBackupCronJobName() string {
+	return b.Name + "-backup"
+}
+
+// NewBackupCronJob returns the CronJob taking the backups scheduled in
+// spec.backup. It must only be called when spec.backup is set.
+func (b *BookStack) NewBackupCronJob() batchv1.CronJob {
+	backup := b.Spec.Backup
+	retention := backup.Retention
+	if retention == 0 {
+		retention = 7
+	}
+
+	// scheduled backups need the database, so they don't run while the
+	// instance is suspended.
+	suspend := b.IsSuspended()
+
+	var historyLimit, backoffLimit int32 = 3, 2
+	return batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.GetBackupCronJobName(),
+			Namespace: b.GetNamespace(),
+			Labels:    labelsForComponent(*b, BackupComponent),
+		},
+		Spec: batchv1.CronJobSpec{
+			Schedule:                   backup.Schedule,
+			Suspend:                    &suspend,
+			ConcurrencyPolicy:          batchv1.ForbidConcurrent,
+			SuccessfulJobsHistoryLimit: &historyLimit,
+			FailedJobsHistoryLimit:     &historyLimit,
+			JobTemplate: batchv1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labelsForComponent(*b, BackupComponent),
+				},
+				Spec: batchv1.JobSpec{
+					BackoffLimit: &backoffLimit,
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels: labelsForComponent(*b, BackupComponent),
+						},
+						Spec: b.backupPodSpec(backupOptions{
+							namePrefix:    b.GetName(),
+							s3:            &backup.S3,
+							compression:   backup.Compression,
+							encryptionKey: backup.EncryptionKeySecretRef,
+							retention:     retention,
+						}),
+					},
+				},
+			},
+		},
+	}
+}
+
+// NewBackupJob returns the Job taking the on-demand backup requested by
+// backup.
+func (b *BookStack) NewBackupJob(backup *BookStackBackup) batchv1.Job {
+	var backoffLimit int32 = 2
+	return batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      backup.GetName(),
+			Namespace: b.GetNamespace(),
+			Labels:    labelsForComponent(*b, BackupComponent),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labelsForComponent(*b, BackupComponent),
+				},
+				Spec: b.backupPodSpec(backupOptions{
+					namePrefix:    backup.GetName(),
+					s3:            backup.target().S3,
+					pvc:           backup.target().PVC,
+					compression:   backup.Spec.Compression,
+					encryptionKey: backup.Spec.EncryptionKeySecretRef,
+				}),
+			},
+		},
+	}
+}
+
+// backupPodSpec returns a pod that dumps the database, archives it with
+// the app volume and uploads the archive. Each step runs in its own
+// container so that each can use an image providing the needed tools.
+func (b *BookStack) backupPodSpec(opts backupOptions) corev1.PodSpec {
+	compression := opts.compression
+	if compression == "" {
+		compression = BackupCompressionGzip
+	}
+
+	archiveEnv := []corev1.EnvVar{
+		{Name: "COMPRESSION", Value: string(compression)},
+	}
+
+	if opts.encryptionKey != nil {
+		archiveEnv = append(archiveEnv,
+			secretEnv("ENCRYPTION_KEY", opts.encryptionKey.Name, opts.encryptionKey.Key))
+	}
+
+	pod := corev1.PodSpec{
+		RestartPolicy:   corev1.RestartPolicyNever,
+		Affinity:        b.colocatedAffinity(),
+		SecurityContext: b.podSecurityContext(),
+		Volumes: []corev1.Volume{
+			{
+				Name:         "work",
+				VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+			},
+			{
+				Name: "app-config",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: b.GetName() + "-pvc",
+						ReadOnly:  true,
+					},
+				},
+			},
+		},
+		InitContainers: []corev1.Container{
+			{
+				Name:            "dump",
+				Image:           b.dbImage(),
+				Command:         []string{"sh", "-c", dumpScript},
+				SecurityContext: b.dbSecurityContext(),
+				Env: append(b.dbClientEnv(),
+					corev1.EnvVar{Name: "BACKUP_PREFIX", Value: opts.namePrefix}),
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "work", MountPath: "/work"},
+				},
+			},
+			{
+				Name:            "archive",
+				Image:           DefaultArchiveImage,
+				Command:         []string{"sh", "-c", archiveScript},
+				SecurityContext: b.appSecurityContext(),
+				Env:             archiveEnv,
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "work", MountPath: "/work"},
+					{Name: "app-config", MountPath: "/config", ReadOnly: true},
+				},
+			},
+		},
+	}
+
+	if opts.s3 != nil {
+		pod.Containers = []corev1.Container{
+			{
+				Name:            BackupResultContainer,
+				Image:           DefaultS3ClientImage,
+				Command:         []string{"bash", "-c", s3UploadScript},
+				SecurityContext: b.appSecurityContext(),
+				// mc keeps its configuration in the home directory.
+				Env: append(opts.s3.env(),
+					corev1.EnvVar{Name: "BACKUP_PREFIX", Value: opts.namePrefix},
+					corev1.EnvVar{Name: "RETENTION", Value: strconv.Itoa(int(opts.retention))},
+					corev1.EnvVar{Name: "HOME", Value: "/work"},
+				),
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "work", MountPath: "/work"},
+				},
+			},
+		}
+	}
+
+	if opts.pvc != nil {
+		pod.Volumes = append(pod.Volumes, opts.pvc.volume("target"))
+		pod.Containers = []corev1.Container{
+			{
+				Name:            BackupResultContainer,
+				Image:           DefaultArchiveImage,
+				Command:         []string{"sh", "-c", pvcUploadScript},
+				SecurityContext: b.appSecurityContext(),
+				Env:             opts.pvc.env(),
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "work", MountPath: "/work"},
+					{Name: "target", MountPath: "/target"},
+				},
+			},
+		}
+	}
+
+	return pod
+}
+
+// colocatedAffinity schedules a pod onto the node running the instance,
+// so that it can mount the instance's ReadWriteOnce volumes.
+func (b *BookStack) colocatedAffinity() *corev1.Affinity {
+	return &corev1.Affinity{
+		PodAffinity: &corev1.PodAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+				{
+					LabelSelector: &metav1.LabelSelector{
+						MatchLabels: selectorForInstance(*b),
+					},
+					TopologyKey: corev1.LabelHostname,
+				},
+			},
+		},
+	}
+}
+
+// dbClientEnv returns the environment used by MariaDB clients to connect
+// to the instance's database through its DB Service.
+func (b *BookStack) dbClientEnv() []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: "DB_HOST", Value: b.GetDBServiceName()},
+		configMapEnv("MYSQL_DATABASE", b.GetName()+"-db-cm", "MYSQL_DATABASE"),
+		configMapEnv("MYSQL_USER", b.GetName()+"-db-cm", "MYSQL_USER"),
+		// MYSQL_PWD is read by the MariaDB clients, keeping the password
+		// off the command line.
+		secretEnv("MYSQL_PWD", b.GetName()+"-db-secret", "MYSQL_PASSWORD"),
+	}
+}
+
+// env returns the environment used by s3UploadScript to reach the target.
+func (t *S3Target) env() []corev1.EnvVar {
+	env := []corev1.EnvVar{
+		{Name: "S3_ENDPOINT", Value: t.Endpoint},
+		{Name: "S3_BUCKET", Value: t.Bucket},
+		{Name: "S3_PREFIX", Value: t.Prefix},
+		secretEnv("AWS_ACCESS_KEY_ID", t.CredentialsSecretRef.Name, "AWS_ACCESS_KEY_ID"),
+		secretEnv("AWS_SECRET_ACCESS_KEY", t.CredentialsSecretRef.Name, "AWS_SECRET_ACCESS_KEY"),
+	}
+
+	if t.Insecure {
+		env = append(env, corev1.EnvVar{Name: "S3_INSECURE", Value: "true"})
+	}
+
+	return env
+}
+
+// volume returns a volume named name mounting the claim.
+func (t *PVCTarget) volume(name string) corev1.Volume {
+	return corev1.Volume{
+		Name: name,
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: t.ClaimName,
+			},
+		},
+	}
+}
+
+// env returns the environment used by pvcUploadScript to reach the target.
+func (t *PVCTarget) env() []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: "CLAIM_NAME", Value: t.ClaimName},
+		{Name: "TARGET_PATH", Value: t.Path},
+	}
+}
+
+// dumpScript dumps the database to /work/database.sql and picks the
+// archive name. mariadb-dump replaces mysqldump in newer MariaDB images.
+const dumpScript = `set -eu
+echo "${BACKUP_PREFIX}-$(date -u +%Y%m%dT%H%M%SZ)" > /work/name
+dump=mariadb-dump
+command -v "$dump" >/dev/null 2>&1 || dump=mysqldump
+"$dump" --single-transaction --routines --host="$DB_HOST" --user="$MYSQL_USER" "$MYSQL_DATABASE" > /work/database.sql
+`
+
+// archiveScript packages the database dump and the app volume, then
+// compresses and encrypts the archive as configured.
+const archiveScript = `set -eu
+name="$(cat /work/name).tar"
+mkdir -p /work/out
+tar -cf "/work/out/$name" -C /work database.sql -C / config
+if [ "$COMPRESSION" = gzip ]; then
+  gzip "/work/out/$name"
+  name="$name.gz"
+fi
+if [ -n "${ENCRYPTION_KEY:-}" ]; then
+  openssl enc -aes-256-cbc -pbkdf2 -salt -pass env:ENCRYPTION_KEY -in "/work/out/$name" -out "/work/out/$name.enc"
+  rm "/work/out/$name"
+  name="$name.enc"
+fi
+echo "$name" > /work/archive
+`
+
+// s3UploadScript uploads the archive, prunes backups beyond the retention
+// count and reports the BackupResult.
+const s3UploadScript = `set -euo pipefail
+mc() { command mc ${S3_INSECURE:+--insecure} "$@"; }
+archive="$(cat /work/archive)"
+dest="target/${S3_BUCKET}${S3_PREFIX:+/${S3_PREFIX%/}}"
+mc alias set target "$S3_ENDPOINT" "$AWS_ACCESS_KEY_ID" "$AWS_SECRET_ACCESS_KEY" --api S3v4 >/dev/null
+mc cp "/work/out/$archive" "$dest/$archive"
+if [ "${RETENTION:-0}" -gt 0 ]; then
+  mapfile -t backups < <(mc find "$dest" --name "${BACKUP_PREFIX}-[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]T*" | sort)
+  excess=$(( ${#backups[@]} - RETENTION ))
+  for (( i=0; i<excess; i++ )); do
+    mc rm "${backups[$i]}"
+  done
+fi
+size=$(stat -c %s "/work/out/$archive")
+printf '{"location":"s3://%s/%s","size":%s}' "${dest#target/}" "$archive" "$size" > /dev/termination-log
+`
+
+// pvcUploadScript copies the archive onto the target volume and reports
+// the BackupResult.
+const pvcUploadScript = `set -eu
+archive="$(cat /work/archive)"
+dir="${TARGET_PATH#/}"
+dir="${dir%/}"
+mkdir -p "/target/$dir"
+cp "/work/out/$archive" "/target/$dir/$archive"
+size=$(stat -c %s "/work/out/$archive")
+printf '{"location":"pvc://%s/%s","size":%s}' "$CLAIM_NAME" "${dir:+$dir/}$archive" "$size" > /dev/termination-log
+`
+
+// s3CleanupScript deletes the archive at LOCATION from the target bucket.
+// An archive that is already gone is not an error, any other failure is.
+const s3CleanupScript = `set -euo pipefail
+mc() { command mc ${S3_INSECURE:+--insecure} "$@"; }
+mc alias set target "$S3_ENDPOINT" "$AWS_ACCESS_KEY_ID" "$AWS_SECRET_ACCESS_KEY" --api S3v4 >/dev/null
+if ! out=$(mc rm "target/${LOCATION#s3://}" 2>&1); then
+  case "$out" in
+  *"Object does not exist"*|*NoSuchKey*) echo "$LOCATION is already deleted" ;;
+  *) echo "$out" >&2; exit 1 ;;
+  esac
+fi
+`
+
+// pvcCleanupScript deletes the archive at LOCATION from the target volume.
+const pvcCleanupScript = `set -eu
+rm -f "/target/${LOCATION#pvc://$CLAIM_NAME/}"
+`
@@ -0,0 +1,274 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseBackupResult(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    BackupResult
+		wantErr bool
+	}{
+		{
+			name:    "s3",
+			message: `{"location":"s3://backups/wiki/wiki-20220101T030000Z.tar.gz","size":1024}`,
+			want:    BackupResult{Location: "s3://backups/wiki/wiki-20220101T030000Z.tar.gz", SizeBytes: 1024},
+		},
+		{
+			name:    "pvc",
+			message: `{"location":"pvc://backups/wiki-20220101T030000Z.tar","size":0}`,
+			want:    BackupResult{Location: "pvc://backups/wiki-20220101T030000Z.tar"},
+		},
+		{
+			name:    "empty",
+			message: "",
+			wantErr: true,
+		},
+		{
+			name:    "truncated",
+			message: `{"location":"s3://backups/wiki`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid size",
+			message: `{"location":"s3://backups/a.tar","size":"large"}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseBackupResult(tt.message)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseBackupResult() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParseBackupResult() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// mcStandIn stands in for the MinIO client and a MinIO server, serving the
+// target alias from the directory in S3_ROOT.
+const mcStandIn = `#!/bin/sh
+set -eu
+[ "$1" = --insecure ] && shift
+cmd=$1
+shift
+path() { echo "$S3_ROOT/${1#target/}"; }
+case "$cmd" in
+alias) ;;
+cp) mkdir -p "$(dirname "$(path "$2")")" && cp "$1" "$(path "$2")" ;;
+find) [ -d "$(path "$1")" ] && find "$(path "$1")" -name "$3" | sed "s|^$S3_ROOT/|target/|" ;;
+rm)
+  [ "$1" = --force ] && shift
+  if [ -n "${S3_DENY:-}" ]; then echo "mc: <ERROR> Failed to remove '$1'. Access Denied." >&2; exit 1; fi
+  if [ ! -f "$(path "$1")" ]; then echo "mc: <ERROR> Failed to remove '$1'. Object does not exist." >&2; exit 1; fi
+  rm "$(path "$1")"
+  ;;
+*) echo "unexpected mc command $cmd" >&2; exit 1 ;;
+esac
+`
+
+func TestS3UploadScript(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+
+	const archive = "wiki-20220105T030000Z.tar.gz"
+
+	tests := []struct {
+		name      string
+		prefix    string
+		retention string
+		existing  []string
+		want      []string
+		location  string
+	}{
+		{
+			name:      "prunes the oldest backups beyond the retention",
+			prefix:    "nightly/",
+			retention: "2",
+			existing:  []string{"wiki-20220101T030000Z.tar.gz", "wiki-20220103T030000Z.tar.gz", "wiki-20220102T030000Z.tar.gz"},
+			want:      []string{"wiki-20220103T030000Z.tar.gz", archive},
+			location:  "s3://backups/nightly/" + archive,
+		},
+		{
+			name:      "keeps every backup without retention",
+			retention: "0",
+			existing:  []string{"wiki-20220101T030000Z.tar.gz", "wiki-20220102T030000Z.tar.gz"},
+			want:      []string{"wiki-20220101T030000Z.tar.gz", "wiki-20220102T030000Z.tar.gz", archive},
+			location:  "s3://backups/" + archive,
+		},
+		{
+			name:      "leaves other objects alone",
+			retention: "1",
+			existing:  []string{"wiki-20220101T030000Z.tar.gz", "other-20220101T030000Z.tar.gz", "wiki-notes.txt"},
+			want:      []string{"other-20220101T030000Z.tar.gz", archive, "wiki-notes.txt"},
+			location:  "s3://backups/" + archive,
+		},
+		{
+			name:      "uploads to an empty bucket",
+			retention: "3",
+			want:      []string{archive},
+			location:  "s3://backups/" + archive,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			work := filepath.Join(dir, "work")
+			bin := filepath.Join(dir, "bin")
+			bucket := filepath.Join(dir, "s3", "backups", strings.TrimSuffix(tt.prefix, "/"))
+			for _, d := range []string{filepath.Join(work, "out"), bin, bucket} {
+				if err := os.MkdirAll(d, 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			writeFile(t, filepath.Join(bin, "mc"), mcStandIn, 0o755)
+			writeFile(t, filepath.Join(work, "archive"), archive+"\n", 0o644)
+			writeFile(t, filepath.Join(work, "out", archive), "archive", 0o644)
+			for _, name := range tt.existing {
+				writeFile(t, filepath.Join(bucket, name), "old", 0o644)
+			}
+
+			result := filepath.Join(dir, "termination-log")
+			script := strings.NewReplacer("/work/", work+"/", "/dev/termination-log", result).Replace(s3UploadScript)
+
+			cmd := exec.Command("bash", "-c", script)
+			cmd.Env = append(os.Environ(),
+				"PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"),
+				"S3_ROOT="+filepath.Join(dir, "s3"),
+				"S3_ENDPOINT=http://minio.local:9000",
+				"S3_BUCKET=backups",
+				"S3_PREFIX="+tt.prefix,
+				"AWS_ACCESS_KEY_ID=minio",
+				"AWS_SECRET_ACCESS_KEY=minio123",
+				"BACKUP_PREFIX=wiki",
+				"RETENTION="+tt.retention,
+			)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("s3UploadScript failed: %v\n%s", err, out)
+			}
+
+			entries, err := os.ReadDir(bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bucket holds %v, want %v", got, tt.want)
+			}
+
+			message, err := os.ReadFile(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			backup, err := ParseBackupResult(string(message))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (BackupResult{Location: tt.location, SizeBytes: int64(len("archive"))}); backup != want {
+				t.Errorf("result = %+v, want %+v", backup, want)
+			}
+		})
+	}
+}
+
+func TestS3CleanupScript(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+
+	const archive = "wiki-20220105T030000Z.tar.gz"
+
+	tests := []struct {
+		name    string
+		exists  bool
+		deny    bool
+		wantErr bool
+	}{
+		{name: "deletes the archive", exists: true},
+		{name: "tolerates a deleted archive"},
+		{name: "fails on other errors", exists: true, deny: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			bin := filepath.Join(dir, "bin")
+			bucket := filepath.Join(dir, "s3", "backups")
+			for _, d := range []string{bin, bucket} {
+				if err := os.MkdirAll(d, 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			writeFile(t, filepath.Join(bin, "mc"), mcStandIn, 0o755)
+			if tt.exists {
+				writeFile(t, filepath.Join(bucket, archive), "archive", 0o644)
+			}
+
+			cmd := exec.Command("bash", "-c", s3CleanupScript)
+			cmd.Env = append(os.Environ(),
+				"PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"),
+				"S3_ROOT="+filepath.Join(dir, "s3"),
+				"S3_ENDPOINT=http://minio.local:9000",
+				"AWS_ACCESS_KEY_ID=minio",
+				"AWS_SECRET_ACCESS_KEY=minio123",
+				"LOCATION=s3://backups/"+archive,
+			)
+			if tt.deny {
+				cmd.Env = append(cmd.Env, "S3_DENY=1")
+			}
+
+			out, err := cmd.CombinedOutput()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("s3CleanupScript error = %v, wantErr %v\n%s", err, tt.wantErr, out)
+			}
+
+			if _, err := os.Stat(filepath.Join(bucket, archive)); !tt.wantErr && !os.IsNotExist(err) {
+				t.Errorf("archive was not deleted: %v", err)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, name, content string, mode os.FileMode) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+}
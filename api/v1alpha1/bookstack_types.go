@@ -33,14 +33,153 @@ type BookStackSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	// Foo is an example field of BookStack. Edit bookstack_types.go to remove/update
-	Foo string `json:"foo,omitempty"`
+	// Auth configures how users authenticate to BookStack. BookStack's
+	// built-in email and password login is used when unset.
+	// +optional
+	Auth *AuthSpec `json:"auth,omitempty"`
+
+	// ExtraConfig holds additional BookStack settings, such as APP_LANG
+	// or STORAGE_TYPE, added to the app ConfigMap. These override the
+	// values generated by the operator.
+	// +optional
+	ExtraConfig map[string]string `json:"extraConfig,omitempty"`
+
+	// EnvFrom lists additional sources of environment variables for the
+	// BookStack container. These override the app ConfigMap and Secret,
+	// and later sources override earlier ones.
+	// +optional
+	EnvFrom []corev1.EnvFromSource `json:"envFrom,omitempty"`
+
+	// Env lists additional environment variables for the BookStack
+	// container. These override all other sources.
+	//
+	// Overrides for the settings the operator owns (APP_URL, AUTH_METHOD,
+	// DB_DATABASE, DB_HOST, DB_PASS and DB_USER) are ignored in
+	// ExtraConfig, EnvFrom and Env.
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+
+	// PodTemplate customizes the resources, scheduling and security
+	// context of the BookStack pod and its containers.
+	// +optional
+	PodTemplate BookStackPodTemplate `json:"podTemplate,omitempty"`
+
+	// Hardened runs the instance in a mode compliant with the restricted
+	// Pod Security Standard, using images that run as non-root.
+	// +optional
+	Hardened *HardenedSpec `json:"hardened,omitempty"`
+
+	// Backup schedules backups of the database and the app volume to
+	// S3-compatible storage.
+	// +optional
+	Backup *BackupSpec `json:"backup,omitempty"`
+
+	// Export schedules exports of every book, in the formats BookStack
+	// exports, to S3-compatible storage or a PersistentVolumeClaim.
+	// +optional
+	Export *ExportSpec `json:"export,omitempty"`
+
+	// AuditForwarding forwards the BookStack audit log to a log sink,
+	// polling it through the API.
+	// +optional
+	AuditForwarding *AuditForwardingSpec `json:"auditForwarding,omitempty"`
+
+	// Version is the tag of the BookStack image to run, e.g.
+	// v23.05.2-ls90. Changes are rolled out by an upgrade that backs the
+	// instance up to the target of spec.backup, if set, and runs the
+	// migrations of the new version first. Downgrades are refused. The
+	// image's default tag is followed when unset.
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// Admin configures the admin account that replaces BookStack's
+	// default admin@admin.com account on first boot. The default account
+	// is given a generated password when unset.
+	// +optional
+	Admin *AdminSpec `json:"admin,omitempty"`
+
+	// APIToken configures the API token the operator registers in
+	// BookStack to manage the instance through its API.
+	// +optional
+	APIToken *APITokenSpec `json:"apiToken,omitempty"`
+
+	// Maintenance puts the instance into maintenance mode: its Service
+	// serves a maintenance page instead of BookStack, while BookStack and
+	// its database keep running for an administrator to work on. Upgrades
+	// and restores wait until it is unset.
+	// +optional
+	Maintenance bool `json:"maintenance,omitempty"`
+
+	// Suspended scales the instance to zero, keeping its volumes, Secrets
+	// and Service. Scheduled backups are suspended, and upgrades, backups
+	// and restores wait until it is unset.
+	// +optional
+	Suspended bool `json:"suspended,omitempty"`
+
+	// ImagePolicy pins the BookStack image to a digest and reports newer
+	// versions of it.
+	// +optional
+	ImagePolicy *ImagePolicySpec `json:"imagePolicy,omitempty"`
+
+	// Storage configures the app and DB volumes. It must be set when the
+	// instance is created, as the volume claims can't be changed later.
+	// +optional
+	Storage *StorageSpec `json:"storage,omitempty"`
 }
 
 // BookStackStatus defines the observed state of BookStack
 type BookStackStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	// Conditions represent the latest available observations of the
+	// instance's state.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Backup reports the outcome of scheduled backups.
+	// +optional
+	Backup *BackupStatus `json:"backup,omitempty"`
+
+	// Export reports the outcome of scheduled exports.
+	// +optional
+	Export *ExportStatus `json:"export,omitempty"`
+
+	// AuditForwarding reports the last audit log event forwarded.
+	// +optional
+	AuditForwarding *AuditForwardingStatus `json:"auditForwarding,omitempty"`
+
+	// Version is the version the Deployment runs.
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// Upgrade reports the progress of the latest version change.
+	// +optional
+	Upgrade *UpgradeStatus `json:"upgrade,omitempty"`
+
+	// Image reports the digest the BookStack image resolved to and the
+	// newer versions available.
+	// +optional
+	Image *ImageStatus `json:"image,omitempty"`
+
+	// APIToken reports the operator's API token.
+	// +optional
+	APIToken *APITokenStatus `json:"apiToken,omitempty"`
+
+	// DataLayout is the layout of the data volumes the instance was
+	// created with. Hardened mode can't be switched once it is recorded.
+	// +optional
+	DataLayout DataLayout `json:"dataLayout,omitempty"`
+
+	// ScaledDownReplicas is the number of replicas the Deployment ran
+	// before the instance scaled to zero, which it is scaled back to.
+	// +optional
+	ScaledDownReplicas *int32 `json:"scaledDownReplicas,omitempty"`
+
+	// AdminAdopted is set when the instance was already serving before its
+	// admin account was first bootstrapped. It stays exposed meanwhile.
+	// +optional
+	AdminAdopted bool `json:"adminAdopted,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -66,6 +205,12 @@ func (b *BookStack) GetServiceName() string {
 	return b.Name + "-svc"
 }
 
+// GetDBServiceName returns the name of the Service exposing the database
+// to the Jobs the operator runs against the instance.
+func (b *BookStack) GetDBServiceName() string {
+	return b.Name + "-db"
+}
+
 func (b *BookStack) NewServiceAccount() corev1.ServiceAccount {
 	return corev1.ServiceAccount{
 		ObjectMeta: metav1.ObjectMeta{
@@ -78,7 +223,6 @@ func (b *BookStack) NewServiceAccount() corev1.ServiceAccount {
 
 // TODO Come back to this, PV and PVC first.
 func (b *BookStack) NewDeployment() appsv1.Deployment {
-	var one int32 = 1
 	return appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      b.GetName(),
@@ -86,7 +230,7 @@ func (b *BookStack) NewDeployment() appsv1.Deployment {
 			Labels:    labelsForInstance(*b),
 		},
 		Spec: appsv1.DeploymentSpec{
-			Replicas: &one,
+			Replicas: b.replicas(),
 			Selector: &metav1.LabelSelector{
 				MatchLabels: selectorForInstance(*b),
 			},
@@ -97,7 +241,7 @@ func (b *BookStack) NewDeployment() appsv1.Deployment {
 					Labels:    labelsForInstance(*b),
 				},
 				Spec: corev1.PodSpec{
-					Volumes: []corev1.Volume{
+					Volumes: append([]corev1.Volume{
 						{
 							Name: "app-config",
 							VolumeSource: corev1.VolumeSource{
@@ -114,20 +258,13 @@ func (b *BookStack) NewDeployment() appsv1.Deployment {
 								},
 							},
 						},
-					},
+					}, append(b.authVolumes(), b.scratchVolumes()...)...),
 					Containers: []corev1.Container{
 						{
 							Name:  "bookstack",
-							Image: "lscr.io/linuxserver/bookstack:latest",
-							Ports: []corev1.ContainerPort{
-								{
-									Name:          "http",
-									HostPort:      6785,
-									ContainerPort: 80,
-									Protocol:      "TCP",
-								},
-							},
-							EnvFrom: []corev1.EnvFromSource{
+							Image: b.appImage(),
+							Ports: b.appPorts(),
+							EnvFrom: append([]corev1.EnvFromSource{
 								{
 									ConfigMapRef: &corev1.ConfigMapEnvSource{
 										LocalObjectReference: corev1.LocalObjectReference{
@@ -142,17 +279,25 @@ func (b *BookStack) NewDeployment() appsv1.Deployment {
 										},
 									},
 								},
-							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "app-config",
-									MountPath: "/config",
-								},
-							},
+							}, b.Spec.EnvFrom...),
+							Env:             append(b.hardenedAppEnv(), append(b.userEnv(), b.ownedEnv()...)...),
+							Resources:       b.Spec.PodTemplate.App.Resources,
+							SecurityContext: b.appSecurityContext(),
+							ReadinessProbe:  b.appReadinessProbe(),
+							LivenessProbe:   b.appLivenessProbe(),
+							StartupProbe:    b.appStartupProbe(),
+							VolumeMounts: append(b.appDataVolumeMounts(),
+								append(b.authVolumeMounts(), b.scratchVolumeMounts("app-")...)...),
 						},
 						{
-							Name:  "bookstack-db",
-							Image: "lscr.io/linuxserver/mariadb:latest",
+							Name:            "bookstack-db",
+							Image:           b.dbImage(),
+							Resources:       b.Spec.PodTemplate.DB.Resources,
+							SecurityContext: b.dbSecurityContext(),
+							ReadinessProbe:  b.dbReadinessProbe(),
+							LivenessProbe:   b.dbLivenessProbe(),
+							StartupProbe:    b.dbStartupProbe(),
+							Env:             b.hardenedDBEnv(),
 							EnvFrom: []corev1.EnvFromSource{
 								{
 									ConfigMapRef: &corev1.ConfigMapEnvSource{
@@ -169,15 +314,21 @@ func (b *BookStack) NewDeployment() appsv1.Deployment {
 									},
 								},
 							},
-							VolumeMounts: []corev1.VolumeMount{
+							VolumeMounts: append([]corev1.VolumeMount{
 								{
 									Name:      "db-config",
-									MountPath: "/config",
+									MountPath: b.dbDataMountPath(),
 								},
-							},
+							}, b.scratchVolumeMounts("db-")...),
 						},
 					},
-					ServiceAccountName: b.GetName() + "-sa",
+					ServiceAccountName:        b.GetName() + "-sa",
+					NodeSelector:              b.Spec.PodTemplate.NodeSelector,
+					Tolerations:               b.Spec.PodTemplate.Tolerations,
+					Affinity:                  b.Spec.PodTemplate.Affinity,
+					TopologySpreadConstraints: b.Spec.PodTemplate.TopologySpreadConstraints,
+					PriorityClassName:         b.Spec.PodTemplate.PriorityClassName,
+					SecurityContext:           b.podSecurityContext(),
 				},
 			},
 		},
@@ -197,30 +348,73 @@ func (b *BookStack) NewService() corev1.Service {
 					Name:       "http",
 					Protocol:   "TCP",
 					Port:       80,
-					TargetPort: intstr.IntOrString{IntVal: 80},
+					TargetPort: intstr.FromInt(int(b.servicePort())),
 				},
 			},
-			Selector: selectorForInstance(*b),
+			Selector: b.serviceSelector(),
 			Type:     "NodePort",
 		},
 	}
 }
 
+// NewDBService returns a cluster-internal Service for the database, used
+// by backup and maintenance Jobs.
+func (b *BookStack) NewDBService() corev1.Service {
+	return corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.GetDBServiceName(),
+			Namespace: b.GetNamespace(),
+			Labels:    labelsForInstance(*b),
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "mysql",
+					Protocol:   "TCP",
+					Port:       dbPort,
+					TargetPort: intstr.FromInt(dbPort),
+				},
+			},
+			Selector: selectorForInstance(*b),
+			Type:     "ClusterIP",
+		},
+	}
+}
+
 func (b *BookStack) NewAppConfigMap() corev1.ConfigMap {
+	data := map[string]string{
+		"APP_URL":     "http://example.com/", // placeholder, modified at creationtime
+		"AUTH_METHOD": b.authMethod(),
+		"DB_DATABASE": "bookstackapp",
+		"DB_HOST":     "localhost",
+		"DB_USER":     "bookstack",
+		"PGID":        "1000",
+		"PUID":        "1000",
+		"TZ":          "America/Chicago",
+	}
+
+	// the hardened images don't use PUID and PGID, and must reach the
+	// database over TCP rather than a socket.
+	if b.IsHardened() {
+		data["DB_HOST"] = "127.0.0.1"
+		delete(data, "PGID")
+		delete(data, "PUID")
+	}
+
+	for k, v := range b.authConfig() {
+		data[k] = v
+	}
+
+	for k, v := range b.extraConfig() {
+		data[k] = v
+	}
+
 	return corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      b.GetName() + "-cm",
 			Namespace: b.GetNamespace(),
 		},
-		Data: map[string]string{
-			"APP_URL":     "http://example.com/", // placeholder, modified at creationtime
-			"DB_DATABASE": "bookstackapp",
-			"DB_HOST":     "localhost",
-			"DB_USER":     "bookstack",
-			"PGID":        "1000",
-			"PUID":        "1000",
-			"TZ":          "America/Chicago",
-		},
+		Data: data,
 	}
 }
 
@@ -324,7 +518,6 @@ func (b *BookStack) NewDBPersistentVolume() corev1.PersistentVolume {
 }
 
 func (b *BookStack) NewDBPersistentVolumeClaim() corev1.PersistentVolumeClaim {
-	manual := "manual"
 	return corev1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      b.GetName() + "-db-pvc",
@@ -340,13 +533,13 @@ func (b *BookStack) NewDBPersistentVolumeClaim() corev1.PersistentVolumeClaim {
 					"storage": *resource.NewQuantity(2, resource.Format("Gi")),
 				},
 			},
-			StorageClassName: &manual,
+			StorageClassName: b.storageClassName(),
+			DataSource:       b.dbDataSource(),
 		},
 	}
 }
 
 func (b *BookStack) NewAppPersistentVolumeClaim() corev1.PersistentVolumeClaim {
-	manual := "manual"
 	return corev1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      b.GetName() + "-pvc",
@@ -362,7 +555,8 @@ func (b *BookStack) NewAppPersistentVolumeClaim() corev1.PersistentVolumeClaim {
 					"storage": *resource.NewQuantity(2, resource.Format("Gi")),
 				},
 			},
-			StorageClassName: &manual,
+			StorageClassName: b.storageClassName(),
+			DataSource:       b.appDataSource(),
 		},
 	}
 }
@@ -0,0 +1,295 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"errors"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BackupArtifactsFinalizer is added to BookStackBackups whose archive is
+// deleted along with them.
+const BackupArtifactsFinalizer = "tools.opdev.io/backup-artifacts"
+
+// BackupPhase is the lifecycle phase of a BookStackBackup.
+type BackupPhase string
+
+const (
+	BackupPhasePending   BackupPhase = "Pending"
+	BackupPhaseRunning   BackupPhase = "Running"
+	BackupPhaseCompleted BackupPhase = "Completed"
+	BackupPhaseFailed    BackupPhase = "Failed"
+)
+
+// BackupMode selects how a BookStackBackup backs up an instance.
+// +kubebuilder:validation:Enum=Archive;Snapshot
+type BackupMode string
+
+const (
+	// BackupModeArchive dumps the database and archives it with the app
+	// volume to a target.
+	BackupModeArchive BackupMode = "Archive"
+	// BackupModeSnapshot takes VolumeSnapshots of the app and DB volumes.
+	BackupModeSnapshot BackupMode = "Snapshot"
+)
+
+// BookStackBackupSpec defines the desired state of BookStackBackup
+type BookStackBackupSpec struct {
+	// BookStackRef names the BookStack instance to back up. It must be in
+	// the same namespace as the BookStackBackup.
+	BookStackRef corev1.LocalObjectReference `json:"bookStackRef"`
+
+	// Mode selects whether the backup is an archive stored in a target or
+	// a pair of VolumeSnapshots.
+	// +kubebuilder:default=Archive
+	// +optional
+	Mode BackupMode `json:"mode,omitempty"`
+
+	// Target is where the backup archive is stored. It is required in
+	// Archive mode.
+	// +optional
+	Target *BackupTarget `json:"target,omitempty"`
+
+	// Snapshot configures backups in Snapshot mode.
+	// +optional
+	Snapshot *SnapshotOptions `json:"snapshot,omitempty"`
+
+	// Compression selects how the backup archive is compressed.
+	// +kubebuilder:default=gzip
+	// +optional
+	Compression BackupCompression `json:"compression,omitempty"`
+
+	// EncryptionKeySecretRef references the key of a Secret holding the
+	// passphrase used to encrypt the backup archive with AES-256. The
+	// archive is not encrypted when unset.
+	// +optional
+	EncryptionKeySecretRef *corev1.SecretKeySelector `json:"encryptionKeySecretRef,omitempty"`
+
+	// DeleteArtifacts deletes the backup archive from the target when the
+	// BookStackBackup is deleted. The VolumeSnapshots of Snapshot mode are
+	// always deleted along with the BookStackBackup.
+	// +optional
+	DeleteArtifacts bool `json:"deleteArtifacts,omitempty"`
+}
+
+// BackupTarget is where a backup archive is stored. Exactly one target
+// must be set.
+// +kubebuilder:validation:MinProperties=1
+// +kubebuilder:validation:MaxProperties=1
+type BackupTarget struct {
+	// S3 stores the archive in an S3-compatible bucket.
+	// +optional
+	S3 *S3Target `json:"s3,omitempty"`
+
+	// PVC stores the archive on a PersistentVolumeClaim in the BookStack
+	// namespace.
+	// +optional
+	PVC *PVCTarget `json:"pvc,omitempty"`
+}
+
+// PVCTarget is a directory on a PersistentVolumeClaim.
+type PVCTarget struct {
+	// ClaimName is the name of the PersistentVolumeClaim.
+	// +kubebuilder:validation:MinLength=1
+	ClaimName string `json:"claimName"`
+
+	// Path is the directory on the volume archives are stored in.
+	// +optional
+	Path string `json:"path,omitempty"`
+}
+
+// BookStackBackupStatus defines the observed state of BookStackBackup
+type BookStackBackupStatus struct {
+	// Phase is the lifecycle phase of the backup.
+	// +optional
+	Phase BackupPhase `json:"phase,omitempty"`
+
+	// Message describes the reason for the current phase.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// StartTime is when the backup Job started.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is when the backup completed.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// SizeBytes is the size of the backup archive.
+	// +optional
+	SizeBytes int64 `json:"sizeBytes,omitempty"`
+
+	// Location is the URL of the backup archive, using the s3:// or
+	// pvc:// scheme.
+	// +optional
+	Location string `json:"location,omitempty"`
+
+	// AppImage is the BookStack image the instance ran when the backup
+	// was taken.
+	// +optional
+	AppImage string `json:"appImage,omitempty"`
+
+	// DataLayout is the data layout of the instance when the backup was
+	// taken, which decides the security context of the cleanup Job.
+	// +optional
+	DataLayout DataLayout `json:"dataLayout,omitempty"`
+
+	// AppSnapshotName is the VolumeSnapshot of the app volume taken in
+	// Snapshot mode.
+	// +optional
+	AppSnapshotName string `json:"appSnapshotName,omitempty"`
+
+	// DBSnapshotName is the VolumeSnapshot of the DB volume taken in
+	// Snapshot mode.
+	// +optional
+	DBSnapshotName string `json:"dbSnapshotName,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="BookStack",type=string,JSONPath=`.spec.bookStackRef.name`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Location",type=string,JSONPath=`.status.location`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// BookStackBackup is the Schema for the bookstackbackups API
+type BookStackBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BookStackBackupSpec   `json:"spec,omitempty"`
+	Status BookStackBackupStatus `json:"status,omitempty"`
+}
+
+// IsSnapshot returns true if the backup is taken in Snapshot mode.
+func (b *BookStackBackup) IsSnapshot() bool {
+	return b.Spec.Mode == BackupModeSnapshot
+}
+
+// ValidateTarget returns an error if an Archive mode backup has no target.
+func (b *BookStackBackup) ValidateTarget() error {
+	if !b.IsSnapshot() && b.Spec.Target == nil {
+		return errors.New("target must be set in Archive mode")
+	}
+
+	return nil
+}
+
+// target returns the target of the backup, which is empty in Snapshot
+// mode.
+func (b *BookStackBackup) target() BackupTarget {
+	if b.Spec.Target == nil {
+		return BackupTarget{}
+	}
+
+	return *b.Spec.Target
+}
+
+// IsFinished returns true once the backup has completed or failed.
+func (b *BookStackBackup) IsFinished() bool {
+	return b.Status.Phase == BackupPhaseCompleted || b.Status.Phase == BackupPhaseFailed
+}
+
+// NewCleanupJob returns a Job deleting the backup archive from its target.
+// It may run after the instance is deleted, so it runs as the backup pod
+// did according to the recorded data layout.
+func (b *BookStackBackup) NewCleanupJob() batchv1.Job {
+	var securityContext *corev1.SecurityContext
+	pod := corev1.PodSpec{
+		RestartPolicy: corev1.RestartPolicyNever,
+		Volumes: []corev1.Volume{
+			{
+				Name:         "work",
+				VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+			},
+		},
+	}
+
+	if b.Status.DataLayout == DataLayoutHardened {
+		pod.SecurityContext = hardenedPodSecurityContext(hardenedFSGroup)
+		securityContext = restrictedSecurityContext(hardenedAppUser)
+	}
+
+	env := []corev1.EnvVar{{Name: "LOCATION", Value: b.Status.Location}}
+	if s3 := b.target().S3; s3 != nil {
+		pod.Containers = []corev1.Container{
+			{
+				Name:            "cleanup",
+				Image:           DefaultS3ClientImage,
+				Command:         []string{"bash", "-c", s3CleanupScript},
+				SecurityContext: securityContext,
+				// mc keeps its configuration in the home directory.
+				Env: append(append(env, s3.env()...), corev1.EnvVar{Name: "HOME", Value: "/work"}),
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "work", MountPath: "/work"},
+				},
+			},
+		}
+	}
+
+	if pvc := b.target().PVC; pvc != nil {
+		pod.Volumes = append(pod.Volumes, pvc.volume("target"))
+		pod.Containers = []corev1.Container{
+			{
+				Name:            "cleanup",
+				Image:           DefaultArchiveImage,
+				Command:         []string{"sh", "-c", pvcCleanupScript},
+				SecurityContext: securityContext,
+				Env:             append(env, corev1.EnvVar{Name: "CLAIM_NAME", Value: pvc.ClaimName}),
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "target", MountPath: "/target"},
+				},
+			},
+		}
+	}
+
+	var backoffLimit int32 = 2
+
+	return batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.GetName() + "-cleanup",
+			Namespace: b.GetNamespace(),
+			Labels: map[string]string{
+				"app":         "bookstack-backup-cleanup",
+				InstanceLabel: b.Spec.BookStackRef.Name,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: pod,
+			},
+		},
+	}
+}
+
+//+kubebuilder:object:root=true
+
+// BookStackBackupList contains a list of BookStackBackup
+type BookStackBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []BookStackBackup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&BookStackBackup{}, &BookStackBackupList{})
+}
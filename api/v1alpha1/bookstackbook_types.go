@@ -0,0 +1,135 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BookStackBookSpec defines the desired state of BookStackBook
+type BookStackBookSpec struct {
+	// BookStackRef names the BookStack instance the book is in. It must be
+	// in the same namespace as the BookStackBook.
+	BookStackRef corev1.LocalObjectReference `json:"bookStackRef"`
+
+	// Name is the name of the book. An existing book with the name is
+	// adopted. Once synced, the book is followed by its ID, so renaming it
+	// renames the book.
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=255
+	Name string `json:"name"`
+
+	// Description describes the book. The description is left as it is
+	// when unset.
+	// +optional
+	Description string `json:"description,omitempty"`
+
+	// Tags are the tags of the book, in order. The tags are left as they
+	// are when unset.
+	// +optional
+	Tags []ContentTag `json:"tags,omitempty"`
+
+	// Cover selects the key of a ConfigMap holding the cover image of the
+	// book. The key is the file name of the image, e.g. cover.png.
+	// +optional
+	Cover *corev1.ConfigMapKeySelector `json:"cover,omitempty"`
+
+	// Permissions override the permissions of the roles on the book. The
+	// permissions are left as they are when unset.
+	// +optional
+	Permissions *EntityPermissions `json:"permissions,omitempty"`
+
+	// DeletionPolicy selects whether the book is deleted from BookStack,
+	// along with its chapters and pages, when the BookStackBook is
+	// deleted. Defaults to Retain.
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+}
+
+// BookStackBookStatus defines the observed state of BookStackBook
+type BookStackBookStatus struct {
+	// ID is the ID of the book in BookStack.
+	// +optional
+	ID int `json:"id,omitempty"`
+
+	// Slug is the URL path segment of the book.
+	// +optional
+	Slug string `json:"slug,omitempty"`
+
+	// Adopted is true if the book existed before the BookStackBook.
+	// +optional
+	Adopted bool `json:"adopted,omitempty"`
+
+	// CoverHash is the SHA-256 hash of the cover image last uploaded.
+	// +optional
+	CoverHash string `json:"coverHash,omitempty"`
+
+	// LastSyncTime is when the book was last found in sync.
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// Conditions report whether the book is in sync.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="BookStack",type=string,JSONPath=`.spec.bookStackRef.name`
+//+kubebuilder:printcolumn:name="Name",type=string,JSONPath=`.spec.name`
+//+kubebuilder:printcolumn:name="ID",type=integer,JSONPath=`.status.id`
+//+kubebuilder:printcolumn:name="Synced",type=string,JSONPath=`.status.conditions[?(@.type=="Synced")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// BookStackBook is the Schema for the bookstackbooks API
+type BookStackBook struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BookStackBookSpec   `json:"spec,omitempty"`
+	Status BookStackBookStatus `json:"status,omitempty"`
+}
+
+// InstanceName returns the name of the BookStack instance the book is in.
+func (b *BookStackBook) InstanceName() string {
+	return b.Spec.BookStackRef.Name
+}
+
+// GetConditions returns the conditions of the book.
+func (b *BookStackBook) GetConditions() *[]metav1.Condition {
+	return &b.Status.Conditions
+}
+
+// RetainsBook returns true if the book is kept in BookStack when the
+// BookStackBook is deleted.
+func (b *BookStackBook) RetainsBook() bool {
+	return b.Spec.DeletionPolicy != DeletionPolicyDelete
+}
+
+//+kubebuilder:object:root=true
+
+// BookStackBookList contains a list of BookStackBook
+type BookStackBookList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []BookStackBook `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&BookStackBook{}, &BookStackBookList{})
+}
@@ -0,0 +1,340 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// DefaultKubectlImage runs the Jobs collecting Markdown files from a
+	// volume into a ConfigMap.
+	DefaultKubectlImage = "docker.io/bitnami/kubectl:latest"
+
+	// PageCollectorComponent labels the resources collecting Markdown files
+	// from a volume.
+	PageCollectorComponent = "page-collector"
+)
+
+// PageSourceConfigMap selects Markdown files held in a ConfigMap.
+type PageSourceConfigMap struct {
+	// Name of the ConfigMap, in the namespace of the BookStackPageSource.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// Keys are the keys holding Markdown files. Defaults to every key
+	// ending in .md.
+	// +optional
+	Keys []string `json:"keys,omitempty"`
+}
+
+// PageSourceVolume selects the Markdown files in a directory of a
+// PersistentVolumeClaim.
+type PageSourceVolume struct {
+	// ClaimName is the name of the PersistentVolumeClaim.
+	// +kubebuilder:validation:MinLength=1
+	ClaimName string `json:"claimName"`
+
+	// Path is the directory within the claim. The files ending in .md
+	// directly in the directory are synced.
+	// +optional
+	Path string `json:"path,omitempty"`
+}
+
+// BookStackPageSourceSpec defines the desired state of BookStackPageSource
+type BookStackPageSourceSpec struct {
+	// BookStackRef names the BookStack instance the pages are in. It must
+	// be in the same namespace as the BookStackPageSource.
+	BookStackRef corev1.LocalObjectReference `json:"bookStackRef"`
+
+	// Book is the name of the book pages are synced into, unless their
+	// front-matter names another. The book must exist.
+	// +optional
+	Book string `json:"book,omitempty"`
+
+	// ConfigMaps hold Markdown files to sync.
+	// +optional
+	ConfigMaps []PageSourceConfigMap `json:"configMaps,omitempty"`
+
+	// Volume is a directory of Markdown files to sync. The files are
+	// collected into a ConfigMap by a Job mounting the claim.
+	// +optional
+	Volume *PageSourceVolume `json:"volume,omitempty"`
+
+	// Prune deletes the pages synced from files that were removed from the
+	// source.
+	// +optional
+	Prune bool `json:"prune,omitempty"`
+
+	// DeletionPolicy selects whether the synced pages are deleted from
+	// BookStack when the BookStackPageSource is deleted. Defaults to
+	// Retain.
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+}
+
+// SyncedPage is a page synced from a Markdown file.
+type SyncedPage struct {
+	// Key identifies the file, as <configmap>/<key> or <claim>/<file>.
+	Key string `json:"key"`
+
+	// ID is the ID of the page in BookStack.
+	ID int `json:"id"`
+
+	// Hash is the SHA-256 hash of the file and the book it was synced
+	// into. The page is only updated when the hash changes.
+	Hash string `json:"hash"`
+}
+
+// BookStackPageSourceStatus defines the observed state of BookStackPageSource
+type BookStackPageSourceStatus struct {
+	// Pages are the pages synced from the source.
+	// +optional
+	Pages []SyncedPage `json:"pages,omitempty"`
+
+	// VolumeCollectionTime is when the Markdown files were last collected
+	// from the volume.
+	// +optional
+	VolumeCollectionTime *metav1.Time `json:"volumeCollectionTime,omitempty"`
+
+	// LastSyncTime is when the pages were last synced.
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// Conditions report whether the pages are in sync.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="BookStack",type=string,JSONPath=`.spec.bookStackRef.name`
+//+kubebuilder:printcolumn:name="Book",type=string,JSONPath=`.spec.book`
+//+kubebuilder:printcolumn:name="Synced",type=string,JSONPath=`.status.conditions[?(@.type=="Synced")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// BookStackPageSource is the Schema for the bookstackpagesources API
+type BookStackPageSource struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BookStackPageSourceSpec   `json:"spec,omitempty"`
+	Status BookStackPageSourceStatus `json:"status,omitempty"`
+}
+
+// InstanceName returns the name of the BookStack instance the pages are
+// in.
+func (s *BookStackPageSource) InstanceName() string {
+	return s.Spec.BookStackRef.Name
+}
+
+// GetConditions returns the conditions of the page source.
+func (s *BookStackPageSource) GetConditions() *[]metav1.Condition {
+	return &s.Status.Conditions
+}
+
+// RetainsPages returns true if the synced pages are kept in BookStack when
+// the BookStackPageSource is deleted.
+func (s *BookStackPageSource) RetainsPages() bool {
+	return s.Spec.DeletionPolicy != DeletionPolicyDelete
+}
+
+// ReadsConfigMap returns true if the source reads the ConfigMap with the
+// name, including the ConfigMap the volume is collected into.
+func (s *BookStackPageSource) ReadsConfigMap(name string) bool {
+	if s.Spec.Volume != nil && name == s.GetVolumeConfigMapName() {
+		return true
+	}
+
+	for _, cm := range s.Spec.ConfigMaps {
+		if cm.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetVolumeConfigMapName returns the name of the ConfigMap the Markdown
+// files of the volume are collected into.
+func (s *BookStackPageSource) GetVolumeConfigMapName() string {
+	return s.GetName() + "-volume"
+}
+
+// GetCollectorName returns the name of the Job collecting the Markdown
+// files of the volume, and of its ServiceAccount, Role and RoleBinding.
+func (s *BookStackPageSource) GetCollectorName() string {
+	return s.GetName() + "-collector"
+}
+
+// labels returns the labels of the resources collecting the volume.
+func (s *BookStackPageSource) labels() map[string]string {
+	return map[string]string{
+		"app":         "bookstack-" + PageCollectorComponent,
+		InstanceLabel: s.Spec.BookStackRef.Name,
+	}
+}
+
+// NewVolumeConfigMap returns the empty ConfigMap the Markdown files of the
+// volume are collected into. The collector only updates it, so it needs no
+// permission to create ConfigMaps.
+func (s *BookStackPageSource) NewVolumeConfigMap() corev1.ConfigMap {
+	return corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.GetVolumeConfigMapName(),
+			Namespace: s.GetNamespace(),
+			Labels:    s.labels(),
+		},
+	}
+}
+
+// NewCollectorServiceAccount returns the ServiceAccount of the collector
+// Job.
+func (s *BookStackPageSource) NewCollectorServiceAccount() corev1.ServiceAccount {
+	return corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.GetCollectorName(),
+			Namespace: s.GetNamespace(),
+			Labels:    s.labels(),
+		},
+	}
+}
+
+// NewCollectorRole returns the Role letting the collector Job update the
+// volume ConfigMap, and nothing else.
+func (s *BookStackPageSource) NewCollectorRole() rbacv1.Role {
+	return rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.GetCollectorName(),
+			Namespace: s.GetNamespace(),
+			Labels:    s.labels(),
+		},
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups:     []string{""},
+				Resources:     []string{"configmaps"},
+				ResourceNames: []string{s.GetVolumeConfigMapName()},
+				Verbs:         []string{"get", "patch"},
+			},
+		},
+	}
+}
+
+// NewCollectorRoleBinding returns the RoleBinding granting the collector
+// Role to its ServiceAccount.
+func (s *BookStackPageSource) NewCollectorRoleBinding() rbacv1.RoleBinding {
+	return rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.GetCollectorName(),
+			Namespace: s.GetNamespace(),
+			Labels:    s.labels(),
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     s.GetCollectorName(),
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      s.GetCollectorName(),
+				Namespace: s.GetNamespace(),
+			},
+		},
+	}
+}
+
+// NewCollectorJob returns the Job collecting the Markdown files of the
+// volume into the volume ConfigMap.
+func (s *BookStackPageSource) NewCollectorJob() batchv1.Job {
+	var backoffLimit int32 = 2
+	return batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.GetCollectorName(),
+			Namespace: s.GetNamespace(),
+			Labels:    s.labels(),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: s.labels(),
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy:      corev1.RestartPolicyNever,
+					ServiceAccountName: s.GetCollectorName(),
+					Volumes: []corev1.Volume{
+						{
+							Name: "source",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: s.Spec.Volume.ClaimName,
+									ReadOnly:  true,
+								},
+							},
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:    "collect",
+							Image:   DefaultKubectlImage,
+							Command: []string{"sh", "-c", collectPagesScript},
+							Env: []corev1.EnvVar{
+								{Name: "SOURCE_PATH", Value: s.Spec.Volume.Path},
+								{Name: "CONFIGMAP", Value: s.GetVolumeConfigMapName()},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "source", MountPath: "/source", ReadOnly: true},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// collectPagesScript replaces the data of the volume ConfigMap with the
+// Markdown files in the source directory. Server-side apply leaves the
+// owner reference set by the operator alone, and keeps the files out of a
+// last-applied annotation, which would halve the size the ConfigMap can
+// hold.
+const collectPagesScript = `set -eu
+cd "/source/${SOURCE_PATH}"
+set --
+for f in *.md; do
+  [ -f "$f" ] && set -- "$@" "--from-file=$f"
+done
+kubectl create configmap "$CONFIGMAP" "$@" --dry-run=client -o yaml |
+  kubectl apply --server-side --force-conflicts --field-manager=bookstack-page-collector -f -
+`
+
+//+kubebuilder:object:root=true
+
+// BookStackPageSourceList contains a list of BookStackPageSource
+type BookStackPageSourceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []BookStackPageSource `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&BookStackPageSource{}, &BookStackPageSourceList{})
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"errors"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RestorePhase is the lifecycle phase of a BookStackRestore.
+type RestorePhase string
+
+const (
+	RestorePhasePending   RestorePhase = "Pending"
+	RestorePhaseRunning   RestorePhase = "Running"
+	RestorePhaseCompleted RestorePhase = "Completed"
+	RestorePhaseFailed    RestorePhase = "Failed"
+)
+
+// Condition types reported in BookStackRestoreStatus, in the order the
+// steps of a restore run.
+const (
+	// ConditionScaledDown indicates whether the instance was stopped.
+	ConditionScaledDown = "ScaledDown"
+
+	// ConditionDataRestored indicates whether the database and the app
+	// volume were restored from the backup.
+	ConditionDataRestored = "DataRestored"
+
+	// ConditionScaledUp indicates whether the instance was started again.
+	ConditionScaledUp = "ScaledUp"
+
+	// ConditionMigrated indicates whether the BookStack migrations ran
+	// against the restored database.
+	ConditionMigrated = "Migrated"
+)
+
+// BookStackRestoreSpec defines the desired state of BookStackRestore
+type BookStackRestoreSpec struct {
+	// BookStackRef names the BookStack instance to restore. It must be in
+	// the same namespace as the BookStackRestore.
+	BookStackRef corev1.LocalObjectReference `json:"bookStackRef"`
+
+	// Source is the backup archive to restore.
+	Source RestoreSource `json:"source"`
+
+	// EncryptionKeySecretRef references the key of a Secret holding the
+	// passphrase the archive was encrypted with. It defaults to the key of
+	// the referenced BookStackBackup.
+	// +optional
+	EncryptionKeySecretRef *corev1.SecretKeySelector `json:"encryptionKeySecretRef,omitempty"`
+}
+
+// RestoreSource is a backup archive. Either BackupRef, or one of S3 and
+// PVC together with Archive, must be set.
+type RestoreSource struct {
+	// BackupRef names a completed BookStackBackup in the same namespace.
+	// +optional
+	BackupRef *corev1.LocalObjectReference `json:"backupRef,omitempty"`
+
+	// S3 is the bucket holding the archive.
+	// +optional
+	S3 *S3Target `json:"s3,omitempty"`
+
+	// PVC is the volume directory holding the archive.
+	// +optional
+	PVC *PVCTarget `json:"pvc,omitempty"`
+
+	// Archive is the name of the archive in the S3 prefix or the PVC
+	// directory, e.g. my-bookstack-20220301T020000Z.tar.gz.
+	// +optional
+	Archive string `json:"archive,omitempty"`
+
+	// AppImage is the BookStack image the backup was taken with. When it
+	// differs from the image the instance runs, or is unknown, the
+	// BookStack migrations are run after the restore. It defaults to the
+	// image recorded by the referenced BookStackBackup.
+	// +optional
+	AppImage string `json:"appImage,omitempty"`
+}
+
+// BookStackRestoreStatus defines the observed state of BookStackRestore
+type BookStackRestoreStatus struct {
+	// Phase is the lifecycle phase of the restore.
+	// +optional
+	Phase RestorePhase `json:"phase,omitempty"`
+
+	// StartTime is when the restore started.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is when the restore completed or failed.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// Conditions record the progress of each step of the restore.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="BookStack",type=string,JSONPath=`.spec.bookStackRef.name`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// BookStackRestore is the Schema for the bookstackrestores API
+type BookStackRestore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BookStackRestoreSpec   `json:"spec,omitempty"`
+	Status BookStackRestoreStatus `json:"status,omitempty"`
+}
+
+// IsFinished returns true once the restore has completed or failed.
+func (r *BookStackRestore) IsFinished() bool {
+	return r.Status.Phase == RestorePhaseCompleted || r.Status.Phase == RestorePhaseFailed
+}
+
+// ValidateSource returns an error if spec.source does not name exactly
+// one archive.
+func (r *BookStackRestore) ValidateSource() error {
+	source := r.Spec.Source
+
+	set := 0
+	for _, isSet := range []bool{source.BackupRef != nil, source.S3 != nil, source.PVC != nil} {
+		if isSet {
+			set++
+		}
+	}
+
+	if set != 1 {
+		return errors.New("exactly one of source.backupRef, source.s3 and source.pvc must be set")
+	}
+
+	if source.BackupRef == nil && source.Archive == "" {
+		return errors.New("source.archive must be set with source.s3 or source.pvc")
+	}
+
+	return nil
+}
+
+// SourceImage returns the BookStack image the restored backup was taken
+// with, or an empty string if it is unknown. backup is the referenced
+// BookStackBackup, if any.
+func (r *BookStackRestore) SourceImage(backup *BookStackBackup) string {
+	if r.Spec.Source.AppImage != "" || backup == nil {
+		return r.Spec.Source.AppImage
+	}
+
+	return backup.Status.AppImage
+}
+
+//+kubebuilder:object:root=true
+
+// BookStackRestoreList contains a list of BookStackRestore
+type BookStackRestoreList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []BookStackRestore `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&BookStackRestore{}, &BookStackRestoreList{})
+}
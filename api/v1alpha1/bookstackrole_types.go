@@ -0,0 +1,169 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RolePermission is a permission of a role, e.g. content-export for a
+// system permission or page-update-all for a content permission.
+// +kubebuilder:validation:Pattern=`^[a-z]+(-[a-z]+)*$`
+type RolePermission string
+
+// BookStackRoleSpec defines the desired state of BookStackRole
+type BookStackRoleSpec struct {
+	// BookStackRef names the BookStack instance the role is in. It must be
+	// in the same namespace as the BookStackRole.
+	BookStackRef corev1.LocalObjectReference `json:"bookStackRef"`
+
+	// DisplayName is the name of the role. An existing role with the name
+	// is adopted.
+	// +kubebuilder:validation:MinLength=3
+	// +kubebuilder:validation:MaxLength=180
+	DisplayName string `json:"displayName"`
+
+	// Description describes the role. The description is left as it is
+	// when unset.
+	// +kubebuilder:validation:MaxLength=180
+	// +optional
+	Description string `json:"description,omitempty"`
+
+	// Permissions are the system and content permissions of the role, e.g.
+	// content-export, users-manage or page-update-all. The permissions of
+	// the role are left as they are when unset.
+	// +optional
+	Permissions []RolePermission `json:"permissions,omitempty"`
+
+	// ExternalAuthID maps the role to the group of the same ID in the
+	// external auth provider, when group sync is enabled for LDAP, SAML or
+	// OIDC. The mapping is left as it is when unset.
+	// +optional
+	ExternalAuthID string `json:"externalAuthID,omitempty"`
+
+	// MFAEnforced requires the users of the role to set up multi-factor
+	// authentication.
+	// +optional
+	MFAEnforced bool `json:"mfaEnforced,omitempty"`
+
+	// DriftPolicy selects whether changes made to the role in BookStack are
+	// reverted or only reported. Defaults to Revert.
+	// +optional
+	DriftPolicy DriftPolicy `json:"driftPolicy,omitempty"`
+
+	// DeletionPolicy selects whether the role is deleted from BookStack
+	// along with the BookStackRole. Defaults to Delete.
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// MigrateUsersTo is the display name of the role the users of the role
+	// are given when it is deleted.
+	// +optional
+	MigrateUsersTo string `json:"migrateUsersTo,omitempty"`
+}
+
+// BookStackRoleStatus defines the observed state of BookStackRole
+type BookStackRoleStatus struct {
+	// ID is the ID of the role in BookStack.
+	// +optional
+	ID int `json:"id,omitempty"`
+
+	// Adopted is true if the role existed before the BookStackRole.
+	// +optional
+	Adopted bool `json:"adopted,omitempty"`
+
+	// AppliedGeneration is the generation of the spec last applied to the
+	// role.
+	// +optional
+	AppliedGeneration int64 `json:"appliedGeneration,omitempty"`
+
+	// Drift lists the fields changed in BookStack since the spec was
+	// applied, when the drift policy is Report.
+	// +optional
+	Drift []string `json:"drift,omitempty"`
+
+	// LastSyncTime is when the role was last checked for drift.
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// Conditions report whether the role is in sync.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="BookStack",type=string,JSONPath=`.spec.bookStackRef.name`
+//+kubebuilder:printcolumn:name="Role",type=string,JSONPath=`.spec.displayName`
+//+kubebuilder:printcolumn:name="ID",type=integer,JSONPath=`.status.id`
+//+kubebuilder:printcolumn:name="Synced",type=string,JSONPath=`.status.conditions[?(@.type=="Synced")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// BookStackRole is the Schema for the bookstackroles API
+type BookStackRole struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BookStackRoleSpec   `json:"spec,omitempty"`
+	Status BookStackRoleStatus `json:"status,omitempty"`
+}
+
+// InstanceName returns the name of the BookStack instance the role is in.
+func (r *BookStackRole) InstanceName() string {
+	return r.Spec.BookStackRef.Name
+}
+
+// GetConditions returns the conditions of the role.
+func (r *BookStackRole) GetConditions() *[]metav1.Condition {
+	return &r.Status.Conditions
+}
+
+// RetainsRole returns true if the role is kept in BookStack when the
+// BookStackRole is deleted.
+func (r *BookStackRole) RetainsRole() bool {
+	return r.Spec.DeletionPolicy == DeletionPolicyRetain
+}
+
+// RevertsDrift returns true if changes made to the role in BookStack are
+// reverted.
+func (r *BookStackRole) RevertsDrift() bool {
+	return r.Spec.DriftPolicy != DriftPolicyReport
+}
+
+// PermissionNames returns the permissions of the role.
+func (r *BookStackRole) PermissionNames() []string {
+	var names []string
+	for _, p := range r.Spec.Permissions {
+		names = append(names, string(p))
+	}
+
+	return names
+}
+
+//+kubebuilder:object:root=true
+
+// BookStackRoleList contains a list of BookStackRole
+type BookStackRoleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []BookStackRole `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&BookStackRole{}, &BookStackRoleList{})
+}
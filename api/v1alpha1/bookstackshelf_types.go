@@ -0,0 +1,152 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BookStackShelfSpec defines the desired state of BookStackShelf
+type BookStackShelfSpec struct {
+	// BookStackRef names the BookStack instance the shelf is in. It must be
+	// in the same namespace as the BookStackShelf.
+	BookStackRef corev1.LocalObjectReference `json:"bookStackRef"`
+
+	// Name is the name of the shelf. An existing shelf with the name is
+	// adopted. Once synced, the shelf is followed by its ID, so renaming it
+	// renames the shelf.
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=255
+	Name string `json:"name"`
+
+	// Description describes the shelf. The description is left as it is
+	// when unset.
+	// +optional
+	Description string `json:"description,omitempty"`
+
+	// Tags are the tags of the shelf, in order. The tags are left as they
+	// are when unset.
+	// +optional
+	Tags []ContentTag `json:"tags,omitempty"`
+
+	// Books name the BookStackBooks on the shelf, in order. The books must
+	// be in the same namespace and instance as the shelf. The books on the
+	// shelf are left as they are when unset.
+	// +optional
+	Books []corev1.LocalObjectReference `json:"books,omitempty"`
+
+	// Cover selects the key of a ConfigMap holding the cover image of the
+	// shelf. The key is the file name of the image, e.g. cover.png.
+	// +optional
+	Cover *corev1.ConfigMapKeySelector `json:"cover,omitempty"`
+
+	// Permissions override the permissions of the roles on the shelf. The
+	// permissions are left as they are when unset.
+	// +optional
+	Permissions *EntityPermissions `json:"permissions,omitempty"`
+
+	// DeletionPolicy selects whether the shelf is deleted from BookStack
+	// when the BookStackShelf is deleted. Its books are kept either way.
+	// Defaults to Delete.
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+}
+
+// BookStackShelfStatus defines the observed state of BookStackShelf
+type BookStackShelfStatus struct {
+	// ID is the ID of the shelf in BookStack.
+	// +optional
+	ID int `json:"id,omitempty"`
+
+	// Slug is the URL path segment of the shelf.
+	// +optional
+	Slug string `json:"slug,omitempty"`
+
+	// Adopted is true if the shelf existed before the BookStackShelf.
+	// +optional
+	Adopted bool `json:"adopted,omitempty"`
+
+	// CoverHash is the SHA-256 hash of the cover image last uploaded.
+	// +optional
+	CoverHash string `json:"coverHash,omitempty"`
+
+	// LastSyncTime is when the shelf was last found in sync.
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// Conditions report whether the shelf is in sync.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="BookStack",type=string,JSONPath=`.spec.bookStackRef.name`
+//+kubebuilder:printcolumn:name="Name",type=string,JSONPath=`.spec.name`
+//+kubebuilder:printcolumn:name="ID",type=integer,JSONPath=`.status.id`
+//+kubebuilder:printcolumn:name="Synced",type=string,JSONPath=`.status.conditions[?(@.type=="Synced")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// BookStackShelf is the Schema for the bookstackshelves API
+type BookStackShelf struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BookStackShelfSpec   `json:"spec,omitempty"`
+	Status BookStackShelfStatus `json:"status,omitempty"`
+}
+
+// InstanceName returns the name of the BookStack instance the shelf is in.
+func (s *BookStackShelf) InstanceName() string {
+	return s.Spec.BookStackRef.Name
+}
+
+// GetConditions returns the conditions of the shelf.
+func (s *BookStackShelf) GetConditions() *[]metav1.Condition {
+	return &s.Status.Conditions
+}
+
+// RetainsShelf returns true if the shelf is kept in BookStack when the
+// BookStackShelf is deleted.
+func (s *BookStackShelf) RetainsShelf() bool {
+	return s.Spec.DeletionPolicy == DeletionPolicyRetain
+}
+
+// HasBook returns true if the book with the name is on the shelf.
+func (s *BookStackShelf) HasBook(name string) bool {
+	for _, book := range s.Spec.Books {
+		if book.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+//+kubebuilder:object:root=true
+
+// BookStackShelfList contains a list of BookStackShelf
+type BookStackShelfList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []BookStackShelf `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&BookStackShelf{}, &BookStackShelfList{})
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BookStackUserSpec defines the desired state of BookStackUser
+type BookStackUserSpec struct {
+	// BookStackRef names the BookStack instance the user is in. It must be
+	// in the same namespace as the BookStackUser.
+	BookStackRef corev1.LocalObjectReference `json:"bookStackRef"`
+
+	// Email is the email the user logs in with. An existing user with the
+	// email is adopted.
+	// +kubebuilder:validation:MinLength=1
+	Email string `json:"email"`
+
+	// Name is the display name of the user.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// Roles are the display names of the roles of the user, e.g. Editor.
+	// +optional
+	Roles []string `json:"roles,omitempty"`
+
+	// ExternalAuthID is the ID of the user in the external auth provider,
+	// when logging in through LDAP, SAML or OIDC. The ID BookStack records
+	// is left as it is when unset.
+	// +optional
+	ExternalAuthID string `json:"externalAuthID,omitempty"`
+
+	// SendInvite emails the user an invitation to choose a password when
+	// it is created.
+	// +optional
+	SendInvite bool `json:"sendInvite,omitempty"`
+
+	// DeletionPolicy selects whether the user is deleted from BookStack
+	// along with the BookStackUser. Defaults to Delete.
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// MigrateOwnershipTo is the email of the user the content owned by the
+	// user is given to when it is deleted. The content keeps no owner when
+	// unset.
+	// +optional
+	MigrateOwnershipTo string `json:"migrateOwnershipTo,omitempty"`
+}
+
+// BookStackUserStatus defines the observed state of BookStackUser
+type BookStackUserStatus struct {
+	// ID is the ID of the user in BookStack.
+	// +optional
+	ID int `json:"id,omitempty"`
+
+	// Adopted is true if the user existed before the BookStackUser.
+	// +optional
+	Adopted bool `json:"adopted,omitempty"`
+
+	// LastSyncTime is when the user was last found in sync.
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// Conditions report whether the user is in sync.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="BookStack",type=string,JSONPath=`.spec.bookStackRef.name`
+//+kubebuilder:printcolumn:name="Email",type=string,JSONPath=`.spec.email`
+//+kubebuilder:printcolumn:name="ID",type=integer,JSONPath=`.status.id`
+//+kubebuilder:printcolumn:name="Synced",type=string,JSONPath=`.status.conditions[?(@.type=="Synced")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// BookStackUser is the Schema for the bookstackusers API
+type BookStackUser struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BookStackUserSpec   `json:"spec,omitempty"`
+	Status BookStackUserStatus `json:"status,omitempty"`
+}
+
+// InstanceName returns the name of the BookStack instance the user is in.
+func (u *BookStackUser) InstanceName() string {
+	return u.Spec.BookStackRef.Name
+}
+
+// GetConditions returns the conditions of the user.
+func (u *BookStackUser) GetConditions() *[]metav1.Condition {
+	return &u.Status.Conditions
+}
+
+// RetainsUser returns true if the user is kept in BookStack when the
+// BookStackUser is deleted.
+func (u *BookStackUser) RetainsUser() bool {
+	return u.Spec.DeletionPolicy == DeletionPolicyRetain
+}
+
+//+kubebuilder:object:root=true
+
+// BookStackUserList contains a list of BookStackUser
+type BookStackUserList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []BookStackUser `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&BookStackUser{}, &BookStackUserList{})
+}
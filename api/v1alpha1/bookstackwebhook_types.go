@@ -0,0 +1,368 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// WebhookSyncComponent is the component label of the Jobs syncing
+	// webhooks into the BookStack database.
+	WebhookSyncComponent = "webhook-sync"
+
+	// WebhookSyncContainer is the webhook sync Job container whose
+	// termination message holds the WebhookSyncResult.
+	WebhookSyncContainer = "sync"
+
+	// WebhookGenerationAnnotation records on a webhook sync Job the
+	// generation of the BookStackWebhook it applies.
+	WebhookGenerationAnnotation = "tools.opdev.io/webhook-generation"
+)
+
+// WebhookEvent is an activity a webhook is called for, or all for every
+// activity.
+// +kubebuilder:validation:Enum=all;auth_login;auth_register;auth_password_reset_request;auth_password_reset_update;book_create;book_create_from_chapter;book_update;book_delete;book_sort;bookshelf_create;bookshelf_create_from_book;bookshelf_update;bookshelf_delete;chapter_create;chapter_update;chapter_delete;chapter_move;page_create;page_update;page_delete;page_restore;page_move;comment_create;comment_update;comment_delete;permissions_update;revision_restore;revision_delete;setting_update;maintenance_action_run;recycle_bin_empty;recycle_bin_restore;recycle_bin_destroy;user_create;user_update;user_delete;api_token_create;api_token_update;api_token_delete;role_create;role_update;role_delete;mfa_setup_method;mfa_remove_method;webhook_create;webhook_update;webhook_delete
+type WebhookEvent string
+
+// BookStackWebhookSpec defines the desired state of BookStackWebhook
+type BookStackWebhookSpec struct {
+	// BookStackRef names the BookStack instance the webhook is in. It must
+	// be in the same namespace as the BookStackWebhook.
+	BookStackRef corev1.LocalObjectReference `json:"bookStackRef"`
+
+	// Name is the name of the webhook. An existing webhook with the name
+	// is adopted. Defaults to the name of the BookStackWebhook.
+	// +kubebuilder:validation:MaxLength=150
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Endpoint is the URL the webhook posts the event data to.
+	// +kubebuilder:validation:MaxLength=500
+	// +kubebuilder:validation:Pattern=`^https?://`
+	Endpoint string `json:"endpoint"`
+
+	// Events are the activities the webhook is called for, e.g.
+	// page_update, or all for every activity.
+	// +kubebuilder:validation:MinItems=1
+	Events []WebhookEvent `json:"events"`
+
+	// Active enables the webhook. Defaults to true.
+	// +kubebuilder:default=true
+	// +optional
+	Active *bool `json:"active,omitempty"`
+
+	// TimeoutSeconds is how long BookStack waits for the endpoint to
+	// respond. Defaults to 3.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=600
+	// +kubebuilder:default=3
+	// +optional
+	TimeoutSeconds int32 `json:"timeoutSeconds,omitempty"`
+
+	// DeletionPolicy selects whether the webhook is deleted from BookStack
+	// along with the BookStackWebhook. Defaults to Delete.
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+}
+
+// BookStackWebhookStatus defines the observed state of BookStackWebhook
+type BookStackWebhookStatus struct {
+	// ID is the ID of the webhook in BookStack.
+	// +optional
+	ID int `json:"id,omitempty"`
+
+	// Adopted is true if the webhook existed before the BookStackWebhook.
+	// +optional
+	Adopted bool `json:"adopted,omitempty"`
+
+	// AppliedGeneration is the generation of the spec last applied to the
+	// webhook.
+	// +optional
+	AppliedGeneration int64 `json:"appliedGeneration,omitempty"`
+
+	// LastError is the error BookStack last reported calling the endpoint.
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+
+	// LastErrorTime is when BookStack last failed to call the endpoint.
+	// +optional
+	LastErrorTime *metav1.Time `json:"lastErrorTime,omitempty"`
+
+	// LastCallTime is when BookStack last called the endpoint.
+	// +optional
+	LastCallTime *metav1.Time `json:"lastCallTime,omitempty"`
+
+	// LastSyncTime is when the webhook was last synced.
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// Conditions report whether the webhook is in sync.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="BookStack",type=string,JSONPath=`.spec.bookStackRef.name`
+//+kubebuilder:printcolumn:name="Endpoint",type=string,JSONPath=`.spec.endpoint`
+//+kubebuilder:printcolumn:name="ID",type=integer,JSONPath=`.status.id`
+//+kubebuilder:printcolumn:name="Synced",type=string,JSONPath=`.status.conditions[?(@.type=="Synced")].status`
+//+kubebuilder:printcolumn:name="Last Error",type=string,JSONPath=`.status.lastError`,priority=1
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// BookStackWebhook is the Schema for the bookstackwebhooks API
+type BookStackWebhook struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BookStackWebhookSpec   `json:"spec,omitempty"`
+	Status BookStackWebhookStatus `json:"status,omitempty"`
+}
+
+// InstanceName returns the name of the BookStack instance the webhook is
+// in.
+func (w *BookStackWebhook) InstanceName() string {
+	return w.Spec.BookStackRef.Name
+}
+
+// GetConditions returns the conditions of the webhook.
+func (w *BookStackWebhook) GetConditions() *[]metav1.Condition {
+	return &w.Status.Conditions
+}
+
+// WebhookName returns the name of the webhook in BookStack.
+func (w *BookStackWebhook) WebhookName() string {
+	return valueOrDefault(w.Spec.Name, w.Name)
+}
+
+// IsActive returns true if the webhook is enabled.
+func (w *BookStackWebhook) IsActive() bool {
+	return w.Spec.Active == nil || *w.Spec.Active
+}
+
+// RetainsWebhook returns true if the webhook is kept in BookStack when the
+// BookStackWebhook is deleted.
+func (w *BookStackWebhook) RetainsWebhook() bool {
+	return w.Spec.DeletionPolicy == DeletionPolicyRetain
+}
+
+// GetSyncJobName returns the name of the Job syncing the webhook.
+func (w *BookStackWebhook) GetSyncJobName() string {
+	return w.Name + "-webhook-sync"
+}
+
+// GetDeleteJobName returns the name of the Job deleting the webhook.
+func (w *BookStackWebhook) GetDeleteJobName() string {
+	return w.Name + "-webhook-delete"
+}
+
+// NewSyncJob returns the Job creating or updating the webhook in the
+// database of instance, and reporting its ID and last error.
+func (w *BookStackWebhook) NewSyncJob(instance *BookStack) batchv1.Job {
+	timeout := w.Spec.TimeoutSeconds
+	if timeout == 0 {
+		timeout = 3
+	}
+
+	active := "0"
+	if w.IsActive() {
+		active = "1"
+	}
+
+	events := make([]string, 0, len(w.Spec.Events))
+	for _, event := range w.Spec.Events {
+		events = append(events, string(event))
+	}
+
+	job := w.newJob(instance, w.GetSyncJobName(), webhookSyncScript,
+		corev1.EnvVar{Name: "WEBHOOK_ID", Value: strconv.Itoa(w.Status.ID)},
+		// the name and endpoint are hex encoded, so they can be used in SQL
+		// without escaping.
+		corev1.EnvVar{Name: "NAME_HEX", Value: hex.EncodeToString([]byte(w.WebhookName()))},
+		corev1.EnvVar{Name: "ENDPOINT_HEX", Value: hex.EncodeToString([]byte(w.Spec.Endpoint))},
+		corev1.EnvVar{Name: "ACTIVE", Value: active},
+		corev1.EnvVar{Name: "TIMEOUT", Value: strconv.Itoa(int(timeout))},
+		corev1.EnvVar{Name: "EVENTS", Value: strings.Join(events, " ")},
+	)
+	job.Annotations = map[string]string{WebhookGenerationAnnotation: strconv.FormatInt(w.Generation, 10)}
+
+	return job
+}
+
+// NewDeleteJob returns the Job deleting the webhook from the database of
+// instance. It must only be called when status.id is set.
+func (w *BookStackWebhook) NewDeleteJob(instance *BookStack) batchv1.Job {
+	return w.newJob(instance, w.GetDeleteJobName(), webhookDeleteScript,
+		corev1.EnvVar{Name: "WEBHOOK_ID", Value: strconv.Itoa(w.Status.ID)},
+	)
+}
+
+// newJob returns a Job running script against the database of instance
+// with the environment env.
+func (w *BookStackWebhook) newJob(instance *BookStack, name, script string, env ...corev1.EnvVar) batchv1.Job {
+	var backoffLimit int32 = 2
+	return batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: w.GetNamespace(),
+			Labels:    labelsForComponent(*instance, WebhookSyncComponent),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labelsForComponent(*instance, WebhookSyncComponent),
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy:   corev1.RestartPolicyNever,
+					SecurityContext: instance.podSecurityContext(),
+					Containers: []corev1.Container{
+						{
+							Name:            WebhookSyncContainer,
+							Image:           instance.dbImage(),
+							Command:         []string{"sh", "-c", script},
+							SecurityContext: instance.dbSecurityContext(),
+							Env:             append(instance.dbClientEnv(), env...),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// WebhookSyncResult is written by webhook sync Jobs as the termination
+// message of the WebhookSyncContainer.
+type WebhookSyncResult struct {
+	ID      int  `json:"id"`
+	Adopted bool `json:"adopted"`
+	// LastError is hex encoded, as it may hold any text.
+	LastError     string `json:"lastError"`
+	LastCalledAt  string `json:"lastCalledAt"`
+	LastErroredAt string `json:"lastErroredAt"`
+}
+
+// ParseWebhookSyncResult parses the termination message of a webhook sync
+// Job, decoding the last error.
+func ParseWebhookSyncResult(message string) (WebhookSyncResult, error) {
+	var result WebhookSyncResult
+	if err := json.Unmarshal([]byte(message), &result); err != nil {
+		return result, fmt.Errorf("unable to parse webhook sync result %q: %w", message, err)
+	}
+
+	lastError, err := hex.DecodeString(result.LastError)
+	if err != nil {
+		return result, fmt.Errorf("unable to parse webhook sync result %q: %w", message, err)
+	}
+	result.LastError = string(lastError)
+
+	return result, nil
+}
+
+// LastCallTime returns when the webhook was last called, or nil.
+func (r WebhookSyncResult) LastCallTime() *metav1.Time {
+	return parseWebhookTime(r.LastCalledAt)
+}
+
+// LastErrorTime returns when the webhook last failed, or nil.
+func (r WebhookSyncResult) LastErrorTime() *metav1.Time {
+	return parseWebhookTime(r.LastErroredAt)
+}
+
+// parseWebhookTime parses a timestamp reported by the sync Job, returning
+// nil if it is empty or invalid.
+func parseWebhookTime(value string) *metav1.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil
+	}
+
+	return &metav1.Time{Time: t}
+}
+
+// webhookSyncScript waits for BookStack's webhook tables, finds the
+// webhook by ID or else by name, creates or updates it and its tracked
+// events, and writes its ID and last call and error as the result. The
+// events are validated by the API, so they can be used in SQL without
+// escaping. BookStack stores times in UTC.
+const webhookSyncScript = `set -eu
+client=mariadb
+command -v "$client" >/dev/null 2>&1 || client=mysql
+db() { "$client" --host="$DB_HOST" --user="$MYSQL_USER" --skip-column-names -e "$1" "$MYSQL_DATABASE"; }
+i=0
+until db "SELECT 1 FROM webhook_tracked_events LIMIT 1;" >/dev/null 2>&1; do
+  i=$((i + 1))
+  if [ "$i" -ge 60 ]; then
+    echo "BookStack has not created its webhook tables" >&2
+    exit 1
+  fi
+  sleep 5
+done
+name="CONVERT(UNHEX('$NAME_HEX') USING utf8mb4)"
+endpoint="CONVERT(UNHEX('$ENDPOINT_HEX') USING utf8mb4)"
+adopted=false
+id=""
+if [ "$WEBHOOK_ID" != 0 ]; then
+  id=$(db "SELECT id FROM webhooks WHERE id = $WEBHOOK_ID;")
+fi
+if [ -z "$id" ]; then
+  id=$(db "SELECT id FROM webhooks WHERE name = $name ORDER BY id LIMIT 1;")
+  [ -z "$id" ] || [ "$WEBHOOK_ID" != 0 ] || adopted=true
+fi
+if [ -z "$id" ]; then
+  id=$(db "INSERT INTO webhooks (name, endpoint, active, timeout, created_at, updated_at) VALUES ($name, $endpoint, $ACTIVE, $TIMEOUT, NOW(), NOW()); SELECT LAST_INSERT_ID();")
+else
+  db "UPDATE webhooks SET name = $name, endpoint = $endpoint, active = $ACTIVE, timeout = $TIMEOUT, updated_at = NOW() WHERE id = $id;"
+fi
+values=""
+for event in $EVENTS; do
+  values="$values${values:+, }($id, '$event', NOW(), NOW())"
+done
+db "DELETE FROM webhook_tracked_events WHERE webhook_id = $id; INSERT INTO webhook_tracked_events (webhook_id, event, created_at, updated_at) VALUES $values;"
+db "SELECT CONCAT('{\"id\":', id, ',\"adopted\":$adopted,\"lastError\":\"', HEX(LEFT(COALESCE(last_error, ''), 1000)), '\",\"lastCalledAt\":\"', COALESCE(DATE_FORMAT(last_called_at, '%Y-%m-%dT%H:%i:%sZ'), ''), '\",\"lastErroredAt\":\"', COALESCE(DATE_FORMAT(last_errored_at, '%Y-%m-%dT%H:%i:%sZ'), ''), '\"}') FROM webhooks WHERE id = $id;" > /dev/termination-log
+`
+
+// webhookDeleteScript deletes the webhook and its tracked events.
+const webhookDeleteScript = `set -eu
+client=mariadb
+command -v "$client" >/dev/null 2>&1 || client=mysql
+db() { "$client" --host="$DB_HOST" --user="$MYSQL_USER" --skip-column-names -e "$1" "$MYSQL_DATABASE"; }
+db "DELETE FROM webhook_tracked_events WHERE webhook_id = $WEBHOOK_ID; DELETE FROM webhooks WHERE id = $WEBHOOK_ID;"
+`
+
+//+kubebuilder:object:root=true
+
+// BookStackWebhookList contains a list of BookStackWebhook
+type BookStackWebhookList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []BookStackWebhook `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&BookStackWebhook{}, &BookStackWebhookList{})
+}
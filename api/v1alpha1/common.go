@@ -1,11 +1,76 @@
 package v1alpha1
 
+import (
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// InstanceLabel is the label identifying the instance a resource belongs to.
+const InstanceLabel = "bookstack-instance"
+
 func selectorForInstance(instance BookStack) map[string]string {
 	return map[string]string{
-		"app":                "bookstack",
-		"bookstack-instance": instance.Name,
+		"app":         "bookstack",
+		InstanceLabel: instance.Name,
 	}
 }
 
 // labelsForInstance is an alias for selectorForInstance
 var labelsForInstance = selectorForInstance
+
+// labelsForComponent returns the labels for pods the operator runs
+// alongside the instance, e.g. backup Jobs. These must not match
+// selectorForInstance, or the pods would receive Service traffic.
+func labelsForComponent(instance BookStack, component string) map[string]string {
+	return map[string]string{
+		"app":         "bookstack-" + component,
+		InstanceLabel: instance.Name,
+	}
+}
+
+// valueOrDefault returns value, or def if value is empty.
+func valueOrDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+
+	return value
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// configMapEnv returns an environment variable populated from a ConfigMap key.
+func configMapEnv(name, configMap, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: configMap},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+// secretEnv returns an environment variable populated from a Secret key.
+func secretEnv(name, secret, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secret},
+				Key:                  key,
+			},
+		},
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// Condition types reported in BookStackStatus.
+const (
+	// ConditionAuthConfigured indicates whether the auth configuration
+	// was rendered into the app configuration.
+	ConditionAuthConfigured = "AuthConfigured"
+
+	// ConditionOverridesAccepted indicates whether all of the settings in
+	// spec.extraConfig and spec.env were applied.
+	ConditionOverridesAccepted = "OverridesAccepted"
+
+	// ConditionRestrictedCompliant indicates whether an instance in
+	// hardened mode complies with the restricted Pod Security Standard.
+	ConditionRestrictedCompliant = "RestrictedCompliant"
+
+	// ConditionHardenedModeApplied indicates whether spec.hardened.enabled
+	// is applied. It is only reported when a switch of hardened mode was
+	// rejected, as the data of the instance would not be found after it.
+	ConditionHardenedModeApplied = "HardenedModeApplied"
+
+	// ConditionDigestPinned indicates whether the BookStack image runs by
+	// the digest its tag resolved to.
+	ConditionDigestPinned = "DigestPinned"
+
+	// ConditionUpgradeAvailable indicates whether a newer version is
+	// available in the update channel.
+	ConditionUpgradeAvailable = "UpgradeAvailable"
+
+	// ConditionMaintenance indicates whether the instance's Service serves
+	// the maintenance page.
+	ConditionMaintenance = "Maintenance"
+
+	// ConditionSuspended indicates whether the instance is suspended and
+	// scaled to zero.
+	ConditionSuspended = "Suspended"
+
+	// ConditionPaused indicates whether reconciliation of the instance is
+	// paused by the tools.opdev.io/paused annotation.
+	ConditionPaused = "Paused"
+
+	// ConditionAdminBootstrapped indicates whether BookStack's default
+	// admin account was replaced by the configured one.
+	ConditionAdminBootstrapped = "AdminBootstrapped"
+
+	// ConditionAPITokenReady indicates whether the operator's API token
+	// is registered in BookStack.
+	ConditionAPITokenReady = "APITokenReady"
+
+	// ConditionAuditForwarding indicates whether the audit log is being
+	// forwarded to its sink.
+	ConditionAuditForwarding = "AuditForwarding"
+)
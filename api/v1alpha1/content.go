@@ -0,0 +1,79 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// ContentTag is a tag attached to a shelf or book.
+type ContentTag struct {
+	// Name of the tag.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// Value of the tag.
+	// +optional
+	Value string `json:"value,omitempty"`
+}
+
+// ContentPermissionSet grants actions on a shelf or book.
+type ContentPermissionSet struct {
+	// +optional
+	View bool `json:"view,omitempty"`
+	// +optional
+	Create bool `json:"create,omitempty"`
+	// +optional
+	Update bool `json:"update,omitempty"`
+	// +optional
+	Delete bool `json:"delete,omitempty"`
+}
+
+// RoleContentPermissions grants actions on a shelf or book to the users of
+// a role.
+type RoleContentPermissions struct {
+	// Role is the display name of the role.
+	// +kubebuilder:validation:MinLength=1
+	Role string `json:"role"`
+
+	ContentPermissionSet `json:",inline"`
+}
+
+// EntityPermissions are the permissions of a shelf or book, overriding the
+// permissions of the roles. They need BookStack v23.01 or later.
+type EntityPermissions struct {
+	// Owner is the email of the user owning the shelf or book. The owner
+	// is left as it is when unset.
+	// +optional
+	Owner string `json:"owner,omitempty"`
+
+	// Roles grant actions to the users of the roles.
+	// +optional
+	Roles []RoleContentPermissions `json:"roles,omitempty"`
+
+	// Fallback grants actions to the roles not listed in roles. The roles
+	// keep their own permissions when unset.
+	// +optional
+	Fallback *ContentPermissionSet `json:"fallback,omitempty"`
+}
+
+// RoleNames returns the display names of the roles the permissions are
+// granted to.
+func (p *EntityPermissions) RoleNames() []string {
+	var names []string
+	for _, role := range p.Roles {
+		names = append(names, role.Role)
+	}
+
+	return names
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"strconv"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ExportComponent labels the Jobs that export the content of an instance.
+const ExportComponent = "export"
+
+// ExportFormat is a format BookStack exports books in.
+// +kubebuilder:validation:Enum=markdown;html;pdf;plaintext
+type ExportFormat string
+
+const (
+	ExportFormatMarkdown  ExportFormat = "markdown"
+	ExportFormatHTML      ExportFormat = "html"
+	ExportFormatPDF       ExportFormat = "pdf"
+	ExportFormatPlainText ExportFormat = "plaintext"
+)
+
+// ExportSpec schedules exports of every book through the BookStack API.
+type ExportSpec struct {
+	// Schedule is the Cron schedule on which exports are taken.
+	// +kubebuilder:validation:MinLength=1
+	Schedule string `json:"schedule"`
+
+	// Formats are the formats each book is exported in.
+	// +kubebuilder:validation:MinItems=1
+	Formats []ExportFormat `json:"formats"`
+
+	// Target is where export archives are stored.
+	Target BackupTarget `json:"target"`
+
+	// Retention is the number of exports kept in an S3 target. Older
+	// exports are deleted once a new export is uploaded.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=7
+	// +optional
+	Retention int32 `json:"retention,omitempty"`
+}
+
+// ExportStatus reports the outcome of scheduled exports.
+type ExportStatus struct {
+	// LastSuccessfulExportTime is when the last successful export
+	// completed.
+	// +optional
+	LastSuccessfulExportTime *metav1.Time `json:"lastSuccessfulExportTime,omitempty"`
+
+	// LastExportSizeBytes is the size of the last successful export
+	// archive.
+	// +optional
+	LastExportSizeBytes int64 `json:"lastExportSizeBytes,omitempty"`
+
+	// LastExportLocation is the URL of the last successful export archive.
+	// +optional
+	LastExportLocation string `json:"lastExportLocation,omitempty"`
+
+	// LastFailedExportTime is when the last failed export failed.
+	// +optional
+	LastFailedExportTime *metav1.Time `json:"lastFailedExportTime,omitempty"`
+
+	// LastFailureMessage describes why the last failed export failed.
+	// +optional
+	LastFailureMessage string `json:"lastFailureMessage,omitempty"`
+}
+
+// GetExportCronJobName returns the name of the scheduled export CronJob.
+func (b *BookStack) GetExportCronJobName() string {
+	return b.Name + "-export"
+}
+
+// NewExportCronJob returns the CronJob taking the exports scheduled in
+// spec.export. It must only be called when spec.export is set.
+func (b *BookStack) NewExportCronJob() batchv1.CronJob {
+	export := b.Spec.Export
+	retention := export.Retention
+	if retention == 0 {
+		retention = 7
+	}
+
+	// exports go through the API, so they don't run while it is down, not
+	// exposed yet or the operator's token is not ready.
+	suspend := b.IsSuspended() || b.InMaintenance() || !b.AdminBootstrapped() ||
+		!meta.IsStatusConditionTrue(b.Status.Conditions, ConditionAPITokenReady)
+
+	var formats []string
+	for _, format := range export.Formats {
+		formats = append(formats, string(format))
+	}
+
+	prefix := b.GetExportCronJobName()
+	pod := corev1.PodSpec{
+		RestartPolicy:   corev1.RestartPolicyNever,
+		SecurityContext: b.podSecurityContext(),
+		Volumes: []corev1.Volume{
+			{
+				Name:         "work",
+				VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+			},
+		},
+		InitContainers: []corev1.Container{
+			{
+				// the BookStack image provides PHP to parse the API's
+				// responses.
+				Name:            "export",
+				Image:           b.appImage(),
+				Command:         []string{"php", "-r", exportScript},
+				SecurityContext: b.appSecurityContext(),
+				Env: []corev1.EnvVar{
+					{Name: "API_URL", Value: b.APIURL()},
+					{Name: "EXPORT_PREFIX", Value: prefix},
+					{Name: "FORMATS", Value: strings.Join(formats, ",")},
+					secretEnv("TOKEN_ID", b.GetAPITokenSecretName(), APITokenIDKey),
+					secretEnv("TOKEN_SECRET", b.GetAPITokenSecretName(), APITokenSecretKey),
+				},
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "work", MountPath: "/work"},
+				},
+			},
+			{
+				Name:            "archive",
+				Image:           DefaultArchiveImage,
+				Command:         []string{"sh", "-c", exportArchiveScript},
+				SecurityContext: b.appSecurityContext(),
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "work", MountPath: "/work"},
+				},
+			},
+		},
+	}
+
+	// the archive is uploaded by the backup upload scripts, which report
+	// a BackupResult.
+	if s3 := export.Target.S3; s3 != nil {
+		pod.Containers = []corev1.Container{
+			{
+				Name:            BackupResultContainer,
+				Image:           DefaultS3ClientImage,
+				Command:         []string{"bash", "-c", s3UploadScript},
+				SecurityContext: b.appSecurityContext(),
+				// mc keeps its configuration in the home directory.
+				Env: append(s3.env(),
+					corev1.EnvVar{Name: "BACKUP_PREFIX", Value: prefix},
+					corev1.EnvVar{Name: "RETENTION", Value: strconv.Itoa(int(retention))},
+					corev1.EnvVar{Name: "HOME", Value: "/work"},
+				),
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "work", MountPath: "/work"},
+				},
+			},
+		}
+	}
+
+	if pvc := export.Target.PVC; pvc != nil {
+		pod.Volumes = append(pod.Volumes, pvc.volume("target"))
+		pod.Containers = []corev1.Container{
+			{
+				Name:            BackupResultContainer,
+				Image:           DefaultArchiveImage,
+				Command:         []string{"sh", "-c", pvcUploadScript},
+				SecurityContext: b.appSecurityContext(),
+				Env:             pvc.env(),
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "work", MountPath: "/work"},
+					{Name: "target", MountPath: "/target"},
+				},
+			},
+		}
+	}
+
+	var historyLimit, backoffLimit int32 = 3, 2
+	return batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.GetExportCronJobName(),
+			Namespace: b.GetNamespace(),
+			Labels:    labelsForComponent(*b, ExportComponent),
+		},
+		Spec: batchv1.CronJobSpec{
+			Schedule:                   export.Schedule,
+			Suspend:                    &suspend,
+			ConcurrencyPolicy:          batchv1.ForbidConcurrent,
+			SuccessfulJobsHistoryLimit: &historyLimit,
+			FailedJobsHistoryLimit:     &historyLimit,
+			JobTemplate: batchv1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labelsForComponent(*b, ExportComponent),
+				},
+				Spec: batchv1.JobSpec{
+					BackoffLimit: &backoffLimit,
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels: labelsForComponent(*b, ExportComponent),
+						},
+						Spec: pod,
+					},
+				},
+			},
+		},
+	}
+}
+
+// exportScript exports every book in each of the FORMATS into a dated
+// directory of /work, retrying the requests the API rate limits, and
+// records the directory name in /work/name.
+const exportScript = `
+$base = rtrim(getenv('API_URL'), '/') . '/api/';
+$context = stream_context_create(['http' => [
+    'header' => 'Authorization: Token ' . getenv('TOKEN_ID') . ':' . getenv('TOKEN_SECRET'),
+    'ignore_errors' => true,
+    'timeout' => 300,
+]]);
+function get($path) {
+    global $base, $context;
+    for ($attempt = 0; $attempt < 10; $attempt++) {
+        $body = file_get_contents($base . $path, false, $context);
+        $status = isset($http_response_header) ? (int) explode(' ', $http_response_header[0])[1] : 0;
+        if ($status === 200) {
+            return $body;
+        }
+        if ($status !== 429) {
+            fwrite(STDERR, "GET $path returned $status\n");
+            exit(1);
+        }
+        sleep(10);
+    }
+    fwrite(STDERR, "GET $path is rate limited\n");
+    exit(1);
+}
+$extensions = ['markdown' => 'md', 'html' => 'html', 'pdf' => 'pdf', 'plaintext' => 'txt'];
+$name = getenv('EXPORT_PREFIX') . '-' . gmdate('Ymd\THis\Z');
+mkdir("/work/$name", 0755, true);
+$count = 0;
+for ($offset = 0; ; $offset += 100) {
+    $books = json_decode(get("books?count=100&offset=$offset&sort=id"), true);
+    foreach ($books['data'] as $book) {
+        foreach (explode(',', getenv('FORMATS')) as $format) {
+            file_put_contents("/work/$name/{$book['slug']}.{$extensions[$format]}", get("books/{$book['id']}/export/$format"));
+        }
+        $count++;
+    }
+    if ($offset + 100 >= $books['total']) {
+        break;
+    }
+}
+file_put_contents('/work/name', $name);
+echo "exported $count books\n";
+`
+
+// exportArchiveScript packages the exported books into a dated archive.
+const exportArchiveScript = `set -eu
+name="$(cat /work/name)"
+mkdir -p /work/out
+tar -czf "/work/out/$name.tar.gz" -C /work "$name"
+echo "$name.tar.gz" > /work/archive
+`
@@ -0,0 +1,457 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// DefaultAppImage is the BookStack image used by default.
+	DefaultAppImage = "lscr.io/linuxserver/bookstack:latest"
+	// DefaultDBImage is the MariaDB image used by default.
+	DefaultDBImage = "lscr.io/linuxserver/mariadb:latest"
+
+	// DefaultHardenedAppImage is the BookStack image used in hardened mode.
+	DefaultHardenedAppImage = "docker.io/solidnerd/bookstack:latest"
+	// DefaultHardenedDBImage is the MariaDB image used in hardened mode.
+	DefaultHardenedDBImage = "docker.io/bitnami/mariadb:latest"
+
+	// hardenedAppUser is the UID of www-data in DefaultHardenedAppImage.
+	hardenedAppUser int64 = 33
+	// hardenedDBUser is the UID of the mariadb user in DefaultHardenedDBImage.
+	hardenedDBUser int64 = 1001
+	// hardenedFSGroup is the default group owning the data volumes.
+	hardenedFSGroup int64 = 1001
+
+	// hardenedAppPort is the unprivileged port the hardened app image
+	// listens on.
+	hardenedAppPort int32 = 8080
+
+	// hardenedAppRoot is the BookStack installation in the hardened app image.
+	hardenedAppRoot = "/var/www/bookstack"
+	// hardenedDBDataPath is the MariaDB data directory in the hardened DB image.
+	hardenedDBDataPath = "/bitnami/mariadb"
+)
+
+// HardenedSpec configures a hardened mode in which the instance complies
+// with the restricted Pod Security Standard.
+type HardenedSpec struct {
+	// Enabled runs the containers as non-root with all capabilities
+	// dropped, the RuntimeDefault seccomp profile and a read-only root
+	// filesystem.
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+
+	// AppImage is the BookStack image used in hardened mode. It must run
+	// as a non-root user and listen on port 8080.
+	// +optional
+	AppImage string `json:"appImage,omitempty"`
+
+	// DBImage is the MariaDB image used in hardened mode. It must run as a
+	// non-root user and accept the MARIADB_* environment variables.
+	// +optional
+	DBImage string `json:"dbImage,omitempty"`
+
+	// FSGroup is the group that owns the data volumes.
+	// +kubebuilder:default=1001
+	// +optional
+	FSGroup *int64 `json:"fsGroup,omitempty"`
+}
+
+// DataLayout is the layout of the data volumes, which differs between the
+// default and the hardened images.
+// +kubebuilder:validation:Enum=Standard;Hardened
+type DataLayout string
+
+const (
+	// DataLayoutStandard is the layout of the default images.
+	DataLayoutStandard DataLayout = "Standard"
+	// DataLayoutHardened is the layout of the hardened images.
+	DataLayoutHardened DataLayout = "Hardened"
+)
+
+// IsHardened returns true if the instance runs in hardened mode. Once the
+// data layout of the instance is recorded it decides, as the data volumes
+// can't be used by the images of the other mode.
+func (b *BookStack) IsHardened() bool {
+	if b.Status.DataLayout != "" {
+		return b.Status.DataLayout == DataLayoutHardened
+	}
+
+	return b.SpecDataLayout() == DataLayoutHardened
+}
+
+// SpecDataLayout returns the data layout spec.hardened asks for.
+func (b *BookStack) SpecDataLayout() DataLayout {
+	if b.Spec.Hardened != nil && b.Spec.Hardened.Enabled {
+		return DataLayoutHardened
+	}
+
+	return DataLayoutStandard
+}
+
+// DataLayoutOf returns the data layout the Deployment of an instance
+// mounts its DB volume with.
+func DataLayoutOf(deployment *appsv1.Deployment) DataLayout {
+	for _, c := range deployment.Spec.Template.Spec.Containers {
+		for _, m := range c.VolumeMounts {
+			if m.Name == "db-config" && m.MountPath == hardenedDBDataPath {
+				return DataLayoutHardened
+			}
+		}
+	}
+
+	return DataLayoutStandard
+}
+
+// appImage returns the BookStack image for the instance, by digest if it
+// is pinned.
+func (b *BookStack) appImage() string {
+	image := b.TagImage()
+	if digest := b.PinnedDigest(); digest != "" {
+		return image + "@" + digest
+	}
+
+	return image
+}
+
+// baseAppImage returns the BookStack image for the instance before its
+// tag is pinned to a version.
+func (b *BookStack) baseAppImage() string {
+	if b.IsHardened() {
+		return valueOrDefault(b.Spec.Hardened.AppImage, DefaultHardenedAppImage)
+	}
+
+	return DefaultAppImage
+}
+
+// dbImage returns the MariaDB image for the instance.
+func (b *BookStack) dbImage() string {
+	if b.IsHardened() {
+		return valueOrDefault(b.Spec.Hardened.DBImage, DefaultHardenedDBImage)
+	}
+
+	return DefaultDBImage
+}
+
+// appPort returns the port the BookStack container listens on.
+func (b *BookStack) appPort() int32 {
+	if b.IsHardened() {
+		return hardenedAppPort
+	}
+
+	return 80
+}
+
+// appPorts returns the ports of the BookStack container. Host ports are
+// forbidden by the restricted Pod Security Standard.
+func (b *BookStack) appPorts() []corev1.ContainerPort {
+	port := corev1.ContainerPort{
+		Name:          "http",
+		HostPort:      6785,
+		ContainerPort: b.appPort(),
+		Protocol:      "TCP",
+	}
+
+	if b.IsHardened() {
+		port.HostPort = 0
+	}
+
+	return []corev1.ContainerPort{port}
+}
+
+// podSecurityContext returns the pod security context, defaulting to
+// non-root with RuntimeDefault seccomp in hardened mode.
+func (b *BookStack) podSecurityContext() *corev1.PodSecurityContext {
+	if b.Spec.PodTemplate.SecurityContext != nil || !b.IsHardened() {
+		return b.Spec.PodTemplate.SecurityContext
+	}
+
+	fsGroup := hardenedFSGroup
+	if b.Spec.Hardened.FSGroup != nil {
+		fsGroup = *b.Spec.Hardened.FSGroup
+	}
+
+	return hardenedPodSecurityContext(fsGroup)
+}
+
+// hardenedPodSecurityContext returns a pod security context running as
+// non-root with RuntimeDefault seccomp and fsGroup owning the volumes.
+func hardenedPodSecurityContext(fsGroup int64) *corev1.PodSecurityContext {
+	nonRoot := true
+	return &corev1.PodSecurityContext{
+		RunAsNonRoot: &nonRoot,
+		FSGroup:      &fsGroup,
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+}
+
+// appSecurityContext returns the BookStack container security context.
+func (b *BookStack) appSecurityContext() *corev1.SecurityContext {
+	if b.Spec.PodTemplate.App.SecurityContext != nil || !b.IsHardened() {
+		return b.Spec.PodTemplate.App.SecurityContext
+	}
+
+	return restrictedSecurityContext(hardenedAppUser)
+}
+
+// dbSecurityContext returns the MariaDB container security context.
+func (b *BookStack) dbSecurityContext() *corev1.SecurityContext {
+	if b.Spec.PodTemplate.DB.SecurityContext != nil || !b.IsHardened() {
+		return b.Spec.PodTemplate.DB.SecurityContext
+	}
+
+	return restrictedSecurityContext(hardenedDBUser)
+}
+
+// restrictedSecurityContext returns a container security context that
+// satisfies the restricted Pod Security Standard.
+func restrictedSecurityContext(uid int64) *corev1.SecurityContext {
+	nonRoot, no, yes := true, false, true
+	return &corev1.SecurityContext{
+		RunAsUser:                &uid,
+		RunAsNonRoot:             &nonRoot,
+		AllowPrivilegeEscalation: &no,
+		ReadOnlyRootFilesystem:   &yes,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+}
+
+// scratchDirs returns the writable directories needed by a container with
+// a read-only root filesystem, indexed by volume name.
+func (b *BookStack) scratchDirs() map[string]string {
+	if !b.IsHardened() {
+		return nil
+	}
+
+	return map[string]string{
+		"app-tmp":             "/tmp",
+		"app-apache-run":      "/var/run/apache2",
+		"app-bootstrap-cache": hardenedAppRoot + "/bootstrap/cache",
+		"app-framework":       hardenedAppRoot + "/storage/framework",
+		"app-logs":            hardenedAppRoot + "/storage/logs",
+		"db-tmp":              "/tmp",
+		"db-run-tmp":          "/opt/bitnami/mariadb/tmp",
+		"db-conf":             "/opt/bitnami/mariadb/conf",
+		"db-logs":             "/opt/bitnami/mariadb/logs",
+	}
+}
+
+// scratchVolumes returns the emptyDir volumes backing scratchDirs.
+func (b *BookStack) scratchVolumes() []corev1.Volume {
+	var volumes []corev1.Volume
+	for _, name := range sortedKeys(b.scratchDirs()) {
+		volumes = append(volumes, corev1.Volume{
+			Name:         name,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+	}
+
+	return volumes
+}
+
+// scratchVolumeMounts returns the scratch mounts of the container whose
+// volumes are prefixed with prefix.
+func (b *BookStack) scratchVolumeMounts(prefix string) []corev1.VolumeMount {
+	dirs := b.scratchDirs()
+
+	var mounts []corev1.VolumeMount
+	for _, name := range sortedKeys(dirs) {
+		if strings.HasPrefix(name, prefix) {
+			mounts = append(mounts, corev1.VolumeMount{Name: name, MountPath: dirs[name]})
+		}
+	}
+
+	return mounts
+}
+
+// appDataVolumeMounts returns the mounts of the app data volume. The
+// hardened image keeps uploads in the BookStack installation, so the
+// directories the linuxserver image uses under /config are mounted there.
+func (b *BookStack) appDataVolumeMounts() []corev1.VolumeMount {
+	if !b.IsHardened() {
+		return []corev1.VolumeMount{
+			{
+				Name:      "app-config",
+				MountPath: "/config",
+			},
+		}
+	}
+
+	return []corev1.VolumeMount{
+		{
+			Name:      "app-config",
+			MountPath: hardenedAppRoot + "/public/uploads",
+			SubPath:   "www/uploads",
+		},
+		{
+			Name:      "app-config",
+			MountPath: hardenedAppRoot + "/storage/uploads",
+			SubPath:   "www/files",
+		},
+	}
+}
+
+// dbDataMountPath returns where the DB data volume is mounted.
+func (b *BookStack) dbDataMountPath() string {
+	if b.IsHardened() {
+		return hardenedDBDataPath
+	}
+
+	return "/config"
+}
+
+// hardenedAppEnv maps the operator's app settings to the names used by
+// the hardened app image.
+func (b *BookStack) hardenedAppEnv() []corev1.EnvVar {
+	if !b.IsHardened() {
+		return nil
+	}
+
+	return []corev1.EnvVar{
+		configMapEnv("DB_USERNAME", b.GetName()+"-cm", "DB_USER"),
+		secretEnv("DB_PASSWORD", b.GetName()+"-secret", "DB_PASS"),
+	}
+}
+
+// hardenedDBEnv maps the operator's DB settings to the names used by the
+// hardened DB image.
+func (b *BookStack) hardenedDBEnv() []corev1.EnvVar {
+	if !b.IsHardened() {
+		return nil
+	}
+
+	return []corev1.EnvVar{
+		configMapEnv("MARIADB_DATABASE", b.GetName()+"-db-cm", "MYSQL_DATABASE"),
+		configMapEnv("MARIADB_USER", b.GetName()+"-db-cm", "MYSQL_USER"),
+		secretEnv("MARIADB_PASSWORD", b.GetName()+"-db-secret", "MYSQL_PASSWORD"),
+		secretEnv("MARIADB_ROOT_PASSWORD", b.GetName()+"-db-secret", "MYSQL_ADMIN_PASS"),
+	}
+}
+
+// RestrictedViolations lists the reasons the instance's pod would be
+// rejected in a namespace enforcing the restricted Pod Security Standard.
+func (b *BookStack) RestrictedViolations() []string {
+	var violations []string
+
+	for _, image := range []string{b.appImage(), b.dbImage()} {
+		if strings.Contains(image, "linuxserver/") {
+			violations = append(violations, fmt.Sprintf("image %s must run as root", image))
+		}
+	}
+
+	for _, port := range b.appPorts() {
+		if port.HostPort != 0 {
+			violations = append(violations, fmt.Sprintf("container port %s uses a host port", port.Name))
+		}
+	}
+
+	if psc := b.podSecurityContext(); psc != nil {
+		if psc.RunAsUser != nil && *psc.RunAsUser == 0 {
+			violations = append(violations, "pod runAsUser is 0")
+		}
+		if psc.RunAsNonRoot != nil && !*psc.RunAsNonRoot {
+			violations = append(violations, "pod runAsNonRoot is false")
+		}
+	}
+
+	containers := map[string]*corev1.SecurityContext{
+		"bookstack":    b.appSecurityContext(),
+		"bookstack-db": b.dbSecurityContext(),
+	}
+
+	for _, name := range []string{"bookstack", "bookstack-db"} {
+		for _, v := range securityContextViolations(containers[name], b.podSecurityContext()) {
+			violations = append(violations, name+": "+v)
+		}
+	}
+
+	return violations
+}
+
+// securityContextViolations checks a container security context against
+// the restricted Pod Security Standard.
+func securityContextViolations(sc *corev1.SecurityContext, psc *corev1.PodSecurityContext) []string {
+	if sc == nil {
+		sc = &corev1.SecurityContext{}
+	}
+
+	var violations []string
+	if sc.Privileged != nil && *sc.Privileged {
+		violations = append(violations, "privileged is true")
+	}
+
+	if sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+		violations = append(violations, "allowPrivilegeEscalation is not false")
+	}
+
+	if sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+		violations = append(violations, "runAsUser is 0")
+	}
+
+	nonRoot := sc.RunAsNonRoot
+	if nonRoot == nil && psc != nil {
+		nonRoot = psc.RunAsNonRoot
+	}
+	if nonRoot == nil || !*nonRoot {
+		violations = append(violations, "runAsNonRoot is not true")
+	}
+
+	if sc.Capabilities == nil || !containsCapability(sc.Capabilities.Drop, "ALL") {
+		violations = append(violations, "capabilities do not drop ALL")
+	}
+
+	if sc.Capabilities != nil {
+		for _, c := range sc.Capabilities.Add {
+			if c != "NET_BIND_SERVICE" {
+				violations = append(violations, fmt.Sprintf("capability %s is added", c))
+			}
+		}
+	}
+
+	seccomp := sc.SeccompProfile
+	if seccomp == nil && psc != nil {
+		seccomp = psc.SeccompProfile
+	}
+	if seccomp == nil || seccomp.Type == corev1.SeccompProfileTypeUnconfined {
+		violations = append(violations, "seccompProfile is not RuntimeDefault or Localhost")
+	}
+
+	return violations
+}
+
+func containsCapability(caps []corev1.Capability, c corev1.Capability) bool {
+	for _, cap := range caps {
+		if cap == c {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHardenedJobPods(t *testing.T) {
+	s3 := &S3Target{Endpoint: "https://s3.example.com", Bucket: "backups"}
+	pvc := &PVCTarget{ClaimName: "backups"}
+
+	instance := &BookStack{
+		ObjectMeta: metav1.ObjectMeta{Name: "wiki", Namespace: "docs"},
+		Spec: BookStackSpec{
+			Hardened: &HardenedSpec{Enabled: true},
+			Backup:   &BackupSpec{Schedule: "0 3 * * *", S3: *s3},
+			Export:   &ExportSpec{Schedule: "0 4 * * *", Formats: []ExportFormat{"markdown"}, Target: BackupTarget{PVC: pvc}},
+		},
+	}
+
+	backup := func(target BackupTarget) *BookStackBackup {
+		return &BookStackBackup{
+			ObjectMeta: metav1.ObjectMeta{Name: "wiki-backup", Namespace: "docs"},
+			Spec:       BookStackBackupSpec{Target: &target},
+			Status:     BookStackBackupStatus{Location: "s3://backups/a.tar", DataLayout: DataLayoutHardened},
+		}
+	}
+
+	pods := map[string]corev1.PodSpec{
+		"backup cronjob": instance.NewBackupCronJob().Spec.JobTemplate.Spec.Template.Spec,
+		"pvc backup":     instance.NewBackupJob(backup(BackupTarget{PVC: pvc})).Spec.Template.Spec,
+		"export cronjob": instance.NewExportCronJob().Spec.JobTemplate.Spec.Template.Spec,
+		"s3 cleanup":     backup(BackupTarget{S3: s3}).NewCleanupJob().Spec.Template.Spec,
+		"pvc cleanup":    backup(BackupTarget{PVC: pvc}).NewCleanupJob().Spec.Template.Spec,
+	}
+
+	for name, pod := range pods {
+		t.Run(name, func(t *testing.T) {
+			if pod.SecurityContext == nil {
+				t.Fatal("pod security context is not set")
+			}
+
+			for _, c := range append(pod.InitContainers, pod.Containers...) {
+				for _, v := range securityContextViolations(c.SecurityContext, pod.SecurityContext) {
+					t.Errorf("%s: %s", c.Name, v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultUpdateCheckInterval is how often the update channel is checked
+// when spec.imagePolicy.checkInterval is unset.
+const defaultUpdateCheckInterval = 6 * time.Hour
+
+// UpdateChannel selects the newer versions reported as available.
+// +kubebuilder:validation:Enum=Patch;Minor;Major
+type UpdateChannel string
+
+const (
+	// UpdateChannelPatch follows the releases of the running major and
+	// minor version, e.g. v23.05.3 for v23.05.2.
+	UpdateChannelPatch UpdateChannel = "Patch"
+	// UpdateChannelMinor follows the releases of the running major
+	// version, e.g. v23.06.0 for v23.05.2.
+	UpdateChannelMinor UpdateChannel = "Minor"
+	// UpdateChannelMajor follows all releases.
+	UpdateChannelMajor UpdateChannel = "Major"
+)
+
+// ImagePolicySpec configures how the BookStack image is resolved and
+// which newer versions are reported.
+type ImagePolicySpec struct {
+	// PinDigest runs the image by the digest its tag resolves to, so that
+	// the instance keeps running the same image if the tag is moved. The
+	// tag is resolved once, when the instance first runs it.
+	// +optional
+	PinDigest bool `json:"pinDigest,omitempty"`
+
+	// Registry is the base URL of the registry queried for the image, e.g.
+	// https://mirror.example.com. The registry in the image name is queried
+	// when unset.
+	// +optional
+	Registry string `json:"registry,omitempty"`
+
+	// InsecureSkipTLSVerify disables the verification of the registry's
+	// certificate.
+	// +optional
+	InsecureSkipTLSVerify bool `json:"insecureSkipTLSVerify,omitempty"`
+
+	// Channel reports newer versions of the image as available in
+	// status.image. They are not applied, an upgrade is started by setting
+	// spec.version. Newer versions are not checked for when unset.
+	// +optional
+	Channel UpdateChannel `json:"channel,omitempty"`
+
+	// CheckInterval is how often the channel is checked for newer
+	// versions. Defaults to 6h.
+	// +optional
+	CheckInterval *metav1.Duration `json:"checkInterval,omitempty"`
+}
+
+// ImageStatus reports the resolved image and the newer versions available.
+type ImageStatus struct {
+	// Image is the image the digest was resolved for.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Digest is the digest the image resolved to.
+	// +optional
+	Digest string `json:"digest,omitempty"`
+
+	// ResolvedTime is when the digest was resolved.
+	// +optional
+	ResolvedTime *metav1.Time `json:"resolvedTime,omitempty"`
+
+	// UpgradeImage is the image of the version an upgrade in progress
+	// moves to, the digest of which its migrations run when the instance
+	// pins its digest.
+	// +optional
+	UpgradeImage string `json:"upgradeImage,omitempty"`
+
+	// UpgradeDigest is the digest UpgradeImage resolved to.
+	// +optional
+	UpgradeDigest string `json:"upgradeDigest,omitempty"`
+
+	// AvailableVersion is the newest version in the update channel, if it
+	// is newer than the running version.
+	// +optional
+	AvailableVersion string `json:"availableVersion,omitempty"`
+
+	// LastCheckTime is when the update channel was last checked.
+	// +optional
+	LastCheckTime *metav1.Time `json:"lastCheckTime,omitempty"`
+}
+
+// PinsDigest returns true if the instance runs its image by digest.
+func (b *BookStack) PinsDigest() bool {
+	return b.Spec.ImagePolicy != nil && b.Spec.ImagePolicy.PinDigest
+}
+
+// UpdateChannel returns the update channel followed by the instance, or
+// an empty string if it follows none.
+func (b *BookStack) UpdateChannel() UpdateChannel {
+	if b.Spec.ImagePolicy == nil {
+		return ""
+	}
+
+	return b.Spec.ImagePolicy.Channel
+}
+
+// UpdateCheckInterval returns how often the update channel is checked.
+func (b *BookStack) UpdateCheckInterval() time.Duration {
+	if b.Spec.ImagePolicy == nil || b.Spec.ImagePolicy.CheckInterval == nil {
+		return defaultUpdateCheckInterval
+	}
+
+	return b.Spec.ImagePolicy.CheckInterval.Duration
+}
+
+// TagImage returns the BookStack image the instance runs, by tag.
+func (b *BookStack) TagImage() string {
+	return b.AppImageFor(b.DeployedVersion())
+}
+
+// PinnedDigest returns the digest the instance's image resolved to, or an
+// empty string if it isn't pinned or the digest isn't resolved yet.
+func (b *BookStack) PinnedDigest() string {
+	if !b.PinsDigest() || b.Status.Image == nil || b.Status.Image.Image != b.TagImage() {
+		return ""
+	}
+
+	return b.Status.Image.Digest
+}
+
+// UpgradeTargetImage returns the image of the version an upgrade moves
+// to, or an empty string if no upgrade needs it resolved, i.e. it isn't
+// started, is rolling out or is finished.
+func (b *BookStack) UpgradeTargetImage() string {
+	upgrade := b.Status.Upgrade
+	if upgrade == nil || (upgrade.Phase != UpgradePhaseBackingUp && upgrade.Phase != UpgradePhaseMigrating) {
+		return ""
+	}
+
+	return b.AppImageFor(upgrade.ToVersion)
+}
+
+// UpgradeDigest returns the digest the image of the version an upgrade
+// moves to resolved to, or an empty string if it isn't resolved yet or the
+// instance doesn't pin its digest.
+func (b *BookStack) UpgradeDigest() string {
+	image := b.UpgradeTargetImage()
+	if image == "" || !b.PinsDigest() || b.Status.Image == nil || b.Status.Image.UpgradeImage != image {
+		return ""
+	}
+
+	return b.Status.Image.UpgradeDigest
+}
+
+// NewestInChannel returns the newest of tags in the update channel of the
+// instance that is newer than the running version, or an empty string if
+// there is none. Only tags in the same format as the running version's are
+// considered, e.g. v23.05.3-ls91 for v23.05.2-ls90.
+func (b *BookStack) NewestInChannel(tags []string) string {
+	current := ImageTag(b.TagImage())
+	if !IsComparableVersion(current) {
+		return ""
+	}
+
+	shape := digits.ReplaceAllString(current, "#")
+	running := numbers(current)
+
+	newest, newestNumbers := "", running
+	for _, tag := range tags {
+		if digits.ReplaceAllString(tag, "#") != shape {
+			continue
+		}
+
+		n := numbers(tag)
+		if !b.inChannel(running, n) || compareNumbers(n, newestNumbers) <= 0 {
+			continue
+		}
+
+		newest, newestNumbers = tag, n
+	}
+
+	return newest
+}
+
+// inChannel returns true if the version numbers candidate are in the
+// update channel for the running version numbers. Both have the same
+// format.
+func (b *BookStack) inChannel(running, candidate []int) bool {
+	switch b.UpdateChannel() {
+	case UpdateChannelPatch:
+		return len(running) < 2 || running[0] == candidate[0] && running[1] == candidate[1]
+	case UpdateChannelMinor:
+		return running[0] == candidate[0]
+	case UpdateChannelMajor:
+		return true
+	}
+
+	return false
+}
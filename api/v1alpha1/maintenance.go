@@ -0,0 +1,210 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// DefaultMaintenanceImage serves the maintenance page.
+	DefaultMaintenanceImage = "docker.io/nginxinc/nginx-unprivileged:stable-alpine"
+
+	// MaintenanceComponent labels the pods serving the maintenance page.
+	MaintenanceComponent = "maintenance"
+
+	// maintenancePort is the port the maintenance page is served on.
+	maintenancePort int32 = 8080
+
+	// maintenanceUser is the UID of nginx in DefaultMaintenanceImage.
+	maintenanceUser int64 = 101
+)
+
+// InMaintenance returns true if the instance is put into maintenance mode.
+func (b *BookStack) InMaintenance() bool {
+	return b.Spec.Maintenance
+}
+
+// ServesMaintenancePage returns true if the instance's Service routes to
+// the maintenance page rather than BookStack.
+func (b *BookStack) ServesMaintenancePage() bool {
+	return meta.IsStatusConditionTrue(b.Status.Conditions, ConditionMaintenance)
+}
+
+// GetMaintenanceName returns the name of the maintenance page Deployment
+// and ConfigMap.
+func (b *BookStack) GetMaintenanceName() string {
+	return b.GetName() + "-maintenance"
+}
+
+// serviceSelector returns the selector of the instance's Service. BookStack
+// isn't exposed until its default admin account is replaced, unless it was
+// already serving before, nor while the migrations of a restore run.
+func (b *BookStack) serviceSelector() map[string]string {
+	if b.ServesMaintenancePage() {
+		return labelsForComponent(*b, MaintenanceComponent)
+	}
+
+	_, migrating := b.GetAnnotations()[RestoreMigratingAnnotation]
+	if !(b.AdminBootstrapped() || b.AdminAdopted()) || migrating {
+		return labelsForComponent(*b, unexposedComponent)
+	}
+
+	return selectorForInstance(*b)
+}
+
+// servicePort returns the port the instance's Service routes to.
+func (b *BookStack) servicePort() int32 {
+	if b.ServesMaintenancePage() {
+		return maintenancePort
+	}
+
+	return b.appPort()
+}
+
+// NewMaintenanceConfigMap returns the ConfigMap holding the maintenance
+// page and the configuration of the server serving it.
+func (b *BookStack) NewMaintenanceConfigMap() corev1.ConfigMap {
+	return corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.GetMaintenanceName(),
+			Namespace: b.GetNamespace(),
+			Labels:    labelsForComponent(*b, MaintenanceComponent),
+		},
+		Data: map[string]string{
+			"nginx.conf":       maintenanceServerConfig,
+			"maintenance.html": maintenancePage,
+		},
+	}
+}
+
+// NewMaintenanceDeployment returns the Deployment serving the maintenance
+// page while the instance is in maintenance mode.
+func (b *BookStack) NewMaintenanceDeployment() appsv1.Deployment {
+	var replicas int32 = 1
+	labels := labelsForComponent(*b, MaintenanceComponent)
+
+	return appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.GetMaintenanceName(),
+			Namespace: b.GetNamespace(),
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					SecurityContext: b.podSecurityContext(),
+					Volumes: []corev1.Volume{
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{Name: b.GetMaintenanceName()},
+								},
+							},
+						},
+						{
+							Name:         "tmp",
+							VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:            "maintenance",
+							Image:           DefaultMaintenanceImage,
+							Command:         []string{"nginx", "-c", "/etc/maintenance/nginx.conf", "-g", "daemon off;"},
+							SecurityContext: restrictedSecurityContext(maintenanceUser),
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "http",
+									ContainerPort: maintenancePort,
+									Protocol:      "TCP",
+								},
+							},
+							ReadinessProbe: &corev1.Probe{
+								ProbeHandler: corev1.ProbeHandler{
+									TCPSocket: &corev1.TCPSocketAction{
+										Port: intstr.FromInt(int(maintenancePort)),
+									},
+								},
+								PeriodSeconds: 2,
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "config", MountPath: "/etc/maintenance", ReadOnly: true},
+								{Name: "tmp", MountPath: "/tmp"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// maintenanceServerConfig answers every request with the maintenance page
+// and a 503 status, so that clients and monitors retry later.
+const maintenanceServerConfig = `pid /tmp/nginx.pid;
+events {}
+http {
+  default_type text/html;
+  client_body_temp_path /tmp/client_temp;
+  proxy_temp_path /tmp/proxy_temp;
+  fastcgi_temp_path /tmp/fastcgi_temp;
+  uwsgi_temp_path /tmp/uwsgi_temp;
+  scgi_temp_path /tmp/scgi_temp;
+  access_log /dev/stdout;
+  error_log /dev/stderr;
+  server {
+    listen 8080;
+    root /etc/maintenance;
+    error_page 503 /maintenance.html;
+    location / {
+      add_header Retry-After 300 always;
+      return 503;
+    }
+    location = /maintenance.html {
+      internal;
+      add_header Retry-After 300 always;
+    }
+  }
+}
+`
+
+// maintenancePage is served while the instance is in maintenance mode.
+const maintenancePage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Down for maintenance</title>
+</head>
+<body style="font-family: sans-serif; text-align: center; margin-top: 10%;">
+  <h1>Down for maintenance</h1>
+  <p>BookStack is undergoing maintenance and will be back shortly.</p>
+</body>
+</html>
+`
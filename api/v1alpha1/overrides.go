@@ -0,0 +1,124 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// OperatorOwnedConfigKeys are the app settings the operator must control
+// for BookStack to work. Overrides for these keys are ignored.
+var OperatorOwnedConfigKeys = []string{
+	"APP_URL",
+	"AUTH_METHOD",
+	"DB_DATABASE",
+	"DB_HOST",
+	"DB_PASS",
+	"DB_USER",
+}
+
+// operatorOwnedSecretKeys are the operator owned keys held in the app
+// Secret rather than the app ConfigMap.
+var operatorOwnedSecretKeys = map[string]bool{
+	"DB_PASS": true,
+}
+
+func isOperatorOwned(key string) bool {
+	for _, owned := range OperatorOwnedConfigKeys {
+		if key == owned {
+			return true
+		}
+	}
+
+	return false
+}
+
+// extraConfig returns spec.extraConfig without operator owned keys.
+func (b *BookStack) extraConfig() map[string]string {
+	cfg := map[string]string{}
+	for k, v := range b.Spec.ExtraConfig {
+		if !isOperatorOwned(k) {
+			cfg[k] = v
+		}
+	}
+
+	return cfg
+}
+
+// userEnv returns spec.env without operator owned keys.
+func (b *BookStack) userEnv() []corev1.EnvVar {
+	var env []corev1.EnvVar
+	for _, e := range b.Spec.Env {
+		if !isOperatorOwned(e.Name) {
+			env = append(env, e)
+		}
+	}
+
+	return env
+}
+
+// ownedEnv pins the operator owned keys on the app container. Explicit
+// env entries take precedence over every envFrom source, so this keeps
+// spec.envFrom from overriding them.
+func (b *BookStack) ownedEnv() []corev1.EnvVar {
+	if len(b.Spec.EnvFrom) == 0 {
+		return nil
+	}
+
+	env := make([]corev1.EnvVar, 0, len(OperatorOwnedConfigKeys))
+	for _, key := range OperatorOwnedConfigKeys {
+		if operatorOwnedSecretKeys[key] {
+			env = append(env, secretEnv(key, b.GetName()+"-secret", key))
+			continue
+		}
+
+		env = append(env, configMapEnv(key, b.GetName()+"-cm", key))
+	}
+
+	return env
+}
+
+// IgnoredOverrides returns the operator owned keys set in spec.extraConfig
+// or spec.env and the probe overrides Kubernetes doesn't allow, which the
+// operator ignores.
+func (b *BookStack) IgnoredOverrides() []string {
+	ignored := map[string]bool{}
+	for k := range b.Spec.ExtraConfig {
+		if isOperatorOwned(k) {
+			ignored[k] = true
+		}
+	}
+
+	for _, e := range b.Spec.Env {
+		if isOperatorOwned(e.Name) {
+			ignored[e.Name] = true
+		}
+	}
+
+	keys := make([]string, 0, len(ignored))
+	for k := range ignored {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	keys = append(keys, b.Spec.PodTemplate.App.Probes.ignored("podTemplate.app.probes")...)
+	keys = append(keys, b.Spec.PodTemplate.DB.Probes.ignored("podTemplate.db.probes")...)
+
+	return keys
+}
@@ -0,0 +1,27 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// PausedAnnotation pauses the reconciliation of a BookStack when set to
+// "true". The operator reports the Paused condition, but leaves the
+// instance's resources as they are so that they can be changed by hand.
+const PausedAnnotation = "tools.opdev.io/paused"
+
+// IsPaused returns true if the reconciliation of the instance is paused.
+func (b *BookStack) IsPaused() bool {
+	return b.GetAnnotations()[PausedAnnotation] == "true"
+}
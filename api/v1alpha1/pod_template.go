@@ -0,0 +1,76 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// BookStackPodTemplate customizes scheduling, quality of service and
+// security settings of the BookStack pod.
+type BookStackPodTemplate struct {
+	// NodeSelector must match a node's labels for the pod to be
+	// scheduled on that node.
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// Tolerations allow the pod to be scheduled onto tainted nodes.
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// Affinity holds the pod's scheduling constraints.
+	// +optional
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+
+	// TopologySpreadConstraints describes how the pod is spread across
+	// topology domains.
+	// +optional
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+
+	// PriorityClassName is the priority class assigned to the pod.
+	// +optional
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+
+	// SecurityContext holds pod-level security attributes.
+	// +optional
+	SecurityContext *corev1.PodSecurityContext `json:"securityContext,omitempty"`
+
+	// App customizes the BookStack container.
+	// +optional
+	App ContainerTemplate `json:"app,omitempty"`
+
+	// DB customizes the MariaDB container.
+	// +optional
+	DB ContainerTemplate `json:"db,omitempty"`
+}
+
+// ContainerTemplate customizes a container of the BookStack pod.
+type ContainerTemplate struct {
+	// Resources holds the compute resource requests and limits of the
+	// container.
+	// +optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// SecurityContext holds container-level security attributes.
+	// +optional
+	SecurityContext *corev1.SecurityContext `json:"securityContext,omitempty"`
+
+	// Probes overrides the thresholds and timeouts of the container's
+	// readiness, liveness and startup probes.
+	// +optional
+	Probes ContainerProbes `json:"probes,omitempty"`
+}
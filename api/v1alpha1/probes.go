@@ -0,0 +1,218 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// dbPort is the port MariaDB listens on.
+const dbPort = 3306
+
+// ContainerProbes overrides the thresholds and timeouts of the probes the
+// operator configures for a container.
+type ContainerProbes struct {
+	// Readiness overrides the readiness probe.
+	// +optional
+	Readiness *ProbeOverrides `json:"readiness,omitempty"`
+
+	// Liveness overrides the liveness probe.
+	// +optional
+	Liveness *ProbeOverrides `json:"liveness,omitempty"`
+
+	// Startup overrides the startup probe, which must allow enough time
+	// for BookStack's migrations to complete on first boot.
+	// +optional
+	Startup *ProbeOverrides `json:"startup,omitempty"`
+}
+
+// ProbeOverrides holds the probe settings that may be overridden. Unset
+// fields keep the operator's defaults.
+type ProbeOverrides struct {
+	// InitialDelaySeconds is the delay before the probe is first run.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	InitialDelaySeconds *int32 `json:"initialDelaySeconds,omitempty"`
+
+	// PeriodSeconds is how often the probe is run.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	PeriodSeconds *int32 `json:"periodSeconds,omitempty"`
+
+	// TimeoutSeconds is how long the probe may take before it fails.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TimeoutSeconds *int32 `json:"timeoutSeconds,omitempty"`
+
+	// SuccessThreshold is the number of consecutive successes for the
+	// probe to be considered successful after having failed. It only
+	// applies to the readiness probe, as Kubernetes requires 1 for the
+	// others.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	SuccessThreshold *int32 `json:"successThreshold,omitempty"`
+
+	// FailureThreshold is the number of consecutive failures for the
+	// probe to be considered failed.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	FailureThreshold *int32 `json:"failureThreshold,omitempty"`
+}
+
+// apply copies the set overrides onto probe. The success threshold is
+// only copied onto readiness probes.
+func (o *ProbeOverrides) apply(probe *corev1.Probe, readiness bool) *corev1.Probe {
+	if o == nil {
+		return probe
+	}
+
+	if o.InitialDelaySeconds != nil {
+		probe.InitialDelaySeconds = *o.InitialDelaySeconds
+	}
+	if o.PeriodSeconds != nil {
+		probe.PeriodSeconds = *o.PeriodSeconds
+	}
+	if o.TimeoutSeconds != nil {
+		probe.TimeoutSeconds = *o.TimeoutSeconds
+	}
+	if o.SuccessThreshold != nil && readiness {
+		probe.SuccessThreshold = *o.SuccessThreshold
+	}
+	if o.FailureThreshold != nil {
+		probe.FailureThreshold = *o.FailureThreshold
+	}
+
+	return probe
+}
+
+// ignored returns the paths, below prefix, of the overrides that don't
+// apply: success thresholds other than 1 on the liveness and startup
+// probes.
+func (p ContainerProbes) ignored(prefix string) []string {
+	var paths []string
+	if o := p.Liveness; o != nil && o.SuccessThreshold != nil && *o.SuccessThreshold != 1 {
+		paths = append(paths, prefix+".liveness.successThreshold")
+	}
+	if o := p.Startup; o != nil && o.SuccessThreshold != nil && *o.SuccessThreshold != 1 {
+		paths = append(paths, prefix+".startup.successThreshold")
+	}
+
+	return paths
+}
+
+// appStatusHandler queries BookStack's /status endpoint, which fails if
+// the database, cache or session store is unavailable.
+func appStatusHandler() corev1.ProbeHandler {
+	return corev1.ProbeHandler{
+		HTTPGet: &corev1.HTTPGetAction{
+			Path: "/status",
+			Port: intstr.FromString("http"),
+		},
+	}
+}
+
+// appReadinessProbe keeps the pod out of the Service while BookStack
+// can't serve requests.
+func (b *BookStack) appReadinessProbe() *corev1.Probe {
+	return b.Spec.PodTemplate.App.Probes.Readiness.apply(&corev1.Probe{
+		ProbeHandler:     appStatusHandler(),
+		PeriodSeconds:    10,
+		TimeoutSeconds:   5,
+		SuccessThreshold: 1,
+		FailureThreshold: 3,
+	}, true)
+}
+
+// appLivenessProbe restarts BookStack if it stops accepting connections.
+// It doesn't use /status so that a database outage doesn't also restart
+// the app.
+func (b *BookStack) appLivenessProbe() *corev1.Probe {
+	return b.Spec.PodTemplate.App.Probes.Liveness.apply(&corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			TCPSocket: &corev1.TCPSocketAction{
+				Port: intstr.FromString("http"),
+			},
+		},
+		PeriodSeconds:    10,
+		TimeoutSeconds:   5,
+		SuccessThreshold: 1,
+		FailureThreshold: 6,
+	}, false)
+}
+
+// appStartupProbe allows up to ten minutes for first-boot migrations
+// before the other probes take over.
+func (b *BookStack) appStartupProbe() *corev1.Probe {
+	return b.Spec.PodTemplate.App.Probes.Startup.apply(&corev1.Probe{
+		ProbeHandler:     appStatusHandler(),
+		PeriodSeconds:    10,
+		TimeoutSeconds:   5,
+		SuccessThreshold: 1,
+		FailureThreshold: 60,
+	}, false)
+}
+
+// dbReadinessProbe pings MariaDB. mariadb-admin replaces mysqladmin in
+// newer MariaDB images, so both are tried.
+func (b *BookStack) dbReadinessProbe() *corev1.Probe {
+	return b.Spec.PodTemplate.DB.Probes.Readiness.apply(&corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			Exec: &corev1.ExecAction{
+				Command: []string{
+					"sh", "-c",
+					"mariadb-admin ping -h 127.0.0.1 || mysqladmin ping -h 127.0.0.1",
+				},
+			},
+		},
+		PeriodSeconds:    10,
+		TimeoutSeconds:   5,
+		SuccessThreshold: 1,
+		FailureThreshold: 3,
+	}, true)
+}
+
+// dbLivenessProbe restarts MariaDB if it stops accepting connections.
+func (b *BookStack) dbLivenessProbe() *corev1.Probe {
+	return b.Spec.PodTemplate.DB.Probes.Liveness.apply(&corev1.Probe{
+		ProbeHandler:     dbTCPHandler(),
+		PeriodSeconds:    10,
+		TimeoutSeconds:   5,
+		SuccessThreshold: 1,
+		FailureThreshold: 6,
+	}, false)
+}
+
+// dbStartupProbe allows up to five minutes for MariaDB to initialize
+// its data directory.
+func (b *BookStack) dbStartupProbe() *corev1.Probe {
+	return b.Spec.PodTemplate.DB.Probes.Startup.apply(&corev1.Probe{
+		ProbeHandler:     dbTCPHandler(),
+		PeriodSeconds:    10,
+		TimeoutSeconds:   5,
+		SuccessThreshold: 1,
+		FailureThreshold: 30,
+	}, false)
+}
+
+func dbTCPHandler() corev1.ProbeHandler {
+	return corev1.ProbeHandler{
+		TCPSocket: &corev1.TCPSocketAction{
+			Port: intstr.FromInt(dbPort),
+		},
+	}
+}
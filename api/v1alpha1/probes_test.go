@@ -0,0 +1,54 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProbeSuccessThreshold(t *testing.T) {
+	three := int32(3)
+	overrides := &ProbeOverrides{SuccessThreshold: &three}
+
+	b := &BookStack{}
+	b.Spec.PodTemplate.App.Probes = ContainerProbes{Readiness: overrides, Liveness: overrides, Startup: overrides}
+	b.Spec.PodTemplate.DB.Probes = ContainerProbes{Liveness: overrides}
+
+	if got := b.appReadinessProbe().SuccessThreshold; got != 3 {
+		t.Errorf("app readiness SuccessThreshold = %d, want 3", got)
+	}
+
+	for name, got := range map[string]int32{
+		"app liveness": b.appLivenessProbe().SuccessThreshold,
+		"app startup":  b.appStartupProbe().SuccessThreshold,
+		"db liveness":  b.dbLivenessProbe().SuccessThreshold,
+	} {
+		if got != 1 {
+			t.Errorf("%s SuccessThreshold = %d, want 1", name, got)
+		}
+	}
+
+	want := []string{
+		"podTemplate.app.probes.liveness.successThreshold",
+		"podTemplate.app.probes.startup.successThreshold",
+		"podTemplate.db.probes.liveness.successThreshold",
+	}
+	if got := b.IgnoredOverrides(); !reflect.DeepEqual(got, want) {
+		t.Errorf("IgnoredOverrides() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,377 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"path"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// RestoreInProgressAnnotation is set on a BookStack to the name of the
+	// BookStackRestore restoring it. The instance is scaled to zero while
+	// it is set.
+	RestoreInProgressAnnotation = "tools.opdev.io/restore-in-progress"
+
+	// RestoreMigratingAnnotation replaces RestoreInProgressAnnotation once
+	// the data is restored. The instance runs so that the migrations can
+	// reach its database, but isn't exposed while it is set.
+	RestoreMigratingAnnotation = "tools.opdev.io/restore-migrating"
+
+	// RestoreFinalizer releases the annotations a BookStackRestore set on
+	// its instance when it is deleted.
+	RestoreFinalizer = "tools.opdev.io/restore"
+
+	// RestoreComponent labels the Jobs that restore an instance.
+	RestoreComponent = "restore"
+
+	// defaultAppRoot is the BookStack installation in DefaultAppImage.
+	defaultAppRoot = "/app/www"
+)
+
+// ScalesToZero reports whether the instance's Deployment is scaled to
+// zero, which it is while the instance is suspended or a restore or a
+// snapshot needs it stopped.
+func (b *BookStack) ScalesToZero() bool {
+	if b.IsSuspended() {
+		return true
+	}
+
+	for _, annotation := range []string{RestoreInProgressAnnotation, SnapshotInProgressAnnotation} {
+		if _, ok := b.GetAnnotations()[annotation]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// replicas returns the number of replicas of the instance's Deployment,
+// which is zero when it scales to zero and otherwise left to whoever
+// scales it.
+func (b *BookStack) replicas() *int32 {
+	if !b.ScalesToZero() {
+		return nil
+	}
+
+	var replicas int32
+	return &replicas
+}
+
+// RestoringBy returns the name of the BookStackRestore restoring the
+// instance, or an empty string if none is.
+func (b *BookStack) RestoringBy() string {
+	for _, annotation := range []string{RestoreInProgressAnnotation, RestoreMigratingAnnotation} {
+		if owner, ok := b.GetAnnotations()[annotation]; ok {
+			return owner
+		}
+	}
+
+	return ""
+}
+
+// dbDataDir returns the MariaDB data directory of the DB image.
+func (b *BookStack) dbDataDir() string {
+	if b.IsHardened() {
+		return hardenedDBDataPath + "/data"
+	}
+
+	return b.dbDataMountPath() + "/databases"
+}
+
+// appRoot returns the BookStack installation in the app image.
+func (b *BookStack) appRoot() string {
+	if b.IsHardened() {
+		return hardenedAppRoot
+	}
+
+	return defaultAppRoot
+}
+
+// NewRestoreJob returns the Job restoring the database and the app volume
+// from the archive named by restore. backup is the BookStackBackup named
+// by restore's source, if any. The Job mounts the instance's volumes, so
+// it must only run while the instance is scaled to zero.
+func (b *BookStack) NewRestoreJob(restore *BookStackRestore, backup *BookStackBackup) batchv1.Job {
+	source := restore.Spec.Source
+	s3, pvc := source.S3, source.PVC
+	encryptionKey := restore.Spec.EncryptionKeySecretRef
+
+	var location string
+	switch {
+	case backup != nil:
+		s3, pvc = backup.target().S3, backup.target().PVC
+		location = backup.Status.Location
+		if encryptionKey == nil {
+			encryptionKey = backup.Spec.EncryptionKeySecretRef
+		}
+	case s3 != nil:
+		location = "s3://" + path.Join(s3.Bucket, s3.Prefix, source.Archive)
+	case pvc != nil:
+		location = "pvc://" + path.Join(pvc.ClaimName, pvc.Path, source.Archive)
+	}
+
+	pod := corev1.PodSpec{
+		RestartPolicy:   corev1.RestartPolicyNever,
+		SecurityContext: b.podSecurityContext(),
+		Volumes: []corev1.Volume{
+			{
+				Name:         "work",
+				VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+			},
+			{
+				Name: "app-config",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: b.GetName() + "-pvc",
+					},
+				},
+			},
+			{
+				Name: "db-config",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: b.GetName() + "-db-pvc",
+					},
+				},
+			},
+		},
+		Containers: []corev1.Container{
+			{
+				Name:            "restore-db",
+				Image:           b.dbImage(),
+				Command:         []string{"sh", "-c", restoreDBScript},
+				SecurityContext: b.dbSecurityContext(),
+				Env: []corev1.EnvVar{
+					{Name: "DATADIR", Value: b.dbDataDir()},
+					configMapEnv("MYSQL_DATABASE", b.GetName()+"-db-cm", "MYSQL_DATABASE"),
+				},
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "work", MountPath: "/work"},
+					{Name: "db-config", MountPath: b.dbDataMountPath()},
+				},
+			},
+		},
+	}
+
+	fetch := corev1.Container{
+		Name:            "fetch",
+		SecurityContext: b.appSecurityContext(),
+		Env:             []corev1.EnvVar{{Name: "LOCATION", Value: location}},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "work", MountPath: "/work"},
+		},
+	}
+
+	if s3 != nil {
+		fetch.Image = DefaultS3ClientImage
+		fetch.Command = []string{"bash", "-c", s3FetchScript}
+		// mc keeps its configuration in the home directory.
+		fetch.Env = append(append(fetch.Env, s3.env()...), corev1.EnvVar{Name: "HOME", Value: "/work"})
+	}
+
+	if pvc != nil {
+		pod.Volumes = append(pod.Volumes, pvc.volume("source"))
+		fetch.Image = DefaultArchiveImage
+		fetch.Command = []string{"sh", "-c", pvcFetchScript}
+		fetch.Env = append(fetch.Env, corev1.EnvVar{Name: "CLAIM_NAME", Value: pvc.ClaimName})
+		fetch.VolumeMounts = append(fetch.VolumeMounts,
+			corev1.VolumeMount{Name: "source", MountPath: "/source", ReadOnly: true})
+	}
+
+	var extractEnv []corev1.EnvVar
+	if encryptionKey != nil {
+		extractEnv = append(extractEnv, secretEnv("ENCRYPTION_KEY", encryptionKey.Name, encryptionKey.Key))
+	}
+
+	pod.InitContainers = []corev1.Container{
+		fetch,
+		{
+			Name:            "extract",
+			Image:           DefaultArchiveImage,
+			Command:         []string{"sh", "-c", extractScript},
+			SecurityContext: b.appSecurityContext(),
+			Env:             extractEnv,
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: "work", MountPath: "/work"},
+				{Name: "app-config", MountPath: "/config"},
+			},
+		},
+	}
+
+	var backoffLimit int32
+	return batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      restore.GetName() + "-restore",
+			Namespace: b.GetNamespace(),
+			Labels:    labelsForComponent(*b, RestoreComponent),
+		},
+		Spec: batchv1.JobSpec{
+			// a partial restore must not be retried over.
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labelsForComponent(*b, RestoreComponent),
+				},
+				Spec: pod,
+			},
+		},
+	}
+}
+
+// NewMigrateJob returns the Job named name running the migrations of the
+// BookStack image against the instance's database. It connects through
+// the DB Service, so it must only run while the instance is running.
+func (b *BookStack) NewMigrateJob(name, image string) batchv1.Job {
+	env := append(b.hardenedAppEnv(), append(b.userEnv(), b.ownedEnv()...)...)
+	// the app configuration points at the DB container in the instance pod.
+	env = append(env, corev1.EnvVar{Name: "DB_HOST", Value: b.GetDBServiceName()})
+
+	var backoffLimit int32 = 2
+	return batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: b.GetNamespace(),
+			Labels:    labelsForComponent(*b, RestoreComponent),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labelsForComponent(*b, RestoreComponent),
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy:   corev1.RestartPolicyNever,
+					Affinity:        b.colocatedAffinity(),
+					SecurityContext: b.podSecurityContext(),
+					Volumes: append([]corev1.Volume{
+						{
+							Name: "app-config",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: b.GetName() + "-pvc",
+								},
+							},
+						},
+					}, b.scratchVolumes()...),
+					Containers: []corev1.Container{
+						{
+							Name:            "migrate",
+							Image:           image,
+							Command:         []string{"php", "artisan", "migrate", "--force"},
+							WorkingDir:      b.appRoot(),
+							SecurityContext: b.appSecurityContext(),
+							EnvFrom: append([]corev1.EnvFromSource{
+								{
+									ConfigMapRef: &corev1.ConfigMapEnvSource{
+										LocalObjectReference: corev1.LocalObjectReference{
+											Name: b.GetName() + "-cm",
+										},
+									},
+								},
+								{
+									SecretRef: &corev1.SecretEnvSource{
+										LocalObjectReference: corev1.LocalObjectReference{
+											Name: b.GetName() + "-secret",
+										},
+									},
+								},
+							}, b.Spec.EnvFrom...),
+							Env:          env,
+							VolumeMounts: append(b.appDataVolumeMounts(), b.scratchVolumeMounts("app-")...),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// s3FetchScript downloads the archive at LOCATION to /work.
+const s3FetchScript = `set -euo pipefail
+mc() { command mc ${S3_INSECURE:+--insecure} "$@"; }
+archive="$(basename "$LOCATION")"
+mc alias set target "$S3_ENDPOINT" "$AWS_ACCESS_KEY_ID" "$AWS_SECRET_ACCESS_KEY" --api S3v4 >/dev/null
+mc cp "target/${LOCATION#s3://}" "/work/$archive"
+echo "$archive" > /work/archive
+`
+
+// pvcFetchScript copies the archive at LOCATION from the source volume to
+// /work.
+const pvcFetchScript = `set -eu
+archive="$(basename "$LOCATION")"
+cp "/source/${LOCATION#pvc://$CLAIM_NAME/}" "/work/$archive"
+echo "$archive" > /work/archive
+`
+
+// extractScript decrypts and unpacks the archive, then replaces the
+// contents of the app volume with the archived ones.
+const extractScript = `set -eu
+cd /work
+archive="$(cat /work/archive)"
+case "$archive" in *.enc)
+  if [ -z "${ENCRYPTION_KEY:-}" ]; then
+    echo "$archive is encrypted but no encryption key is set" >&2
+    exit 1
+  fi
+  openssl enc -d -aes-256-cbc -pbkdf2 -pass env:ENCRYPTION_KEY -in "$archive" -out "${archive%.enc}"
+  rm "$archive"
+  archive="${archive%.enc}"
+esac
+case "$archive" in *.gz)
+  gunzip "$archive"
+  archive="${archive%.gz}"
+esac
+mkdir -p /work/restore
+tar -xf "$archive" -C /work/restore
+rm "$archive"
+find /config -mindepth 1 -maxdepth 1 ! -name lost+found -exec rm -rf {} +
+tar -C /work/restore/config -cf - . | tar -C /config -xf -
+`
+
+// restoreDBScript starts a private MariaDB server on the DB volume and
+// replaces the BookStack database with the archived dump. Grant tables
+// are skipped, so no credentials are needed to reach the server over its
+// socket.
+const restoreDBScript = `set -eu
+server=mariadbd
+command -v "$server" >/dev/null 2>&1 || server=mysqld
+client=mariadb
+command -v "$client" >/dev/null 2>&1 || client=mysql
+user=""
+if [ "$(id -u)" = 0 ]; then
+  user="--user=$(stat -c %U "$DATADIR")"
+fi
+"$server" --no-defaults $user --datadir="$DATADIR" --tmpdir=/work --skip-grant-tables --skip-networking --socket=/work/mysqld.sock --pid-file=/work/mysqld.pid &
+pid=$!
+tries=0
+until "$client" --socket=/work/mysqld.sock -e 'SELECT 1' >/dev/null 2>&1; do
+  tries=$((tries + 1))
+  if [ "$tries" -ge 60 ]; then
+    echo "database server did not start" >&2
+    exit 1
+  fi
+  sleep 2
+done
+"$client" --socket=/work/mysqld.sock -e "DROP DATABASE IF EXISTS $MYSQL_DATABASE; CREATE DATABASE $MYSQL_DATABASE;"
+"$client" --socket=/work/mysqld.sock "$MYSQL_DATABASE" < /work/restore/database.sql
+kill "$pid"
+wait "$pid" || true
+`
@@ -0,0 +1,99 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// redirectBinding is the SAML2 binding BookStack uses to reach the IdP.
+const redirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+
+// samlIDP holds the identity provider settings BookStack needs when it
+// does not load the IdP metadata itself.
+type samlIDP struct {
+	EntityID    string
+	SSOURL      string
+	SLOURL      string
+	Certificate string
+}
+
+// samlEntityDescriptor is the subset of SAML2 metadata read by the operator.
+type samlEntityDescriptor struct {
+	XMLName  xml.Name `xml:"EntityDescriptor"`
+	EntityID string   `xml:"entityID,attr"`
+	IDP      struct {
+		KeyDescriptors []struct {
+			Use         string `xml:"use,attr"`
+			Certificate string `xml:"KeyInfo>X509Data>X509Certificate"`
+		} `xml:"KeyDescriptor"`
+		SingleSignOnServices []samlEndpoint `xml:"SingleSignOnService"`
+		SingleLogoutServices []samlEndpoint `xml:"SingleLogoutService"`
+	} `xml:"IDPSSODescriptor"`
+}
+
+type samlEndpoint struct {
+	Binding  string `xml:"Binding,attr"`
+	Location string `xml:"Location,attr"`
+}
+
+// parseSAMLMetadata extracts the identity provider settings from SAML2
+// metadata XML.
+func parseSAMLMetadata(metadata string) (*samlIDP, error) {
+	var ed samlEntityDescriptor
+	if err := xml.Unmarshal([]byte(metadata), &ed); err != nil {
+		return nil, fmt.Errorf("unable to parse auth.saml2.idpMetadata: %w", err)
+	}
+
+	idp := samlIDP{
+		EntityID: ed.EntityID,
+		SSOURL:   endpointFor(ed.IDP.SingleSignOnServices),
+		SLOURL:   endpointFor(ed.IDP.SingleLogoutServices),
+	}
+
+	for _, kd := range ed.IDP.KeyDescriptors {
+		if kd.Use == "" || kd.Use == "signing" {
+			idp.Certificate = strings.Join(strings.Fields(kd.Certificate), "")
+			break
+		}
+	}
+
+	if idp.EntityID == "" || idp.SSOURL == "" || idp.Certificate == "" {
+		return nil, errors.New("auth.saml2.idpMetadata must define an entityID, a SingleSignOnService and a signing certificate")
+	}
+
+	return &idp, nil
+}
+
+// endpointFor returns the location of the HTTP-Redirect endpoint, falling
+// back to the first endpoint listed.
+func endpointFor(endpoints []samlEndpoint) string {
+	for _, e := range endpoints {
+		if e.Binding == redirectBinding {
+			return e.Location
+		}
+	}
+
+	if len(endpoints) > 0 {
+		return endpoints[0].Location
+	}
+
+	return ""
+}
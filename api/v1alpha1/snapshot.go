@@ -0,0 +1,216 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"strconv"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// SnapshotInProgressAnnotation is set on a BookStack to the name of the
+	// BookStackBackup snapshotting it with the ScaleDown quiesce mode. The
+	// instance is scaled to zero while it is set.
+	SnapshotInProgressAnnotation = "tools.opdev.io/snapshot-in-progress"
+
+	// SnapshotFinalizer resumes the instance a Snapshot mode backup
+	// quiesced when the backup is deleted before it finished.
+	SnapshotFinalizer = "tools.opdev.io/snapshot"
+
+	// SnapshotComponent labels the Jobs that quiesce an instance for a
+	// snapshot.
+	SnapshotComponent = "snapshot"
+
+	// dbLockTimeoutSeconds bounds how long the DB lock Job holds the lock
+	// if the operator fails to release it.
+	dbLockTimeoutSeconds = 600
+)
+
+// QuiesceMode selects how an instance is quiesced while it is snapshotted.
+// +kubebuilder:validation:Enum=FlushTables;ScaleDown
+type QuiesceMode string
+
+const (
+	// QuiesceFlushTables holds a read lock on the database while the
+	// snapshots are taken. BookStack stays up, but can't write.
+	QuiesceFlushTables QuiesceMode = "FlushTables"
+	// QuiesceScaleDown scales the instance to zero while the snapshots are
+	// taken.
+	QuiesceScaleDown QuiesceMode = "ScaleDown"
+)
+
+// SnapshotOptions configures a BookStackBackup in Snapshot mode.
+type SnapshotOptions struct {
+	// VolumeSnapshotClassName is the class of the VolumeSnapshots. The
+	// default class of the CSI driver is used when unset.
+	// +optional
+	VolumeSnapshotClassName *string `json:"volumeSnapshotClassName,omitempty"`
+
+	// Quiesce selects how the instance is quiesced while the snapshots
+	// are taken.
+	// +kubebuilder:default=FlushTables
+	// +optional
+	Quiesce QuiesceMode `json:"quiesce,omitempty"`
+
+	// Retention is the number of completed Snapshot mode backups of the
+	// instance kept. Older BookStackBackups are deleted, along with their
+	// snapshots, once this backup completes. All are kept when unset.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Retention int32 `json:"retention,omitempty"`
+}
+
+// quiesceMode returns how the instance is quiesced for the backup.
+func (b *BookStackBackup) quiesceMode() QuiesceMode {
+	if b.Spec.Snapshot == nil || b.Spec.Snapshot.Quiesce == "" {
+		return QuiesceFlushTables
+	}
+
+	return b.Spec.Snapshot.Quiesce
+}
+
+// ScalesDown returns true if the instance is scaled to zero while it is
+// snapshotted.
+func (b *BookStackBackup) ScalesDown() bool {
+	return b.quiesceMode() == QuiesceScaleDown
+}
+
+// SnapshotRetention returns the number of Snapshot mode backups to keep,
+// or zero to keep all.
+func (b *BookStackBackup) SnapshotRetention() int {
+	if b.Spec.Snapshot == nil {
+		return 0
+	}
+
+	return int(b.Spec.Snapshot.Retention)
+}
+
+// NewVolumeSnapshots returns the VolumeSnapshots of the app and DB volume
+// claims taken by backup.
+func (b *BookStack) NewVolumeSnapshots(backup *BookStackBackup) []snapshotv1.VolumeSnapshot {
+	var class *string
+	if backup.Spec.Snapshot != nil {
+		class = backup.Spec.Snapshot.VolumeSnapshotClassName
+	}
+
+	claims := []struct{ suffix, claim string }{
+		{"-app", b.GetName() + "-pvc"},
+		{"-db", b.GetName() + "-db-pvc"},
+	}
+
+	snapshots := make([]snapshotv1.VolumeSnapshot, 0, len(claims))
+	for _, c := range claims {
+		claim := c.claim
+		snapshots = append(snapshots, snapshotv1.VolumeSnapshot{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      backup.GetName() + c.suffix,
+				Namespace: b.GetNamespace(),
+				Labels:    labelsForComponent(*b, SnapshotComponent),
+			},
+			Spec: snapshotv1.VolumeSnapshotSpec{
+				Source: snapshotv1.VolumeSnapshotSource{
+					PersistentVolumeClaimName: &claim,
+				},
+				VolumeSnapshotClassName: class,
+			},
+		})
+	}
+
+	return snapshots
+}
+
+// NewDBLockJob returns the Job holding a read lock on the instance's
+// database while backup takes its snapshots. The Job's pod becomes ready
+// once the lock is held, and the lock is released when the Job is deleted.
+func (b *BookStack) NewDBLockJob(backup *BookStackBackup) batchv1.Job {
+	var backoffLimit int32
+	var deadline int64 = dbLockTimeoutSeconds + 60
+	return batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      backup.GetName() + "-lock",
+			Namespace: b.GetNamespace(),
+			Labels:    labelsForComponent(*b, SnapshotComponent),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:          &backoffLimit,
+			ActiveDeadlineSeconds: &deadline,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labelsForComponent(*b, SnapshotComponent),
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy:   corev1.RestartPolicyNever,
+					SecurityContext: b.podSecurityContext(),
+					Volumes: []corev1.Volume{
+						{
+							Name:         "work",
+							VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:            "lock",
+							Image:           b.dbImage(),
+							Command:         []string{"sh", "-c", dbLockScript},
+							SecurityContext: b.dbSecurityContext(),
+							Env: append(b.dbClientEnv(), corev1.EnvVar{
+								Name:  "LOCK_TIMEOUT",
+								Value: strconv.Itoa(dbLockTimeoutSeconds),
+							}),
+							ReadinessProbe: &corev1.Probe{
+								ProbeHandler: corev1.ProbeHandler{
+									Exec: &corev1.ExecAction{
+										Command: []string{"test", "-f", "/work/locked"},
+									},
+								},
+								PeriodSeconds: 1,
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "work", MountPath: "/work"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// dbLockScript holds a read lock on the database for LOCK_TIMEOUT seconds,
+// creating /work/locked once it is held. FLUSH TABLES WITH READ LOCK needs
+// the RELOAD privilege, so the BookStack tables are locked individually
+// when the BookStack user lacks it.
+const dbLockScript = `set -eu
+client=mariadb
+command -v "$client" >/dev/null 2>&1 || client=mysql
+db() { "$client" --host="$DB_HOST" --user="$MYSQL_USER" "$@" "$MYSQL_DATABASE"; }
+if db -e "FLUSH TABLES WITH READ LOCK; UNLOCK TABLES;" >/dev/null 2>&1; then
+  lock="FLUSH TABLES WITH READ LOCK;"
+else
+  tables=$(db --skip-column-names -e "SET SESSION group_concat_max_len = 65536; SELECT GROUP_CONCAT(CONCAT(table_name, ' READ')) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE';")
+  lock="LOCK TABLES $tables;"
+fi
+db --unbuffered --skip-column-names -e "$lock SELECT 'locked'; SELECT SLEEP($LOCK_TIMEOUT);" | while read -r line; do
+  if [ "$line" = locked ]; then
+    touch /work/locked
+  fi
+done
+`
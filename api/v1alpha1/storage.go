@@ -0,0 +1,79 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// staticStorageClassName is the storage class of the hostPath volumes the
+// operator creates when no storage class is configured.
+const staticStorageClassName = "manual"
+
+// StorageSpec configures the app and DB volumes.
+type StorageSpec struct {
+	// StorageClassName is the storage class of the volume claims. When set,
+	// the volumes are provisioned by the storage class rather than backed
+	// by hostPath volumes created by the operator. Snapshot backups require
+	// a CSI storage class.
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+
+	// AppDataSource populates the app volume claim, e.g. from a
+	// VolumeSnapshot taken by a snapshot backup.
+	// +optional
+	AppDataSource *corev1.TypedLocalObjectReference `json:"appDataSource,omitempty"`
+
+	// DBDataSource populates the DB volume claim, e.g. from a
+	// VolumeSnapshot taken by a snapshot backup.
+	// +optional
+	DBDataSource *corev1.TypedLocalObjectReference `json:"dbDataSource,omitempty"`
+}
+
+// UsesStaticVolumes returns true if the operator creates the
+// PersistentVolumes bound by the instance's claims.
+func (b *BookStack) UsesStaticVolumes() bool {
+	return b.Spec.Storage == nil || b.Spec.Storage.StorageClassName == nil
+}
+
+// storageClassName returns the storage class of the volume claims.
+func (b *BookStack) storageClassName() *string {
+	if b.UsesStaticVolumes() {
+		name := staticStorageClassName
+		return &name
+	}
+
+	return b.Spec.Storage.StorageClassName
+}
+
+// appDataSource returns the data source of the app volume claim.
+func (b *BookStack) appDataSource() *corev1.TypedLocalObjectReference {
+	if b.Spec.Storage == nil {
+		return nil
+	}
+
+	return b.Spec.Storage.AppDataSource
+}
+
+// dbDataSource returns the data source of the DB volume claim.
+func (b *BookStack) dbDataSource() *corev1.TypedLocalObjectReference {
+	if b.Spec.Storage == nil {
+		return nil
+	}
+
+	return b.Spec.Storage.DBDataSource
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// SyncFinalizer is added to the resources synced into BookStack through its
+// API, so that their BookStack counterpart is removed along with them.
+const SyncFinalizer = "tools.opdev.io/bookstack-sync"
+
+// ConditionSynced indicates whether a resource is in sync with its
+// counterpart in BookStack.
+const ConditionSynced = "Synced"
+
+// DeletionPolicy selects what happens to the BookStack counterpart of a
+// resource when the resource is deleted.
+// +kubebuilder:validation:Enum=Delete;Retain
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete deletes the counterpart in BookStack.
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyRetain keeps the counterpart in BookStack.
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+)
+
+// DriftPolicy selects what happens when a resource is changed in BookStack
+// after it was synced.
+// +kubebuilder:validation:Enum=Revert;Report
+type DriftPolicy string
+
+const (
+	// DriftPolicyRevert reverts the changes made in BookStack.
+	DriftPolicyRevert DriftPolicy = "Revert"
+	// DriftPolicyReport keeps the changes made in BookStack and reports
+	// them in the Synced condition, until the spec changes.
+	DriftPolicyReport DriftPolicy = "Report"
+)
@@ -0,0 +1,237 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// UpgradePhase is the step an upgrade between versions is at.
+type UpgradePhase string
+
+const (
+	// UpgradePhaseBackingUp takes a backup of the instance before it is
+	// upgraded.
+	UpgradePhaseBackingUp UpgradePhase = "BackingUp"
+	// UpgradePhaseMigrating runs the migrations of the new version.
+	UpgradePhaseMigrating UpgradePhase = "Migrating"
+	// UpgradePhaseRollingOut rolls the new version out.
+	UpgradePhaseRollingOut UpgradePhase = "RollingOut"
+	// UpgradePhaseSucceeded indicates the new version is running.
+	UpgradePhaseSucceeded UpgradePhase = "Succeeded"
+	// UpgradePhaseFailed indicates a step failed. The instance keeps
+	// running the previous version.
+	UpgradePhaseFailed UpgradePhase = "Failed"
+	// UpgradePhaseRefused indicates the version change is not supported,
+	// e.g. a downgrade.
+	UpgradePhaseRefused UpgradePhase = "Refused"
+)
+
+// UpgradeStatus reports the progress of the latest version change.
+type UpgradeStatus struct {
+	// FromVersion is the version the instance is upgraded from.
+	FromVersion string `json:"fromVersion"`
+
+	// ToVersion is the version the instance is upgraded to.
+	ToVersion string `json:"toVersion"`
+
+	// Phase is the step the upgrade is at.
+	Phase UpgradePhase `json:"phase"`
+
+	// Message describes the reason for the current phase.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// BackupName is the BookStackBackup taken before the upgrade.
+	// +optional
+	BackupName string `json:"backupName,omitempty"`
+
+	// StartTime is when the upgrade started.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// MigrationStartTime is when the upgrade moved on to its migrations.
+	// +optional
+	MigrationStartTime *metav1.Time `json:"migrationStartTime,omitempty"`
+
+	// CompletionTime is when the upgrade succeeded, failed or was refused.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// IsFinished returns true once the upgrade has succeeded, failed or was
+// refused.
+func (u *UpgradeStatus) IsFinished() bool {
+	switch u.Phase {
+	case UpgradePhaseSucceeded, UpgradePhaseFailed, UpgradePhaseRefused:
+		return true
+	}
+
+	return false
+}
+
+// versionPattern matches the dotted numeric version in an image tag, e.g.
+// 23.05.2 in v23.05.2-ls90.
+var versionPattern = regexp.MustCompile(`\d+(\.\d+)*`)
+
+// digits matches the numbers in an image tag.
+var digits = regexp.MustCompile(`\d+`)
+
+// invalidNameChars matches the characters not allowed in object names.
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// IsComparableVersion returns true if the image tag v holds a version that
+// can be compared, i.e. it isn't a tag like latest.
+func IsComparableVersion(v string) bool {
+	return versionPattern.MatchString(v)
+}
+
+// CompareVersions compares the versions in the image tags a and b,
+// returning -1, 0 or 1 if a is older than, the same as or newer than b.
+func CompareVersions(a, b string) (int, error) {
+	va, vb := versionPattern.FindString(a), versionPattern.FindString(b)
+	if va == "" || vb == "" {
+		return 0, fmt.Errorf("unable to compare versions %q and %q", a, b)
+	}
+
+	return compareNumbers(numbers(va), numbers(vb)), nil
+}
+
+// numbers returns the numbers in s, in order.
+func numbers(s string) []int {
+	runs := digits.FindAllString(s, -1)
+	n := make([]int, len(runs))
+	for i, run := range runs {
+		n[i], _ = strconv.Atoi(run)
+	}
+
+	return n
+}
+
+// compareNumbers compares a and b number by number, returning -1, 0 or 1
+// if a is lower than, equal to or higher than b. Missing numbers count as
+// zero.
+func compareNumbers(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var na, nb int
+		if i < len(a) {
+			na = a[i]
+		}
+		if i < len(b) {
+			nb = b[i]
+		}
+
+		switch {
+		case na < nb:
+			return -1
+		case na > nb:
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// DeployedVersion returns the version the instance's Deployment runs, or
+// an empty string if it follows the image's default tag. It only moves to
+// spec.version once an upgrade reaches its rollout.
+func (b *BookStack) DeployedVersion() string {
+	if b.Spec.Version == "" {
+		return ""
+	}
+
+	return valueOrDefault(b.Status.Version, b.Spec.Version)
+}
+
+// AppImageFor returns the BookStack image running version.
+func (b *BookStack) AppImageFor(version string) string {
+	image := b.baseAppImage()
+	if version == "" {
+		return image
+	}
+
+	return imageRepository(image) + ":" + version
+}
+
+// imageRepository returns image without its tag or digest.
+func imageRepository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+
+	return image
+}
+
+// ImageTag returns the tag of image, or an empty string if it has none.
+func ImageTag(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[i+1:]
+	}
+
+	return ""
+}
+
+// dnsLabel converts s to a string usable in object names.
+func dnsLabel(s string) string {
+	s = strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(s), "-"), "-")
+	if len(s) > 30 {
+		s = strings.TrimRight(s[:30], "-")
+	}
+
+	return s
+}
+
+// GetUpgradeJobName returns the name of the Job running the migrations of
+// version.
+func (b *BookStack) GetUpgradeJobName(version string) string {
+	return b.GetName() + "-migrate-" + dnsLabel(version)
+}
+
+// NewPreUpgradeBackup returns the BookStackBackup taken before upgrading
+// to version. It backs up to the target of spec.backup, so it must only be
+// called when spec.backup is set.
+func (b *BookStack) NewPreUpgradeBackup(version string) BookStackBackup {
+	s3 := b.Spec.Backup.S3
+	return BookStackBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      b.GetName() + "-pre-upgrade-" + dnsLabel(version),
+			Namespace: b.GetNamespace(),
+			Labels:    labelsForComponent(*b, BackupComponent),
+		},
+		Spec: BookStackBackupSpec{
+			BookStackRef:           corev1.LocalObjectReference{Name: b.GetName()},
+			Mode:                   BackupModeArchive,
+			Target:                 &BackupTarget{S3: &s3},
+			Compression:            b.Spec.Backup.Compression,
+			EncryptionKeySecretRef: b.Spec.Backup.EncryptionKeySecretRef,
+		},
+	}
+}
@@ -0,0 +1,298 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	subrec "github.com/opdev/subreconciler"
+	"golang.org/x/crypto/bcrypt"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// generatedPasswordBytes is the number of random bytes in a generated
+// admin password.
+const generatedPasswordBytes = 18
+
+// BookStackAdminReconciler replaces BookStack's default admin account with
+// the one configured in spec.admin.
+type BookStackAdminReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks,verbs=get;list;watch
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+
+// Reconcile will store the admin credentials in the admin Secret and, once
+// BookStack is up, run the Job replacing the default admin account. The
+// account is only bootstrapped once, later changes are made in BookStack.
+func (r *BookStackAdminReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("admin reconciliation initiated.")
+	defer l.Info("admin reconciliation complete.")
+
+	var instance toolsv1alpha1.BookStack
+	err := r.Client.Get(ctx, req.NamespacedName, &instance)
+
+	if apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if instance.IsPaused() {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if instance.AdminBootstrapped() {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	// BookStack creates the default admin account when it first starts.
+	var deployment appsv1.Deployment
+	err = r.Client.Get(ctx, client.ObjectKeyFromObject(&instance), &deployment)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if err = r.adoptServingInstance(ctx, &instance, &deployment); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if res, err := r.reconcileAdminSecret(ctx, &instance); subrec.ShouldHaltOrRequeue(res, err) {
+		return subrec.Evaluate(res, err)
+	}
+
+	if deployment.Status.AvailableReplicas == 0 {
+		return r.reportBootstrap(ctx, &instance, metav1.ConditionFalse, "WaitingForBookStack", "waiting for BookStack to become available")
+	}
+
+	new := instance.NewAdminBootstrapJob()
+
+	err = ctrl.SetControllerReference(&instance, &new, r.Scheme)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	var existing batchv1.Job
+	err = r.Client.Get(ctx, client.ObjectKeyFromObject(&new), &existing)
+
+	if apierrors.IsNotFound(err) {
+		l.Info("creating resource", new.Kind, new.Name)
+		if err := r.Client.Create(ctx, &new); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		return r.reportBootstrap(ctx, &instance, metav1.ConditionFalse, "Bootstrapping", fmt.Sprintf("job %s is replacing the default admin account", new.Name))
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if failed := jobFailure(&existing); failed != "" {
+		return r.retryBootstrap(ctx, &instance, &existing, failed)
+	}
+
+	if existing.Status.Succeeded == 0 {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	// the result is lost if the pod was deleted, the account is then
+	// reported as replaced.
+	result, err := jobResult(ctx, r.Client, &existing, toolsv1alpha1.AdminBootstrapContainer)
+	if err != nil {
+		l.Error(err, "unable to read the admin bootstrap result")
+	}
+
+	if result == toolsv1alpha1.AdminAccountKept {
+		return r.reportBootstrap(ctx, &instance, metav1.ConditionTrue, "AlreadyReplaced", fmt.Sprintf("the default admin account was already replaced in BookStack, the existing admins are kept and the %s Secret is unused", instance.GetAdminSecretName()))
+	}
+
+	return r.reportBootstrap(ctx, &instance, metav1.ConditionTrue, "Bootstrapped", fmt.Sprintf("the admin account is %s, its credentials are in the %s Secret", instance.AdminEmail(), instance.GetAdminSecretName()))
+}
+
+// adoptServingInstance records that the instance was already serving
+// before its admin account was first bootstrapped, i.e. by an operator
+// that didn't bootstrap it, so that it isn't unexposed while it is.
+func (r *BookStackAdminReconciler) adoptServingInstance(ctx context.Context, instance *toolsv1alpha1.BookStack, deployment *appsv1.Deployment) error {
+	if instance.AdminAdopted() || deployment.Status.AvailableReplicas == 0 ||
+		meta.FindStatusCondition(instance.Status.Conditions, toolsv1alpha1.ConditionAdminBootstrapped) != nil {
+		return nil
+	}
+
+	return patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+		status.AdminAdopted = true
+	})
+}
+
+// reconcileAdminSecret stores the admin email and the bcrypt hash of its
+// password in the admin Secret, generating the password if none is
+// configured. The hash is only renewed when the password changes.
+func (r *BookStackAdminReconciler) reconcileAdminSecret(ctx context.Context, instance *toolsv1alpha1.BookStack) (*ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	var existing corev1.Secret
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: instance.Namespace, Name: instance.GetAdminSecretName()}, &existing)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.RequeueWithError(err)
+	}
+	found := err == nil
+
+	password := string(existing.Data[toolsv1alpha1.AdminPasswordKey])
+	if ref := instance.AdminPasswordSecretRef(); ref != nil {
+		var source corev1.Secret
+		err := r.Client.Get(ctx, client.ObjectKey{Namespace: instance.Namespace, Name: ref.Name}, &source)
+		if apierrors.IsNotFound(err) {
+			if _, err := r.reportBootstrap(ctx, instance, metav1.ConditionFalse, "SecretNotFound", fmt.Sprintf("secret %s not found", ref.Name)); err != nil {
+				return subrec.RequeueWithError(err)
+			}
+
+			return subrec.RequeueWithDelay(30 * time.Second)
+		}
+
+		if err != nil {
+			return subrec.RequeueWithError(err)
+		}
+
+		password = string(source.Data[ref.Key])
+		if password == "" {
+			if _, err := r.reportBootstrap(ctx, instance, metav1.ConditionFalse, "SecretNotFound", fmt.Sprintf("secret %s has no %s key", ref.Name, ref.Key)); err != nil {
+				return subrec.RequeueWithError(err)
+			}
+
+			return subrec.RequeueWithDelay(30 * time.Second)
+		}
+	}
+
+	if password == "" {
+		if password, err = generatePassword(); err != nil {
+			return subrec.RequeueWithError(err)
+		}
+	}
+
+	hash := existing.Data[toolsv1alpha1.AdminPasswordHashKey]
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		if hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+			return subrec.RequeueWithError(err)
+		}
+	}
+
+	new := instance.NewAdminSecret(password, string(hash))
+
+	err = ctrl.SetControllerReference(instance, &new, r.Scheme)
+	if err != nil {
+		return subrec.RequeueWithError(err)
+	}
+
+	if !found {
+		l.Info("creating resource", new.Kind, new.Name)
+		if err := r.Client.Create(ctx, &new); err != nil {
+			return subrec.RequeueWithError(err)
+		}
+
+		return subrec.ContinueReconciling()
+	}
+
+	patchDiff := client.MergeFrom(existing.DeepCopy())
+	existing.Labels = new.Labels
+	existing.OwnerReferences = new.OwnerReferences
+	existing.Data = new.Data
+
+	if err = r.Patch(ctx, &existing, patchDiff); err != nil {
+		return subrec.RequeueWithError(err)
+	}
+
+	return subrec.ContinueReconciling()
+}
+
+// retryBootstrap reports the failure of the bootstrap Job and, once it has
+// been kept for inspection long enough, deletes it so that the account is
+// bootstrapped again. BookStack stays unexposed in the meantime, unless it
+// was adopted, as its default admin account may still be logged into.
+func (r *BookStackAdminReconciler) retryBootstrap(ctx context.Context, instance *toolsv1alpha1.BookStack, job *batchv1.Job, failed string) (ctrl.Result, error) {
+	wait, err := retryFailedJob(ctx, r.Client, job, apiRetryInterval)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if wait > 0 {
+		if _, err := r.reportBootstrap(ctx, instance, metav1.ConditionFalse, "Failed", failed); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		return subrec.Evaluate(subrec.RequeueWithDelay(wait))
+	}
+
+	return r.reportBootstrap(ctx, instance, metav1.ConditionFalse, "Retrying", fmt.Sprintf("retrying after %s", failed))
+}
+
+// reportBootstrap records the AdminBootstrapped condition.
+func (r *BookStackAdminReconciler) reportBootstrap(ctx context.Context, instance *toolsv1alpha1.BookStack, status metav1.ConditionStatus, reason, message string) (ctrl.Result, error) {
+	err := setCondition(ctx, r.Client, instance, metav1.Condition{
+		Type:    toolsv1alpha1.ConditionAdminBootstrapped,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// generatePassword returns a random password.
+func generatePassword() (string, error) {
+	b := make([]byte, generatedPasswordBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BookStackAdminReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&toolsv1alpha1.BookStack{}).
+		Owns(&appsv1.Deployment{}).
+		Owns(&corev1.Secret{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
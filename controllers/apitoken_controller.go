@@ -0,0 +1,349 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	subrec "github.com/opdev/subreconciler"
+	"golang.org/x/crypto/bcrypt"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// apiTokenIDBytes and apiTokenSecretBytes are the number of random bytes
+// in a generated API token ID and secret.
+const (
+	apiTokenIDBytes     = 16
+	apiTokenSecretBytes = 24
+)
+
+// BookStackAPITokenReconciler registers the API token the operator uses to
+// manage an instance through the BookStack API, and rotates it.
+type BookStackAPITokenReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks,verbs=get;list;watch
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+
+// Reconcile will, once BookStack is up, generate an API token into the API
+// token Secret and run the Job registering it for the operator's service
+// user. The token is replaced every rotation interval; the previous one
+// stays valid until it expires.
+func (r *BookStackAPITokenReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("api token reconciliation initiated.")
+	defer l.Info("api token reconciliation complete.")
+
+	var instance toolsv1alpha1.BookStack
+	err := r.Client.Get(ctx, req.NamespacedName, &instance)
+
+	if apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if instance.IsPaused() {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	// the token is registered in the database BookStack migrates when it
+	// first starts.
+	var deployment appsv1.Deployment
+	err = r.Client.Get(ctx, client.ObjectKeyFromObject(&instance), &deployment)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if deployment.Status.AvailableReplicas == 0 {
+		return r.reportToken(ctx, &instance, metav1.ConditionFalse, "WaitingForBookStack", "waiting for BookStack to become available")
+	}
+
+	secret := instance.NewAPITokenSecret(nil)
+	err = r.Client.Get(ctx, client.ObjectKeyFromObject(&secret), &secret)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	active := string(secret.Data[toolsv1alpha1.APITokenIDKey])
+	pending := string(secret.Data[toolsv1alpha1.PendingAPITokenIDKey])
+
+	if pending == "" && !r.rotationDue(&instance, active) {
+		return r.reportToken(ctx, &instance, metav1.ConditionTrue, "Ready", fmt.Sprintf("token %s is registered, its credentials are in the %s Secret", active, secret.Name))
+	}
+
+	if pending == "" {
+		if pending, err = r.generateToken(ctx, &instance, secret.Data); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	interval := instance.APITokenRotationInterval()
+	new := instance.NewAPITokenJob(pending, time.Now().Add(2*interval))
+
+	err = ctrl.SetControllerReference(&instance, &new, r.Scheme)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	var existing batchv1.Job
+	err = r.Client.Get(ctx, client.ObjectKeyFromObject(&new), &existing)
+
+	if apierrors.IsNotFound(err) {
+		l.Info("creating resource", new.Kind, new.Name)
+		if err := r.Client.Create(ctx, &new); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		return r.reportToken(ctx, &instance, metav1.ConditionFalse, "Registering", fmt.Sprintf("job %s is registering token %s", new.Name, pending))
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if failed := jobFailure(&existing); failed != "" {
+		// the pending token is kept, so the retry registers the same one.
+		wait, err := retryFailedJob(ctx, r.Client, &existing, apiRetryInterval)
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		if wait == 0 {
+			return r.reportToken(ctx, &instance, metav1.ConditionFalse, "Retrying", fmt.Sprintf("retrying after %s", failed))
+		}
+
+		if _, err := r.reportToken(ctx, &instance, metav1.ConditionFalse, "Failed", failed); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		return subrec.Evaluate(subrec.RequeueWithDelay(wait))
+	}
+
+	if existing.Status.Succeeded == 0 {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err = r.activateToken(ctx, &instance, &existing, secret.Data); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return r.reportToken(ctx, &instance, metav1.ConditionTrue, "Ready", fmt.Sprintf("token %s is registered, its credentials are in the %s Secret", pending, secret.Name))
+}
+
+// rotationDue returns true if the active token is missing, unknown to the
+// status or older than the rotation interval.
+func (r *BookStackAPITokenReconciler) rotationDue(instance *toolsv1alpha1.BookStack, active string) bool {
+	status := instance.Status.APIToken
+	if active == "" || status == nil || status.TokenID != active || status.LastRotationTime == nil {
+		return true
+	}
+
+	return time.Since(status.LastRotationTime.Time) >= instance.APITokenRotationInterval()
+}
+
+// generateToken stores a new token in the pending keys of the API token
+// Secret, keeping the active one, and returns its ID.
+func (r *BookStackAPITokenReconciler) generateToken(ctx context.Context, instance *toolsv1alpha1.BookStack, data map[string][]byte) (string, error) {
+	id, err := randomHex(apiTokenIDBytes)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := randomHex(apiTokenSecretBytes)
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	next := copyData(data)
+	next[toolsv1alpha1.PendingAPITokenIDKey] = []byte(id)
+	next[toolsv1alpha1.PendingAPITokenSecretKey] = []byte(secret)
+	next[toolsv1alpha1.PendingAPITokenSecretHashKey] = hash
+
+	if err := r.applySecret(ctx, instance, next); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// activateToken makes the token registered by the job the active one and
+// records it in the status, then removes the job.
+func (r *BookStackAPITokenReconciler) activateToken(ctx context.Context, instance *toolsv1alpha1.BookStack, job *batchv1.Job, data map[string][]byte) error {
+	tokenID := string(data[toolsv1alpha1.PendingAPITokenIDKey])
+
+	next := copyData(data)
+	next[toolsv1alpha1.APITokenIDKey] = data[toolsv1alpha1.PendingAPITokenIDKey]
+	next[toolsv1alpha1.APITokenSecretKey] = data[toolsv1alpha1.PendingAPITokenSecretKey]
+	delete(next, toolsv1alpha1.PendingAPITokenIDKey)
+	delete(next, toolsv1alpha1.PendingAPITokenSecretKey)
+	delete(next, toolsv1alpha1.PendingAPITokenSecretHashKey)
+
+	if err := r.applySecret(ctx, instance, next); err != nil {
+		return err
+	}
+
+	rotated := job.CreationTimestamp
+	if job.Status.CompletionTime != nil {
+		rotated = *job.Status.CompletionTime
+	}
+
+	var expiration *metav1.Time
+	if expires, err := time.Parse("2006-01-02", jobEnv(job, "EXPIRES_AT")); err == nil {
+		expiration = &metav1.Time{Time: expires}
+	}
+
+	err := patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+		status.APIToken = &toolsv1alpha1.APITokenStatus{
+			SecretName:       instance.GetAPITokenSecretName(),
+			TokenID:          tokenID,
+			LastRotationTime: &rotated,
+			ExpirationTime:   expiration,
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	err = r.Client.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// applySecret creates or updates the API token Secret with data.
+func (r *BookStackAPITokenReconciler) applySecret(ctx context.Context, instance *toolsv1alpha1.BookStack, data map[string][]byte) error {
+	l := log.FromContext(ctx)
+
+	new := instance.NewAPITokenSecret(data)
+
+	err := ctrl.SetControllerReference(instance, &new, r.Scheme)
+	if err != nil {
+		return err
+	}
+
+	var existing corev1.Secret
+	err = r.Client.Get(ctx, client.ObjectKeyFromObject(&new), &existing)
+
+	if apierrors.IsNotFound(err) {
+		l.Info("creating resource", new.Kind, new.Name)
+		return r.Client.Create(ctx, &new)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// a merge patch would keep the removed pending keys.
+	existing.Labels = new.Labels
+	existing.OwnerReferences = new.OwnerReferences
+	existing.Data = new.Data
+
+	return r.Client.Update(ctx, &existing)
+}
+
+// reportToken records the APITokenReady condition. A ready token is
+// requeued for its rotation.
+func (r *BookStackAPITokenReconciler) reportToken(ctx context.Context, instance *toolsv1alpha1.BookStack, status metav1.ConditionStatus, reason, message string) (ctrl.Result, error) {
+	err := setCondition(ctx, r.Client, instance, metav1.Condition{
+		Type:    toolsv1alpha1.ConditionAPITokenReady,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if status != metav1.ConditionTrue || instance.Status.APIToken == nil || instance.Status.APIToken.LastRotationTime == nil {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	due := instance.Status.APIToken.LastRotationTime.Add(instance.APITokenRotationInterval())
+	return subrec.Evaluate(subrec.RequeueWithDelay(time.Until(due) + time.Second))
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// copyData returns a copy of the data of a Secret.
+func copyData(data map[string][]byte) map[string][]byte {
+	copied := make(map[string][]byte, len(data))
+	for k, v := range data {
+		copied[k] = v
+	}
+
+	return copied
+}
+
+// jobEnv returns the value of the environment variable set on the
+// containers of the job.
+func jobEnv(job *batchv1.Job, name string) string {
+	for _, c := range job.Spec.Template.Spec.Containers {
+		for _, env := range c.Env {
+			if env.Name == name {
+				return env.Value
+			}
+		}
+	}
+
+	return ""
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BookStackAPITokenReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&toolsv1alpha1.BookStack{}).
+		Owns(&appsv1.Deployment{}).
+		Owns(&corev1.Secret{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
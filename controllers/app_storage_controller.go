@@ -64,38 +64,45 @@ func (r *BookStackAppStorageReconciler) Reconcile(ctx context.Context, req ctrl.
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
 
-	// app pv
-	appPV := instance.NewAppPersistentVolume()
-
-	err = ctrl.SetControllerReference(&instance, &appPV, r.Scheme)
-	if err != nil {
-		return subrec.Evaluate(subrec.RequeueWithError(err))
+	if instance.IsPaused() {
+		return subrec.Evaluate(subrec.DoNotRequeue())
 	}
 
-	// If app secret exists, get it and patch it
-	var existingPV corev1.PersistentVolume
-	err = r.Client.Get(ctx, client.ObjectKeyFromObject(&appPV), &existingPV)
+	// the PV is only needed when the claim is not dynamically provisioned.
+	if instance.UsesStaticVolumes() {
+		// app pv
+		appPV := instance.NewAppPersistentVolume()
 
-	if apierrors.IsNotFound(err) {
-		// create the resource because it does not exist.
-		l.Info("creating resource", appPV.Kind, appPV.Name)
-		if err := r.Client.Create(ctx, &appPV); err != nil {
+		err = ctrl.SetControllerReference(&instance, &appPV, r.Scheme)
+		if err != nil {
 			return subrec.Evaluate(subrec.RequeueWithError(err))
 		}
-	}
 
-	if err != nil {
-		return subrec.Evaluate(subrec.RequeueWithError(err))
-	}
+		// If app secret exists, get it and patch it
+		var existingPV corev1.PersistentVolume
+		err = r.Client.Get(ctx, client.ObjectKeyFromObject(&appPV), &existingPV)
 
-	l.Info("updating resources if necessary", existingPV.Kind, existingPV.GetName())
-	patchDiff := client.MergeFrom(&existingPV)
-	if err = mergo.Merge(&existingPV, appPV, mergo.WithOverride); err != nil {
-		return subrec.Evaluate(subrec.RequeueWithError(err))
-	}
+		if apierrors.IsNotFound(err) {
+			// create the resource because it does not exist.
+			l.Info("creating resource", appPV.Kind, appPV.Name)
+			if err := r.Client.Create(ctx, &appPV); err != nil {
+				return subrec.Evaluate(subrec.RequeueWithError(err))
+			}
+		}
 
-	if err = r.Patch(ctx, &existingPV, patchDiff); err != nil {
-		return subrec.Evaluate(subrec.RequeueWithError(err))
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		l.Info("updating resources if necessary", existingPV.Kind, existingPV.GetName())
+		patchDiff := client.MergeFrom(&existingPV)
+		if err = mergo.Merge(&existingPV, appPV, mergo.WithOverride); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		if err = r.Patch(ctx, &existingPV, patchDiff); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
 	}
 
 	// app pvc
@@ -0,0 +1,201 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	"github.com/opdev/bookstack-operator/internal/bookstackapi"
+	subrec "github.com/opdev/subreconciler"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// auditBatchSize is the number of audit log entries read and forwarded
+	// at a time.
+	auditBatchSize = 100
+
+	// auditMaxBatches bounds the batches forwarded in one reconciliation,
+	// so a long backlog doesn't hold up the worker.
+	auditMaxBatches = 10
+
+	// auditBacklogDelay is how soon forwarding resumes when a backlog is
+	// left.
+	auditBacklogDelay = time.Second
+)
+
+// BookStackAuditForwarderReconciler forwards the BookStack audit log to
+// the configured sink, polling it through the API.
+type BookStackAuditForwarderReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Stdout receives the events forwarded to the Stdout sink. Defaults to
+	// os.Stdout.
+	Stdout io.Writer
+}
+
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks,verbs=get;list;watch
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+
+// Reconcile will forward the audit log entries logged since the last one
+// forwarded, in order. The cursor in status.auditForwarding only moves
+// past an entry once its sink accepted it, so each entry is delivered at
+// least once: entries are sent again if recording the cursor fails.
+func (r *BookStackAuditForwarderReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("audit forwarding reconciliation initiated.")
+	defer l.Info("audit forwarding reconciliation complete.")
+
+	var instance toolsv1alpha1.BookStack
+	err := r.Client.Get(ctx, req.NamespacedName, &instance)
+
+	if apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if instance.IsPaused() {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if instance.Spec.AuditForwarding == nil {
+		// forwarding is disabled, the cursor is kept in case it is
+		// enabled again.
+		if err = removeCondition(ctx, r.Client, &instance, toolsv1alpha1.ConditionAuditForwarding); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	interval := instance.AuditPollInterval()
+
+	if err = instance.ValidateAuditSink(); err != nil {
+		return r.reportForwarding(ctx, &instance, metav1.ConditionFalse, "InvalidSpec", err.Error(), 0)
+	}
+
+	api, reason, err := apiClient(ctx, r.Client, &instance)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if reason != "" {
+		return r.reportForwarding(ctx, &instance, metav1.ConditionFalse, "Waiting", reason, interval)
+	}
+
+	sink, err := newAuditSink(ctx, r.Client, &instance, r.Stdout)
+	if err != nil {
+		return r.reportForwarding(ctx, &instance, metav1.ConditionFalse, "SinkError", err.Error(), apiRetryInterval)
+	}
+
+	for batch := 0; batch < auditMaxBatches; batch++ {
+		entries, _, err := api.ListAuditLog(ctx, &bookstackapi.ListOptions{
+			Count:  auditBatchSize,
+			Sort:   "+id",
+			Filter: map[string]string{"id:gt": strconv.Itoa(instance.AuditCursor())},
+		})
+		if err != nil {
+			return r.reportForwarding(ctx, &instance, metav1.ConditionFalse, "APIError", err.Error(), apiRetryInterval)
+		}
+
+		if len(entries) == 0 {
+			return r.reportForwarding(ctx, &instance, metav1.ConditionTrue, "Forwarding", r.forwardingMessage(&instance), interval)
+		}
+
+		events := make([]auditEvent, 0, len(entries))
+		for _, entry := range entries {
+			events = append(events, auditEvent{Instance: instance.Name, Namespace: instance.Namespace, AuditLogEntry: entry})
+		}
+
+		if err = sink.send(ctx, events); err != nil {
+			return r.reportForwarding(ctx, &instance, metav1.ConditionFalse, "SinkError", err.Error(), apiRetryInterval)
+		}
+
+		last := entries[len(entries)-1]
+		l.Info("forwarded audit log entries", "count", len(entries), "lastEventID", last.ID)
+
+		err = patchStatus(ctx, r.Client, &instance, func(status *toolsv1alpha1.BookStackStatus) {
+			status.AuditForwarding = &toolsv1alpha1.AuditForwardingStatus{
+				LastEventID:     last.ID,
+				LastEventType:   last.Type,
+				LastEventTime:   &metav1.Time{Time: last.CreatedAt},
+				LastForwardTime: &metav1.Time{Time: time.Now()},
+			}
+		})
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		if len(entries) < auditBatchSize {
+			return r.reportForwarding(ctx, &instance, metav1.ConditionTrue, "Forwarding", r.forwardingMessage(&instance), interval)
+		}
+	}
+
+	// more entries are likely waiting, resume shortly.
+	return r.reportForwarding(ctx, &instance, metav1.ConditionTrue, "Forwarding", r.forwardingMessage(&instance), auditBacklogDelay)
+}
+
+// forwardingMessage describes the progress of forwarding.
+func (r *BookStackAuditForwarderReconciler) forwardingMessage(instance *toolsv1alpha1.BookStack) string {
+	sink := instance.Spec.AuditForwarding.Sink
+	if instance.AuditCursor() == 0 {
+		return fmt.Sprintf("no audit log entries forwarded to the %s sink yet", sink)
+	}
+
+	return fmt.Sprintf("audit log entries up to %d are forwarded to the %s sink", instance.AuditCursor(), sink)
+}
+
+// reportForwarding records the AuditForwarding condition, checking back
+// after requeueAfter, or only once the instance changes if it is zero.
+func (r *BookStackAuditForwarderReconciler) reportForwarding(ctx context.Context, instance *toolsv1alpha1.BookStack, status metav1.ConditionStatus, reason, message string, requeueAfter time.Duration) (ctrl.Result, error) {
+	err := setCondition(ctx, r.Client, instance, metav1.Condition{
+		Type:    toolsv1alpha1.ConditionAuditForwarding,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if requeueAfter == 0 {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	return subrec.Evaluate(subrec.RequeueWithDelay(requeueAfter))
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BookStackAuditForwarderReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&toolsv1alpha1.BookStack{}).
+		Complete(r)
+}
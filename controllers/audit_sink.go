@@ -0,0 +1,217 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	"github.com/opdev/bookstack-operator/internal/bookstackapi"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// auditSinkTimeout bounds how long a batch of events takes to deliver.
+const auditSinkTimeout = 30 * time.Second
+
+// auditEvent is an audit log entry as forwarded, tagged with the instance
+// it was read from.
+type auditEvent struct {
+	Instance  string `json:"instance"`
+	Namespace string `json:"namespace"`
+	bookstackapi.AuditLogEntry
+}
+
+// auditSink delivers batches of audit events. A batch is either delivered
+// as a whole or the error is returned, so the cursor only moves past
+// events that were delivered.
+type auditSink interface {
+	send(ctx context.Context, events []auditEvent) error
+}
+
+// newAuditSink returns the sink configured for the instance. Events sent
+// to the Stdout sink are written to stdout.
+func newAuditSink(ctx context.Context, c client.Client, instance *toolsv1alpha1.BookStack, stdout io.Writer) (auditSink, error) {
+	forwarding := instance.Spec.AuditForwarding
+	switch forwarding.Sink {
+	case toolsv1alpha1.AuditSinkSyslog:
+		protocol := forwarding.Syslog.Protocol
+		if protocol == "" {
+			protocol = "udp"
+		}
+
+		return &syslogSink{
+			address:  forwarding.Syslog.Address,
+			protocol: protocol,
+			hostname: fmt.Sprintf("%s.%s", instance.Name, instance.Namespace),
+		}, nil
+	case toolsv1alpha1.AuditSinkWebhook:
+		headers := http.Header{}
+		if ref := forwarding.Webhook.HeadersSecretRef; ref != nil {
+			var secret corev1.Secret
+			if err := c.Get(ctx, client.ObjectKey{Namespace: instance.Namespace, Name: ref.Name}, &secret); err != nil {
+				return nil, err
+			}
+
+			for name, value := range secret.Data {
+				headers.Set(name, string(value))
+			}
+		}
+
+		return &webhookSink{
+			url:        forwarding.Webhook.URL,
+			headers:    headers,
+			httpClient: &http.Client{Timeout: auditSinkTimeout},
+		}, nil
+	default:
+		if stdout == nil {
+			stdout = os.Stdout
+		}
+
+		return &writerSink{w: stdout}, nil
+	}
+}
+
+// writerSink writes each event as a JSON line.
+type writerSink struct {
+	w io.Writer
+}
+
+func (s *writerSink) send(_ context.Context, events []auditEvent) error {
+	var buf bytes.Buffer
+	if err := encodeEvents(&buf, events); err != nil {
+		return err
+	}
+
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+// syslogSink sends each event as an RFC 5424 message whose body is the
+// JSON event. Over UDP each message is a datagram, over TCP messages are
+// newline-delimited.
+type syslogSink struct {
+	address  string
+	protocol string
+	hostname string
+}
+
+// syslogPriority is the priority of the messages: facility local0,
+// severity informational.
+const syslogPriority = 16*8 + 6
+
+func (s *syslogSink) send(ctx context.Context, events []auditEvent) error {
+	dialer := net.Dialer{Timeout: auditSinkTimeout}
+	conn, err := dialer.DialContext(ctx, s.protocol, s.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(auditSinkTimeout)); err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		msg := fmt.Sprintf("<%d>1 %s %s bookstack - %s - %s",
+			syslogPriority, event.CreatedAt.UTC().Format(time.RFC3339), s.hostname, syslogMsgID(event.Type), body)
+		if s.protocol == "tcp" {
+			msg += "\n"
+		}
+
+		if _, err = io.WriteString(conn, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syslogMsgID returns the MSGID field for the activity, which must be a
+// non-empty token of at most 32 characters.
+func syslogMsgID(activity string) string {
+	if activity == "" {
+		return "-"
+	}
+	if len(activity) > 32 {
+		return activity[:32]
+	}
+
+	return activity
+}
+
+// webhookSink posts each batch of events as newline-delimited JSON. The
+// batch is delivered if the endpoint responds with a 2xx status.
+type webhookSink struct {
+	url        string
+	headers    http.Header
+	httpClient *http.Client
+}
+
+func (s *webhookSink) send(ctx context.Context, events []auditEvent) error {
+	var buf bytes.Buffer
+	if err := encodeEvents(&buf, events); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, &buf)
+	if err != nil {
+		return err
+	}
+
+	for name, values := range s.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// encodeEvents writes each event to w as a JSON line.
+func encodeEvents(w io.Writer, events []auditEvent) error {
+	enc := json.NewEncoder(w)
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
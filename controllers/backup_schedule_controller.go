@@ -0,0 +1,134 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	subrec "github.com/opdev/subreconciler"
+	batchv1 "k8s.io/api/batch/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// BookStackBackupScheduleReconciler reconciles the scheduled backup
+// CronJob and reports the outcome of its Jobs.
+type BookStackBackupScheduleReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks/finalizers,verbs=update
+//+kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=batch,resources=cronjobs/finalizers,verbs=update
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+
+// Reconcile will ensure that the backup CronJob for BookStack reaches
+// the desired state, and records the last successful backup.
+func (r *BookStackBackupScheduleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("backup schedule reconciliation initiated.")
+	defer l.Info("backup schedule reconciliation complete.")
+	bookstackInstanceKey := req.NamespacedName
+
+	// Get the BookStack instance to make sure it still exists.
+	var instance toolsv1alpha1.BookStack
+	err := r.Client.Get(ctx, bookstackInstanceKey, &instance)
+
+	if apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if instance.IsPaused() {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if instance.Spec.Backup == nil {
+		// backups are not scheduled, remove the CronJob if it exists.
+		if err = deleteCronJob(ctx, r.Client, instance.Namespace, instance.GetBackupCronJobName()); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err = applyCronJob(ctx, r.Client, r.Scheme, &instance, instance.NewBackupCronJob()); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	// the CronJob is applied first, so that failing to record the last
+	// backup never holds it up.
+	if err = r.recordLastBackup(ctx, &instance); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue()) // success
+}
+
+// recordLastBackup records the most recent successful and failed scheduled
+// backups in the instance status.
+func (r *BookStackBackupScheduleReconciler) recordLastBackup(ctx context.Context, instance *toolsv1alpha1.BookStack) error {
+	var last scheduleResult
+	if status := instance.Status.Backup; status != nil {
+		last = scheduleResult{
+			SuccessTime:    status.LastSuccessfulBackupTime,
+			SizeBytes:      status.LastBackupSizeBytes,
+			Location:       status.LastBackupLocation,
+			FailureTime:    status.LastFailedBackupTime,
+			FailureMessage: status.LastFailureMessage,
+		}
+	}
+
+	next, changed, err := lastScheduleResult(ctx, r.Client, instance, instance.GetBackupCronJobName(), last)
+	if err != nil || !changed {
+		return err
+	}
+
+	return patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+		status.Backup = &toolsv1alpha1.BackupStatus{
+			LastSuccessfulBackupTime: next.SuccessTime,
+			LastBackupSizeBytes:      next.SizeBytes,
+			LastBackupLocation:       next.Location,
+			LastFailedBackupTime:     next.FailureTime,
+			LastFailureMessage:       next.FailureMessage,
+		}
+	})
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BookStackBackupScheduleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&toolsv1alpha1.BookStack{}).
+		Owns(&batchv1.CronJob{}).
+		// Jobs are owned by the CronJob, so map them to their instance
+		// by label.
+		Watches(&source.Kind{Type: &batchv1.Job{}}, handler.EnqueueRequestsFromMapFunc(instanceForLabeledObject)).
+		Complete(r)
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	"github.com/opdev/bookstack-operator/internal/bookstackapi"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// apiResyncInterval is how often the resources synced through the
+	// BookStack API are checked for drift.
+	apiResyncInterval = 10 * time.Minute
+
+	// apiRetryInterval is how long a sync waits for the BookStack API to
+	// become usable, or before retrying a failed request.
+	apiRetryInterval = time.Minute
+)
+
+// apiClient returns a client for the BookStack API of the instance,
+// authenticated with the operator's API token. If the API can't be used
+// yet, it returns a nil client and the reason.
+func apiClient(ctx context.Context, c client.Client, instance *toolsv1alpha1.BookStack) (*bookstackapi.Client, string, error) {
+	switch {
+	case instance.IsPaused():
+		return nil, fmt.Sprintf("reconciliation of BookStack %s is paused", instance.Name), nil
+	case instance.IsSuspended():
+		return nil, fmt.Sprintf("BookStack %s is suspended", instance.Name), nil
+	case instance.InMaintenance():
+		return nil, fmt.Sprintf("BookStack %s is in maintenance mode", instance.Name), nil
+	case !instance.AdminBootstrapped():
+		// the Service doesn't route to BookStack until then.
+		return nil, fmt.Sprintf("the admin account of BookStack %s is not bootstrapped", instance.Name), nil
+	case !meta.IsStatusConditionTrue(instance.Status.Conditions, toolsv1alpha1.ConditionAPITokenReady):
+		return nil, fmt.Sprintf("the API token of BookStack %s is not ready", instance.Name), nil
+	}
+
+	var secret corev1.Secret
+	if err := c.Get(ctx, client.ObjectKey{Namespace: instance.Namespace, Name: instance.GetAPITokenSecretName()}, &secret); err != nil {
+		return nil, "", err
+	}
+
+	tokenID := string(secret.Data[toolsv1alpha1.APITokenIDKey])
+	tokenSecret := string(secret.Data[toolsv1alpha1.APITokenSecretKey])
+	if tokenID == "" || tokenSecret == "" {
+		return nil, fmt.Sprintf("secret %s holds no API token", secret.Name), nil
+	}
+
+	api, err := bookstackapi.NewClient(instance.APIURL(), tokenID, tokenSecret)
+	return api, "", err
+}
+
+// referencesInstance maps the instance obj to the objects of the list type
+// referencing it.
+func referencesInstance(c client.Client, list client.ObjectList, obj client.Object) []reconcile.Request {
+	if err := c.List(context.Background(), list, client.InNamespace(obj.GetNamespace())); err != nil {
+		return nil
+	}
+
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, item := range items {
+		synced, ok := item.(instanceReferrer)
+		if ok && synced.InstanceName() == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(synced)})
+		}
+	}
+
+	return requests
+}
+
+// instanceReferrer is a resource referencing a BookStack instance.
+type instanceReferrer interface {
+	client.Object
+	InstanceName() string
+}
+
+// sameIDs returns true if a and b hold the same IDs, in any order.
+func sameIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	seen := map[int]int{}
+	for _, id := range a {
+		seen[id]++
+	}
+	for _, id := range b {
+		if seen[id] == 0 {
+			return false
+		}
+		seen[id]--
+	}
+
+	return true
+}
@@ -0,0 +1,371 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	subrec "github.com/opdev/subreconciler"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// backupCleanupRetryInterval is how long a failed cleanup Job is kept
+// before the archive deletion is retried.
+const backupCleanupRetryInterval = 5 * time.Minute
+
+// BookStackBackupReconciler reconciles a BookStackBackup object
+type BookStackBackupReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackbackups,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackbackups/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackbackups/finalizers,verbs=update
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+
+// Reconcile will run the backup Job requested by a BookStackBackup and
+// record its outcome, deleting the archive along with the
+// BookStackBackup if requested.
+func (r *BookStackBackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("backup reconciliation initiated.")
+	defer l.Info("backup reconciliation complete.")
+
+	var backup toolsv1alpha1.BookStackBackup
+	err := r.Client.Get(ctx, req.NamespacedName, &backup)
+
+	if apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if !backup.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, &backup)
+	}
+
+	// keep the finalizer in line with spec.deleteArtifacts.
+	hasFinalizer := controllerutil.ContainsFinalizer(&backup, toolsv1alpha1.BackupArtifactsFinalizer)
+	if backup.Spec.DeleteArtifacts != hasFinalizer {
+		if backup.Spec.DeleteArtifacts {
+			controllerutil.AddFinalizer(&backup, toolsv1alpha1.BackupArtifactsFinalizer)
+		} else {
+			controllerutil.RemoveFinalizer(&backup, toolsv1alpha1.BackupArtifactsFinalizer)
+		}
+
+		if err = r.Client.Update(ctx, &backup); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	// a snapshot in progress keeps its instance quiesced, which the
+	// finalizer undoes if the backup is deleted before it finished.
+	quiescing := backup.IsSnapshot() && !backup.IsFinished()
+	if quiescing != controllerutil.ContainsFinalizer(&backup, toolsv1alpha1.SnapshotFinalizer) {
+		if quiescing {
+			controllerutil.AddFinalizer(&backup, toolsv1alpha1.SnapshotFinalizer)
+		} else {
+			controllerutil.RemoveFinalizer(&backup, toolsv1alpha1.SnapshotFinalizer)
+		}
+
+		if err = r.Client.Update(ctx, &backup); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	if backup.IsFinished() {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err = backup.ValidateTarget(); err != nil {
+		err = patchBackupStatus(ctx, r.Client, &backup, func(status *toolsv1alpha1.BookStackBackupStatus) {
+			status.Phase = toolsv1alpha1.BackupPhaseFailed
+			status.Message = err.Error()
+		})
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if backup.IsSnapshot() {
+		return r.reconcileSnapshot(ctx, &backup)
+	}
+
+	var existing batchv1.Job
+	err = r.Client.Get(ctx, req.NamespacedName, &existing)
+
+	if apierrors.IsNotFound(err) {
+		return r.startBackup(ctx, &backup)
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return r.recordOutcome(ctx, &backup, &existing)
+}
+
+// startBackup creates the backup Job for the referenced instance.
+func (r *BookStackBackupReconciler) startBackup(ctx context.Context, backup *toolsv1alpha1.BookStackBackup) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	var instance toolsv1alpha1.BookStack
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: backup.Namespace, Name: backup.Spec.BookStackRef.Name}, &instance)
+
+	if apierrors.IsNotFound(err) {
+		// the instance may not have been created yet, check back later.
+		return r.wait(ctx, backup, fmt.Sprintf("BookStack %s not found", backup.Spec.BookStackRef.Name))
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if instance.IsPaused() {
+		return r.wait(ctx, backup, fmt.Sprintf("BookStack %s is paused", instance.Name))
+	}
+
+	if instance.IsSuspended() {
+		return r.wait(ctx, backup, fmt.Sprintf("BookStack %s is suspended", instance.Name))
+	}
+
+	// record the image the instance runs, so that restores can tell which
+	// BookStack version the backup came from.
+	var deployment appsv1.Deployment
+	err = r.Client.Get(ctx, client.ObjectKeyFromObject(&instance), &deployment)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	appImage := appImageOf(&deployment)
+
+	// record the data layout, so that the cleanup Job can run as the
+	// backup did once the instance is gone.
+	layout := toolsv1alpha1.DataLayoutStandard
+	if instance.IsHardened() {
+		layout = toolsv1alpha1.DataLayoutHardened
+	}
+
+	new := instance.NewBackupJob(backup)
+
+	err = ctrl.SetControllerReference(backup, &new, r.Scheme)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	l.Info("creating resource", new.Kind, new.Name)
+	if err = r.Client.Create(ctx, &new); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	err = patchBackupStatus(ctx, r.Client, backup, func(status *toolsv1alpha1.BookStackBackupStatus) {
+		now := metav1.Now()
+		status.Phase = toolsv1alpha1.BackupPhaseRunning
+		status.Message = ""
+		status.StartTime = &now
+		status.AppImage = appImage
+		status.DataLayout = layout
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// recordOutcome records the result of the backup Job once it finished.
+func (r *BookStackBackupReconciler) recordOutcome(ctx context.Context, backup *toolsv1alpha1.BookStackBackup, job *batchv1.Job) (ctrl.Result, error) {
+	if failed := jobFailure(job); failed != "" {
+		err := patchBackupStatus(ctx, r.Client, backup, func(status *toolsv1alpha1.BookStackBackupStatus) {
+			now := metav1.Now()
+			status.Phase = toolsv1alpha1.BackupPhaseFailed
+			status.Message = failed
+			status.CompletionTime = &now
+		})
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if job.Status.Succeeded == 0 {
+		// the Job is still running.
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	message, err := jobResult(ctx, r.Client, job, toolsv1alpha1.BackupResultContainer)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	result, err := toolsv1alpha1.ParseBackupResult(message)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	err = patchBackupStatus(ctx, r.Client, backup, func(status *toolsv1alpha1.BookStackBackupStatus) {
+		status.Phase = toolsv1alpha1.BackupPhaseCompleted
+		status.Message = ""
+		status.CompletionTime = job.Status.CompletionTime
+		status.SizeBytes = result.SizeBytes
+		status.Location = result.Location
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// finalize resumes the instance a snapshot quiesced, then deletes the
+// backup archive with a cleanup Job and removes the finalizer once the Job
+// succeeded. A failed cleanup is reported and retried, unless
+// spec.deleteArtifacts is unset in the meantime or the namespace is
+// terminating, in which case the archive is left behind.
+func (r *BookStackBackupReconciler) finalize(ctx context.Context, backup *toolsv1alpha1.BookStackBackup) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if controllerutil.ContainsFinalizer(backup, toolsv1alpha1.SnapshotFinalizer) {
+		if err := r.releaseSnapshot(ctx, backup); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	if !controllerutil.ContainsFinalizer(backup, toolsv1alpha1.BackupArtifactsFinalizer) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	// there is nothing to delete if the backup never completed.
+	if backup.Status.Location != "" && backup.Spec.DeleteArtifacts {
+		new := backup.NewCleanupJob()
+
+		err := ctrl.SetControllerReference(backup, &new, r.Scheme)
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		var existing batchv1.Job
+		err = r.Client.Get(ctx, client.ObjectKeyFromObject(&new), &existing)
+
+		switch {
+		case apierrors.IsNotFound(err):
+			l.Info("creating resource", new.Kind, new.Name)
+			err = r.Client.Create(ctx, &new)
+
+			if !apierrors.HasStatusCause(err, corev1.NamespaceTerminatingCause) {
+				if err != nil {
+					return subrec.Evaluate(subrec.RequeueWithError(err))
+				}
+
+				return subrec.Evaluate(subrec.DoNotRequeue())
+			}
+
+			// no Job can run in a terminating namespace, so the finalizer
+			// would never be removed.
+			l.Error(err, "leaving backup artifacts behind in a terminating namespace", "location", backup.Status.Location)
+		case err != nil:
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		case jobFailure(&existing) != "":
+			return r.retryCleanup(ctx, backup, &existing)
+		case existing.Status.Succeeded == 0:
+			// the cleanup Job is still running.
+			return subrec.Evaluate(subrec.DoNotRequeue())
+		}
+	}
+
+	controllerutil.RemoveFinalizer(backup, toolsv1alpha1.BackupArtifactsFinalizer)
+	if err := r.Client.Update(ctx, backup); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// retryCleanup reports the failure of the cleanup Job on the backup and
+// creates the Job again after backupCleanupRetryInterval.
+func (r *BookStackBackupReconciler) retryCleanup(ctx context.Context, backup *toolsv1alpha1.BookStackBackup, job *batchv1.Job) (ctrl.Result, error) {
+	err := patchBackupStatus(ctx, r.Client, backup, func(status *toolsv1alpha1.BookStackBackupStatus) {
+		status.Message = fmt.Sprintf("unable to delete %s: %s", backup.Status.Location, jobFailure(job))
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	wait, err := retryFailedJob(ctx, r.Client, job, backupCleanupRetryInterval)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if wait == 0 {
+		// the Job's deletion triggers its creation again.
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	return subrec.Evaluate(subrec.RequeueWithDelay(wait))
+}
+
+// wait marks the backup as pending for the reason in message, checking
+// back later.
+func (r *BookStackBackupReconciler) wait(ctx context.Context, backup *toolsv1alpha1.BookStackBackup, message string) (ctrl.Result, error) {
+	err := patchBackupStatus(ctx, r.Client, backup, func(status *toolsv1alpha1.BookStackBackupStatus) {
+		status.Phase = toolsv1alpha1.BackupPhasePending
+		status.Message = message
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.RequeueWithDelay(30 * time.Second))
+}
+
+// patchBackupStatus applies mutate to the backup status and patches the
+// status subresource.
+func patchBackupStatus(ctx context.Context, c client.Client, backup *toolsv1alpha1.BookStackBackup, mutate func(*toolsv1alpha1.BookStackBackupStatus)) error {
+	patch := client.MergeFrom(backup.DeepCopy())
+	mutate(&backup.Status)
+
+	return c.Status().Patch(ctx, backup, patch)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BookStackBackupReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&toolsv1alpha1.BookStackBackup{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
@@ -0,0 +1,418 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	subrec "github.com/opdev/subreconciler"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// snapshotPollInterval is how often the backup controller checks on the
+// quiesced instance and its VolumeSnapshots. These aren't watched, as the
+// VolumeSnapshot API is optional.
+const snapshotPollInterval = 2 * time.Second
+
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create;delete
+
+// reconcileSnapshot takes a Snapshot mode backup: it quiesces the
+// instance, snapshots its volumes, resumes it and waits for the
+// snapshots to become ready.
+func (r *BookStackBackupReconciler) reconcileSnapshot(ctx context.Context, backup *toolsv1alpha1.BookStackBackup) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	var instance toolsv1alpha1.BookStack
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: backup.Namespace, Name: backup.Spec.BookStackRef.Name}, &instance)
+
+	if apierrors.IsNotFound(err) {
+		// the instance may not have been created yet, check back later.
+		return r.wait(ctx, backup, fmt.Sprintf("BookStack %s not found", backup.Spec.BookStackRef.Name))
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	// a backup already under way is finished, as the instance may be
+	// quiesced.
+	if instance.IsSuspended() && backup.Status.Phase != toolsv1alpha1.BackupPhaseRunning {
+		return r.wait(ctx, backup, fmt.Sprintf("BookStack %s is suspended", instance.Name))
+	}
+
+	// scaling down relies on the deployment controller, which skips paused
+	// instances.
+	if instance.IsPaused() && backup.ScalesDown() && backup.Status.Phase != toolsv1alpha1.BackupPhaseRunning {
+		return r.wait(ctx, backup, fmt.Sprintf("reconciliation of BookStack %s is paused", instance.Name))
+	}
+
+	if backup.Status.Phase != toolsv1alpha1.BackupPhaseRunning {
+		var deployment appsv1.Deployment
+		err = r.Client.Get(ctx, client.ObjectKeyFromObject(&instance), &deployment)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		err = patchBackupStatus(ctx, r.Client, backup, func(status *toolsv1alpha1.BookStackBackupStatus) {
+			now := metav1.Now()
+			status.Phase = toolsv1alpha1.BackupPhaseRunning
+			status.Message = "quiescing the instance"
+			status.StartTime = &now
+			status.AppImage = appImageOf(&deployment)
+		})
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	snapshots := instance.NewVolumeSnapshots(backup)
+
+	// the instance only needs to be quiesced until the snapshots are cut.
+	if backup.Status.AppSnapshotName == "" {
+		quiesced, failure, err := r.quiesce(ctx, backup, &instance)
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		if failure != "" {
+			return r.failSnapshot(ctx, backup, &instance, failure)
+		}
+
+		if !quiesced {
+			return subrec.Evaluate(subrec.RequeueWithDelay(snapshotPollInterval))
+		}
+
+		cut := true
+		for i := range snapshots {
+			new := &snapshots[i]
+
+			err = ctrl.SetControllerReference(backup, new, r.Scheme)
+			if err != nil {
+				return subrec.Evaluate(subrec.RequeueWithError(err))
+			}
+
+			var existing snapshotv1.VolumeSnapshot
+			err = r.Client.Get(ctx, client.ObjectKeyFromObject(new), &existing)
+
+			if apierrors.IsNotFound(err) {
+				l.Info("creating resource", "VolumeSnapshot", new.Name)
+				if err := r.Client.Create(ctx, new); err != nil {
+					return subrec.Evaluate(subrec.RequeueWithError(err))
+				}
+
+				cut = false
+				continue
+			}
+
+			if meta.IsNoMatchError(err) {
+				return r.failSnapshot(ctx, backup, &instance, "the VolumeSnapshot API is not installed in the cluster")
+			}
+
+			if err != nil {
+				return subrec.Evaluate(subrec.RequeueWithError(err))
+			}
+
+			if failure := snapshotFailure(&existing); failure != "" {
+				return r.failSnapshot(ctx, backup, &instance, failure)
+			}
+
+			if existing.Status == nil || existing.Status.CreationTime == nil {
+				cut = false
+			}
+		}
+
+		if !cut {
+			return subrec.Evaluate(subrec.RequeueWithDelay(snapshotPollInterval))
+		}
+
+		if err = r.resume(ctx, backup, &instance); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		err = patchBackupStatus(ctx, r.Client, backup, func(status *toolsv1alpha1.BookStackBackupStatus) {
+			status.Message = "waiting for the snapshots to become ready"
+			status.AppSnapshotName = snapshots[0].Name
+			status.DBSnapshotName = snapshots[1].Name
+		})
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	var size int64
+	for i := range snapshots {
+		var existing snapshotv1.VolumeSnapshot
+		if err = r.Client.Get(ctx, client.ObjectKeyFromObject(&snapshots[i]), &existing); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		if failure := snapshotFailure(&existing); failure != "" {
+			return r.failSnapshot(ctx, backup, &instance, failure)
+		}
+
+		if existing.Status == nil || existing.Status.ReadyToUse == nil || !*existing.Status.ReadyToUse {
+			return subrec.Evaluate(subrec.RequeueWithDelay(snapshotPollInterval))
+		}
+
+		if existing.Status.RestoreSize != nil {
+			size += existing.Status.RestoreSize.Value()
+		}
+	}
+
+	err = patchBackupStatus(ctx, r.Client, backup, func(status *toolsv1alpha1.BookStackBackupStatus) {
+		now := metav1.Now()
+		status.Phase = toolsv1alpha1.BackupPhaseCompleted
+		status.Message = ""
+		status.CompletionTime = &now
+		status.SizeBytes = size
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if err = r.pruneSnapshots(ctx, backup); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// quiesce stops writes to the instance, either by scaling it to zero or by
+// holding a read lock on its database. It returns whether the instance is
+// quiesced, or the reason it can't be.
+func (r *BookStackBackupReconciler) quiesce(ctx context.Context, backup *toolsv1alpha1.BookStackBackup, instance *toolsv1alpha1.BookStack) (bool, string, error) {
+	l := log.FromContext(ctx)
+
+	if backup.ScalesDown() {
+		if err := releaseStaleSnapshot(ctx, r.Client, instance); err != nil {
+			return false, "", err
+		}
+
+		for _, annotation := range []string{toolsv1alpha1.RestoreInProgressAnnotation, toolsv1alpha1.RestoreMigratingAnnotation, toolsv1alpha1.SnapshotInProgressAnnotation} {
+			if owner, ok := instance.Annotations[annotation]; ok && owner != backup.Name {
+				// a restore or another snapshot is under way.
+				return false, "", nil
+			}
+		}
+
+		if _, ok := instance.Annotations[toolsv1alpha1.SnapshotInProgressAnnotation]; !ok {
+			patch := client.MergeFrom(instance.DeepCopy())
+			metav1.SetMetaDataAnnotation(&instance.ObjectMeta, toolsv1alpha1.SnapshotInProgressAnnotation, backup.Name)
+			if err := r.Client.Patch(ctx, instance, patch); err != nil {
+				return false, "", err
+			}
+		}
+
+		var deployment appsv1.Deployment
+		err := r.Client.Get(ctx, client.ObjectKeyFromObject(instance), &deployment)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return false, "", err
+		}
+
+		return deployment.Status.Replicas == 0, "", nil
+	}
+
+	new := instance.NewDBLockJob(backup)
+
+	err := ctrl.SetControllerReference(backup, &new, r.Scheme)
+	if err != nil {
+		return false, "", err
+	}
+
+	var existing batchv1.Job
+	err = r.Client.Get(ctx, client.ObjectKeyFromObject(&new), &existing)
+
+	if apierrors.IsNotFound(err) {
+		l.Info("creating resource", new.Kind, new.Name)
+		return false, "", r.Client.Create(ctx, &new)
+	}
+
+	if err != nil {
+		return false, "", err
+	}
+
+	if failure := jobFailure(&existing); failure != "" {
+		return false, failure, nil
+	}
+
+	var pods corev1.PodList
+	if err = r.Client.List(ctx, &pods,
+		client.InNamespace(existing.Namespace),
+		client.MatchingLabels{"job-name": existing.Name},
+	); err != nil {
+		return false, "", err
+	}
+
+	// the lock pod turns ready once it holds the lock.
+	for _, pod := range pods.Items {
+		for _, c := range pod.Status.Conditions {
+			if c.Type == corev1.PodReady && c.Status == corev1.ConditionTrue {
+				return true, "", nil
+			}
+		}
+	}
+
+	return false, "", nil
+}
+
+// resume undoes quiesce.
+func (r *BookStackBackupReconciler) resume(ctx context.Context, backup *toolsv1alpha1.BookStackBackup, instance *toolsv1alpha1.BookStack) error {
+	if backup.ScalesDown() {
+		if instance.Annotations[toolsv1alpha1.SnapshotInProgressAnnotation] != backup.Name {
+			return nil
+		}
+
+		patch := client.MergeFrom(instance.DeepCopy())
+		delete(instance.Annotations, toolsv1alpha1.SnapshotInProgressAnnotation)
+		return r.Client.Patch(ctx, instance, patch)
+	}
+
+	// deleting the lock Job ends its DB session, releasing the lock.
+	lock := instance.NewDBLockJob(backup)
+	err := r.Client.Delete(ctx, &lock, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+// releaseSnapshot resumes the instance of the deleted backup, if it still
+// exists, and removes the snapshot finalizer.
+func (r *BookStackBackupReconciler) releaseSnapshot(ctx context.Context, backup *toolsv1alpha1.BookStackBackup) error {
+	var instance toolsv1alpha1.BookStack
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: backup.Namespace, Name: backup.Spec.BookStackRef.Name}, &instance)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	if err == nil {
+		if err = r.resume(ctx, backup, &instance); err != nil {
+			return err
+		}
+	}
+
+	controllerutil.RemoveFinalizer(backup, toolsv1alpha1.SnapshotFinalizer)
+	return r.Client.Update(ctx, backup)
+}
+
+// releaseStaleSnapshot removes the SnapshotInProgressAnnotation of the
+// instance if the BookStackBackup owning it is gone or finished, as it
+// would otherwise keep the instance scaled to zero.
+func releaseStaleSnapshot(ctx context.Context, c client.Client, instance *toolsv1alpha1.BookStack) error {
+	owner, ok := instance.Annotations[toolsv1alpha1.SnapshotInProgressAnnotation]
+	if !ok {
+		return nil
+	}
+
+	var backup toolsv1alpha1.BookStackBackup
+	err := c.Get(ctx, client.ObjectKey{Namespace: instance.Namespace, Name: owner}, &backup)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	if err == nil && !backup.IsFinished() {
+		return nil
+	}
+
+	log.FromContext(ctx).Info("releasing the snapshot lock of a finished backup", "BookStackBackup", owner)
+	patch := client.MergeFrom(instance.DeepCopy())
+	delete(instance.Annotations, toolsv1alpha1.SnapshotInProgressAnnotation)
+	return c.Patch(ctx, instance, patch)
+}
+
+// failSnapshot resumes the instance and marks the backup as failed.
+func (r *BookStackBackupReconciler) failSnapshot(ctx context.Context, backup *toolsv1alpha1.BookStackBackup, instance *toolsv1alpha1.BookStack, message string) (ctrl.Result, error) {
+	if err := r.resume(ctx, backup, instance); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	err := patchBackupStatus(ctx, r.Client, backup, func(status *toolsv1alpha1.BookStackBackupStatus) {
+		now := metav1.Now()
+		status.Phase = toolsv1alpha1.BackupPhaseFailed
+		status.Message = message
+		status.CompletionTime = &now
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// pruneSnapshots deletes the oldest completed Snapshot mode backups of the
+// instance beyond the retention count of backup. Their VolumeSnapshots are
+// garbage collected along with them.
+func (r *BookStackBackupReconciler) pruneSnapshots(ctx context.Context, backup *toolsv1alpha1.BookStackBackup) error {
+	l := log.FromContext(ctx)
+
+	retention := backup.SnapshotRetention()
+	if retention == 0 {
+		return nil
+	}
+
+	var backups toolsv1alpha1.BookStackBackupList
+	if err := r.Client.List(ctx, &backups, client.InNamespace(backup.Namespace)); err != nil {
+		return err
+	}
+
+	var completed []toolsv1alpha1.BookStackBackup
+	for _, b := range backups.Items {
+		if b.Spec.BookStackRef.Name == backup.Spec.BookStackRef.Name && b.IsSnapshot() &&
+			b.Status.Phase == toolsv1alpha1.BackupPhaseCompleted && b.Status.CompletionTime != nil {
+			completed = append(completed, b)
+		}
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return completed[i].Status.CompletionTime.After(completed[j].Status.CompletionTime.Time)
+	})
+
+	for i := retention; i < len(completed); i++ {
+		l.Info("deleting resource beyond retention", "BookStackBackup", completed[i].Name)
+		if err := r.Client.Delete(ctx, &completed[i]); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapshotFailure returns the error reported by a VolumeSnapshot, or an
+// empty string if it has not failed.
+func snapshotFailure(snapshot *snapshotv1.VolumeSnapshot) string {
+	if snapshot.Status == nil || snapshot.Status.Error == nil || snapshot.Status.Error.Message == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("VolumeSnapshot %s failed: %s", snapshot.Name, *snapshot.Status.Error.Message)
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// snapshotBackup returns a running ScaleDown Snapshot mode backup of the
+// wiki instance.
+func snapshotBackup(name string) *toolsv1alpha1.BookStackBackup {
+	return &toolsv1alpha1.BookStackBackup{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "docs"},
+		Spec: toolsv1alpha1.BookStackBackupSpec{
+			BookStackRef: corev1.LocalObjectReference{Name: "wiki"},
+			Mode:         toolsv1alpha1.BackupModeSnapshot,
+			Snapshot:     &toolsv1alpha1.SnapshotOptions{Quiesce: toolsv1alpha1.QuiesceScaleDown},
+		},
+		Status: toolsv1alpha1.BookStackBackupStatus{Phase: toolsv1alpha1.BackupPhaseRunning},
+	}
+}
+
+func TestReleaseStaleSnapshot(t *testing.T) {
+	finished := snapshotBackup("finished")
+	finished.Status.Phase = toolsv1alpha1.BackupPhaseFailed
+
+	tests := []struct {
+		name     string
+		owner    string
+		wantKept bool
+	}{
+		{name: "running backup", owner: "running", wantKept: true},
+		{name: "finished backup", owner: "finished"},
+		{name: "deleted backup", owner: "deleted"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := &toolsv1alpha1.BookStack{ObjectMeta: metav1.ObjectMeta{
+				Name:        "wiki",
+				Namespace:   "docs",
+				Annotations: map[string]string{toolsv1alpha1.SnapshotInProgressAnnotation: tt.owner},
+			}}
+
+			c := fake.NewClientBuilder().WithScheme(testScheme()).
+				WithObjects(instance, snapshotBackup("running"), finished).Build()
+
+			ctx := context.Background()
+			if err := releaseStaleSnapshot(ctx, c, instance); err != nil {
+				t.Fatalf("releaseStaleSnapshot() error = %v", err)
+			}
+
+			if err := c.Get(ctx, client.ObjectKeyFromObject(instance), instance); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, kept := instance.Annotations[toolsv1alpha1.SnapshotInProgressAnnotation]; kept != tt.wantKept {
+				t.Errorf("annotation kept = %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestSnapshotFinalizer(t *testing.T) {
+	instance := &toolsv1alpha1.BookStack{ObjectMeta: metav1.ObjectMeta{
+		Name:        "wiki",
+		Namespace:   "docs",
+		Annotations: map[string]string{toolsv1alpha1.SnapshotInProgressAnnotation: "nightly"},
+	}}
+
+	now := metav1.Now()
+	backup := snapshotBackup("nightly")
+	backup.Finalizers = []string{toolsv1alpha1.SnapshotFinalizer}
+	backup.DeletionTimestamp = &now
+
+	scheme := testScheme()
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(instance, backup).Build()
+	r := &BookStackBackupReconciler{Client: c, Scheme: scheme}
+
+	ctx := context.Background()
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(backup)}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	if err := c.Get(ctx, client.ObjectKeyFromObject(instance), instance); err != nil {
+		t.Fatal(err)
+	}
+
+	if owner, ok := instance.Annotations[toolsv1alpha1.SnapshotInProgressAnnotation]; ok {
+		t.Errorf("annotation is still set to %s", owner)
+	}
+}
+
+// testScheme returns a scheme holding the Kubernetes and the operator's
+// types.
+func testScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = toolsv1alpha1.AddToScheme(scheme)
+
+	return scheme
+}
@@ -0,0 +1,279 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	"github.com/opdev/bookstack-operator/internal/bookstackapi"
+	subrec "github.com/opdev/subreconciler"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// BookStackBookReconciler reconciles a BookStackBook object
+type BookStackBookReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackbooks,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackbooks/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackbooks/finalizers,verbs=update
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch
+
+// Reconcile will create the book in BookStack, or adopt the existing book
+// with its name, and apply the spec, cover image and permissions to it.
+// Once synced, the book is followed by the ID in its status, so renaming it
+// doesn't create another book. Changes made to the book in BookStack are
+// reverted. The book is deleted from BookStack along with the BookStackBook
+// only if the deletion policy is Delete.
+func (r *BookStackBookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("book reconciliation initiated.")
+	defer l.Info("book reconciliation complete.")
+
+	var book toolsv1alpha1.BookStackBook
+	err := r.Client.Get(ctx, req.NamespacedName, &book)
+
+	if apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if !book.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, &book)
+	}
+
+	if !controllerutil.ContainsFinalizer(&book, toolsv1alpha1.SyncFinalizer) {
+		controllerutil.AddFinalizer(&book, toolsv1alpha1.SyncFinalizer)
+		if err = r.Client.Update(ctx, &book); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	var instance toolsv1alpha1.BookStack
+	err = r.Client.Get(ctx, client.ObjectKey{Namespace: book.Namespace, Name: book.Spec.BookStackRef.Name}, &instance)
+
+	if apierrors.IsNotFound(err) {
+		return waitToSync(ctx, r.Client, &book, fmt.Sprintf("BookStack %s not found", book.Spec.BookStackRef.Name))
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	api, reason, err := apiClient(ctx, r.Client, &instance)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if reason != "" {
+		return waitToSync(ctx, r.Client, &book, reason)
+	}
+
+	return r.sync(ctx, &book, api)
+}
+
+// sync creates or adopts the book and applies the spec to it.
+func (r *BookStackBookReconciler) sync(ctx context.Context, book *toolsv1alpha1.BookStackBook, api *bookstackapi.Client) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	existing, err := r.findBook(ctx, api, book)
+	if err != nil {
+		return syncFailed(ctx, r.Client, book, err)
+	}
+
+	desired := bookstackapi.BookRequest{
+		Name:        book.Spec.Name,
+		Description: book.Spec.Description,
+		Tags:        contentTags(book.Spec.Tags),
+	}
+
+	adopted := book.Status.Adopted
+	switch {
+	case existing == nil:
+		l.Info("creating BookStack book", "name", desired.Name)
+		if existing, err = api.CreateBook(ctx, desired); err != nil {
+			return syncFailed(ctx, r.Client, book, err)
+		}
+	case bookChanged(existing, desired):
+		if book.Status.ID == 0 {
+			adopted = true
+		}
+
+		l.Info("updating BookStack book", "id", existing.ID)
+		if existing, err = api.UpdateBook(ctx, existing.ID, desired); err != nil {
+			return syncFailed(ctx, r.Client, book, err)
+		}
+	case book.Status.ID == 0:
+		adopted = true
+	}
+
+	// the ID is recorded first, so that a rename follows the book even if
+	// the rest of the sync fails.
+	err = patchSyncedStatus(ctx, r.Client, book, func() {
+		book.Status.ID = existing.ID
+		book.Status.Slug = existing.Slug
+		book.Status.Adopted = adopted
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	coverHash := ""
+	if book.Spec.Cover != nil {
+		image, hash, reason, err := coverImage(ctx, r.Client, book.Namespace, book.Spec.Cover)
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		if reason != "" {
+			return waitToSync(ctx, r.Client, book, reason)
+		}
+
+		if hash != book.Status.CoverHash || existing.Cover == nil {
+			l.Info("uploading BookStack book cover", "id", existing.ID)
+			if _, err = api.SetBookCover(ctx, existing.ID, book.Spec.Cover.Key, image); err != nil {
+				return syncFailed(ctx, r.Client, book, err)
+			}
+		}
+		coverHash = hash
+	}
+
+	if book.Spec.Permissions != nil {
+		reason, err := syncContentPermissions(ctx, api, bookstackapi.ContentTypeBook, existing.ID, book.Spec.Permissions)
+		if err != nil {
+			return syncFailed(ctx, r.Client, book, err)
+		}
+
+		if reason != "" {
+			return waitToSync(ctx, r.Client, book, reason)
+		}
+	}
+
+	err = patchSyncedStatus(ctx, r.Client, book, func() {
+		now := metav1.Now()
+		book.Status.CoverHash = coverHash
+		book.Status.LastSyncTime = &now
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return reportSynced(ctx, r.Client, book, metav1.ConditionTrue, "Synced", fmt.Sprintf("book %d is in sync", existing.ID), apiResyncInterval)
+}
+
+// findBook returns the book recorded in the status or, if it is gone, the
+// book with the name. It returns nil if neither exists.
+func (r *BookStackBookReconciler) findBook(ctx context.Context, api *bookstackapi.Client, book *toolsv1alpha1.BookStackBook) (*bookstackapi.Book, error) {
+	if book.Status.ID != 0 {
+		existing, err := api.GetBook(ctx, book.Status.ID)
+		if err == nil || !bookstackapi.IsNotFound(err) {
+			return existing, err
+		}
+	}
+
+	books, _, err := api.ListBooks(ctx, &bookstackapi.ListOptions{Filter: map[string]string{"name": book.Spec.Name}})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range books {
+		if b.Name == book.Spec.Name {
+			// the listing leaves out the tags of the book.
+			return api.GetBook(ctx, b.ID)
+		}
+	}
+
+	return nil, nil
+}
+
+// finalize deletes the book from BookStack, if the deletion policy is
+// Delete, and removes the finalizer.
+func (r *BookStackBookReconciler) finalize(ctx context.Context, book *toolsv1alpha1.BookStackBook) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if !controllerutil.ContainsFinalizer(book, toolsv1alpha1.SyncFinalizer) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	var instance toolsv1alpha1.BookStack
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: book.Namespace, Name: book.Spec.BookStackRef.Name}, &instance)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	// there is nothing to delete if the book was never synced, or went
+	// with its instance.
+	if book.Status.ID != 0 && !book.RetainsBook() && err == nil {
+		api, reason, err := apiClient(ctx, r.Client, &instance)
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		if reason != "" {
+			return waitToSync(ctx, r.Client, book, reason)
+		}
+
+		l.Info("deleting BookStack book", "id", book.Status.ID)
+		if err = api.DeleteBook(ctx, book.Status.ID); err != nil && !bookstackapi.IsNotFound(err) {
+			return syncFailed(ctx, r.Client, book, err)
+		}
+	}
+
+	controllerutil.RemoveFinalizer(book, toolsv1alpha1.SyncFinalizer)
+	if err := r.Client.Update(ctx, book); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// bookChanged returns true if the book differs from desired. The
+// description and tags are only compared when desired sets them.
+func bookChanged(existing *bookstackapi.Book, desired bookstackapi.BookRequest) bool {
+	return existing.Name != desired.Name ||
+		(desired.Description != "" && existing.Description != desired.Description) ||
+		(len(desired.Tags) > 0 && !sameTags(existing.Tags, desired.Tags))
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BookStackBookReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&toolsv1alpha1.BookStackBook{}).
+		// books wait for their instance's API token.
+		Watches(&source.Kind{Type: &toolsv1alpha1.BookStack{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			return referencesInstance(r.Client, &toolsv1alpha1.BookStackBookList{}, obj)
+		})).
+		Complete(r)
+}
@@ -0,0 +1,576 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	"github.com/opdev/bookstack-operator/internal/bookstackapi"
+	subrec "github.com/opdev/subreconciler"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// BookStackPageSourceReconciler reconciles a BookStackPageSource object
+type BookStackPageSourceReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackpagesources,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackpagesources/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackpagesources/finalizers,verbs=update
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;create
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles;rolebindings,verbs=get;list;watch;create
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+
+// Reconcile will read the Markdown files of the source and create or update
+// a page in BookStack for each, in the book and chapter named by the spec
+// or the file's front-matter. A page is only updated when its file changes.
+// The files of a volume are first collected into a ConfigMap by a Job.
+// Pages whose files are removed are deleted if the source prunes.
+func (r *BookStackPageSourceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("page source reconciliation initiated.")
+	defer l.Info("page source reconciliation complete.")
+
+	var src toolsv1alpha1.BookStackPageSource
+	err := r.Client.Get(ctx, req.NamespacedName, &src)
+
+	if apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if !src.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, &src)
+	}
+
+	if !controllerutil.ContainsFinalizer(&src, toolsv1alpha1.SyncFinalizer) {
+		controllerutil.AddFinalizer(&src, toolsv1alpha1.SyncFinalizer)
+		if err = r.Client.Update(ctx, &src); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	var instance toolsv1alpha1.BookStack
+	err = r.Client.Get(ctx, client.ObjectKey{Namespace: src.Namespace, Name: src.Spec.BookStackRef.Name}, &instance)
+
+	if apierrors.IsNotFound(err) {
+		return waitToSync(ctx, r.Client, &src, fmt.Sprintf("BookStack %s not found", src.Spec.BookStackRef.Name))
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	api, reason, err := apiClient(ctx, r.Client, &instance)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if reason != "" {
+		return waitToSync(ctx, r.Client, &src, reason)
+	}
+
+	files, reason, err := r.readFiles(ctx, &src)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if reason != "" {
+		return waitToSync(ctx, r.Client, &src, reason)
+	}
+
+	return r.sync(ctx, &src, api, files)
+}
+
+// readFiles returns the Markdown files of the source by key. If a file
+// can't be read yet, it returns the reason instead, so that pages aren't
+// pruned for a missing ConfigMap.
+func (r *BookStackPageSourceReconciler) readFiles(ctx context.Context, src *toolsv1alpha1.BookStackPageSource) (map[string]string, string, error) {
+	files := map[string]string{}
+	for _, sel := range src.Spec.ConfigMaps {
+		var cm corev1.ConfigMap
+		err := r.Client.Get(ctx, client.ObjectKey{Namespace: src.Namespace, Name: sel.Name}, &cm)
+
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Sprintf("configmap %s not found", sel.Name), nil
+		}
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		keys := sel.Keys
+		if len(keys) == 0 {
+			for key := range cm.Data {
+				if strings.HasSuffix(key, ".md") {
+					keys = append(keys, key)
+				}
+			}
+		}
+
+		for _, key := range keys {
+			content, found := cm.Data[key]
+			if !found {
+				return nil, fmt.Sprintf("configmap %s has no key %s", sel.Name, key), nil
+			}
+			files[sel.Name+"/"+key] = content
+		}
+	}
+
+	if src.Spec.Volume != nil {
+		collected, reason, err := r.collectVolume(ctx, src)
+		if err != nil || reason != "" {
+			return nil, reason, err
+		}
+
+		for key, content := range collected {
+			files[src.Spec.Volume.ClaimName+"/"+key] = content
+		}
+	}
+
+	return files, "", nil
+}
+
+// collectVolume returns the Markdown files last collected from the volume.
+// The files are collected again by a Job every resync interval; the files
+// of the previous collection are used while it runs.
+func (r *BookStackPageSourceReconciler) collectVolume(ctx context.Context, src *toolsv1alpha1.BookStackPageSource) (map[string]string, string, error) {
+	l := log.FromContext(ctx)
+
+	cm := src.NewVolumeConfigMap()
+	sa := src.NewCollectorServiceAccount()
+	role := src.NewCollectorRole()
+	binding := src.NewCollectorRoleBinding()
+	for _, obj := range []client.Object{&cm, &sa, &role, &binding} {
+		if err := r.createIfMissing(ctx, src, obj); err != nil {
+			return nil, "", err
+		}
+	}
+
+	var job batchv1.Job
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: src.Namespace, Name: src.GetCollectorName()}, &job)
+
+	switch {
+	case apierrors.IsNotFound(err):
+		collected := src.Status.VolumeCollectionTime
+		if collected == nil || time.Since(collected.Time) >= apiResyncInterval {
+			new := src.NewCollectorJob()
+			if err := ctrl.SetControllerReference(src, &new, r.Scheme); err != nil {
+				return nil, "", err
+			}
+
+			l.Info("creating resource", new.Kind, new.Name)
+			if err := r.Client.Create(ctx, &new); err != nil {
+				return nil, "", err
+			}
+		}
+	case err != nil:
+		return nil, "", err
+	case job.Status.Succeeded > 0:
+		err = patchSyncedStatus(ctx, r.Client, src, func() {
+			now := metav1.Now()
+			src.Status.VolumeCollectionTime = &now
+		})
+		if err != nil {
+			return nil, "", err
+		}
+
+		err = r.Client.Delete(ctx, &job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, "", err
+		}
+	case jobFailure(&job) != "":
+		// the failed job is kept for inspection until the next attempt.
+		for _, c := range job.Status.Conditions {
+			if c.Type == batchv1.JobFailed && time.Since(c.LastTransitionTime.Time) < apiRetryInterval {
+				return nil, jobFailure(&job), nil
+			}
+		}
+
+		err = r.Client.Delete(ctx, &job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, "", err
+		}
+
+		return nil, jobFailure(&job), nil
+	}
+
+	if src.Status.VolumeCollectionTime == nil {
+		return nil, fmt.Sprintf("collecting Markdown files from claim %s", src.Spec.Volume.ClaimName), nil
+	}
+
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(&cm), &cm); err != nil {
+		return nil, "", err
+	}
+
+	return cm.Data, "", nil
+}
+
+// createIfMissing creates obj, owned by the source, unless it exists.
+func (r *BookStackPageSourceReconciler) createIfMissing(ctx context.Context, src *toolsv1alpha1.BookStackPageSource, obj client.Object) error {
+	l := log.FromContext(ctx)
+
+	existing := obj.DeepCopyObject().(client.Object)
+	err := r.Client.Get(ctx, client.ObjectKeyFromObject(obj), existing)
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	if err = ctrl.SetControllerReference(src, obj, r.Scheme); err != nil {
+		return err
+	}
+
+	l.Info("creating resource", obj.GetObjectKind().GroupVersionKind().Kind, obj.GetName())
+	return r.Client.Create(ctx, obj)
+}
+
+// sync creates or updates the page of each file, and prunes the pages of
+// the removed files.
+func (r *BookStackPageSourceReconciler) sync(ctx context.Context, src *toolsv1alpha1.BookStackPageSource, api *bookstackapi.Client, files map[string]string) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	previous := map[string]toolsv1alpha1.SyncedPage{}
+	claimed := map[int]string{}
+	for _, page := range src.Status.Pages {
+		previous[page.Key] = page
+		claimed[page.ID] = page.Key
+	}
+
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	locator := &pageLocator{api: api, books: map[string]int{}, chapters: map[string]int{}}
+	var synced []toolsv1alpha1.SyncedPage
+	var failures []string
+	for _, key := range keys {
+		prev, wasSynced := previous[key]
+
+		page, err := parseMarkdownPage(key, files[key], src.Spec.Book)
+		if err == nil {
+			prev, err = r.syncPage(ctx, locator, page, prev, claimed)
+		}
+
+		if err != nil {
+			failures = append(failures, err.Error())
+			if !wasSynced {
+				continue
+			}
+		}
+
+		synced = append(synced, prev)
+		claimed[prev.ID] = key
+	}
+
+	for _, page := range src.Status.Pages {
+		if _, found := files[page.Key]; found || !src.Spec.Prune {
+			continue
+		}
+
+		l.Info("deleting BookStack page", "id", page.ID, "key", page.Key)
+		if err := api.DeletePage(ctx, page.ID); err != nil && !bookstackapi.IsNotFound(err) {
+			failures = append(failures, fmt.Sprintf("%s: %v", page.Key, err))
+			synced = append(synced, page)
+		}
+	}
+	sort.Slice(synced, func(i, j int) bool { return synced[i].Key < synced[j].Key })
+
+	err := patchSyncedStatus(ctx, r.Client, src, func() {
+		now := metav1.Now()
+		src.Status.Pages = synced
+		src.Status.LastSyncTime = &now
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if len(failures) > 0 {
+		return reportSynced(ctx, r.Client, src, metav1.ConditionFalse, "PagesFailed", fmt.Sprintf("%d pages failed to sync: %s", len(failures), strings.Join(failures, "; ")), apiRetryInterval)
+	}
+
+	return reportSynced(ctx, r.Client, src, metav1.ConditionTrue, "Synced", fmt.Sprintf("%d pages are in sync", len(synced)), apiResyncInterval)
+}
+
+// syncPage creates or updates the page read from a file, unless the file
+// is unchanged since prev was synced. An existing page with the title is
+// adopted, unless another file is synced into it.
+func (r *BookStackPageSourceReconciler) syncPage(ctx context.Context, locator *pageLocator, page markdownPage, prev toolsv1alpha1.SyncedPage, claimed map[int]string) (toolsv1alpha1.SyncedPage, error) {
+	l := log.FromContext(ctx)
+
+	if prev.ID != 0 && prev.Hash == page.Hash {
+		// the page is synced again if it was deleted in BookStack.
+		exists, err := locator.pageExists(ctx, prev.ID)
+		if err != nil {
+			return prev, fmt.Errorf("%s: %w", page.Key, err)
+		}
+
+		if exists {
+			return prev, nil
+		}
+	}
+
+	bookID, chapterID, err := locator.locate(ctx, page.Book, page.Chapter)
+	if err != nil {
+		return prev, fmt.Errorf("%s: %w", page.Key, err)
+	}
+
+	existing, err := locator.findPage(ctx, prev.ID, page.Title, bookID, chapterID)
+	if err != nil {
+		return prev, fmt.Errorf("%s: %w", page.Key, err)
+	}
+
+	if existing != nil {
+		if other, found := claimed[existing.ID]; found && other != page.Key {
+			return prev, fmt.Errorf("%s: page %d is synced from %s", page.Key, existing.ID, other)
+		}
+	}
+
+	req := bookstackapi.PageRequest{
+		Name:     page.Title,
+		Markdown: page.Markdown,
+		Priority: page.Priority,
+		Tags:     page.Tags,
+	}
+	if chapterID != 0 {
+		req.ChapterID = chapterID
+	} else {
+		req.BookID = bookID
+	}
+
+	if existing == nil {
+		l.Info("creating BookStack page", "name", page.Title, "key", page.Key)
+		existing, err = locator.api.CreatePage(ctx, req)
+	} else {
+		l.Info("updating BookStack page", "id", existing.ID, "key", page.Key)
+		existing, err = locator.api.UpdatePage(ctx, existing.ID, req)
+	}
+	if err != nil {
+		return prev, fmt.Errorf("%s: %w", page.Key, err)
+	}
+
+	return toolsv1alpha1.SyncedPage{Key: page.Key, ID: existing.ID, Hash: page.Hash}, nil
+}
+
+// finalize deletes the synced pages from BookStack, if the deletion policy
+// is Delete, and removes the finalizer.
+func (r *BookStackPageSourceReconciler) finalize(ctx context.Context, src *toolsv1alpha1.BookStackPageSource) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if !controllerutil.ContainsFinalizer(src, toolsv1alpha1.SyncFinalizer) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	var instance toolsv1alpha1.BookStack
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: src.Namespace, Name: src.Spec.BookStackRef.Name}, &instance)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	// there is nothing to delete if no page was synced, or the pages went
+	// with their instance.
+	if len(src.Status.Pages) > 0 && !src.RetainsPages() && err == nil {
+		api, reason, err := apiClient(ctx, r.Client, &instance)
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		if reason != "" {
+			return waitToSync(ctx, r.Client, src, reason)
+		}
+
+		for _, page := range src.Status.Pages {
+			l.Info("deleting BookStack page", "id", page.ID, "key", page.Key)
+			if err = api.DeletePage(ctx, page.ID); err != nil && !bookstackapi.IsNotFound(err) {
+				return syncFailed(ctx, r.Client, src, err)
+			}
+		}
+	}
+
+	controllerutil.RemoveFinalizer(src, toolsv1alpha1.SyncFinalizer)
+	if err := r.Client.Update(ctx, src); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// pageLocator finds the books, chapters and pages pages are synced into,
+// remembering the books and chapters for the rest of the sync.
+type pageLocator struct {
+	api      *bookstackapi.Client
+	books    map[string]int
+	chapters map[string]int
+	// pages holds the IDs of the pages in BookStack, once listed.
+	pages map[int]bool
+}
+
+// pageExists returns true if the page with the ID exists. The pages are
+// listed once per sync, rather than read one by one.
+func (p *pageLocator) pageExists(ctx context.Context, id int) (bool, error) {
+	if p.pages == nil {
+		pages, err := p.api.ListAllPages(ctx, nil)
+		if err != nil {
+			return false, err
+		}
+
+		p.pages = make(map[int]bool, len(pages))
+		for _, page := range pages {
+			p.pages[page.ID] = true
+		}
+	}
+
+	return p.pages[id], nil
+}
+
+// locate returns the IDs of the book and chapter with the names, creating
+// the chapter if it is missing. The chapter ID is 0 if chapter is empty.
+func (p *pageLocator) locate(ctx context.Context, book, chapter string) (int, int, error) {
+	bookID, found := p.books[book]
+	if !found {
+		books, _, err := p.api.ListBooks(ctx, &bookstackapi.ListOptions{Filter: map[string]string{"name": book}})
+		if err != nil {
+			return 0, 0, err
+		}
+
+		for _, b := range books {
+			if b.Name == book {
+				bookID = b.ID
+				break
+			}
+		}
+
+		if bookID == 0 {
+			return 0, 0, fmt.Errorf("book %s not found", book)
+		}
+		p.books[book] = bookID
+	}
+
+	if chapter == "" {
+		return bookID, 0, nil
+	}
+
+	key := fmt.Sprintf("%d/%s", bookID, chapter)
+	if chapterID, found := p.chapters[key]; found {
+		return bookID, chapterID, nil
+	}
+
+	chapters, _, err := p.api.ListChapters(ctx, &bookstackapi.ListOptions{Filter: map[string]string{
+		"book_id": strconv.Itoa(bookID),
+		"name":    chapter,
+	}})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, c := range chapters {
+		if c.Name == chapter {
+			p.chapters[key] = c.ID
+			return bookID, c.ID, nil
+		}
+	}
+
+	log.FromContext(ctx).Info("creating BookStack chapter", "name", chapter, "bookID", bookID)
+	created, err := p.api.CreateChapter(ctx, bookstackapi.ChapterRequest{BookID: bookID, Name: chapter})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	p.chapters[key] = created.ID
+	return bookID, created.ID, nil
+}
+
+// findPage returns the page with the ID or, if it is gone, the page with
+// the title in the book and chapter. It returns nil if neither exists.
+func (p *pageLocator) findPage(ctx context.Context, id int, title string, bookID, chapterID int) (*bookstackapi.Page, error) {
+	if id != 0 {
+		existing, err := p.api.GetPage(ctx, id)
+		if err == nil || !bookstackapi.IsNotFound(err) {
+			return existing, err
+		}
+	}
+
+	pages, _, err := p.api.ListPages(ctx, &bookstackapi.ListOptions{Filter: map[string]string{
+		"book_id": strconv.Itoa(bookID),
+		"name":    title,
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range pages {
+		if pages[i].Name == title && pages[i].ChapterID == chapterID {
+			return &pages[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BookStackPageSourceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&toolsv1alpha1.BookStackPageSource{}).
+		Owns(&batchv1.Job{}).
+		// page sources wait for their instance's API token.
+		Watches(&source.Kind{Type: &toolsv1alpha1.BookStack{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			return referencesInstance(r.Client, &toolsv1alpha1.BookStackPageSourceList{}, obj)
+		})).
+		// pages are synced as soon as their ConfigMap changes.
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			var sources toolsv1alpha1.BookStackPageSourceList
+			if err := r.Client.List(context.Background(), &sources, client.InNamespace(obj.GetNamespace())); err != nil {
+				return nil
+			}
+
+			var requests []reconcile.Request
+			for _, src := range sources.Items {
+				if src.ReadsConfigMap(obj.GetName()) {
+					requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&src)})
+				}
+			}
+
+			return requests
+		})).
+		Complete(r)
+}
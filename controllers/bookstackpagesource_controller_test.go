@@ -0,0 +1,116 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	"github.com/opdev/bookstack-operator/internal/bookstackapi"
+	"github.com/opdev/bookstack-operator/internal/bookstackapi/fake"
+)
+
+func TestSyncPage(t *testing.T) {
+	const content = "# Restart\n\nSteps.\n"
+
+	tests := []struct {
+		name string
+		// change is applied to BookStack and the file after the first sync.
+		change      func(t *testing.T, api *bookstackapi.Client, prev toolsv1alpha1.SyncedPage) string
+		wantSameID  bool
+		wantUpdated bool
+	}{
+		{
+			name: "unchanged",
+			change: func(t *testing.T, api *bookstackapi.Client, prev toolsv1alpha1.SyncedPage) string {
+				return content
+			},
+			wantSameID: true,
+		},
+		{
+			name: "changed file",
+			change: func(t *testing.T, api *bookstackapi.Client, prev toolsv1alpha1.SyncedPage) string {
+				return content + "More steps.\n"
+			},
+			wantSameID:  true,
+			wantUpdated: true,
+		},
+		{
+			name: "deleted in BookStack",
+			change: func(t *testing.T, api *bookstackapi.Client, prev toolsv1alpha1.SyncedPage) string {
+				if err := api.DeletePage(context.Background(), prev.ID); err != nil {
+					t.Fatalf("DeletePage() error = %v", err)
+				}
+				return content
+			},
+			wantUpdated: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			srv := fake.NewServer()
+			defer srv.Close()
+
+			api, err := bookstackapi.NewClient(srv.URL, fake.TokenID, fake.TokenSecret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := api.CreateBook(ctx, bookstackapi.BookRequest{Name: "Runbooks"}); err != nil {
+				t.Fatal(err)
+			}
+
+			r := &BookStackPageSourceReconciler{}
+			sync := func(content string, prev toolsv1alpha1.SyncedPage) toolsv1alpha1.SyncedPage {
+				t.Helper()
+				page, err := parseMarkdownPage("restart.md", content, "Runbooks")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				locator := &pageLocator{api: api, books: map[string]int{}, chapters: map[string]int{}}
+				synced, err := r.syncPage(ctx, locator, page, prev, map[int]string{})
+				if err != nil {
+					t.Fatalf("syncPage() error = %v", err)
+				}
+				return synced
+			}
+
+			prev := sync(content, toolsv1alpha1.SyncedPage{})
+			before, err := api.GetPage(ctx, prev.ID)
+			if err != nil {
+				t.Fatalf("GetPage() error = %v", err)
+			}
+
+			got := sync(tt.change(t, api, prev), prev)
+
+			if same := got.ID == prev.ID; same != tt.wantSameID {
+				t.Errorf("syncPage() kept page %d = %v, want %v (now %d)", prev.ID, same, tt.wantSameID, got.ID)
+			}
+
+			after, err := api.GetPage(ctx, got.ID)
+			if err != nil {
+				t.Fatalf("page %d is not in BookStack: %v", got.ID, err)
+			}
+			if updated := got.ID != before.ID || after.UpdatedAt.After(before.UpdatedAt) || after.Markdown != before.Markdown; updated != tt.wantUpdated {
+				t.Errorf("syncPage() updated the page = %v, want %v", updated, tt.wantUpdated)
+			}
+		})
+	}
+}
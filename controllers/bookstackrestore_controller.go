@@ -0,0 +1,489 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	subrec "github.com/opdev/subreconciler"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// restorePollInterval is how often the restore controller checks on the
+// instance's Deployment while it scales.
+const restorePollInterval = 5 * time.Second
+
+// BookStackRestoreReconciler reconciles a BookStackRestore object
+type BookStackRestoreReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackrestores,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackrestores/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackrestores/finalizers,verbs=update
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackbackups,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile will walk a BookStackRestore through its steps: scaling the
+// instance to zero, restoring its data, scaling it back up and running
+// the BookStack migrations before exposing it again. Each step is
+// recorded as a condition.
+func (r *BookStackRestoreReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("restore reconciliation initiated.")
+	defer l.Info("restore reconciliation complete.")
+
+	var restore toolsv1alpha1.BookStackRestore
+	err := r.Client.Get(ctx, req.NamespacedName, &restore)
+
+	if apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if !restore.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, &restore)
+	}
+
+	if restore.IsFinished() {
+		return r.finished(ctx, &restore)
+	}
+
+	if !controllerutil.ContainsFinalizer(&restore, toolsv1alpha1.RestoreFinalizer) {
+		controllerutil.AddFinalizer(&restore, toolsv1alpha1.RestoreFinalizer)
+		if err = r.Client.Update(ctx, &restore); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	if err = restore.ValidateSource(); err != nil {
+		return r.fail(ctx, &restore, metav1.Condition{
+			Type:    toolsv1alpha1.ConditionDataRestored,
+			Status:  metav1.ConditionFalse,
+			Reason:  "InvalidSource",
+			Message: err.Error(),
+		})
+	}
+
+	var instance toolsv1alpha1.BookStack
+	err = r.Client.Get(ctx, client.ObjectKey{Namespace: restore.Namespace, Name: restore.Spec.BookStackRef.Name}, &instance)
+
+	if apierrors.IsNotFound(err) {
+		return r.wait(ctx, &restore, fmt.Sprintf("BookStack %s not found", restore.Spec.BookStackRef.Name))
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	var backup *toolsv1alpha1.BookStackBackup
+	if ref := restore.Spec.Source.BackupRef; ref != nil {
+		backup = &toolsv1alpha1.BookStackBackup{}
+		err = r.Client.Get(ctx, client.ObjectKey{Namespace: restore.Namespace, Name: ref.Name}, backup)
+
+		if apierrors.IsNotFound(err) {
+			return r.wait(ctx, &restore, fmt.Sprintf("BookStackBackup %s not found", ref.Name))
+		}
+
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		if backup.Status.Phase != toolsv1alpha1.BackupPhaseCompleted {
+			return r.wait(ctx, &restore, fmt.Sprintf("BookStackBackup %s has not completed", ref.Name))
+		}
+	}
+
+	// a restore already under way is finished, as stopping it would leave
+	// the data partially restored.
+	if restore.Status.Phase != toolsv1alpha1.RestorePhaseRunning {
+		switch {
+		case instance.InMaintenance():
+			return r.wait(ctx, &restore, fmt.Sprintf("BookStack %s is in maintenance mode", instance.Name))
+		case instance.IsSuspended():
+			return r.wait(ctx, &restore, fmt.Sprintf("BookStack %s is suspended", instance.Name))
+		case instance.IsPaused():
+			return r.wait(ctx, &restore, fmt.Sprintf("reconciliation of BookStack %s is paused", instance.Name))
+		}
+	}
+
+	// a snapshot lock left by a deleted backup would keep the instance
+	// scaled down once restored.
+	if err = releaseStaleSnapshot(ctx, r.Client, &instance); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if owner := instance.RestoringBy(); owner != "" && owner != restore.Name {
+		return r.wait(ctx, &restore, fmt.Sprintf("BookStack %s is being restored by %s", instance.Name, owner))
+	}
+
+	if !meta.IsStatusConditionTrue(restore.Status.Conditions, toolsv1alpha1.ConditionDataRestored) {
+		return r.restoreData(ctx, &restore, &instance, backup)
+	}
+
+	return r.finishRestore(ctx, &restore, &instance, backup)
+}
+
+// restoreData scales the instance to zero and runs the restore Job.
+func (r *BookStackRestoreReconciler) restoreData(ctx context.Context, restore *toolsv1alpha1.BookStackRestore, instance *toolsv1alpha1.BookStack, backup *toolsv1alpha1.BookStackBackup) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if _, ok := instance.Annotations[toolsv1alpha1.RestoreInProgressAnnotation]; !ok {
+		patch := client.MergeFrom(instance.DeepCopy())
+		metav1.SetMetaDataAnnotation(&instance.ObjectMeta, toolsv1alpha1.RestoreInProgressAnnotation, restore.Name)
+		if err := r.Client.Patch(ctx, instance, patch); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	var deployment appsv1.Deployment
+	err := r.Client.Get(ctx, client.ObjectKeyFromObject(instance), &deployment)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if deployment.Status.Replicas > 0 {
+		err = r.updateStatus(ctx, restore, toolsv1alpha1.RestorePhaseRunning, metav1.Condition{
+			Type:    toolsv1alpha1.ConditionScaledDown,
+			Status:  metav1.ConditionFalse,
+			Reason:  "ScalingDown",
+			Message: fmt.Sprintf("waiting for %d pods to terminate", deployment.Status.Replicas),
+		})
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		return subrec.Evaluate(subrec.RequeueWithDelay(restorePollInterval))
+	}
+
+	err = r.updateStatus(ctx, restore, toolsv1alpha1.RestorePhaseRunning, metav1.Condition{
+		Type:    toolsv1alpha1.ConditionScaledDown,
+		Status:  metav1.ConditionTrue,
+		Reason:  "ScaledDown",
+		Message: "the instance is stopped",
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	new := instance.NewRestoreJob(restore, backup)
+
+	err = ctrl.SetControllerReference(restore, &new, r.Scheme)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	var existing batchv1.Job
+	err = r.Client.Get(ctx, client.ObjectKeyFromObject(&new), &existing)
+
+	if apierrors.IsNotFound(err) {
+		l.Info("creating resource", new.Kind, new.Name)
+		if err := r.Client.Create(ctx, &new); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		err = r.updateStatus(ctx, restore, toolsv1alpha1.RestorePhaseRunning, metav1.Condition{
+			Type:    toolsv1alpha1.ConditionDataRestored,
+			Status:  metav1.ConditionFalse,
+			Reason:  "Restoring",
+			Message: fmt.Sprintf("job %s is restoring the backup", new.Name),
+		})
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if failed := jobFailure(&existing); failed != "" {
+		// the data may be partially restored, so the instance is left
+		// stopped for an administrator to inspect.
+		return r.fail(ctx, restore, metav1.Condition{
+			Type:   toolsv1alpha1.ConditionDataRestored,
+			Status: metav1.ConditionFalse,
+			Reason: "JobFailed",
+			Message: fmt.Sprintf("%s; the instance stays scaled down until the %s annotation is removed or the BookStackRestore deleted",
+				failed, toolsv1alpha1.RestoreInProgressAnnotation),
+		})
+	}
+
+	if existing.Status.Succeeded == 0 {
+		// the Job is still running.
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	err = r.updateStatus(ctx, restore, toolsv1alpha1.RestorePhaseRunning, metav1.Condition{
+		Type:    toolsv1alpha1.ConditionDataRestored,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Restored",
+		Message: "the database and the app volume were restored",
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.Requeue())
+}
+
+// finishRestore scales the instance back up, without exposing it, and
+// runs the BookStack migrations if the backup came from a different
+// BookStack image. The instance is exposed once the restore completed.
+func (r *BookStackRestoreReconciler) finishRestore(ctx context.Context, restore *toolsv1alpha1.BookStackRestore, instance *toolsv1alpha1.BookStack, backup *toolsv1alpha1.BookStackBackup) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if _, ok := instance.Annotations[toolsv1alpha1.RestoreInProgressAnnotation]; ok {
+		patch := client.MergeFrom(instance.DeepCopy())
+		delete(instance.Annotations, toolsv1alpha1.RestoreInProgressAnnotation)
+		metav1.SetMetaDataAnnotation(&instance.ObjectMeta, toolsv1alpha1.RestoreMigratingAnnotation, restore.Name)
+		if err := r.Client.Patch(ctx, instance, patch); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	var deployment appsv1.Deployment
+	err := r.Client.Get(ctx, client.ObjectKeyFromObject(instance), &deployment)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if deployment.Status.ReadyReplicas == 0 {
+		err = r.updateStatus(ctx, restore, toolsv1alpha1.RestorePhaseRunning, metav1.Condition{
+			Type:    toolsv1alpha1.ConditionScaledUp,
+			Status:  metav1.ConditionFalse,
+			Reason:  "ScalingUp",
+			Message: "waiting for the instance to become ready, it is not exposed until the restore completed",
+		})
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		return subrec.Evaluate(subrec.RequeueWithDelay(restorePollInterval))
+	}
+
+	err = r.updateStatus(ctx, restore, toolsv1alpha1.RestorePhaseRunning, metav1.Condition{
+		Type:    toolsv1alpha1.ConditionScaledUp,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Ready",
+		Message: "the instance is running",
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if source := restore.SourceImage(backup); source != "" && source == appImageOf(&deployment) {
+		err = r.updateStatus(ctx, restore, toolsv1alpha1.RestorePhaseCompleted, metav1.Condition{
+			Type:    toolsv1alpha1.ConditionMigrated,
+			Status:  metav1.ConditionTrue,
+			Reason:  "NotRequired",
+			Message: fmt.Sprintf("the backup was taken with the running image %s", source),
+		})
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		return subrec.Evaluate(subrec.Requeue())
+	}
+
+	new := instance.NewMigrateJob(restore.Name+"-migrate", appImageOf(&deployment))
+
+	err = ctrl.SetControllerReference(restore, &new, r.Scheme)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	var existing batchv1.Job
+	err = r.Client.Get(ctx, client.ObjectKeyFromObject(&new), &existing)
+
+	if apierrors.IsNotFound(err) {
+		l.Info("creating resource", new.Kind, new.Name)
+		if err := r.Client.Create(ctx, &new); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		err = r.updateStatus(ctx, restore, toolsv1alpha1.RestorePhaseRunning, metav1.Condition{
+			Type:    toolsv1alpha1.ConditionMigrated,
+			Status:  metav1.ConditionFalse,
+			Reason:  "Migrating",
+			Message: fmt.Sprintf("job %s is running the migrations", new.Name),
+		})
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if failed := jobFailure(&existing); failed != "" {
+		// the database may be partially migrated, so the instance is left
+		// unexposed for an administrator to inspect.
+		return r.fail(ctx, restore, metav1.Condition{
+			Type:   toolsv1alpha1.ConditionMigrated,
+			Status: metav1.ConditionFalse,
+			Reason: "JobFailed",
+			Message: fmt.Sprintf("%s; the instance stays unexposed until the %s annotation is removed or the BookStackRestore deleted",
+				failed, toolsv1alpha1.RestoreMigratingAnnotation),
+		})
+	}
+
+	if existing.Status.Succeeded == 0 {
+		// the Job is still running.
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	err = r.updateStatus(ctx, restore, toolsv1alpha1.RestorePhaseCompleted, metav1.Condition{
+		Type:    toolsv1alpha1.ConditionMigrated,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Migrated",
+		Message: "the migrations ran against the restored database",
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.Requeue())
+}
+
+// finished exposes the instance of a completed restore and removes the
+// finalizer. A failed restore keeps the instance stopped or unexposed for
+// inspection until it is deleted.
+func (r *BookStackRestoreReconciler) finished(ctx context.Context, restore *toolsv1alpha1.BookStackRestore) (ctrl.Result, error) {
+	if restore.Status.Phase != toolsv1alpha1.RestorePhaseCompleted {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	return r.finalize(ctx, restore)
+}
+
+// finalize removes the annotations the restore set on its instance, then
+// the finalizer.
+func (r *BookStackRestoreReconciler) finalize(ctx context.Context, restore *toolsv1alpha1.BookStackRestore) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(restore, toolsv1alpha1.RestoreFinalizer) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	var instance toolsv1alpha1.BookStack
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: restore.Namespace, Name: restore.Spec.BookStackRef.Name}, &instance)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if err == nil {
+		patch := client.MergeFrom(instance.DeepCopy())
+		for _, annotation := range []string{toolsv1alpha1.RestoreInProgressAnnotation, toolsv1alpha1.RestoreMigratingAnnotation} {
+			if owner, ok := instance.Annotations[annotation]; ok && owner == restore.Name {
+				delete(instance.Annotations, annotation)
+			}
+		}
+
+		if err = r.Client.Patch(ctx, &instance, patch); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	controllerutil.RemoveFinalizer(restore, toolsv1alpha1.RestoreFinalizer)
+	if err = r.Client.Update(ctx, restore); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// wait records why the restore cannot start yet and checks back later.
+func (r *BookStackRestoreReconciler) wait(ctx context.Context, restore *toolsv1alpha1.BookStackRestore, message string) (ctrl.Result, error) {
+	err := r.updateStatus(ctx, restore, toolsv1alpha1.RestorePhasePending, metav1.Condition{
+		Type:    toolsv1alpha1.ConditionScaledDown,
+		Status:  metav1.ConditionFalse,
+		Reason:  "Waiting",
+		Message: message,
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.RequeueWithDelay(30 * time.Second))
+}
+
+// fail records cond and marks the restore as failed.
+func (r *BookStackRestoreReconciler) fail(ctx context.Context, restore *toolsv1alpha1.BookStackRestore, cond metav1.Condition) (ctrl.Result, error) {
+	if err := r.updateStatus(ctx, restore, toolsv1alpha1.RestorePhaseFailed, cond); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// updateStatus records phase and cond on the restore, patching the status
+// subresource only if either changed.
+func (r *BookStackRestoreReconciler) updateStatus(ctx context.Context, restore *toolsv1alpha1.BookStackRestore, phase toolsv1alpha1.RestorePhase, cond metav1.Condition) error {
+	original := restore.DeepCopy()
+	cond.ObservedGeneration = restore.Generation
+
+	restore.Status.Phase = phase
+	meta.SetStatusCondition(&restore.Status.Conditions, cond)
+
+	now := metav1.Now()
+	if phase != toolsv1alpha1.RestorePhasePending && restore.Status.StartTime == nil {
+		restore.Status.StartTime = &now
+	}
+
+	if restore.IsFinished() {
+		restore.Status.CompletionTime = &now
+	}
+
+	// SetStatusCondition bumps the transition time of changed conditions
+	// only, so an unchanged status compares equal.
+	if equality.Semantic.DeepEqual(original.Status, restore.Status) {
+		return nil
+	}
+
+	return r.Client.Status().Patch(ctx, restore, client.MergeFrom(original))
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BookStackRestoreReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&toolsv1alpha1.BookStackRestore{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
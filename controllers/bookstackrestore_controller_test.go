@@ -0,0 +1,93 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRestoreFinalize(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation string
+		owner      string
+		wantKept   bool
+	}{
+		{name: "restoring data", annotation: toolsv1alpha1.RestoreInProgressAnnotation, owner: "rollback"},
+		{name: "migrating", annotation: toolsv1alpha1.RestoreMigratingAnnotation, owner: "rollback"},
+		{name: "owned by another restore", annotation: toolsv1alpha1.RestoreInProgressAnnotation, owner: "other", wantKept: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := &toolsv1alpha1.BookStack{ObjectMeta: metav1.ObjectMeta{
+				Name:        "wiki",
+				Namespace:   "docs",
+				Annotations: map[string]string{tt.annotation: tt.owner},
+			}}
+
+			now := metav1.Now()
+			restore := &toolsv1alpha1.BookStackRestore{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "rollback",
+					Namespace:         "docs",
+					Finalizers:        []string{toolsv1alpha1.RestoreFinalizer},
+					DeletionTimestamp: &now,
+				},
+				Spec: toolsv1alpha1.BookStackRestoreSpec{
+					BookStackRef: corev1.LocalObjectReference{Name: "wiki"},
+				},
+			}
+
+			scheme := testScheme()
+
+			c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(instance, restore).Build()
+			r := &BookStackRestoreReconciler{Client: c, Scheme: scheme}
+
+			ctx := context.Background()
+			if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(restore)}); err != nil {
+				t.Fatalf("Reconcile() error = %v", err)
+			}
+
+			if err := c.Get(ctx, client.ObjectKeyFromObject(instance), instance); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, kept := instance.Annotations[tt.annotation]; kept != tt.wantKept {
+				t.Errorf("annotation %s kept = %v, want %v", tt.annotation, kept, tt.wantKept)
+			}
+
+			err := c.Get(ctx, client.ObjectKeyFromObject(restore), restore)
+			if err == nil && len(restore.Finalizers) > 0 {
+				t.Errorf("finalizers = %v, want none", restore.Finalizers)
+			}
+
+			if err != nil && !apierrors.IsNotFound(err) {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	"github.com/opdev/bookstack-operator/internal/bookstackapi"
+	subrec "github.com/opdev/subreconciler"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// BookStackRoleReconciler reconciles a BookStackRole object
+type BookStackRoleReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackroles,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackroles/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackroles/finalizers,verbs=update
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+
+// Reconcile will create the role in BookStack, or adopt the existing role
+// with its display name, and apply the spec to it. Changes made to the role
+// in BookStack are reverted or reported, as the drift policy selects. The
+// role is deleted from BookStack along with the BookStackRole unless
+// retained.
+func (r *BookStackRoleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("role reconciliation initiated.")
+	defer l.Info("role reconciliation complete.")
+
+	var role toolsv1alpha1.BookStackRole
+	err := r.Client.Get(ctx, req.NamespacedName, &role)
+
+	if apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if !role.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, &role)
+	}
+
+	if !controllerutil.ContainsFinalizer(&role, toolsv1alpha1.SyncFinalizer) {
+		controllerutil.AddFinalizer(&role, toolsv1alpha1.SyncFinalizer)
+		if err = r.Client.Update(ctx, &role); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	var instance toolsv1alpha1.BookStack
+	err = r.Client.Get(ctx, client.ObjectKey{Namespace: role.Namespace, Name: role.Spec.BookStackRef.Name}, &instance)
+
+	if apierrors.IsNotFound(err) {
+		return waitToSync(ctx, r.Client, &role, fmt.Sprintf("BookStack %s not found", role.Spec.BookStackRef.Name))
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	api, reason, err := apiClient(ctx, r.Client, &instance)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if reason != "" {
+		return waitToSync(ctx, r.Client, &role, reason)
+	}
+
+	return r.sync(ctx, &role, api)
+}
+
+// sync creates or adopts the role, and applies the spec to it when it
+// changed or when drift is reverted.
+func (r *BookStackRoleReconciler) sync(ctx context.Context, role *toolsv1alpha1.BookStackRole, api *bookstackapi.Client) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	existing, err := r.findRole(ctx, api, role)
+	if err != nil {
+		return syncFailed(ctx, r.Client, role, err)
+	}
+
+	desired := bookstackapi.RoleRequest{
+		DisplayName:    role.Spec.DisplayName,
+		Description:    role.Spec.Description,
+		ExternalAuthID: role.Spec.ExternalAuthID,
+		MFAEnforced:    role.Spec.MFAEnforced,
+		Permissions:    role.PermissionNames(),
+	}
+
+	adopted := role.Status.Adopted
+	var drift []string
+	switch {
+	case existing == nil:
+		l.Info("creating BookStack role", "displayName", desired.DisplayName)
+		if existing, err = api.CreateRole(ctx, desired); err != nil {
+			return syncFailed(ctx, r.Client, role, err)
+		}
+	case role.Status.AppliedGeneration != role.Generation || role.RevertsDrift():
+		if role.Status.ID == 0 {
+			adopted = true
+		}
+
+		if len(roleDrift(existing, desired)) > 0 {
+			l.Info("updating BookStack role", "id", existing.ID)
+			if existing, err = api.UpdateRole(ctx, existing.ID, desired); err != nil {
+				return syncFailed(ctx, r.Client, role, err)
+			}
+		}
+	default:
+		drift = roleDrift(existing, desired)
+	}
+
+	err = patchSyncedStatus(ctx, r.Client, role, func() {
+		now := metav1.Now()
+		role.Status.ID = existing.ID
+		role.Status.Adopted = adopted
+		role.Status.AppliedGeneration = role.Generation
+		role.Status.Drift = drift
+		role.Status.LastSyncTime = &now
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if len(drift) > 0 {
+		return reportSynced(ctx, r.Client, role, metav1.ConditionFalse, "Drifted", fmt.Sprintf("role %d was changed in BookStack: %s", existing.ID, strings.Join(drift, ", ")), apiResyncInterval)
+	}
+
+	return reportSynced(ctx, r.Client, role, metav1.ConditionTrue, "Synced", fmt.Sprintf("role %d is in sync", existing.ID), apiResyncInterval)
+}
+
+// findRole returns the role recorded in the status or, if it is gone, the
+// role with the display name. It returns nil if neither exists.
+func (r *BookStackRoleReconciler) findRole(ctx context.Context, api *bookstackapi.Client, role *toolsv1alpha1.BookStackRole) (*bookstackapi.Role, error) {
+	if role.Status.ID != 0 {
+		existing, err := api.GetRole(ctx, role.Status.ID)
+		if err == nil || !bookstackapi.IsNotFound(err) {
+			return existing, err
+		}
+	}
+
+	id, err := roleIDByName(ctx, api, role.Spec.DisplayName)
+	if err != nil || id == 0 {
+		return nil, err
+	}
+
+	// the listing leaves out the permissions of the role.
+	return api.GetRole(ctx, id)
+}
+
+// finalize deletes the role from BookStack, giving its users to the role
+// set in spec.migrateUsersTo, and removes the finalizer.
+func (r *BookStackRoleReconciler) finalize(ctx context.Context, role *toolsv1alpha1.BookStackRole) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if !controllerutil.ContainsFinalizer(role, toolsv1alpha1.SyncFinalizer) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	var instance toolsv1alpha1.BookStack
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: role.Namespace, Name: role.Spec.BookStackRef.Name}, &instance)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	// there is nothing to delete if the role was never synced, or went
+	// with its instance.
+	if role.Status.ID != 0 && !role.RetainsRole() && err == nil {
+		api, reason, err := apiClient(ctx, r.Client, &instance)
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		if reason != "" {
+			return waitToSync(ctx, r.Client, role, reason)
+		}
+
+		migrateTo := 0
+		if name := role.Spec.MigrateUsersTo; name != "" {
+			if migrateTo, err = roleIDByName(ctx, api, name); err != nil {
+				return syncFailed(ctx, r.Client, role, err)
+			}
+
+			if migrateTo == 0 {
+				return reportSynced(ctx, r.Client, role, metav1.ConditionFalse, "MigrationTargetNotFound", fmt.Sprintf("role %s not found", name), apiRetryInterval)
+			}
+		}
+
+		l.Info("deleting BookStack role", "id", role.Status.ID)
+		if err = api.DeleteRole(ctx, role.Status.ID, migrateTo); err != nil && !bookstackapi.IsNotFound(err) {
+			return syncFailed(ctx, r.Client, role, err)
+		}
+	}
+
+	controllerutil.RemoveFinalizer(role, toolsv1alpha1.SyncFinalizer)
+	if err := r.Client.Update(ctx, role); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// roleDrift returns the fields of the role that differ from desired. The
+// description, external auth ID and permissions are only compared when
+// desired sets them.
+func roleDrift(existing *bookstackapi.Role, desired bookstackapi.RoleRequest) []string {
+	var drift []string
+	if existing.DisplayName != desired.DisplayName {
+		drift = append(drift, "displayName")
+	}
+	if desired.Description != "" && existing.Description != desired.Description {
+		drift = append(drift, "description")
+	}
+	if desired.ExternalAuthID != "" && existing.ExternalAuthID != desired.ExternalAuthID {
+		drift = append(drift, "externalAuthID")
+	}
+	if existing.MFAEnforced != desired.MFAEnforced {
+		drift = append(drift, "mfaEnforced")
+	}
+	if len(desired.Permissions) > 0 && !samePermissions(existing.Permissions, desired.Permissions) {
+		drift = append(drift, "permissions")
+	}
+
+	return drift
+}
+
+// samePermissions returns true if a and b hold the same permissions, in any
+// order.
+func samePermissions(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a, b = append([]string(nil), a...), append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// roleIDByName returns the ID of the role with the display name, or 0 if
+// there is none.
+func roleIDByName(ctx context.Context, api *bookstackapi.Client, name string) (int, error) {
+	roles, _, err := api.ListRoles(ctx, &bookstackapi.ListOptions{Filter: map[string]string{"display_name": name}})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, role := range roles {
+		if role.DisplayName == name {
+			return role.ID, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BookStackRoleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&toolsv1alpha1.BookStackRole{}).
+		// roles wait for their instance's API token.
+		Watches(&source.Kind{Type: &toolsv1alpha1.BookStack{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			return referencesInstance(r.Client, &toolsv1alpha1.BookStackRoleList{}, obj)
+		})).
+		Complete(r)
+}
@@ -0,0 +1,357 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	"github.com/opdev/bookstack-operator/internal/bookstackapi"
+	subrec "github.com/opdev/subreconciler"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// BookStackShelfReconciler reconciles a BookStackShelf object
+type BookStackShelfReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackshelves,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackshelves/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackshelves/finalizers,verbs=update
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks,verbs=get;list;watch
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackbooks,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch
+
+// Reconcile will create the shelf in BookStack, or adopt the existing shelf
+// with its name, and apply the spec, books, cover image and permissions to
+// it. Once synced, the shelf is followed by the ID in its status, so
+// renaming it doesn't create another shelf. Changes made to the shelf in
+// BookStack are reverted. The shelf is deleted from BookStack along with the
+// BookStackShelf unless retained; its books are kept.
+func (r *BookStackShelfReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("shelf reconciliation initiated.")
+	defer l.Info("shelf reconciliation complete.")
+
+	var shelf toolsv1alpha1.BookStackShelf
+	err := r.Client.Get(ctx, req.NamespacedName, &shelf)
+
+	if apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if !shelf.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, &shelf)
+	}
+
+	if !controllerutil.ContainsFinalizer(&shelf, toolsv1alpha1.SyncFinalizer) {
+		controllerutil.AddFinalizer(&shelf, toolsv1alpha1.SyncFinalizer)
+		if err = r.Client.Update(ctx, &shelf); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	var instance toolsv1alpha1.BookStack
+	err = r.Client.Get(ctx, client.ObjectKey{Namespace: shelf.Namespace, Name: shelf.Spec.BookStackRef.Name}, &instance)
+
+	if apierrors.IsNotFound(err) {
+		return waitToSync(ctx, r.Client, &shelf, fmt.Sprintf("BookStack %s not found", shelf.Spec.BookStackRef.Name))
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	api, reason, err := apiClient(ctx, r.Client, &instance)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if reason != "" {
+		return waitToSync(ctx, r.Client, &shelf, reason)
+	}
+
+	return r.sync(ctx, &shelf, api)
+}
+
+// sync creates or adopts the shelf and applies the spec to it.
+func (r *BookStackShelfReconciler) sync(ctx context.Context, shelf *toolsv1alpha1.BookStackShelf, api *bookstackapi.Client) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	bookIDs, reason, err := r.bookIDs(ctx, shelf)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if reason != "" {
+		return waitToSync(ctx, r.Client, shelf, reason)
+	}
+
+	existing, err := r.findShelf(ctx, api, shelf)
+	if err != nil {
+		return syncFailed(ctx, r.Client, shelf, err)
+	}
+
+	desired := bookstackapi.ShelfRequest{
+		Name:        shelf.Spec.Name,
+		Description: shelf.Spec.Description,
+		Tags:        contentTags(shelf.Spec.Tags),
+		Books:       bookIDs,
+	}
+
+	adopted := shelf.Status.Adopted
+	switch {
+	case existing == nil:
+		l.Info("creating BookStack shelf", "name", desired.Name)
+		if existing, err = api.CreateShelf(ctx, desired); err != nil {
+			return syncFailed(ctx, r.Client, shelf, err)
+		}
+	case shelfChanged(existing, desired):
+		if shelf.Status.ID == 0 {
+			adopted = true
+		}
+
+		l.Info("updating BookStack shelf", "id", existing.ID)
+		if existing, err = api.UpdateShelf(ctx, existing.ID, desired); err != nil {
+			return syncFailed(ctx, r.Client, shelf, err)
+		}
+	case shelf.Status.ID == 0:
+		adopted = true
+	}
+
+	// the ID is recorded first, so that a rename follows the shelf even if
+	// the rest of the sync fails.
+	err = patchSyncedStatus(ctx, r.Client, shelf, func() {
+		shelf.Status.ID = existing.ID
+		shelf.Status.Slug = existing.Slug
+		shelf.Status.Adopted = adopted
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	coverHash := ""
+	if shelf.Spec.Cover != nil {
+		image, hash, reason, err := coverImage(ctx, r.Client, shelf.Namespace, shelf.Spec.Cover)
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		if reason != "" {
+			return waitToSync(ctx, r.Client, shelf, reason)
+		}
+
+		if hash != shelf.Status.CoverHash || existing.Cover == nil {
+			l.Info("uploading BookStack shelf cover", "id", existing.ID)
+			if _, err = api.SetShelfCover(ctx, existing.ID, shelf.Spec.Cover.Key, image); err != nil {
+				return syncFailed(ctx, r.Client, shelf, err)
+			}
+		}
+		coverHash = hash
+	}
+
+	if shelf.Spec.Permissions != nil {
+		reason, err := syncContentPermissions(ctx, api, bookstackapi.ContentTypeShelf, existing.ID, shelf.Spec.Permissions)
+		if err != nil {
+			return syncFailed(ctx, r.Client, shelf, err)
+		}
+
+		if reason != "" {
+			return waitToSync(ctx, r.Client, shelf, reason)
+		}
+	}
+
+	err = patchSyncedStatus(ctx, r.Client, shelf, func() {
+		now := metav1.Now()
+		shelf.Status.CoverHash = coverHash
+		shelf.Status.LastSyncTime = &now
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return reportSynced(ctx, r.Client, shelf, metav1.ConditionTrue, "Synced", fmt.Sprintf("shelf %d is in sync", existing.ID), apiResyncInterval)
+}
+
+// bookIDs returns the IDs of the books on the shelf, in order. If a book
+// isn't synced yet, it returns the reason instead.
+func (r *BookStackShelfReconciler) bookIDs(ctx context.Context, shelf *toolsv1alpha1.BookStackShelf) ([]int, string, error) {
+	var ids []int
+	for _, ref := range shelf.Spec.Books {
+		var book toolsv1alpha1.BookStackBook
+		err := r.Client.Get(ctx, client.ObjectKey{Namespace: shelf.Namespace, Name: ref.Name}, &book)
+
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Sprintf("BookStackBook %s not found", ref.Name), nil
+		}
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		if book.InstanceName() != shelf.InstanceName() {
+			return nil, fmt.Sprintf("BookStackBook %s is in BookStack %s", ref.Name, book.InstanceName()), nil
+		}
+
+		if book.Status.ID == 0 {
+			return nil, fmt.Sprintf("BookStackBook %s is not synced yet", ref.Name), nil
+		}
+
+		ids = append(ids, book.Status.ID)
+	}
+
+	return ids, "", nil
+}
+
+// findShelf returns the shelf recorded in the status or, if it is gone, the
+// shelf with the name. It returns nil if neither exists.
+func (r *BookStackShelfReconciler) findShelf(ctx context.Context, api *bookstackapi.Client, shelf *toolsv1alpha1.BookStackShelf) (*bookstackapi.Shelf, error) {
+	if shelf.Status.ID != 0 {
+		existing, err := api.GetShelf(ctx, shelf.Status.ID)
+		if err == nil || !bookstackapi.IsNotFound(err) {
+			return existing, err
+		}
+	}
+
+	shelves, _, err := api.ListShelves(ctx, &bookstackapi.ListOptions{Filter: map[string]string{"name": shelf.Spec.Name}})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range shelves {
+		if b.Name == shelf.Spec.Name {
+			// the listing leaves out the tags and books of the shelf.
+			return api.GetShelf(ctx, b.ID)
+		}
+	}
+
+	return nil, nil
+}
+
+// finalize deletes the shelf from BookStack, if the deletion policy is
+// Delete, and removes the finalizer.
+func (r *BookStackShelfReconciler) finalize(ctx context.Context, shelf *toolsv1alpha1.BookStackShelf) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if !controllerutil.ContainsFinalizer(shelf, toolsv1alpha1.SyncFinalizer) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	var instance toolsv1alpha1.BookStack
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: shelf.Namespace, Name: shelf.Spec.BookStackRef.Name}, &instance)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	// there is nothing to delete if the shelf was never synced, or went
+	// with its instance.
+	if shelf.Status.ID != 0 && !shelf.RetainsShelf() && err == nil {
+		api, reason, err := apiClient(ctx, r.Client, &instance)
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		if reason != "" {
+			return waitToSync(ctx, r.Client, shelf, reason)
+		}
+
+		l.Info("deleting BookStack shelf", "id", shelf.Status.ID)
+		if err = api.DeleteShelf(ctx, shelf.Status.ID); err != nil && !bookstackapi.IsNotFound(err) {
+			return syncFailed(ctx, r.Client, shelf, err)
+		}
+	}
+
+	controllerutil.RemoveFinalizer(shelf, toolsv1alpha1.SyncFinalizer)
+	if err := r.Client.Update(ctx, shelf); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// shelfChanged returns true if the shelf differs from desired. The
+// description, tags and books are only compared when desired sets them.
+func shelfChanged(existing *bookstackapi.Shelf, desired bookstackapi.ShelfRequest) bool {
+	var books []int
+	for _, book := range existing.Books {
+		books = append(books, book.ID)
+	}
+
+	return existing.Name != desired.Name ||
+		(desired.Description != "" && existing.Description != desired.Description) ||
+		(len(desired.Tags) > 0 && !sameTags(existing.Tags, desired.Tags)) ||
+		(len(desired.Books) > 0 && !sameOrder(books, desired.Books))
+}
+
+// sameOrder returns true if a and b hold the same IDs, in the same order.
+func sameOrder(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BookStackShelfReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&toolsv1alpha1.BookStackShelf{}).
+		// shelves wait for their instance's API token.
+		Watches(&source.Kind{Type: &toolsv1alpha1.BookStack{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			return referencesInstance(r.Client, &toolsv1alpha1.BookStackShelfList{}, obj)
+		})).
+		// shelves wait for their books to be synced.
+		Watches(&source.Kind{Type: &toolsv1alpha1.BookStackBook{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			var shelves toolsv1alpha1.BookStackShelfList
+			if err := r.Client.List(context.Background(), &shelves, client.InNamespace(obj.GetNamespace())); err != nil {
+				return nil
+			}
+
+			var requests []reconcile.Request
+			for _, shelf := range shelves.Items {
+				if shelf.HasBook(obj.GetName()) {
+					requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&shelf)})
+				}
+			}
+
+			return requests
+		})).
+		Complete(r)
+}
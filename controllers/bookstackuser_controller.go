@@ -0,0 +1,313 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	"github.com/opdev/bookstack-operator/internal/bookstackapi"
+	subrec "github.com/opdev/subreconciler"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// BookStackUserReconciler reconciles a BookStackUser object
+type BookStackUserReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackusers,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackusers/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackusers/finalizers,verbs=update
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+
+// Reconcile will create the user in BookStack, or adopt the existing user
+// with its email, and revert changes made to it in BookStack. The user is
+// deleted from BookStack along with the BookStackUser unless retained.
+func (r *BookStackUserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("user reconciliation initiated.")
+	defer l.Info("user reconciliation complete.")
+
+	var user toolsv1alpha1.BookStackUser
+	err := r.Client.Get(ctx, req.NamespacedName, &user)
+
+	if apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if !user.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, &user)
+	}
+
+	if !controllerutil.ContainsFinalizer(&user, toolsv1alpha1.SyncFinalizer) {
+		controllerutil.AddFinalizer(&user, toolsv1alpha1.SyncFinalizer)
+		if err = r.Client.Update(ctx, &user); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	var instance toolsv1alpha1.BookStack
+	err = r.Client.Get(ctx, client.ObjectKey{Namespace: user.Namespace, Name: user.Spec.BookStackRef.Name}, &instance)
+
+	if apierrors.IsNotFound(err) {
+		return waitToSync(ctx, r.Client, &user, fmt.Sprintf("BookStack %s not found", user.Spec.BookStackRef.Name))
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	api, reason, err := apiClient(ctx, r.Client, &instance)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if reason != "" {
+		return waitToSync(ctx, r.Client, &user, reason)
+	}
+
+	return r.sync(ctx, &user, api)
+}
+
+// sync creates, adopts or updates the user in BookStack.
+func (r *BookStackUserReconciler) sync(ctx context.Context, user *toolsv1alpha1.BookStackUser, api *bookstackapi.Client) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	roles, missing, err := roleIDs(ctx, api, user.Spec.Roles)
+	if err != nil {
+		return syncFailed(ctx, r.Client, user, err)
+	}
+
+	if len(missing) > 0 {
+		return reportSynced(ctx, r.Client, user, metav1.ConditionFalse, "RoleNotFound", fmt.Sprintf("roles not found: %s", strings.Join(missing, ", ")), apiRetryInterval)
+	}
+
+	existing, err := r.findUser(ctx, api, user)
+	if err != nil {
+		return syncFailed(ctx, r.Client, user, err)
+	}
+
+	desired := bookstackapi.UserRequest{
+		Name:           user.Spec.Name,
+		Email:          user.Spec.Email,
+		ExternalAuthID: user.Spec.ExternalAuthID,
+		Roles:          roles,
+	}
+
+	adopted := user.Status.Adopted
+	switch {
+	case existing == nil:
+		l.Info("creating BookStack user", "email", user.Spec.Email)
+		desired.SendInvite = user.Spec.SendInvite
+		if existing, err = api.CreateUser(ctx, desired); err != nil {
+			return syncFailed(ctx, r.Client, user, err)
+		}
+	case userDrifted(existing, desired):
+		if user.Status.ID == 0 {
+			adopted = true
+		}
+
+		l.Info("updating BookStack user", "id", existing.ID)
+		if existing, err = api.UpdateUser(ctx, existing.ID, desired); err != nil {
+			return syncFailed(ctx, r.Client, user, err)
+		}
+	case user.Status.ID == 0:
+		adopted = true
+	}
+
+	err = patchSyncedStatus(ctx, r.Client, user, func() {
+		now := metav1.Now()
+		user.Status.ID = existing.ID
+		user.Status.Adopted = adopted
+		user.Status.LastSyncTime = &now
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return reportSynced(ctx, r.Client, user, metav1.ConditionTrue, "Synced", fmt.Sprintf("user %d is in sync", existing.ID), apiResyncInterval)
+}
+
+// findUser returns the user recorded in the status or, if it is gone, the
+// user with the email. It returns nil if neither exists.
+func (r *BookStackUserReconciler) findUser(ctx context.Context, api *bookstackapi.Client, user *toolsv1alpha1.BookStackUser) (*bookstackapi.User, error) {
+	if user.Status.ID != 0 {
+		existing, err := api.GetUser(ctx, user.Status.ID)
+		if err == nil || !bookstackapi.IsNotFound(err) {
+			return existing, err
+		}
+	}
+
+	id, err := userIDByEmail(ctx, api, user.Spec.Email)
+	if err != nil || id == 0 {
+		return nil, err
+	}
+
+	// the listing leaves out the roles of the user.
+	return api.GetUser(ctx, id)
+}
+
+// finalize deletes the user from BookStack, giving its content to the
+// user set in spec.migrateOwnershipTo, and removes the finalizer.
+func (r *BookStackUserReconciler) finalize(ctx context.Context, user *toolsv1alpha1.BookStackUser) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if !controllerutil.ContainsFinalizer(user, toolsv1alpha1.SyncFinalizer) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	var instance toolsv1alpha1.BookStack
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: user.Namespace, Name: user.Spec.BookStackRef.Name}, &instance)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	// there is nothing to delete if the user was never synced, or went
+	// with its instance.
+	if user.Status.ID != 0 && !user.RetainsUser() && err == nil {
+		api, reason, err := apiClient(ctx, r.Client, &instance)
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		if reason != "" {
+			return waitToSync(ctx, r.Client, user, reason)
+		}
+
+		migrateTo := 0
+		if email := user.Spec.MigrateOwnershipTo; email != "" {
+			if migrateTo, err = userIDByEmail(ctx, api, email); err != nil {
+				return syncFailed(ctx, r.Client, user, err)
+			}
+
+			if migrateTo == 0 {
+				return reportSynced(ctx, r.Client, user, metav1.ConditionFalse, "MigrationTargetNotFound", fmt.Sprintf("user %s not found", email), apiRetryInterval)
+			}
+		}
+
+		l.Info("deleting BookStack user", "id", user.Status.ID)
+		if err = api.DeleteUser(ctx, user.Status.ID, migrateTo); err != nil && !bookstackapi.IsNotFound(err) {
+			return syncFailed(ctx, r.Client, user, err)
+		}
+	}
+
+	controllerutil.RemoveFinalizer(user, toolsv1alpha1.SyncFinalizer)
+	if err := r.Client.Update(ctx, user); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// userDrifted returns true if the user differs from desired. The external
+// auth ID and roles are only compared when desired sets them.
+func userDrifted(existing *bookstackapi.User, desired bookstackapi.UserRequest) bool {
+	if existing.Name != desired.Name || !strings.EqualFold(existing.Email, desired.Email) {
+		return true
+	}
+
+	if desired.ExternalAuthID != "" && existing.ExternalAuthID != desired.ExternalAuthID {
+		return true
+	}
+
+	if len(desired.Roles) == 0 {
+		return false
+	}
+
+	var roles []int
+	for _, role := range existing.Roles {
+		roles = append(roles, role.ID)
+	}
+
+	return !sameIDs(roles, desired.Roles)
+}
+
+// userIDByEmail returns the ID of the user with the email, or 0 if there
+// is none.
+func userIDByEmail(ctx context.Context, api *bookstackapi.Client, email string) (int, error) {
+	users, _, err := api.ListUsers(ctx, &bookstackapi.ListOptions{Filter: map[string]string{"email": email}})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, u := range users {
+		if strings.EqualFold(u.Email, email) {
+			return u.ID, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// roleIDs returns the IDs of the roles with the display names, and the
+// names no role has.
+func roleIDs(ctx context.Context, api *bookstackapi.Client, names []string) ([]int, []string, error) {
+	if len(names) == 0 {
+		return nil, nil, nil
+	}
+
+	roles, err := api.ListAllRoles(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byName := map[string]int{}
+	for _, role := range roles {
+		byName[role.DisplayName] = role.ID
+	}
+
+	var ids []int
+	var missing []string
+	for _, name := range names {
+		if id, ok := byName[name]; ok {
+			ids = append(ids, id)
+		} else {
+			missing = append(missing, name)
+		}
+	}
+
+	return ids, missing, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BookStackUserReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&toolsv1alpha1.BookStackUser{}).
+		// users wait for their instance's API token.
+		Watches(&source.Kind{Type: &toolsv1alpha1.BookStack{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			return referencesInstance(r.Client, &toolsv1alpha1.BookStackUserList{}, obj)
+		})).
+		Complete(r)
+}
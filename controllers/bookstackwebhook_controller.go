@@ -0,0 +1,334 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	subrec "github.com/opdev/subreconciler"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// webhookDeletePollInterval is how often the Job deleting a webhook is
+// checked. It is owned by the instance, so its completion doesn't trigger
+// a reconciliation.
+const webhookDeletePollInterval = 10 * time.Second
+
+// BookStackWebhookReconciler reconciles a BookStackWebhook object.
+// BookStack has no API for webhooks, so they are synced by Jobs running
+// against its database.
+type BookStackWebhookReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackwebhooks,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackwebhooks/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackwebhooks/finalizers,verbs=update
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+
+// Reconcile will run the Job creating the webhook in BookStack, or
+// adopting the existing webhook with its name, and applying the spec to
+// it. The Job runs again every resync interval, reverting changes made in
+// BookStack and reporting the last error BookStack got calling the
+// endpoint. The webhook is deleted from BookStack along with the
+// BookStackWebhook unless retained.
+func (r *BookStackWebhookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("webhook reconciliation initiated.")
+	defer l.Info("webhook reconciliation complete.")
+
+	var webhook toolsv1alpha1.BookStackWebhook
+	err := r.Client.Get(ctx, req.NamespacedName, &webhook)
+
+	if apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if !webhook.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, &webhook)
+	}
+
+	if !controllerutil.ContainsFinalizer(&webhook, toolsv1alpha1.SyncFinalizer) {
+		controllerutil.AddFinalizer(&webhook, toolsv1alpha1.SyncFinalizer)
+		if err = r.Client.Update(ctx, &webhook); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	var instance toolsv1alpha1.BookStack
+	err = r.Client.Get(ctx, client.ObjectKey{Namespace: webhook.Namespace, Name: webhook.InstanceName()}, &instance)
+
+	if apierrors.IsNotFound(err) {
+		return waitToSync(ctx, r.Client, &webhook, fmt.Sprintf("BookStack %s not found", webhook.InstanceName()))
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	reason, err := r.databaseUnavailable(ctx, &instance)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if reason != "" {
+		return waitToSync(ctx, r.Client, &webhook, reason)
+	}
+
+	return r.sync(ctx, &webhook, &instance)
+}
+
+// databaseUnavailable returns why webhooks can't be synced into the
+// database of the instance, or an empty string if they can. The webhook
+// tables are created when BookStack first starts.
+func (r *BookStackWebhookReconciler) databaseUnavailable(ctx context.Context, instance *toolsv1alpha1.BookStack) (string, error) {
+	switch {
+	case instance.IsPaused():
+		return fmt.Sprintf("reconciliation of BookStack %s is paused", instance.Name), nil
+	case instance.IsSuspended():
+		return fmt.Sprintf("BookStack %s is suspended", instance.Name), nil
+	}
+
+	var deployment appsv1.Deployment
+	err := r.Client.Get(ctx, client.ObjectKeyFromObject(instance), &deployment)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return "", err
+	}
+
+	if deployment.Status.AvailableReplicas == 0 {
+		return fmt.Sprintf("waiting for BookStack %s to become available", instance.Name), nil
+	}
+
+	return "", nil
+}
+
+// sync runs the sync Job when the spec changed or the webhook is due for
+// a resync, and records its result.
+func (r *BookStackWebhookReconciler) sync(ctx context.Context, webhook *toolsv1alpha1.BookStackWebhook, instance *toolsv1alpha1.BookStack) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	var job batchv1.Job
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: webhook.Namespace, Name: webhook.GetSyncJobName()}, &job)
+
+	switch {
+	case apierrors.IsNotFound(err):
+		applied := webhook.Status.AppliedGeneration == webhook.Generation
+		if last := webhook.Status.LastSyncTime; applied && last != nil && time.Since(last.Time) < apiResyncInterval {
+			due := apiResyncInterval - time.Since(last.Time)
+			if !meta.IsStatusConditionTrue(webhook.Status.Conditions, toolsv1alpha1.ConditionSynced) {
+				// the webhook was waiting, e.g. for its instance.
+				return reportSynced(ctx, r.Client, webhook, metav1.ConditionTrue, "Synced", fmt.Sprintf("webhook %d is in sync", webhook.Status.ID), due)
+			}
+
+			return subrec.Evaluate(subrec.RequeueWithDelay(due))
+		}
+
+		new := webhook.NewSyncJob(instance)
+		if err = ctrl.SetControllerReference(webhook, &new, r.Scheme); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		l.Info("creating resource", new.Kind, new.Name)
+		if err = r.Client.Create(ctx, &new); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		if applied {
+			// a resync, the condition stands until the Job completes.
+			return subrec.Evaluate(subrec.DoNotRequeue())
+		}
+
+		return reportSynced(ctx, r.Client, webhook, metav1.ConditionFalse, "Syncing", fmt.Sprintf("job %s is syncing the webhook", new.Name), 0)
+	case err != nil:
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	case job.Status.Succeeded > 0:
+		return r.recordSync(ctx, webhook, &job)
+	case jobFailure(&job) != "":
+		// the failed job is kept for inspection until the next attempt.
+		for _, c := range job.Status.Conditions {
+			if c.Type == batchv1.JobFailed && time.Since(c.LastTransitionTime.Time) < apiRetryInterval {
+				return reportSynced(ctx, r.Client, webhook, metav1.ConditionFalse, "JobFailed", jobFailure(&job), apiRetryInterval-time.Since(c.LastTransitionTime.Time))
+			}
+		}
+
+		err = r.Client.Delete(ctx, &job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		return reportSynced(ctx, r.Client, webhook, metav1.ConditionFalse, "JobFailed", jobFailure(&job), 0)
+	}
+
+	// the Job is running, its completion triggers a reconciliation.
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// recordSync records the result of the succeeded sync Job and removes it.
+func (r *BookStackWebhookReconciler) recordSync(ctx context.Context, webhook *toolsv1alpha1.BookStackWebhook, job *batchv1.Job) (ctrl.Result, error) {
+	message, err := jobResult(ctx, r.Client, job, toolsv1alpha1.WebhookSyncContainer)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	result, err := toolsv1alpha1.ParseWebhookSyncResult(message)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	generation, err := strconv.ParseInt(job.Annotations[toolsv1alpha1.WebhookGenerationAnnotation], 10, 64)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(fmt.Errorf("job %s has no valid generation: %w", job.Name, err)))
+	}
+
+	err = patchSyncedStatus(ctx, r.Client, webhook, func() {
+		if webhook.Status.ID == 0 {
+			webhook.Status.Adopted = result.Adopted
+		}
+		now := metav1.Now()
+		webhook.Status.ID = result.ID
+		webhook.Status.AppliedGeneration = generation
+		webhook.Status.LastError = result.LastError
+		webhook.Status.LastErrorTime = result.LastErrorTime()
+		webhook.Status.LastCallTime = result.LastCallTime()
+		webhook.Status.LastSyncTime = &now
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	err = r.Client.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if generation != webhook.Generation {
+		// the spec changed while the Job ran, sync it next.
+		return subrec.Evaluate(subrec.RequeueWithDelay(time.Second))
+	}
+
+	return reportSynced(ctx, r.Client, webhook, metav1.ConditionTrue, "Synced", fmt.Sprintf("webhook %d is in sync", result.ID), apiResyncInterval)
+}
+
+// finalize runs the Job deleting the webhook from BookStack, and removes
+// the finalizer once it succeeded.
+func (r *BookStackWebhookReconciler) finalize(ctx context.Context, webhook *toolsv1alpha1.BookStackWebhook) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if !controllerutil.ContainsFinalizer(webhook, toolsv1alpha1.SyncFinalizer) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	var instance toolsv1alpha1.BookStack
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: webhook.Namespace, Name: webhook.InstanceName()}, &instance)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	// there is nothing to delete if the webhook was never synced, or went
+	// with its instance.
+	if webhook.Status.ID != 0 && !webhook.RetainsWebhook() && err == nil {
+		reason, err := r.databaseUnavailable(ctx, &instance)
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		if reason != "" {
+			return waitToSync(ctx, r.Client, webhook, reason)
+		}
+
+		// the delete Job is owned by the instance, as dependents created
+		// for an owner being deleted may be collected right away.
+		new := webhook.NewDeleteJob(&instance)
+		if err = ctrl.SetControllerReference(&instance, &new, r.Scheme); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		var job batchv1.Job
+		err = r.Client.Get(ctx, client.ObjectKeyFromObject(&new), &job)
+
+		switch {
+		case apierrors.IsNotFound(err):
+			l.Info("creating resource", new.Kind, new.Name)
+			if err = r.Client.Create(ctx, &new); err != nil {
+				return subrec.Evaluate(subrec.RequeueWithError(err))
+			}
+
+			return reportSynced(ctx, r.Client, webhook, metav1.ConditionFalse, "Deleting", fmt.Sprintf("job %s is deleting webhook %d", new.Name, webhook.Status.ID), webhookDeletePollInterval)
+		case err != nil:
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		case jobFailure(&job) != "":
+			// deleted, so that it runs again once the failure is fixed.
+			err = r.Client.Delete(ctx, &job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+			if err != nil && !apierrors.IsNotFound(err) {
+				return subrec.Evaluate(subrec.RequeueWithError(err))
+			}
+
+			return reportSynced(ctx, r.Client, webhook, metav1.ConditionFalse, "JobFailed", jobFailure(&job), apiRetryInterval)
+		case job.Status.Succeeded == 0:
+			return subrec.Evaluate(subrec.RequeueWithDelay(webhookDeletePollInterval))
+		}
+
+		l.Info("deleted BookStack webhook", "id", webhook.Status.ID)
+		err = r.Client.Delete(ctx, &job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	controllerutil.RemoveFinalizer(webhook, toolsv1alpha1.SyncFinalizer)
+	if err := r.Client.Update(ctx, webhook); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BookStackWebhookReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&toolsv1alpha1.BookStackWebhook{}).
+		Owns(&batchv1.Job{}).
+		// webhooks wait for their instance to become available.
+		Watches(&source.Kind{Type: &toolsv1alpha1.BookStack{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			return referencesInstance(r.Client, &toolsv1alpha1.BookStackWebhookList{}, obj)
+		})).
+		Complete(r)
+}
@@ -19,12 +19,14 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/imdario/mergo"
 	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
 	subrec "github.com/opdev/subreconciler"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -63,6 +65,26 @@ func (r *BookStackConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.R
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
 
+	if instance.IsPaused() {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	// refuse to render auth settings BookStack can't use.
+	if err = instance.ValidateAuth(); err != nil {
+		l.Error(err, "invalid auth configuration")
+		if err := setCondition(ctx, r.Client, &instance, metav1.Condition{
+			Type:    toolsv1alpha1.ConditionAuthConfigured,
+			Status:  metav1.ConditionFalse,
+			Reason:  "InvalidConfiguration",
+			Message: err.Error(),
+		}); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		// wait for the spec to change.
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
 	// app
 	newAppCM := instance.NewAppConfigMap()
 
@@ -100,15 +122,44 @@ func (r *BookStackConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.R
 	}
 
 	l.Info("updating resources if necessary", existingAppCM.Kind, existingAppCM.GetName())
-	patchDiff := client.MergeFrom(&existingAppCM)
+	patchDiff := client.MergeFrom(existingAppCM.DeepCopy())
 	if err = mergo.Merge(&existingAppCM, newAppCM, mergo.WithOverride); err != nil {
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
 
+	// the data is replaced, as merging it would keep the keys of removed
+	// overrides and of auth methods no longer in use.
+	existingAppCM.Data = newAppCM.Data
+
 	if err = r.Patch(ctx, &existingAppCM, patchDiff); err != nil {
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
 
+	if err = setCondition(ctx, r.Client, &instance, metav1.Condition{
+		Type:    toolsv1alpha1.ConditionAuthConfigured,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Rendered",
+		Message: "AUTH_METHOD=" + newAppCM.Data["AUTH_METHOD"],
+	}); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	overrides := metav1.Condition{
+		Type:   toolsv1alpha1.ConditionOverridesAccepted,
+		Status: metav1.ConditionTrue,
+		Reason: "Applied",
+	}
+
+	if ignored := instance.IgnoredOverrides(); len(ignored) > 0 {
+		overrides.Status = metav1.ConditionFalse
+		overrides.Reason = "Ignored"
+		overrides.Message = "ignored overrides: " + strings.Join(ignored, ", ")
+	}
+
+	if err = setCondition(ctx, r.Client, &instance, overrides); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
 	// db
 	newDBCM := instance.NewDBConfigMap()
 
@@ -134,11 +185,13 @@ func (r *BookStackConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.R
 	}
 
 	l.Info("updating resources if necessary", existingDBCM.Kind, existingDBCM.GetName())
-	DBCMpatchDiff := client.MergeFrom(&existingDBCM)
+	DBCMpatchDiff := client.MergeFrom(existingDBCM.DeepCopy())
 	if err = mergo.Merge(&existingDBCM, newDBCM, mergo.WithOverride); err != nil {
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
 
+	existingDBCM.Data = newDBCM.Data
+
 	if err = r.Patch(ctx, &existingDBCM, DBCMpatchDiff); err != nil {
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
@@ -0,0 +1,169 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	"github.com/opdev/bookstack-operator/internal/bookstackapi"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// contentTags returns the tags of a shelf or book as the API takes them.
+func contentTags(tags []toolsv1alpha1.ContentTag) []bookstackapi.Tag {
+	var out []bookstackapi.Tag
+	for _, tag := range tags {
+		out = append(out, bookstackapi.Tag{Name: tag.Name, Value: tag.Value})
+	}
+
+	return out
+}
+
+// sameTags returns true if a and b hold the same tags, in the same order.
+func sameTags(a, b []bookstackapi.Tag) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// coverImage returns the cover image the selector points at and its hash.
+// If the image can't be found, it returns the reason instead.
+func coverImage(ctx context.Context, c client.Client, namespace string, sel *corev1.ConfigMapKeySelector) ([]byte, string, string, error) {
+	var cm corev1.ConfigMap
+	err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: sel.Name}, &cm)
+
+	if apierrors.IsNotFound(err) {
+		return nil, "", fmt.Sprintf("configmap %s not found", sel.Name), nil
+	}
+
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	image, found := cm.BinaryData[sel.Key]
+	if !found {
+		data, inData := cm.Data[sel.Key]
+		if !inData {
+			return nil, "", fmt.Sprintf("configmap %s has no key %s", sel.Name, sel.Key), nil
+		}
+		image = []byte(data)
+	}
+
+	sum := sha256.Sum256(image)
+	return image, hex.EncodeToString(sum[:]), "", nil
+}
+
+// syncContentPermissions applies the permissions to the item of the
+// content type with the ID, if they differ. If a role or the owner can't be
+// found, it returns the reason instead.
+func syncContentPermissions(ctx context.Context, api *bookstackapi.Client, contentType bookstackapi.ContentType, id int, perms *toolsv1alpha1.EntityPermissions) (string, error) {
+	ids, missing, err := roleIDs(ctx, api, perms.RoleNames())
+	if err != nil {
+		return "", err
+	}
+
+	if len(missing) > 0 {
+		return fmt.Sprintf("roles not found: %s", strings.Join(missing, ", ")), nil
+	}
+
+	desired := bookstackapi.ContentPermissionsRequest{
+		RolePermissions:     []bookstackapi.RolePermissions{},
+		FallbackPermissions: &bookstackapi.FallbackPermissions{Inheriting: true},
+	}
+	for i, role := range perms.Roles {
+		desired.RolePermissions = append(desired.RolePermissions, bookstackapi.RolePermissions{
+			RoleID:        ids[i],
+			PermissionSet: permissionSet(role.ContentPermissionSet),
+		})
+	}
+	if perms.Fallback != nil {
+		desired.FallbackPermissions = &bookstackapi.FallbackPermissions{PermissionSet: permissionSet(*perms.Fallback)}
+	}
+	if perms.Owner != "" {
+		if desired.OwnerID, err = userIDByEmail(ctx, api, perms.Owner); err != nil {
+			return "", err
+		}
+
+		if desired.OwnerID == 0 {
+			return fmt.Sprintf("user %s not found", perms.Owner), nil
+		}
+	}
+
+	existing, err := api.GetContentPermissions(ctx, contentType, id)
+	if err != nil {
+		return "", err
+	}
+
+	if samePermissionsRequest(existing, desired) {
+		return "", nil
+	}
+
+	_, err = api.UpdateContentPermissions(ctx, contentType, id, desired)
+	return "", err
+}
+
+// permissionSet returns the actions of set as the API takes them.
+func permissionSet(set toolsv1alpha1.ContentPermissionSet) bookstackapi.PermissionSet {
+	return bookstackapi.PermissionSet{View: set.View, Create: set.Create, Update: set.Update, Delete: set.Delete}
+}
+
+// samePermissionsRequest returns true if the existing permissions are the
+// ones desired. The owner is only compared when desired sets it.
+func samePermissionsRequest(existing *bookstackapi.ContentPermissions, desired bookstackapi.ContentPermissionsRequest) bool {
+	if desired.OwnerID != 0 && (existing.Owner == nil || existing.Owner.ID != desired.OwnerID) {
+		return false
+	}
+
+	if existing.FallbackPermissions != *desired.FallbackPermissions {
+		// the actions of an inheriting fallback don't apply.
+		if !existing.FallbackPermissions.Inheriting || !desired.FallbackPermissions.Inheriting {
+			return false
+		}
+	}
+
+	if len(existing.RolePermissions) != len(desired.RolePermissions) {
+		return false
+	}
+
+	a := append([]bookstackapi.RolePermissions(nil), existing.RolePermissions...)
+	b := append([]bookstackapi.RolePermissions(nil), desired.RolePermissions...)
+	sort.Slice(a, func(i, j int) bool { return a[i].RoleID < a[j].RoleID })
+	sort.Slice(b, func(i, j int) bool { return b[i].RoleID < b[j].RoleID })
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -64,38 +64,45 @@ func (r *BookStackDBStorageReconciler) Reconcile(ctx context.Context, req ctrl.R
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
 
-	// db PV
-	dbPV := instance.NewDBPersistentVolume()
-
-	err = ctrl.SetControllerReference(&instance, &dbPV, r.Scheme)
-	if err != nil {
-		return subrec.Evaluate(subrec.RequeueWithError(err))
+	if instance.IsPaused() {
+		return subrec.Evaluate(subrec.DoNotRequeue())
 	}
 
-	// if existing resource exists, get it and patch it.
-	var existingPV corev1.PersistentVolume
-	err = r.Client.Get(ctx, client.ObjectKeyFromObject(&dbPV), &existingPV)
+	// the PV is only needed when the claim is not dynamically provisioned.
+	if instance.UsesStaticVolumes() {
+		// db PV
+		dbPV := instance.NewDBPersistentVolume()
 
-	if apierrors.IsNotFound(err) {
-		// create the resource because it does not exist.
-		l.Info("creating resource", dbPV.Kind, dbPV.Name)
-		if err := r.Client.Create(ctx, &dbPV); err != nil {
+		err = ctrl.SetControllerReference(&instance, &dbPV, r.Scheme)
+		if err != nil {
 			return subrec.Evaluate(subrec.RequeueWithError(err))
 		}
-	}
 
-	if err != nil {
-		return subrec.Evaluate(subrec.RequeueWithError(err))
-	}
+		// if existing resource exists, get it and patch it.
+		var existingPV corev1.PersistentVolume
+		err = r.Client.Get(ctx, client.ObjectKeyFromObject(&dbPV), &existingPV)
 
-	l.Info("updating resources if necessary", existingPV.Kind, existingPV.GetName())
-	patchDiff := client.MergeFrom(&existingPV)
-	if err = mergo.Merge(&existingPV, dbPV, mergo.WithOverride); err != nil {
-		return subrec.Evaluate(subrec.RequeueWithError(err))
-	}
+		if apierrors.IsNotFound(err) {
+			// create the resource because it does not exist.
+			l.Info("creating resource", dbPV.Kind, dbPV.Name)
+			if err := r.Client.Create(ctx, &dbPV); err != nil {
+				return subrec.Evaluate(subrec.RequeueWithError(err))
+			}
+		}
 
-	if err = r.Patch(ctx, &existingPV, patchDiff); err != nil {
-		return subrec.Evaluate(subrec.RequeueWithError(err))
+		if err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		l.Info("updating resources if necessary", existingPV.Kind, existingPV.GetName())
+		patchDiff := client.MergeFrom(&existingPV)
+		if err = mergo.Merge(&existingPV, dbPV, mergo.WithOverride); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		if err = r.Patch(ctx, &existingPV, patchDiff); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
 	}
 
 	// db pvc
@@ -18,12 +18,20 @@ package controllers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/imdario/mergo"
 	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
 	subrec "github.com/opdev/subreconciler"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -41,6 +49,7 @@ type BookStackDeploymentReconciler struct {
 //+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks/finalizers,verbs=update
 //+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;update;patch
 //+kubebuilder:rbac:groups=apps,resources=deployments/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
 
 // Reconcile will ensure that the Kubernetes Deployment for BookStack
 // reaches the desired state.
@@ -62,8 +71,40 @@ func (r *BookStackDeploymentReconciler) Reconcile(ctx context.Context, req ctrl.
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
 
+	if err = r.reportPaused(ctx, &instance); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if instance.IsPaused() {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err = r.recordDataLayout(ctx, &instance); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if err = r.reportRestrictedCompliance(ctx, &instance); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if res, err := r.reconcileUpgrade(ctx, &instance); subrec.ShouldHaltOrRequeue(res, err) {
+		return subrec.Evaluate(res, err)
+	}
+
+	if err = r.recordScaleDown(ctx, &instance); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	// the image is pinned to the digest the image reconciler recorded in
+	// status.image, the registry is never queried from here.
 	new := instance.NewDeployment()
 
+	secretHash, err := r.appSecretHash(ctx, &instance)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+	new.Spec.Template.Annotations = map[string]string{toolsv1alpha1.AppSecretHashAnnotation: secretHash}
+
 	err = ctrl.SetControllerReference(&instance, &new, r.Scheme)
 	if err != nil {
 		return subrec.Evaluate(subrec.RequeueWithError(err))
@@ -86,22 +127,227 @@ func (r *BookStackDeploymentReconciler) Reconcile(ctx context.Context, req ctrl.
 	}
 
 	l.Info("updating resources if necessary", existing.Kind, existing.GetName())
-	patchDiff := client.MergeFrom(&existing)
+	patchDiff := client.MergeFrom(existing.DeepCopy())
 	if err = mergo.Merge(&existing, new, mergo.WithOverride); err != nil {
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
 
+	// the env, resources and scheduling constraints are replaced, as
+	// merging them would keep the values removed from the spec.
+	for i := range existing.Spec.Template.Spec.Containers {
+		container := &existing.Spec.Template.Spec.Containers[i]
+		if desired := containerNamed(new.Spec.Template.Spec.Containers, container.Name); desired != nil {
+			container.Env = desired.Env
+			container.EnvFrom = desired.EnvFrom
+			container.Resources = desired.Resources
+		}
+	}
+
+	pod := &existing.Spec.Template.Spec
+	pod.NodeSelector = new.Spec.Template.Spec.NodeSelector
+	pod.Tolerations = new.Spec.Template.Spec.Tolerations
+	pod.Affinity = new.Spec.Template.Spec.Affinity
+	pod.TopologySpreadConstraints = new.Spec.Template.Spec.TopologySpreadConstraints
+	pod.PriorityClassName = new.Spec.Template.Spec.PriorityClassName
+
+	// the replicas are otherwise left to kubectl scale or an autoscaler.
+	scaledDown := instance.Status.ScaledDownReplicas
+	if !instance.ScalesToZero() && scaledDown != nil {
+		existing.Spec.Replicas = scaledDown
+	}
+
 	if err = r.Patch(ctx, &existing, patchDiff); err != nil {
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
 
+	if !instance.ScalesToZero() && scaledDown != nil {
+		if err = patchStatus(ctx, r.Client, &instance, func(status *toolsv1alpha1.BookStackStatus) {
+			status.ScaledDownReplicas = nil
+		}); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	if err = r.reportRollout(ctx, &instance, &existing); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if err = r.reportSuspension(ctx, &instance, &existing); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
 	return subrec.Evaluate(subrec.DoNotRequeue()) // success
 }
 
+// containerNamed returns the container with the name, or nil.
+func containerNamed(containers []corev1.Container, name string) *corev1.Container {
+	for i := range containers {
+		if containers[i].Name == name {
+			return &containers[i]
+		}
+	}
+
+	return nil
+}
+
+// appSecretHash returns a hash of the app Secret data, or an empty string
+// until the Secret is created. The pods read the Secret at startup, so the
+// hash is set on them to restart them when it changes.
+func (r *BookStackDeploymentReconciler) appSecretHash(ctx context.Context, instance *toolsv1alpha1.BookStack) (string, error) {
+	secret := instance.NewAppSecret()
+	err := r.Client.Get(ctx, client.ObjectKeyFromObject(&secret), &secret)
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	keys := make([]string, 0, len(secret.Data))
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s=%x\n", key, secret.Data[key])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// reportPaused reports whether reconciliation of the instance is paused.
+// It is reported here for all controllers, which skip paused instances.
+func (r *BookStackDeploymentReconciler) reportPaused(ctx context.Context, instance *toolsv1alpha1.BookStack) error {
+	if !instance.IsPaused() {
+		return removeCondition(ctx, r.Client, instance, toolsv1alpha1.ConditionPaused)
+	}
+
+	return setCondition(ctx, r.Client, instance, metav1.Condition{
+		Type:    toolsv1alpha1.ConditionPaused,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Paused",
+		Message: fmt.Sprintf("the %s annotation is set, changes are not reconciled", toolsv1alpha1.PausedAnnotation),
+	})
+}
+
+// recordDataLayout records the data layout the instance is created with,
+// or that its existing Deployment uses, and reports a rejected switch of
+// hardened mode. The hardened images keep their data in a different
+// layout, so the instance keeps the recorded one rather than starting
+// over on empty directories.
+func (r *BookStackDeploymentReconciler) recordDataLayout(ctx context.Context, instance *toolsv1alpha1.BookStack) error {
+	if instance.Status.DataLayout == "" {
+		layout := instance.SpecDataLayout()
+
+		var existing appsv1.Deployment
+		err := r.Client.Get(ctx, client.ObjectKeyFromObject(instance), &existing)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		if err == nil {
+			layout = toolsv1alpha1.DataLayoutOf(&existing)
+		}
+
+		if err = patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+			status.DataLayout = layout
+		}); err != nil {
+			return err
+		}
+	}
+
+	if instance.SpecDataLayout() == instance.Status.DataLayout {
+		return removeCondition(ctx, r.Client, instance, toolsv1alpha1.ConditionHardenedModeApplied)
+	}
+
+	return setCondition(ctx, r.Client, instance, metav1.Condition{
+		Type:   toolsv1alpha1.ConditionHardenedModeApplied,
+		Status: metav1.ConditionFalse,
+		Reason: "ChangeRejected",
+		Message: fmt.Sprintf("hardened mode can't be switched after creation, the %s images keep their data in a different layout; the instance keeps the %s layout",
+			strings.ToLower(string(instance.SpecDataLayout())), instance.Status.DataLayout),
+	})
+}
+
+// recordScaleDown records the replicas of the instance's Deployment before
+// it scales to zero, so that they are restored afterwards. A Deployment
+// created, or already scaled, to zero is scaled back to one replica.
+func (r *BookStackDeploymentReconciler) recordScaleDown(ctx context.Context, instance *toolsv1alpha1.BookStack) error {
+	if !instance.ScalesToZero() || instance.Status.ScaledDownReplicas != nil {
+		return nil
+	}
+
+	var existing appsv1.Deployment
+	err := r.Client.Get(ctx, client.ObjectKeyFromObject(instance), &existing)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	var replicas int32 = 1
+	if err == nil && existing.Spec.Replicas != nil && *existing.Spec.Replicas > 0 {
+		replicas = *existing.Spec.Replicas
+	}
+
+	return patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+		status.ScaledDownReplicas = &replicas
+	})
+}
+
+// reportRestrictedCompliance reports whether an instance in hardened mode
+// would be admitted under the restricted Pod Security Standard.
+func (r *BookStackDeploymentReconciler) reportRestrictedCompliance(ctx context.Context, instance *toolsv1alpha1.BookStack) error {
+	if !instance.IsHardened() {
+		return removeCondition(ctx, r.Client, instance, toolsv1alpha1.ConditionRestrictedCompliant)
+	}
+
+	cond := metav1.Condition{
+		Type:   toolsv1alpha1.ConditionRestrictedCompliant,
+		Status: metav1.ConditionTrue,
+		Reason: "Compliant",
+	}
+
+	if violations := instance.RestrictedViolations(); len(violations) > 0 {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "Incompatible"
+		cond.Message = strings.Join(violations, "; ")
+	}
+
+	return setCondition(ctx, r.Client, instance, cond)
+}
+
+// reportSuspension reports whether the instance is suspended, once its
+// Deployment has scaled to zero.
+func (r *BookStackDeploymentReconciler) reportSuspension(ctx context.Context, instance *toolsv1alpha1.BookStack, deployment *appsv1.Deployment) error {
+	if !instance.IsSuspended() {
+		return removeCondition(ctx, r.Client, instance, toolsv1alpha1.ConditionSuspended)
+	}
+
+	cond := metav1.Condition{
+		Type:    toolsv1alpha1.ConditionSuspended,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Suspended",
+		Message: "the instance is scaled to zero",
+	}
+
+	if deployment.Status.Replicas > 0 {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "Suspending"
+		cond.Message = fmt.Sprintf("waiting for %d pods to terminate", deployment.Status.Replicas)
+	}
+
+	return setCondition(ctx, r.Client, instance, cond)
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *BookStackDeploymentReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&toolsv1alpha1.BookStack{}).
 		Owns(&appsv1.Deployment{}).
+		Owns(&corev1.Secret{}).
+		Owns(&batchv1.Job{}).
+		Owns(&toolsv1alpha1.BookStackBackup{}).
 		Complete(r)
 }
@@ -0,0 +1,79 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRecordScaleDown(t *testing.T) {
+	int32Ptr := func(i int32) *int32 { return &i }
+
+	tests := []struct {
+		name       string
+		suspended  bool
+		deployment *int32
+		want       *int32
+	}{
+		{name: "running instance", deployment: int32Ptr(3)},
+		{name: "scaled deployment", suspended: true, deployment: int32Ptr(3), want: int32Ptr(3)},
+		{name: "deployment at zero", suspended: true, deployment: int32Ptr(0), want: int32Ptr(1)},
+		{name: "no deployment", suspended: true, want: int32Ptr(1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := &toolsv1alpha1.BookStack{
+				ObjectMeta: metav1.ObjectMeta{Name: "wiki", Namespace: "docs"},
+				Spec:       toolsv1alpha1.BookStackSpec{Suspended: tt.suspended},
+			}
+
+			objects := []client.Object{instance}
+			if tt.deployment != nil {
+				objects = append(objects, &appsv1.Deployment{
+					ObjectMeta: metav1.ObjectMeta{Name: "wiki", Namespace: "docs"},
+					Spec:       appsv1.DeploymentSpec{Replicas: tt.deployment},
+				})
+			}
+
+			scheme := testScheme()
+			c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+			r := &BookStackDeploymentReconciler{Client: c, Scheme: scheme}
+
+			ctx := context.Background()
+			if err := r.recordScaleDown(ctx, instance); err != nil {
+				t.Fatalf("recordScaleDown() error = %v", err)
+			}
+
+			if err := c.Get(ctx, client.ObjectKeyFromObject(instance), instance); err != nil {
+				t.Fatal(err)
+			}
+
+			got := instance.Status.ScaledDownReplicas
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("ScaledDownReplicas = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
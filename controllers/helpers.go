@@ -0,0 +1,126 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// instanceForLabeledObject maps an object to the instance named by its
+// InstanceLabel.
+func instanceForLabeledObject(obj client.Object) []reconcile.Request {
+	name, ok := obj.GetLabels()[toolsv1alpha1.InstanceLabel]
+	if !ok {
+		return nil
+	}
+
+	return []reconcile.Request{
+		{NamespacedName: client.ObjectKey{Namespace: obj.GetNamespace(), Name: name}},
+	}
+}
+
+// isOwnedBy returns true if obj is controlled by owner, which is of the
+// kind. Objects of other kinds may share the owner's name, so the kind and
+// UID are compared.
+func isOwnedBy(obj, owner client.Object, kind string) bool {
+	ref := metav1.GetControllerOf(obj)
+	return ref != nil && ref.Kind == kind && ref.UID == owner.GetUID()
+}
+
+// jobResult returns the termination message written by container in the
+// succeeded pod of job.
+func jobResult(ctx context.Context, c client.Client, job *batchv1.Job, container string) (string, error) {
+	var pods corev1.PodList
+	if err := c.List(ctx, &pods,
+		client.InNamespace(job.Namespace),
+		client.MatchingLabels{"job-name": job.Name},
+	); err != nil {
+		return "", err
+	}
+
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodSucceeded {
+			continue
+		}
+
+		for _, cs := range pod.Status.ContainerStatuses {
+			if cs.Name == container && cs.State.Terminated != nil {
+				return cs.State.Terminated.Message, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no result found for job %s", client.ObjectKeyFromObject(job))
+}
+
+// appImageOf returns the image of the BookStack container of deployment,
+// or an empty string if it has none.
+func appImageOf(deployment *appsv1.Deployment) string {
+	for _, c := range deployment.Spec.Template.Spec.Containers {
+		if c.Name == "bookstack" {
+			return c.Image
+		}
+	}
+
+	return ""
+}
+
+// retryFailedJob keeps the failed job for inspection until it failed
+// longer than backoff ago, returning how much longer it is kept, then
+// deletes it so that it is created again. It returns 0 once the job is
+// deleted.
+func retryFailedJob(ctx context.Context, c client.Client, job *batchv1.Job, backoff time.Duration) (time.Duration, error) {
+	for _, cond := range job.Status.Conditions {
+		if cond.Type != batchv1.JobFailed || cond.Status != corev1.ConditionTrue {
+			continue
+		}
+
+		if wait := backoff - time.Since(cond.LastTransitionTime.Time); wait > 0 {
+			return wait, nil
+		}
+	}
+
+	err := c.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return 0, err
+	}
+
+	return 0, nil
+}
+
+// jobFailure returns the reason a Job failed, or an empty string if it has
+// not failed.
+func jobFailure(job *batchv1.Job) string {
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			return fmt.Sprintf("job %s failed: %s", job.Name, c.Message)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,319 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	"github.com/opdev/bookstack-operator/internal/registry"
+	subrec "github.com/opdev/subreconciler"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// registryRetryInterval is how soon a failed registry query is retried.
+const registryRetryInterval = time.Minute
+
+// upgradeResolveTimeout is how long the migrations of an upgrade wait for
+// the digest of the new version before the upgrade fails.
+const upgradeResolveTimeout = 30 * time.Minute
+
+// BookStackImageReconciler resolves the digest of the BookStack image and
+// checks the update channel for newer versions.
+type BookStackImageReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks,verbs=get;list;watch
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks/status,verbs=get;update;patch
+
+// Reconcile will pin the BookStack image to its digest and report the
+// newer versions in the update channel.
+func (r *BookStackImageReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("image reconciliation initiated.")
+	defer l.Info("image reconciliation complete.")
+
+	var instance toolsv1alpha1.BookStack
+	err := r.Client.Get(ctx, req.NamespacedName, &instance)
+
+	if apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if instance.IsPaused() {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err = r.pinDigest(ctx, &instance); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	resolved, err := r.pinUpgradeDigest(ctx, &instance)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	next, err := r.checkChannel(ctx, &instance)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if !resolved || meta.IsStatusConditionFalse(instance.Status.Conditions, toolsv1alpha1.ConditionDigestPinned) {
+		next = registryRetryInterval
+	}
+
+	if next > 0 {
+		return subrec.Evaluate(subrec.RequeueWithDelay(next))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// checkChannel reports the newest version in the update channel, if it is
+// due for a check, returning how soon it is due again. The channel is also
+// checked once the instance runs the version reported as available.
+func (r *BookStackImageReconciler) checkChannel(ctx context.Context, instance *toolsv1alpha1.BookStack) (time.Duration, error) {
+	status := instance.Status.Image
+
+	if instance.UpdateChannel() == "" {
+		if status != nil && (status.AvailableVersion != "" || status.LastCheckTime != nil) {
+			err := patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+				status.Image.AvailableVersion = ""
+				status.Image.LastCheckTime = nil
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		return 0, removeCondition(ctx, r.Client, instance, toolsv1alpha1.ConditionUpgradeAvailable)
+	}
+
+	interval := instance.UpdateCheckInterval()
+	if status != nil && status.LastCheckTime != nil {
+		stale := status.AvailableVersion != "" && instance.NewestInChannel([]string{status.AvailableVersion}) == ""
+		if due := time.Until(status.LastCheckTime.Add(interval)); due > 0 && !stale {
+			return due, nil
+		}
+	}
+
+	image := instance.TagImage()
+	ref, err := registry.ParseReference(image)
+	if err != nil {
+		return 0, err
+	}
+
+	tags, err := registryClient(instance).Tags(ctx, ref)
+	if err != nil {
+		err = setCondition(ctx, r.Client, instance, metav1.Condition{
+			Type:    toolsv1alpha1.ConditionUpgradeAvailable,
+			Status:  metav1.ConditionUnknown,
+			Reason:  "CheckFailed",
+			Message: err.Error(),
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		return registryRetryInterval, nil
+	}
+
+	available := instance.NewestInChannel(tags)
+
+	now := metav1.Now()
+	err = patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+		if status.Image == nil {
+			status.Image = &toolsv1alpha1.ImageStatus{}
+		}
+		status.Image.AvailableVersion = available
+		status.Image.LastCheckTime = &now
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	cond := metav1.Condition{
+		Type:    toolsv1alpha1.ConditionUpgradeAvailable,
+		Status:  metav1.ConditionFalse,
+		Reason:  "UpToDate",
+		Message: fmt.Sprintf("no newer version of %s in the %s channel", image, instance.UpdateChannel()),
+	}
+
+	if available != "" {
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "NewerVersion"
+		cond.Message = fmt.Sprintf("%s is available in the %s channel", available, instance.UpdateChannel())
+	}
+
+	return interval, setCondition(ctx, r.Client, instance, cond)
+}
+
+// pinDigest resolves the digest of the instance's image when it is pinned
+// and the digest of its current tag isn't resolved yet. The outcome is
+// reported in the DigestPinned condition, and the instance runs its image
+// by tag until the digest is resolved. This is the only place the digest
+// is resolved, the Deployment reads it from status.image.
+func (r *BookStackImageReconciler) pinDigest(ctx context.Context, instance *toolsv1alpha1.BookStack) error {
+	if !instance.PinsDigest() {
+		if status := instance.Status.Image; status != nil && status.Digest != "" {
+			err := patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+				status.Image.Image = ""
+				status.Image.Digest = ""
+				status.Image.ResolvedTime = nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return removeCondition(ctx, r.Client, instance, toolsv1alpha1.ConditionDigestPinned)
+	}
+
+	if instance.PinnedDigest() != "" {
+		return nil
+	}
+
+	image := instance.TagImage()
+	ref, err := registry.ParseReference(image)
+	if err != nil {
+		return err
+	}
+
+	digest, err := registryClient(instance).Digest(ctx, ref)
+	if err != nil {
+		return setCondition(ctx, r.Client, instance, metav1.Condition{
+			Type:    toolsv1alpha1.ConditionDigestPinned,
+			Status:  metav1.ConditionFalse,
+			Reason:  "ResolutionFailed",
+			Message: err.Error(),
+		})
+	}
+
+	now := metav1.Now()
+	err = patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+		if status.Image == nil {
+			status.Image = &toolsv1alpha1.ImageStatus{}
+		}
+		status.Image.Image = image
+		status.Image.Digest = digest
+		status.Image.ResolvedTime = &now
+	})
+	if err != nil {
+		return err
+	}
+
+	return setCondition(ctx, r.Client, instance, metav1.Condition{
+		Type:    toolsv1alpha1.ConditionDigestPinned,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Resolved",
+		Message: fmt.Sprintf("%s resolved to %s", image, digest),
+	})
+}
+
+// pinUpgradeDigest resolves the digest of the version an upgrade moves to
+// when the instance pins its digest, so that its migrations run the image
+// that is then rolled out. It returns false if the digest could not be
+// resolved, reporting why in the upgrade, which fails once its migrations
+// waited for longer than upgradeResolveTimeout.
+func (r *BookStackImageReconciler) pinUpgradeDigest(ctx context.Context, instance *toolsv1alpha1.BookStack) (bool, error) {
+	image := instance.UpgradeTargetImage()
+	if image == "" || !instance.PinsDigest() {
+		if status := instance.Status.Image; status != nil && status.UpgradeImage != "" {
+			err := patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+				status.Image.UpgradeImage = ""
+				status.Image.UpgradeDigest = ""
+			})
+			if err != nil {
+				return false, err
+			}
+		}
+
+		return true, nil
+	}
+
+	if instance.UpgradeDigest() != "" {
+		return true, nil
+	}
+
+	ref, err := registry.ParseReference(image)
+	if err != nil {
+		return false, err
+	}
+
+	digest, err := registryClient(instance).Digest(ctx, ref)
+	if err != nil {
+		upgrade := instance.Status.Upgrade
+		if upgrade.Phase == toolsv1alpha1.UpgradePhaseMigrating && upgrade.MigrationStartTime != nil &&
+			time.Since(upgrade.MigrationStartTime.Time) > upgradeResolveTimeout {
+			now := metav1.Now()
+			return false, patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+				status.Upgrade.Phase = toolsv1alpha1.UpgradePhaseFailed
+				status.Upgrade.Message = fmt.Sprintf("unable to resolve the digest of %s within %s: %v", image, upgradeResolveTimeout, err)
+				status.Upgrade.CompletionTime = &now
+			})
+		}
+
+		message := fmt.Sprintf("%s%s failed: %v", upgradeResolvingPrefix, image, err)
+		if instance.Status.Upgrade.Message == message {
+			return false, nil
+		}
+
+		return false, patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+			status.Upgrade.Message = message
+		})
+	}
+
+	return true, patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+		if status.Image == nil {
+			status.Image = &toolsv1alpha1.ImageStatus{}
+		}
+		status.Image.UpgradeImage = image
+		status.Image.UpgradeDigest = digest
+	})
+}
+
+// registryClient returns the client for the registry of the instance's
+// image.
+func registryClient(instance *toolsv1alpha1.BookStack) *registry.Client {
+	policy := instance.Spec.ImagePolicy
+	if policy == nil {
+		return registry.NewClient("", false)
+	}
+
+	return registry.NewClient(policy.Registry, policy.InsecureSkipTLSVerify)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BookStackImageReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&toolsv1alpha1.BookStack{}).
+		Complete(r)
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/imdario/mergo"
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	subrec "github.com/opdev/subreconciler"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// maintenancePollInterval is how often the maintenance controller checks
+// whether the Service has switched back to BookStack.
+const maintenancePollInterval = 2 * time.Second
+
+// BookStackMaintenanceReconciler serves a maintenance page in place of
+// BookStack while the instance is in maintenance mode.
+type BookStackMaintenanceReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks,verbs=get;list;watch
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch
+
+// Reconcile will run the maintenance page while the instance is in
+// maintenance mode, and report in the Maintenance condition whether the
+// Service routes to it. The Service is switched by the service controller.
+func (r *BookStackMaintenanceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("maintenance reconciliation initiated.")
+	defer l.Info("maintenance reconciliation complete.")
+
+	var instance toolsv1alpha1.BookStack
+	err := r.Client.Get(ctx, req.NamespacedName, &instance)
+
+	if apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if instance.IsPaused() {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	if instance.InMaintenance() {
+		return r.enterMaintenance(ctx, &instance)
+	}
+
+	return r.exitMaintenance(ctx, &instance)
+}
+
+// enterMaintenance runs the maintenance page, switching the Service to it
+// once it is available.
+func (r *BookStackMaintenanceReconciler) enterMaintenance(ctx context.Context, instance *toolsv1alpha1.BookStack) (ctrl.Result, error) {
+	newCM := instance.NewMaintenanceConfigMap()
+	if err := r.apply(ctx, instance, &newCM, &corev1.ConfigMap{}); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	newDeployment := instance.NewMaintenanceDeployment()
+	var existing appsv1.Deployment
+	if err := r.apply(ctx, instance, &newDeployment, &existing); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	cond := metav1.Condition{
+		Type:    toolsv1alpha1.ConditionMaintenance,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Enabled",
+		Message: "the Service serves the maintenance page",
+	}
+
+	// once switched, the Service stays on the maintenance page even if
+	// its pod restarts.
+	if existing.Status.AvailableReplicas == 0 && !instance.ServesMaintenancePage() {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "Enabling"
+		cond.Message = "waiting for the maintenance page to become available"
+	}
+
+	if err := setCondition(ctx, r.Client, instance, cond); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// exitMaintenance switches the Service back to BookStack, removing the
+// maintenance page once it no longer routes to it.
+func (r *BookStackMaintenanceReconciler) exitMaintenance(ctx context.Context, instance *toolsv1alpha1.BookStack) (ctrl.Result, error) {
+	if meta.FindStatusCondition(instance.Status.Conditions, toolsv1alpha1.ConditionMaintenance) == nil {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	err := setCondition(ctx, r.Client, instance, metav1.Condition{
+		Type:    toolsv1alpha1.ConditionMaintenance,
+		Status:  metav1.ConditionFalse,
+		Reason:  "Disabling",
+		Message: "waiting for the Service to route to BookStack",
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	desired := instance.NewService()
+	var svc corev1.Service
+	err = r.Client.Get(ctx, client.ObjectKeyFromObject(&desired), &svc)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if err == nil && !equality.Semantic.DeepEqual(svc.Spec.Selector, desired.Spec.Selector) {
+		return subrec.Evaluate(subrec.RequeueWithDelay(maintenancePollInterval))
+	}
+
+	deployment := instance.NewMaintenanceDeployment()
+	cm := instance.NewMaintenanceConfigMap()
+	for _, obj := range []client.Object{&deployment, &cm} {
+		if err := r.Client.Delete(ctx, obj); err != nil && !apierrors.IsNotFound(err) {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	if err = removeCondition(ctx, r.Client, instance, toolsv1alpha1.ConditionMaintenance); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	return subrec.Evaluate(subrec.DoNotRequeue())
+}
+
+// apply creates new, owned by the instance, or patches the existing object
+// into existing.
+func (r *BookStackMaintenanceReconciler) apply(ctx context.Context, instance *toolsv1alpha1.BookStack, new, existing client.Object) error {
+	l := log.FromContext(ctx)
+
+	if err := ctrl.SetControllerReference(instance, new, r.Scheme); err != nil {
+		return err
+	}
+
+	err := r.Client.Get(ctx, client.ObjectKeyFromObject(new), existing)
+
+	if apierrors.IsNotFound(err) {
+		l.Info("creating resource", new.GetObjectKind().GroupVersionKind().Kind, new.GetName())
+		return r.Client.Create(ctx, new)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	patchDiff := client.MergeFrom(existing.DeepCopyObject().(client.Object))
+	if err = mergo.Merge(existing, new, mergo.WithOverride); err != nil {
+		return err
+	}
+
+	return r.Patch(ctx, existing, patchDiff)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BookStackMaintenanceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&toolsv1alpha1.BookStack{}).
+		Owns(&appsv1.Deployment{}).
+		Owns(&corev1.ConfigMap{}).
+		Complete(r)
+}
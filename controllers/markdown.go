@@ -0,0 +1,126 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/opdev/bookstack-operator/internal/bookstackapi"
+	"sigs.k8s.io/yaml"
+)
+
+// markdownPage is a page read from a Markdown file.
+type markdownPage struct {
+	// Key identifies the file the page was read from.
+	Key string
+	// Book and Chapter are the names of the book and chapter the page is
+	// in. Chapter is empty for a page directly in the book.
+	Book    string
+	Chapter string
+	// Title is the name of the page.
+	Title    string
+	Priority int
+	Tags     []bookstackapi.Tag
+	// Markdown is the content of the file, without its front-matter.
+	Markdown string
+	// Hash identifies the file and the book it is synced into.
+	Hash string
+}
+
+// frontMatter is the YAML header of a Markdown file, between --- lines.
+type frontMatter struct {
+	Title    string            `json:"title,omitempty"`
+	Book     string            `json:"book,omitempty"`
+	Chapter  string            `json:"chapter,omitempty"`
+	Priority int               `json:"priority,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+// parseMarkdownPage reads the Markdown file with the key. The page is in
+// defaultBook unless its front-matter names another book, and is named
+// after its front-matter title, its first heading or its file name. CRLF
+// line endings are read as LF, e.g. for files checked out on Windows.
+func parseMarkdownPage(key, content, defaultBook string) (markdownPage, error) {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+
+	var fm frontMatter
+	body := content
+	if rest := strings.TrimPrefix(content, "---\n"); rest != content {
+		end := strings.Index(rest, "\n---\n")
+		if end < 0 && strings.HasSuffix(rest, "\n---") {
+			end = len(rest) - len("\n---")
+		}
+		if end < 0 {
+			return markdownPage{}, fmt.Errorf("%s: unterminated front-matter", key)
+		}
+
+		if err := yaml.Unmarshal([]byte(rest[:end]), &fm); err != nil {
+			return markdownPage{}, fmt.Errorf("%s: invalid front-matter: %w", key, err)
+		}
+		body = strings.TrimPrefix(strings.TrimPrefix(rest[end:], "\n---"), "\n")
+	}
+
+	page := markdownPage{
+		Key:      key,
+		Book:     fm.Book,
+		Chapter:  fm.Chapter,
+		Title:    fm.Title,
+		Priority: fm.Priority,
+		Markdown: body,
+	}
+	if page.Book == "" {
+		page.Book = defaultBook
+	}
+	if page.Title == "" {
+		page.Title = firstHeading(body)
+	}
+	if page.Title == "" {
+		page.Title = strings.TrimSuffix(path.Base(key), ".md")
+	}
+	if page.Book == "" {
+		return markdownPage{}, fmt.Errorf("%s: no book set in the front-matter or the spec", key)
+	}
+
+	for name, value := range fm.Tags {
+		page.Tags = append(page.Tags, bookstackapi.Tag{Name: name, Value: value})
+	}
+	sort.Slice(page.Tags, func(i, j int) bool { return page.Tags[i].Name < page.Tags[j].Name })
+
+	sum := sha256.Sum256([]byte(defaultBook + "\x00" + content))
+	page.Hash = hex.EncodeToString(sum[:])
+
+	return page, nil
+}
+
+// firstHeading returns the text of the first level one heading of the
+// Markdown, or an empty string if it has none.
+func firstHeading(markdown string) string {
+	scanner := bufio.NewScanner(strings.NewReader(markdown))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); strings.HasPrefix(line, "# ") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "# "))
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opdev/bookstack-operator/internal/bookstackapi"
+)
+
+func TestParseMarkdownPage(t *testing.T) {
+	tests := []struct {
+		name        string
+		key         string
+		content     string
+		defaultBook string
+		want        markdownPage
+		wantErr     string
+	}{
+		{
+			name:        "front-matter",
+			key:         "runbooks/restart.md",
+			content:     "---\ntitle: Restarting\nbook: Runbooks\nchapter: Operations\npriority: 3\ntags:\n  team: sre\n  env: prod\n---\n# Restart\n\nSteps.\n",
+			defaultBook: "Docs",
+			want: markdownPage{
+				Key:      "runbooks/restart.md",
+				Book:     "Runbooks",
+				Chapter:  "Operations",
+				Title:    "Restarting",
+				Priority: 3,
+				Tags:     []bookstackapi.Tag{{Name: "env", Value: "prod"}, {Name: "team", Value: "sre"}},
+				Markdown: "# Restart\n\nSteps.\n",
+			},
+		},
+		{
+			name:        "front-matter only",
+			key:         "empty.md",
+			content:     "---\ntitle: Empty\n---",
+			defaultBook: "Docs",
+			want:        markdownPage{Key: "empty.md", Book: "Docs", Title: "Empty", Markdown: ""},
+		},
+		{
+			name:        "CRLF front-matter",
+			key:         "windows.md",
+			content:     "---\r\ntitle: Windows\r\nbook: Runbooks\r\n---\r\n# Heading\r\n\r\nBody.\r\n",
+			defaultBook: "Docs",
+			want:        markdownPage{Key: "windows.md", Book: "Runbooks", Title: "Windows", Markdown: "# Heading\n\nBody.\n"},
+		},
+		{
+			name:        "title from the first heading",
+			key:         "guide.md",
+			content:     "Intro.\n\n## Not this one\n\n#  Getting Started \n",
+			defaultBook: "Docs",
+			want:        markdownPage{Key: "guide.md", Book: "Docs", Title: "Getting Started", Markdown: "Intro.\n\n## Not this one\n\n#  Getting Started \n"},
+		},
+		{
+			name:        "title from the file name",
+			key:         "notes/on-call.md",
+			content:     "No heading.\n",
+			defaultBook: "Docs",
+			want:        markdownPage{Key: "notes/on-call.md", Book: "Docs", Title: "on-call", Markdown: "No heading.\n"},
+		},
+		{
+			name:        "unterminated front-matter",
+			key:         "broken.md",
+			content:     "---\ntitle: Broken\n# Heading\n",
+			defaultBook: "Docs",
+			wantErr:     "broken.md: unterminated front-matter",
+		},
+		{
+			name:        "invalid front-matter",
+			key:         "invalid.md",
+			content:     "---\ntitle: [unclosed\n---\n",
+			defaultBook: "Docs",
+			wantErr:     "invalid.md: invalid front-matter",
+		},
+		{
+			name:    "no book",
+			key:     "orphan.md",
+			content: "# Orphan\n",
+			wantErr: "orphan.md: no book set",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMarkdownPage(tt.key, tt.content, tt.defaultBook)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("parseMarkdownPage() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMarkdownPage() error = %v", err)
+			}
+
+			if got.Hash == "" {
+				t.Errorf("parseMarkdownPage() returned no hash")
+			}
+			got.Hash = ""
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMarkdownPage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMarkdownPageHash(t *testing.T) {
+	const content = "---\ntitle: Page\n---\nBody.\n"
+
+	hash := func(content, defaultBook string) string {
+		t.Helper()
+		page, err := parseMarkdownPage("page.md", content, defaultBook)
+		if err != nil {
+			t.Fatalf("parseMarkdownPage() error = %v", err)
+		}
+		return page.Hash
+	}
+
+	tests := []struct {
+		name        string
+		content     string
+		defaultBook string
+		wantSame    bool
+	}{
+		{name: "same content", content: content, defaultBook: "Docs", wantSame: true},
+		{name: "CRLF line endings", content: strings.ReplaceAll(content, "\n", "\r\n"), defaultBook: "Docs", wantSame: true},
+		{name: "changed body", content: content + "More.\n", defaultBook: "Docs"},
+		{name: "changed front-matter", content: strings.Replace(content, "Page", "Other", 1), defaultBook: "Docs"},
+		{name: "changed default book", content: content, defaultBook: "Runbooks"},
+	}
+
+	want := hash(content, "Docs")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := hash(tt.content, tt.defaultBook) == want; same != tt.wantSame {
+				t.Errorf("hash unchanged = %v, want %v", same, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestFirstHeading(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		want     string
+	}{
+		{name: "first line", markdown: "# Title\nBody.", want: "Title"},
+		{name: "after text", markdown: "Intro.\n# Title\n", want: "Title"},
+		{name: "indented", markdown: "   # Title  \n", want: "Title"},
+		{name: "level two only", markdown: "## Section\n", want: ""},
+		{name: "first of several", markdown: "# One\n# Two\n", want: "One"},
+		{name: "no space", markdown: "#hashtag\n", want: ""},
+		{name: "empty", markdown: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := firstHeading(tt.markdown); got != tt.want {
+				t.Errorf("firstHeading() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
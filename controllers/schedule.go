@@ -0,0 +1,175 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/imdario/mergo"
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// scheduleResult is the outcome of the Jobs of a scheduled CronJob, e.g.
+// the backups, as recorded in the instance status.
+type scheduleResult struct {
+	SuccessTime    *metav1.Time
+	SizeBytes      int64
+	Location       string
+	FailureTime    *metav1.Time
+	FailureMessage string
+}
+
+// applyCronJob creates the CronJob, owned by the instance, or patches the
+// existing one to match it.
+func applyCronJob(ctx context.Context, c client.Client, scheme *runtime.Scheme, instance *toolsv1alpha1.BookStack, new batchv1.CronJob) error {
+	l := log.FromContext(ctx)
+
+	if err := ctrl.SetControllerReference(instance, &new, scheme); err != nil {
+		return err
+	}
+
+	var existing batchv1.CronJob
+	err := c.Get(ctx, client.ObjectKeyFromObject(&new), &existing)
+
+	if apierrors.IsNotFound(err) {
+		l.Info("creating resource", new.Kind, new.Name)
+		return c.Create(ctx, &new)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	l.Info("updating resources if necessary", existing.Kind, existing.GetName())
+	patchDiff := client.MergeFrom(existing.DeepCopy())
+	if err = mergo.Merge(&existing, new, mergo.WithOverride); err != nil {
+		return err
+	}
+
+	// set explicitly, as mergo may skip the false value and keep the
+	// CronJob suspended once it should run again.
+	existing.Spec.Suspend = new.Spec.Suspend
+
+	return c.Patch(ctx, &existing, patchDiff)
+}
+
+// deleteCronJob removes the CronJob with the name, if it exists.
+func deleteCronJob(ctx context.Context, c client.Client, namespace, name string) error {
+	existing := batchv1.CronJob{}
+	existing.Name = name
+	existing.Namespace = namespace
+
+	if err := c.Delete(ctx, &existing); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// lastScheduleResult returns last updated with the most recent succeeded
+// and failed Jobs of the CronJob, and whether it changed. A succeeded Job
+// whose result can't be read, e.g. because its pod was evicted, is
+// recorded as a failure with the reason rather than retried, as the
+// result won't come back.
+func lastScheduleResult(ctx context.Context, c client.Client, instance *toolsv1alpha1.BookStack, cronJobName string, last scheduleResult) (scheduleResult, bool, error) {
+	var cronJob batchv1.CronJob
+	err := c.Get(ctx, client.ObjectKey{Namespace: instance.Namespace, Name: cronJobName}, &cronJob)
+
+	if apierrors.IsNotFound(err) {
+		return last, false, nil
+	}
+
+	if err != nil {
+		return last, false, err
+	}
+
+	var jobs batchv1.JobList
+	if err := c.List(ctx, &jobs,
+		client.InNamespace(instance.Namespace),
+		client.MatchingLabels{toolsv1alpha1.InstanceLabel: instance.Name},
+	); err != nil {
+		return last, false, err
+	}
+
+	var succeeded, failed *batchv1.Job
+	var failedAt metav1.Time
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if !isOwnedBy(job, &cronJob, "CronJob") {
+			continue
+		}
+
+		if job.Status.Succeeded > 0 && job.Status.CompletionTime != nil {
+			if succeeded == nil || job.Status.CompletionTime.After(succeeded.Status.CompletionTime.Time) {
+				succeeded = job
+			}
+		}
+
+		for _, cond := range job.Status.Conditions {
+			if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue &&
+				(failed == nil || cond.LastTransitionTime.After(failedAt.Time)) {
+				failed, failedAt = job, cond.LastTransitionTime
+			}
+		}
+	}
+
+	next := last
+	changed := false
+
+	if succeeded != nil && (last.SuccessTime == nil || succeeded.Status.CompletionTime.After(last.SuccessTime.Time)) {
+		next.SuccessTime = succeeded.Status.CompletionTime
+		next.SizeBytes = 0
+		next.Location = ""
+		changed = true
+
+		result, err := scheduledJobResult(ctx, c, succeeded)
+		if err != nil {
+			next.FailureTime = succeeded.Status.CompletionTime
+			next.FailureMessage = err.Error()
+		} else {
+			next.SizeBytes = result.SizeBytes
+			next.Location = result.Location
+		}
+	}
+
+	if failed != nil && (last.FailureTime == nil || failedAt.After(last.FailureTime.Time)) {
+		next.FailureTime = &failedAt
+		next.FailureMessage = jobFailure(failed)
+		changed = true
+	}
+
+	return next, changed, nil
+}
+
+// scheduledJobResult reads the result of the succeeded job.
+func scheduledJobResult(ctx context.Context, c client.Client, job *batchv1.Job) (toolsv1alpha1.BackupResult, error) {
+	message, err := jobResult(ctx, c, job, toolsv1alpha1.BackupResultContainer)
+	if err != nil {
+		return toolsv1alpha1.BackupResult{}, fmt.Errorf("unable to read the result of job %s: %w", job.Name, err)
+	}
+
+	return toolsv1alpha1.ParseBackupResult(message)
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestLastScheduleResult(t *testing.T) {
+	instance := &toolsv1alpha1.BookStack{ObjectMeta: metav1.ObjectMeta{Name: "wiki", Namespace: "docs"}}
+
+	cronJob := &batchv1.CronJob{ObjectMeta: metav1.ObjectMeta{
+		Name:      instance.GetBackupCronJobName(),
+		Namespace: "docs",
+		UID:       types.UID("cronjob-uid"),
+	}}
+
+	// failedJob returns a failed Job of the instance controlled by an
+	// owner of the kind, named like the CronJob.
+	failedJob := func(name, kind string, uid types.UID, at time.Time) *batchv1.Job {
+		controller := true
+		return &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "docs",
+				Labels:    map[string]string{toolsv1alpha1.InstanceLabel: "wiki"},
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: kind, Name: cronJob.Name, UID: uid, Controller: &controller},
+				},
+			},
+			Status: batchv1.JobStatus{
+				Conditions: []batchv1.JobCondition{
+					{
+						Type:               batchv1.JobFailed,
+						Status:             corev1.ConditionTrue,
+						Reason:             "BackoffLimitExceeded",
+						Message:            name + " failed",
+						LastTransitionTime: metav1.NewTime(at),
+					},
+				},
+			},
+		}
+	}
+
+	now := time.Now().Truncate(time.Second)
+
+	scheme := testScheme()
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		cronJob,
+		failedJob("wiki-backup-27000000", "CronJob", cronJob.UID, now.Add(-time.Hour)),
+		// an on-demand backup named like the CronJob, failing later.
+		failedJob("wiki-backup-ondemand", "BookStackBackup", types.UID("backup-uid"), now),
+		// a Job left by a deleted CronJob of the same name.
+		failedJob("wiki-backup-26000000", "CronJob", types.UID("old-uid"), now),
+	).Build()
+
+	got, changed, err := lastScheduleResult(context.Background(), c, instance, cronJob.Name, scheduleResult{})
+	if err != nil {
+		t.Fatalf("lastScheduleResult() error = %v", err)
+	}
+
+	if !changed {
+		t.Fatal("lastScheduleResult() changed = false, want true")
+	}
+
+	if got.FailureTime == nil || !got.FailureTime.Time.Equal(now.Add(-time.Hour)) {
+		t.Errorf("FailureTime = %v, want %v", got.FailureTime, now.Add(-time.Hour))
+	}
+
+	if got.SuccessTime != nil {
+		t.Errorf("SuccessTime = %v, want nil", got.SuccessTime)
+	}
+}
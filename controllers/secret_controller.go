@@ -18,6 +18,7 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/imdario/mergo"
 	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
@@ -27,7 +28,10 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 // BookStackSecretReconciler reconciles the deployment resource.
@@ -41,6 +45,8 @@ type BookStackSecretReconciler struct {
 //+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstacks/finalizers,verbs=update
 //+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;update;patch
 //+kubebuilder:rbac:groups=core,resources=configmaps/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=core,resources=secrets/finalizers,verbs=update
 
 // Reconcile will ensure that the Kubernetes Secret for BookStack
 // reaches the desired state.
@@ -62,9 +68,36 @@ func (r *BookStackSecretReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
 
+	if instance.IsPaused() {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
 	// app
 	newAppSecret := instance.NewAppSecret()
 
+	// the configmap reconciler reports invalid auth configuration, so
+	// just wait for the spec to change.
+	if err = instance.ValidateAuth(); err != nil {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	// copy sensitive auth settings from the user-provided secrets.
+	for setting, ref := range instance.AuthSecretRefs() {
+		var refSecret corev1.Secret
+		refSecretKey := client.ObjectKey{Namespace: instance.Namespace, Name: ref.Name}
+		if err = r.Client.Get(ctx, refSecretKey, &refSecret); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+
+		value, ok := refSecret.Data[ref.Key]
+		if !ok {
+			return subrec.Evaluate(subrec.RequeueWithError(
+				fmt.Errorf("key %q not found in secret %s", ref.Key, refSecretKey)))
+		}
+
+		newAppSecret.Data[setting] = value
+	}
+
 	err = ctrl.SetControllerReference(&instance, &newAppSecret, r.Scheme)
 	if err != nil {
 		return subrec.Evaluate(subrec.RequeueWithError(err))
@@ -87,11 +120,15 @@ func (r *BookStackSecretReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 	}
 
 	l.Info("updating resources if necessary", existingAppSecret.Kind, existingAppSecret.GetName())
-	patchDiff := client.MergeFrom(&existingAppSecret)
+	patchDiff := client.MergeFrom(existingAppSecret.DeepCopy())
 	if err = mergo.Merge(&existingAppSecret, newAppSecret, mergo.WithOverride); err != nil {
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
 
+	// the data is replaced, as merging it would keep the settings of auth
+	// methods no longer in use.
+	existingAppSecret.Data = newAppSecret.Data
+
 	if err = r.Patch(ctx, &existingAppSecret, patchDiff); err != nil {
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
@@ -121,11 +158,13 @@ func (r *BookStackSecretReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 	}
 
 	l.Info("updating resources if necessary", existingDBSecret.Kind, existingDBSecret.GetName())
-	DBCMpatchDiff := client.MergeFrom(&existingDBSecret)
+	DBCMpatchDiff := client.MergeFrom(existingDBSecret.DeepCopy())
 	if err = mergo.Merge(&existingDBSecret, newDBSecret, mergo.WithOverride); err != nil {
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
 
+	existingDBSecret.Data = newDBSecret.Data
+
 	if err = r.Patch(ctx, &existingDBSecret, DBCMpatchDiff); err != nil {
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
@@ -138,5 +177,32 @@ func (r *BookStackSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&toolsv1alpha1.BookStack{}).
 		Owns(&corev1.Secret{}).
+		// the auth settings are copied from the user's Secrets, so copy
+		// them again when they change.
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			return instancesReferencingSecret(r.Client, obj)
+		})).
 		Complete(r)
 }
+
+// instancesReferencingSecret maps the Secret obj to the instances whose
+// auth settings reference it.
+func instancesReferencingSecret(c client.Client, obj client.Object) []reconcile.Request {
+	var instances toolsv1alpha1.BookStackList
+	if err := c.List(context.Background(), &instances, client.InNamespace(obj.GetNamespace())); err != nil {
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for i := range instances.Items {
+		instance := &instances.Items[i]
+		for _, ref := range instance.AuthSecretRefs() {
+			if ref.Name == obj.GetName() {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+				break
+			}
+		}
+	}
+
+	return requests
+}
@@ -62,6 +62,10 @@ func (r *BookStackServiceAccountReconciler) Reconcile(ctx context.Context, req c
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
 
+	if instance.IsPaused() {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
 	new := instance.NewServiceAccount()
 
 	err = ctrl.SetControllerReference(&instance, &new, r.Scheme)
@@ -62,6 +62,10 @@ func (r *BookStackServiceReconciler) Reconcile(ctx context.Context, req ctrl.Req
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
 
+	if instance.IsPaused() {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
 	newBookstackSvc := instance.NewService()
 
 	err = ctrl.SetControllerReference(&instance, &newBookstackSvc, r.Scheme)
@@ -86,15 +90,53 @@ func (r *BookStackServiceReconciler) Reconcile(ctx context.Context, req ctrl.Req
 	}
 
 	l.Info("updating service if necessary")
-	patchDiff := client.MergeFrom(&existingSvc)
+	patchDiff := client.MergeFrom(existingSvc.DeepCopy())
 	if err = mergo.Merge(&existingSvc, newBookstackSvc, mergo.WithOverride); err != nil {
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
 
+	// set explicitly, as merging the selector would keep the labels of the
+	// pods the Service routed to before, e.g. the maintenance page.
+	existingSvc.Spec.Selector = newBookstackSvc.Spec.Selector
+
 	if err = r.Patch(ctx, &existingSvc, patchDiff); err != nil {
 		return subrec.Evaluate(subrec.RequeueWithError(err))
 	}
 
+	// db service
+	newDBSvc := instance.NewDBService()
+
+	err = ctrl.SetControllerReference(&instance, &newDBSvc, r.Scheme)
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	// If db service exists, get it and patch it
+	var existingDBSvc corev1.Service
+	err = r.Client.Get(ctx, client.ObjectKeyFromObject(&newDBSvc), &existingDBSvc)
+
+	if apierrors.IsNotFound(err) {
+		// Create resource
+		l.Info("creating resource", newDBSvc.Kind, newDBSvc.Name)
+		if err := r.Client.Create(ctx, &newDBSvc); err != nil {
+			return subrec.Evaluate(subrec.RequeueWithError(err))
+		}
+	}
+
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	l.Info("updating db service if necessary")
+	dbPatchDiff := client.MergeFrom(existingDBSvc.DeepCopy())
+	if err = mergo.Merge(&existingDBSvc, newDBSvc, mergo.WithOverride); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if err = r.Patch(ctx, &existingDBSvc, dbPatchDiff); err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
 	return subrec.Evaluate(subrec.DoNotRequeue()) // success
 }
 
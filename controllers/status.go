@@ -0,0 +1,124 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	subrec "github.com/opdev/subreconciler"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// setCondition records cond on the instance, patching the status
+// subresource only if the condition changed. Several controllers report
+// conditions on the same instance, so the patch uses optimistic locking
+// to avoid dropping conditions set concurrently.
+func setCondition(ctx context.Context, c client.Client, instance *toolsv1alpha1.BookStack, cond metav1.Condition) error {
+	cond.ObservedGeneration = instance.Generation
+
+	existing := meta.FindStatusCondition(instance.Status.Conditions, cond.Type)
+	if existing != nil &&
+		existing.Status == cond.Status &&
+		existing.Reason == cond.Reason &&
+		existing.Message == cond.Message &&
+		existing.ObservedGeneration == cond.ObservedGeneration {
+		return nil
+	}
+
+	patch := client.MergeFromWithOptions(instance.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	meta.SetStatusCondition(&instance.Status.Conditions, cond)
+
+	return c.Status().Patch(ctx, instance, patch)
+}
+
+// removeCondition removes the condition of type condType from the
+// instance, patching the status subresource only if it was present.
+func removeCondition(ctx context.Context, c client.Client, instance *toolsv1alpha1.BookStack, condType string) error {
+	if meta.FindStatusCondition(instance.Status.Conditions, condType) == nil {
+		return nil
+	}
+
+	patch := client.MergeFromWithOptions(instance.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	meta.RemoveStatusCondition(&instance.Status.Conditions, condType)
+
+	return c.Status().Patch(ctx, instance, patch)
+}
+
+// patchStatus applies mutate to the instance status and patches the
+// status subresource.
+func patchStatus(ctx context.Context, c client.Client, instance *toolsv1alpha1.BookStack, mutate func(*toolsv1alpha1.BookStackStatus)) error {
+	patch := client.MergeFromWithOptions(instance.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	mutate(&instance.Status)
+
+	return c.Status().Patch(ctx, instance, patch)
+}
+
+// syncedResource is a resource synced into BookStack, e.g. a user or a
+// shelf, reporting the outcome in its Synced condition.
+type syncedResource interface {
+	client.Object
+	GetConditions() *[]metav1.Condition
+}
+
+// waitToSync reports that obj can't be synced for the reason in message,
+// checking back later.
+func waitToSync(ctx context.Context, c client.Client, obj syncedResource, message string) (ctrl.Result, error) {
+	return reportSynced(ctx, c, obj, metav1.ConditionFalse, "Waiting", message, apiRetryInterval)
+}
+
+// syncFailed reports the error returned by the BookStack API, retrying
+// later.
+func syncFailed(ctx context.Context, c client.Client, obj syncedResource, apiErr error) (ctrl.Result, error) {
+	return reportSynced(ctx, c, obj, metav1.ConditionFalse, "APIError", apiErr.Error(), apiRetryInterval)
+}
+
+// reportSynced records the Synced condition of obj, checking back after
+// requeueAfter, or only once obj or what it owns changes if it is zero.
+func reportSynced(ctx context.Context, c client.Client, obj syncedResource, status metav1.ConditionStatus, reason, message string, requeueAfter time.Duration) (ctrl.Result, error) {
+	err := patchSyncedStatus(ctx, c, obj, func() {
+		meta.SetStatusCondition(obj.GetConditions(), metav1.Condition{
+			Type:               toolsv1alpha1.ConditionSynced,
+			Status:             status,
+			Reason:             reason,
+			Message:            message,
+			ObservedGeneration: obj.GetGeneration(),
+		})
+	})
+	if err != nil {
+		return subrec.Evaluate(subrec.RequeueWithError(err))
+	}
+
+	if requeueAfter == 0 {
+		return subrec.Evaluate(subrec.DoNotRequeue())
+	}
+
+	return subrec.Evaluate(subrec.RequeueWithDelay(requeueAfter))
+}
+
+// patchSyncedStatus applies mutate to the status of obj and patches the
+// status subresource.
+func patchSyncedStatus(ctx context.Context, c client.Client, obj syncedResource, mutate func()) error {
+	patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+	mutate()
+
+	return c.Status().Patch(ctx, obj, patch)
+}
@@ -0,0 +1,398 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	toolsv1alpha1 "github.com/opdev/bookstack-operator/api/v1alpha1"
+	subrec "github.com/opdev/subreconciler"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// upgradeHeldPrefix starts the message reported while an upgrade is held.
+const upgradeHeldPrefix = "held until "
+
+// upgradeResolvingPrefix starts the message reported while the digest of
+// the version an upgrade moves to is resolved.
+const upgradeResolvingPrefix = "resolving the digest of "
+
+//+kubebuilder:rbac:groups=tools.opdev.io,resources=bookstackbackups,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+
+// reconcileUpgrade walks a change of spec.version through its steps: a
+// backup of the instance, the migrations of the new version and the
+// rollout. The instance keeps running the version in status.version until
+// the migrations succeed. It only halts reconciliation on errors, the
+// steps are driven by the events of the owned BookStackBackups and Jobs.
+func (r *BookStackDeploymentReconciler) reconcileUpgrade(ctx context.Context, instance *toolsv1alpha1.BookStack) (*ctrl.Result, error) {
+	if instance.Spec.Version == "" {
+		if instance.Status.Version == "" && instance.Status.Upgrade == nil {
+			return subrec.ContinueReconciling()
+		}
+
+		err := patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+			status.Version = ""
+			status.Upgrade = nil
+		})
+		if err != nil {
+			return subrec.RequeueWithError(err)
+		}
+
+		return subrec.ContinueReconciling()
+	}
+
+	if instance.Status.Version == "" {
+		if err := r.pinVersion(ctx, instance); err != nil {
+			return subrec.RequeueWithError(err)
+		}
+	}
+
+	from, to := instance.Status.Version, instance.Spec.Version
+	upgrade := instance.Status.Upgrade
+
+	if from == to {
+		// a failed or refused upgrade is forgotten once spec.version is
+		// set back, so that it can be retried.
+		if upgrade != nil && upgrade.IsFinished() && upgrade.Phase != toolsv1alpha1.UpgradePhaseSucceeded {
+			err := patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+				status.Upgrade = nil
+			})
+			if err != nil {
+				return subrec.RequeueWithError(err)
+			}
+		}
+
+		return subrec.ContinueReconciling()
+	}
+
+	if upgrade == nil || upgrade.FromVersion != from || upgrade.ToVersion != to {
+		return r.startUpgrade(ctx, instance, from, to)
+	}
+
+	if hold := upgradeHold(instance); hold != "" && upgrade.Phase != toolsv1alpha1.UpgradePhaseRollingOut && !upgrade.IsFinished() {
+		if upgrade.Message == hold {
+			return subrec.ContinueReconciling()
+		}
+
+		held := *upgrade
+		held.Message = hold
+		return r.setUpgrade(ctx, instance, held)
+	}
+
+	if strings.HasPrefix(upgrade.Message, upgradeHeldPrefix) {
+		resumed := *upgrade
+		resumed.Message = ""
+		if res, err := r.setUpgrade(ctx, instance, resumed); subrec.ShouldHaltOrRequeue(res, err) {
+			return res, err
+		}
+	}
+
+	switch upgrade.Phase {
+	case toolsv1alpha1.UpgradePhaseBackingUp:
+		return r.backUpForUpgrade(ctx, instance)
+	case toolsv1alpha1.UpgradePhaseMigrating:
+		return r.migrate(ctx, instance)
+	}
+
+	return subrec.ContinueReconciling()
+}
+
+// upgradeHold returns why the steps of an upgrade can't run, or an empty
+// string if they can. Upgrades are held while an administrator works on
+// the instance, and while it is suspended as they need its database.
+func upgradeHold(instance *toolsv1alpha1.BookStack) string {
+	switch {
+	case instance.IsSuspended():
+		return upgradeHeldPrefix + "the instance is resumed"
+	case instance.InMaintenance():
+		return upgradeHeldPrefix + "maintenance mode is disabled"
+	}
+
+	return ""
+}
+
+// pinVersion records the version the instance runs before its first
+// upgrade: the tag of the running Deployment, or spec.version for a new
+// instance.
+func (r *BookStackDeploymentReconciler) pinVersion(ctx context.Context, instance *toolsv1alpha1.BookStack) error {
+	version := instance.Spec.Version
+
+	var deployment appsv1.Deployment
+	err := r.Client.Get(ctx, client.ObjectKeyFromObject(instance), &deployment)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	if err == nil {
+		if tag := toolsv1alpha1.ImageTag(appImageOf(&deployment)); tag != "" {
+			version = tag
+		}
+	}
+
+	return patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+		status.Version = version
+	})
+}
+
+// startUpgrade starts the upgrade from one version to another, refusing
+// downgrades and versions that can't be compared. The instance may run an
+// untagged version, e.g. latest, before its first upgrade, which is
+// allowed.
+func (r *BookStackDeploymentReconciler) startUpgrade(ctx context.Context, instance *toolsv1alpha1.BookStack, from, to string) (*ctrl.Result, error) {
+	now := metav1.Now()
+	upgrade := toolsv1alpha1.UpgradeStatus{
+		FromVersion: from,
+		ToVersion:   to,
+		Phase:       toolsv1alpha1.UpgradePhaseBackingUp,
+		StartTime:   &now,
+	}
+
+	refusal := ""
+	switch {
+	case !toolsv1alpha1.IsComparableVersion(to):
+		refusal = fmt.Sprintf("version %s can't be compared to other versions", to)
+	case toolsv1alpha1.IsComparableVersion(from):
+		if cmp, _ := toolsv1alpha1.CompareVersions(to, from); cmp < 0 {
+			refusal = fmt.Sprintf("downgrading from %s to %s is not supported", from, to)
+		}
+	}
+
+	if refusal != "" {
+		upgrade.Phase = toolsv1alpha1.UpgradePhaseRefused
+		upgrade.Message = refusal
+		upgrade.CompletionTime = &now
+		return r.setUpgrade(ctx, instance, upgrade)
+	}
+
+	// the Job of an earlier attempt at this upgrade is removed so that
+	// the migrations run again.
+	job := batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instance.GetUpgradeJobName(to),
+			Namespace: instance.Namespace,
+		},
+	}
+	err := r.Client.Delete(ctx, &job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return subrec.RequeueWithError(err)
+	}
+
+	return r.setUpgrade(ctx, instance, upgrade)
+}
+
+// backUpForUpgrade takes the pre-upgrade backup, moving the upgrade on to
+// its migrations once it completes.
+func (r *BookStackDeploymentReconciler) backUpForUpgrade(ctx context.Context, instance *toolsv1alpha1.BookStack) (*ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	upgrade := *instance.Status.Upgrade
+
+	now := metav1.Now()
+	if instance.Spec.Backup == nil {
+		upgrade.Phase = toolsv1alpha1.UpgradePhaseMigrating
+		upgrade.MigrationStartTime = &now
+		upgrade.Message = "spec.backup is not set, the instance is upgraded without a backup"
+		return r.setUpgrade(ctx, instance, upgrade)
+	}
+
+	new := instance.NewPreUpgradeBackup(upgrade.ToVersion)
+
+	err := ctrl.SetControllerReference(instance, &new, r.Scheme)
+	if err != nil {
+		return subrec.RequeueWithError(err)
+	}
+
+	var existing toolsv1alpha1.BookStackBackup
+	err = r.Client.Get(ctx, client.ObjectKeyFromObject(&new), &existing)
+
+	if apierrors.IsNotFound(err) {
+		l.Info("creating resource", new.Kind, new.Name)
+		if err := r.Client.Create(ctx, &new); err != nil {
+			return subrec.RequeueWithError(err)
+		}
+
+		upgrade.BackupName = new.Name
+		upgrade.Message = fmt.Sprintf("backing up to %s", new.Name)
+		return r.setUpgrade(ctx, instance, upgrade)
+	}
+
+	if err != nil {
+		return subrec.RequeueWithError(err)
+	}
+
+	switch existing.Status.Phase {
+	case toolsv1alpha1.BackupPhaseCompleted:
+		upgrade.BackupName = existing.Name
+		upgrade.Phase = toolsv1alpha1.UpgradePhaseMigrating
+		upgrade.MigrationStartTime = &now
+		upgrade.Message = fmt.Sprintf("backed up to %s", existing.Status.Location)
+		return r.setUpgrade(ctx, instance, upgrade)
+	case toolsv1alpha1.BackupPhaseFailed:
+		// the failed backup is removed so that a retry takes a new one.
+		if err := r.Client.Delete(ctx, &existing); err != nil && !apierrors.IsNotFound(err) {
+			return subrec.RequeueWithError(err)
+		}
+
+		return r.failUpgrade(ctx, instance, upgrade, fmt.Sprintf("backup %s failed: %s", existing.Name, existing.Status.Message))
+	}
+
+	return subrec.ContinueReconciling()
+}
+
+// migrate runs the migrations of the new version against the database,
+// rolling the new version out once they succeed. An instance that pins its
+// digest runs the migrations by the digest the image reconciler resolved,
+// which the rollout then pins, so that a tag moved in between doesn't roll
+// out an image the database wasn't migrated for. Other instances run by
+// tag, and so do their migrations.
+func (r *BookStackDeploymentReconciler) migrate(ctx context.Context, instance *toolsv1alpha1.BookStack) (*ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	upgrade := *instance.Status.Upgrade
+
+	target := instance.UpgradeTargetImage()
+	digest := instance.UpgradeDigest()
+	image := target
+	if instance.PinsDigest() {
+		if digest == "" {
+			if strings.HasPrefix(upgrade.Message, upgradeResolvingPrefix) && upgrade.MigrationStartTime != nil {
+				return subrec.ContinueReconciling()
+			}
+
+			// upgrades started before MigrationStartTime was recorded
+			// start waiting for the digest now.
+			if upgrade.MigrationStartTime == nil {
+				now := metav1.Now()
+				upgrade.MigrationStartTime = &now
+			}
+
+			upgrade.Message = upgradeResolvingPrefix + target
+			return r.setUpgrade(ctx, instance, upgrade)
+		}
+
+		image = target + "@" + digest
+	}
+
+	new := instance.NewMigrateJob(instance.GetUpgradeJobName(upgrade.ToVersion), image)
+
+	err := ctrl.SetControllerReference(instance, &new, r.Scheme)
+	if err != nil {
+		return subrec.RequeueWithError(err)
+	}
+
+	var existing batchv1.Job
+	err = r.Client.Get(ctx, client.ObjectKeyFromObject(&new), &existing)
+
+	if apierrors.IsNotFound(err) {
+		l.Info("creating resource", new.Kind, new.Name)
+		if err := r.Client.Create(ctx, &new); err != nil {
+			return subrec.RequeueWithError(err)
+		}
+
+		upgrade.Message = fmt.Sprintf("migrating with %s", image)
+		return r.setUpgrade(ctx, instance, upgrade)
+	}
+
+	if err != nil {
+		return subrec.RequeueWithError(err)
+	}
+
+	if failed := jobFailure(&existing); failed != "" {
+		return r.failUpgrade(ctx, instance, upgrade, fmt.Sprintf("migrations failed: %s", failed))
+	}
+
+	if existing.Status.Succeeded == 0 {
+		return subrec.ContinueReconciling()
+	}
+
+	upgrade.Phase = toolsv1alpha1.UpgradePhaseRollingOut
+	upgrade.Message = fmt.Sprintf("rolling out %s", upgrade.ToVersion)
+
+	now := metav1.Now()
+	err = patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+		status.Version = upgrade.ToVersion
+		status.Upgrade = &upgrade
+		if instance.PinsDigest() {
+			status.Image.Image = target
+			status.Image.Digest = digest
+			status.Image.ResolvedTime = &now
+		}
+	})
+	if err != nil {
+		return subrec.RequeueWithError(err)
+	}
+
+	return subrec.ContinueReconciling()
+}
+
+// reportRollout marks the upgrade succeeded once every replica of the
+// Deployment runs the new version.
+func (r *BookStackDeploymentReconciler) reportRollout(ctx context.Context, instance *toolsv1alpha1.BookStack, deployment *appsv1.Deployment) error {
+	upgrade := instance.Status.Upgrade
+	if upgrade == nil || upgrade.Phase != toolsv1alpha1.UpgradePhaseRollingOut {
+		return nil
+	}
+
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+
+	if deployment.Status.ObservedGeneration < deployment.Generation ||
+		deployment.Status.UpdatedReplicas != replicas ||
+		deployment.Status.AvailableReplicas != replicas ||
+		toolsv1alpha1.ImageTag(appImageOf(deployment)) != upgrade.ToVersion {
+		return nil
+	}
+
+	now := metav1.Now()
+	return patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+		status.Upgrade.Phase = toolsv1alpha1.UpgradePhaseSucceeded
+		status.Upgrade.Message = fmt.Sprintf("%s is running", upgrade.ToVersion)
+		status.Upgrade.CompletionTime = &now
+	})
+}
+
+// failUpgrade records the failure of the upgrade. The instance keeps
+// running the version it was upgraded from.
+func (r *BookStackDeploymentReconciler) failUpgrade(ctx context.Context, instance *toolsv1alpha1.BookStack, upgrade toolsv1alpha1.UpgradeStatus, message string) (*ctrl.Result, error) {
+	now := metav1.Now()
+	upgrade.Phase = toolsv1alpha1.UpgradePhaseFailed
+	upgrade.Message = message
+	upgrade.CompletionTime = &now
+
+	return r.setUpgrade(ctx, instance, upgrade)
+}
+
+// setUpgrade records upgrade on the instance.
+func (r *BookStackDeploymentReconciler) setUpgrade(ctx context.Context, instance *toolsv1alpha1.BookStack, upgrade toolsv1alpha1.UpgradeStatus) (*ctrl.Result, error) {
+	err := patchStatus(ctx, r.Client, instance, func(status *toolsv1alpha1.BookStackStatus) {
+		status.Upgrade = &upgrade
+	})
+	if err != nil {
+		return subrec.RequeueWithError(err)
+	}
+
+	return subrec.ContinueReconciling()
+}
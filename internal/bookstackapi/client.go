@@ -0,0 +1,401 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bookstackapi implements a client for the BookStack REST API,
+// used by the controllers that need state held in BookStack itself.
+//
+// The client authenticates with an API token, pages through listings,
+// retries rate-limited requests and maps API errors to *Error. The fake
+// package serves an in-memory implementation of the API for tests.
+package bookstackapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultMaxRetries is how often a rate-limited request is retried.
+	defaultMaxRetries = 3
+
+	// defaultRetryAfter is how long a rate-limited request waits when the
+	// API doesn't say.
+	defaultRetryAfter = time.Second
+
+	// maxRetryAfter bounds how long a rate-limited request waits.
+	maxRetryAfter = time.Minute
+
+	// pageSize is the number of items requested per page when listing all
+	// items. It is the maximum the API allows.
+	pageSize = 500
+)
+
+// Client is a client for the BookStack REST API.
+type Client struct {
+	baseURL     *url.URL
+	tokenID     string
+	tokenSecret string
+	httpClient  *http.Client
+	maxRetries  int
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used to send requests.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithMaxRetries sets how often a rate-limited request is retried.
+func WithMaxRetries(n int) Option {
+	return func(c *Client) {
+		c.maxRetries = n
+	}
+}
+
+// NewClient returns a client for the BookStack instance at baseURL,
+// authenticating with the API token tokenID and tokenSecret.
+func NewClient(baseURL, tokenID, tokenSecret string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/") + "/api/")
+	if err != nil {
+		return nil, fmt.Errorf("invalid BookStack URL %q: %w", baseURL, err)
+	}
+
+	c := &Client{
+		baseURL:     u,
+		tokenID:     tokenID,
+		tokenSecret: tokenSecret,
+		httpClient:  &http.Client{Timeout: 30 * time.Second},
+		maxRetries:  defaultMaxRetries,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
+}
+
+// Error is an error returned by the BookStack API.
+type Error struct {
+	// StatusCode is the HTTP status of the response.
+	StatusCode int
+	// Message describes the error.
+	Message string
+	// Validation lists the validation failures by field, if the request
+	// was invalid.
+	Validation map[string][]string
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("bookstack api: %d %s", e.StatusCode, e.Message)
+	for _, field := range sortedFields(e.Validation) {
+		msg += fmt.Sprintf("; %s: %s", field, strings.Join(e.Validation[field], " "))
+	}
+
+	return msg
+}
+
+// sortedFields returns the fields of the validation failures in order.
+func sortedFields(validation map[string][]string) []string {
+	fields := make([]string, 0, len(validation))
+	for field := range validation {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	return fields
+}
+
+// IsNotFound returns true if err is a not found error from the API.
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsUnauthorized returns true if err is an authentication error from the
+// API, e.g. an invalid token.
+func IsUnauthorized(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized)
+}
+
+// IsForbidden returns true if err is a permission error from the API.
+func IsForbidden(err error) bool {
+	return hasStatus(err, http.StatusForbidden)
+}
+
+// IsRateLimited returns true if err is a rate-limit error that was still
+// returned after the retries.
+func IsRateLimited(err error) bool {
+	return hasStatus(err, http.StatusTooManyRequests)
+}
+
+// IsInvalid returns true if err is a validation error from the API.
+func IsInvalid(err error) bool {
+	return hasStatus(err, http.StatusUnprocessableEntity)
+}
+
+// hasStatus returns true if err is an *Error with the HTTP status code.
+func hasStatus(err error, code int) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == code
+}
+
+// ListOptions selects a page of a listing.
+type ListOptions struct {
+	// Count is the number of items in the page. The API defaults to 100
+	// and allows up to 500.
+	Count int
+	// Offset is the number of items skipped.
+	Offset int
+	// Sort is the field the items are sorted by, prefixed with - for
+	// descending order, e.g. -created_at.
+	Sort string
+	// Filter restricts the items to those with the field values, e.g.
+	// {"name": "Runbooks"}. Operators are appended to the field name, e.g.
+	// {"created_at:gt": "2022-01-01"}.
+	Filter map[string]string
+}
+
+// query returns the query parameters selecting the page.
+func (o *ListOptions) query() url.Values {
+	q := url.Values{}
+	if o == nil {
+		return q
+	}
+
+	if o.Count > 0 {
+		q.Set("count", strconv.Itoa(o.Count))
+	}
+	if o.Offset > 0 {
+		q.Set("offset", strconv.Itoa(o.Offset))
+	}
+	if o.Sort != "" {
+		q.Set("sort", o.Sort)
+	}
+	for field, value := range o.Filter {
+		q.Set(fmt.Sprintf("filter[%s]", field), value)
+	}
+
+	return q
+}
+
+// list fetches a page of the listing at path into items, a pointer to a
+// slice, returning the total number of items.
+func (c *Client) list(ctx context.Context, path string, opts *ListOptions, items interface{}) (int, error) {
+	var page struct {
+		Data  json.RawMessage `json:"data"`
+		Total int             `json:"total"`
+	}
+
+	if err := c.do(ctx, http.MethodGet, path, opts.query(), nil, &page); err != nil {
+		return 0, err
+	}
+
+	if err := json.Unmarshal(page.Data, items); err != nil {
+		return 0, fmt.Errorf("bookstack api: unable to decode %s: %w", path, err)
+	}
+
+	return page.Total, nil
+}
+
+// listAll fetches every page of the listing at path matching opts, calling
+// next with a pointer to a fresh slice to decode each page into and
+// collect returning its length.
+func (c *Client) listAll(ctx context.Context, path string, opts *ListOptions, next func() interface{}, collect func() int) error {
+	page := ListOptions{Count: pageSize}
+	if opts != nil {
+		page.Sort = opts.Sort
+		page.Filter = opts.Filter
+	}
+
+	for {
+		total, err := c.list(ctx, path, &page, next())
+		if err != nil {
+			return err
+		}
+
+		n := collect()
+		page.Offset += n
+		if n == 0 || page.Offset >= total {
+			return nil
+		}
+	}
+}
+
+// do sends a request to the API at path, encoding body as JSON if set and
+// decoding the response into out if set.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	if body == nil {
+		return c.send(ctx, method, path, query, "", nil, out)
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	return c.send(ctx, method, path, query, "application/json", payload, out)
+}
+
+// upload updates the item at path with a multipart form holding fields and
+// the file in fileField, decoding the response into out if set. The API
+// only reads files from POST requests, so the update method is sent as the
+// _method field.
+func (c *Client) upload(ctx context.Context, path string, fields map[string]string, fileField, filename string, file []byte, out interface{}) error {
+	var payload bytes.Buffer
+	form := multipart.NewWriter(&payload)
+
+	if err := form.WriteField("_method", http.MethodPut); err != nil {
+		return err
+	}
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+
+	part, err := form.CreateFormFile(fileField, filename)
+	if err != nil {
+		return err
+	}
+	if _, err = part.Write(file); err != nil {
+		return err
+	}
+	if err = form.Close(); err != nil {
+		return err
+	}
+
+	return c.send(ctx, http.MethodPost, path, nil, form.FormDataContentType(), payload.Bytes(), out)
+}
+
+// send sends a request to the API at path with the payload of the content
+// type, decoding the response into out if set. Rate-limited requests are
+// retried after the delay the API asks for.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, contentType string, payload []byte, out interface{}) error {
+	target, err := c.baseURL.Parse(path)
+	if err != nil {
+		return err
+	}
+	target.RawQuery = query.Encode()
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("Authorization", fmt.Sprintf("Token %s:%s", c.tokenID, c.tokenSecret))
+		req.Header.Set("Accept", "application/json")
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < c.maxRetries {
+			resp.Body.Close()
+			if err := wait(ctx, retryAfter(resp)); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			return decodeError(resp)
+		}
+
+		if out == nil || resp.StatusCode == http.StatusNoContent {
+			return nil
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("bookstack api: unable to decode %s %s: %w", method, path, err)
+		}
+
+		return nil
+	}
+}
+
+// retryAfter returns how long the API asks a rate-limited request to wait.
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return defaultRetryAfter
+	}
+
+	if d := time.Duration(seconds) * time.Second; d < maxRetryAfter {
+		return d
+	}
+
+	return maxRetryAfter
+}
+
+// wait sleeps for d, or until ctx is done.
+func wait(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// decodeError returns the *Error in the response.
+func decodeError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return apiErr
+	}
+
+	var body struct {
+		Error struct {
+			Message    string              `json:"message"`
+			Validation map[string][]string `json:"validation"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &body) == nil && body.Error.Message != "" {
+		apiErr.Message = body.Error.Message
+		apiErr.Validation = body.Error.Validation
+	}
+
+	return apiErr
+}
@@ -0,0 +1,502 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bookstackapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/opdev/bookstack-operator/internal/bookstackapi/fake"
+)
+
+// newTestClient returns a client for the fake server, authenticated with
+// the token it accepts.
+func newTestClient(t *testing.T, srv *fake.Server, opts ...Option) *Client {
+	t.Helper()
+
+	c, err := NewClient(srv.URL, fake.TokenID, fake.TokenSecret, opts...)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+
+	return c
+}
+
+// createBooks creates n books named Book 1 to Book n.
+func createBooks(t *testing.T, c *Client, n int) {
+	t.Helper()
+
+	for i := 1; i <= n; i++ {
+		if _, err := c.CreateBook(context.Background(), BookRequest{Name: fmt.Sprintf("Book %d", i)}); err != nil {
+			t.Fatalf("CreateBook() error = %v", err)
+		}
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	srv := fake.NewServer()
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		tokenID     string
+		tokenSecret string
+		wantErr     func(error) bool
+	}{
+		{
+			name:        "valid token",
+			tokenID:     fake.TokenID,
+			tokenSecret: fake.TokenSecret,
+		},
+		{
+			name:        "wrong secret",
+			tokenID:     fake.TokenID,
+			tokenSecret: "wrong",
+			wantErr:     IsUnauthorized,
+		},
+		{
+			name:        "swapped id and secret",
+			tokenID:     fake.TokenSecret,
+			tokenSecret: fake.TokenID,
+			wantErr:     IsUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewClient(srv.URL, tt.tokenID, tt.tokenSecret)
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+
+			info, err := c.SystemInfo(context.Background())
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Fatalf("SystemInfo() error = %v, want an unauthorized error", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("SystemInfo() error = %v", err)
+			}
+			if info.Version != fake.Version {
+				t.Errorf("SystemInfo().Version = %q, want %q", info.Version, fake.Version)
+			}
+		})
+	}
+}
+
+func TestListOptionsQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *ListOptions
+		want string
+	}{
+		{
+			name: "nil",
+			want: "",
+		},
+		{
+			name: "page",
+			opts: &ListOptions{Count: 50, Offset: 100, Sort: "-created_at"},
+			want: "count=50&offset=100&sort=-created_at",
+		},
+		{
+			name: "filters",
+			opts: &ListOptions{Filter: map[string]string{"name": "Runbooks & Guides", "id:gt": "10"}},
+			want: "filter%5Bid%3Agt%5D=10&filter%5Bname%5D=Runbooks+%26+Guides",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.query().Encode(); got != tt.want {
+				t.Errorf("query() = %q, want %q", got, tt.want)
+			}
+
+			if tt.opts != nil {
+				q, err := url.ParseQuery(tt.want)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for field, value := range tt.opts.Filter {
+					if got := q.Get("filter[" + field + "]"); got != value {
+						t.Errorf("filter[%s] = %q, want %q", field, got, value)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestListFilter(t *testing.T) {
+	srv := fake.NewServer()
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	createBooks(t, c, 12)
+	if _, err := c.CreateBook(context.Background(), BookRequest{Name: "Runbooks & Guides"}); err != nil {
+		t.Fatalf("CreateBook() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		filter map[string]string
+		want   []string
+	}{
+		{
+			name:   "equal",
+			filter: map[string]string{"name": "Runbooks & Guides"},
+			want:   []string{"Runbooks & Guides"},
+		},
+		{
+			name:   "like",
+			filter: map[string]string{"name:like": "%Book 1%"},
+			want:   []string{"Book 1", "Book 10", "Book 11", "Book 12"},
+		},
+		{
+			name:   "combined",
+			filter: map[string]string{"name:like": "%Book 1%", "name:ne": "Book 1"},
+			want:   []string{"Book 10", "Book 11", "Book 12"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			books, total, err := c.ListBooks(context.Background(), &ListOptions{Sort: "+id", Filter: tt.filter})
+			if err != nil {
+				t.Fatalf("ListBooks() error = %v", err)
+			}
+
+			var got []string
+			for _, book := range books {
+				got = append(got, book.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) || total != len(tt.want) {
+				t.Errorf("ListBooks() = %v (total %d), want %v", got, total, tt.want)
+			}
+		})
+	}
+}
+
+func TestListAll(t *testing.T) {
+	srv := fake.NewServer()
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	createBooks(t, c, 2*pageSize+1)
+
+	tests := []struct {
+		name      string
+		opts      *ListOptions
+		wantCount int
+		wantFirst string
+		wantPages int
+	}{
+		{
+			name:      "every page",
+			wantCount: 2*pageSize + 1,
+			wantFirst: "Book 1",
+			wantPages: 3,
+		},
+		{
+			name:      "sorted",
+			opts:      &ListOptions{Sort: "-id"},
+			wantCount: 2*pageSize + 1,
+			wantFirst: fmt.Sprintf("Book %d", 2*pageSize+1),
+			wantPages: 3,
+		},
+		{
+			name:      "filtered",
+			opts:      &ListOptions{Filter: map[string]string{"name:like": "%Book 1%"}},
+			wantCount: 1 + 10 + 100 + 2,
+			wantFirst: "Book 1",
+			wantPages: 1,
+		},
+		{
+			name:      "empty",
+			opts:      &ListOptions{Filter: map[string]string{"name": "Missing"}},
+			wantCount: 0,
+			wantPages: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := srv.Requests()
+
+			books, err := c.ListAllBooks(context.Background(), tt.opts)
+			if err != nil {
+				t.Fatalf("ListAllBooks() error = %v", err)
+			}
+
+			if len(books) != tt.wantCount {
+				t.Errorf("ListAllBooks() returned %d books, want %d", len(books), tt.wantCount)
+			}
+			if len(books) > 0 && books[0].Name != tt.wantFirst {
+				t.Errorf("ListAllBooks()[0] = %q, want %q", books[0].Name, tt.wantFirst)
+			}
+			if pages := srv.Requests() - before; pages != tt.wantPages {
+				t.Errorf("ListAllBooks() fetched %d pages, want %d", pages, tt.wantPages)
+			}
+
+			seen := map[int]bool{}
+			for _, book := range books {
+				if seen[book.ID] {
+					t.Fatalf("ListAllBooks() returned book %d twice", book.ID)
+				}
+				seen[book.ID] = true
+			}
+		})
+	}
+}
+
+func TestRateLimitRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		rateLimited  int
+		maxRetries   int
+		wantErr      bool
+		wantRequests int
+	}{
+		{
+			name:         "not limited",
+			maxRetries:   3,
+			wantRequests: 1,
+		},
+		{
+			name:         "retried",
+			rateLimited:  2,
+			maxRetries:   3,
+			wantRequests: 3,
+		},
+		{
+			name:         "out of retries",
+			rateLimited:  4,
+			maxRetries:   3,
+			wantErr:      true,
+			wantRequests: 4,
+		},
+		{
+			name:         "no retries",
+			rateLimited:  1,
+			maxRetries:   0,
+			wantErr:      true,
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fake.NewServer()
+			defer srv.Close()
+
+			c := newTestClient(t, srv, WithMaxRetries(tt.maxRetries))
+			srv.RateLimit(tt.rateLimited)
+
+			_, err := c.SystemInfo(context.Background())
+			if tt.wantErr {
+				if !IsRateLimited(err) {
+					t.Errorf("SystemInfo() error = %v, want a rate-limit error", err)
+				}
+			} else if err != nil {
+				t.Errorf("SystemInfo() error = %v", err)
+			}
+
+			if got := srv.Requests(); got != tt.wantRequests {
+				t.Errorf("server received %d requests, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{header: "", want: defaultRetryAfter.String()},
+		{header: "invalid", want: defaultRetryAfter.String()},
+		{header: "-1", want: defaultRetryAfter.String()},
+		{header: "0", want: "0s"},
+		{header: "5", want: "5s"},
+		{header: "3600", want: maxRetryAfter.String()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if tt.header != "" {
+				resp.Header.Set("Retry-After", tt.header)
+			}
+
+			if got := retryAfter(resp).String(); got != tt.want {
+				t.Errorf("retryAfter() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetCover(t *testing.T) {
+	srv := fake.NewServer()
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	book, err := c.CreateBook(context.Background(), BookRequest{Name: "Runbooks"})
+	if err != nil {
+		t.Fatalf("CreateBook() error = %v", err)
+	}
+	shelf, err := c.CreateShelf(context.Background(), ShelfRequest{Name: "Operations"})
+	if err != nil {
+		t.Fatalf("CreateShelf() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		setCover func() (*Image, error)
+		wantName string
+		wantErr  func(error) bool
+	}{
+		{
+			name: "book",
+			setCover: func() (*Image, error) {
+				got, err := c.SetBookCover(context.Background(), book.ID, "cover.png", []byte("png"))
+				if err != nil {
+					return nil, err
+				}
+				return got.Cover, nil
+			},
+			wantName: "cover.png",
+		},
+		{
+			name: "shelf",
+			setCover: func() (*Image, error) {
+				got, err := c.SetShelfCover(context.Background(), shelf.ID, "shelf.jpg", []byte("jpg"))
+				if err != nil {
+					return nil, err
+				}
+				return got.Cover, nil
+			},
+			wantName: "shelf.jpg",
+		},
+		{
+			name: "missing book",
+			setCover: func() (*Image, error) {
+				_, err := c.SetBookCover(context.Background(), 9999, "cover.png", []byte("png"))
+				return nil, err
+			},
+			wantErr: IsNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cover, err := tt.setCover()
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Fatalf("set cover error = %v, want a not found error", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("set cover error = %v", err)
+			}
+			if cover == nil || cover.Name != tt.wantName {
+				t.Errorf("cover = %+v, want %s", cover, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	srv := fake.NewServer()
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+
+	tests := []struct {
+		name          string
+		call          func() error
+		wantNotFound  bool
+		wantInvalid   bool
+		wantForbidden bool
+	}{
+		{
+			name: "missing book",
+			call: func() error {
+				_, err := c.GetBook(context.Background(), 9999)
+				return err
+			},
+			wantNotFound: true,
+		},
+		{
+			name: "deleting a missing page",
+			call: func() error {
+				return c.DeletePage(context.Background(), 9999)
+			},
+			wantNotFound: true,
+		},
+		{
+			name: "wrapped not found",
+			call: func() error {
+				_, err := c.GetShelf(context.Background(), 9999)
+				return fmt.Errorf("syncing shelf: %w", err)
+			},
+			wantNotFound: true,
+		},
+		{
+			name: "invalid request",
+			call: func() error {
+				_, err := c.CreateBook(context.Background(), BookRequest{})
+				return err
+			},
+			wantInvalid: true,
+		},
+		{
+			name: "not an API error",
+			call: func() error {
+				return errors.New("connection refused")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			if err == nil {
+				t.Fatal("call succeeded, want an error")
+			}
+
+			if got := IsNotFound(err); got != tt.wantNotFound {
+				t.Errorf("IsNotFound(%v) = %v, want %v", err, got, tt.wantNotFound)
+			}
+			if got := IsInvalid(err); got != tt.wantInvalid {
+				t.Errorf("IsInvalid(%v) = %v, want %v", err, got, tt.wantInvalid)
+			}
+			if got := IsForbidden(err); got != tt.wantForbidden {
+				t.Errorf("IsForbidden(%v) = %v, want %v", err, got, tt.wantForbidden)
+			}
+		})
+	}
+}
@@ -0,0 +1,368 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bookstackapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Tag is a name and optional value attached to content.
+type Tag struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+// Image is an image uploaded to BookStack, e.g. the cover of a book.
+type Image struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// Shelf is a BookStack shelf, a collection of books.
+type Shelf struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Slug        string    `json:"slug"`
+	Description string    `json:"description"`
+	Tags        []Tag     `json:"tags,omitempty"`
+	Cover       *Image    `json:"cover,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// Books is only set when the shelf is read on its own.
+	Books []Book `json:"books,omitempty"`
+}
+
+// ShelfRequest creates or updates a shelf.
+type ShelfRequest struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Tags        []Tag  `json:"tags,omitempty"`
+	// Books are the IDs of the books on the shelf, in order. An update
+	// replaces the books when set.
+	Books []int `json:"books,omitempty"`
+}
+
+// Book is a BookStack book.
+type Book struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Slug        string    `json:"slug"`
+	Description string    `json:"description"`
+	Tags        []Tag     `json:"tags,omitempty"`
+	Cover       *Image    `json:"cover,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// BookRequest creates or updates a book.
+type BookRequest struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Tags        []Tag  `json:"tags,omitempty"`
+}
+
+// Chapter is a BookStack chapter, a group of pages within a book.
+type Chapter struct {
+	ID          int       `json:"id"`
+	BookID      int       `json:"book_id"`
+	Name        string    `json:"name"`
+	Slug        string    `json:"slug"`
+	Description string    `json:"description"`
+	Priority    int       `json:"priority"`
+	Tags        []Tag     `json:"tags,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ChapterRequest creates or updates a chapter.
+type ChapterRequest struct {
+	// BookID is the book the chapter is in. Setting it on update moves
+	// the chapter.
+	BookID      int    `json:"book_id,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Priority    int    `json:"priority,omitempty"`
+	Tags        []Tag  `json:"tags,omitempty"`
+}
+
+// Page is a BookStack page.
+type Page struct {
+	ID        int    `json:"id"`
+	BookID    int    `json:"book_id"`
+	ChapterID int    `json:"chapter_id"`
+	Name      string `json:"name"`
+	Slug      string `json:"slug"`
+	// HTML and Markdown are only set when the page is read on its own.
+	HTML          string    `json:"html,omitempty"`
+	Markdown      string    `json:"markdown,omitempty"`
+	Priority      int       `json:"priority"`
+	Draft         bool      `json:"draft"`
+	Template      bool      `json:"template"`
+	RevisionCount int       `json:"revision_count"`
+	Tags          []Tag     `json:"tags,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// PageRequest creates or updates a page. A page is in either a book or a
+// chapter, and has either HTML or Markdown content.
+type PageRequest struct {
+	BookID    int    `json:"book_id,omitempty"`
+	ChapterID int    `json:"chapter_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	HTML      string `json:"html,omitempty"`
+	Markdown  string `json:"markdown,omitempty"`
+	Priority  int    `json:"priority,omitempty"`
+	Tags      []Tag  `json:"tags,omitempty"`
+}
+
+// ListShelves returns a page of shelves and the total number of shelves.
+func (c *Client) ListShelves(ctx context.Context, opts *ListOptions) ([]Shelf, int, error) {
+	var shelves []Shelf
+	total, err := c.list(ctx, "shelves", opts, &shelves)
+	return shelves, total, err
+}
+
+// ListAllShelves returns every shelf matching opts, ignoring its Count and
+// Offset.
+func (c *Client) ListAllShelves(ctx context.Context, opts *ListOptions) ([]Shelf, error) {
+	var all, page []Shelf
+	err := c.listAll(ctx, "shelves", opts,
+		func() interface{} { page = nil; return &page },
+		func() int { all = append(all, page...); return len(page) })
+	return all, err
+}
+
+// GetShelf returns the shelf with the ID, including its books.
+func (c *Client) GetShelf(ctx context.Context, id int) (*Shelf, error) {
+	var shelf Shelf
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("shelves/%d", id), nil, nil, &shelf); err != nil {
+		return nil, err
+	}
+
+	return &shelf, nil
+}
+
+// CreateShelf creates a shelf.
+func (c *Client) CreateShelf(ctx context.Context, req ShelfRequest) (*Shelf, error) {
+	var shelf Shelf
+	if err := c.do(ctx, http.MethodPost, "shelves", nil, req, &shelf); err != nil {
+		return nil, err
+	}
+
+	return &shelf, nil
+}
+
+// UpdateShelf updates the shelf with the ID.
+func (c *Client) UpdateShelf(ctx context.Context, id int, req ShelfRequest) (*Shelf, error) {
+	var shelf Shelf
+	if err := c.do(ctx, http.MethodPut, fmt.Sprintf("shelves/%d", id), nil, req, &shelf); err != nil {
+		return nil, err
+	}
+
+	return &shelf, nil
+}
+
+// SetShelfCover replaces the cover image of the shelf with the ID.
+func (c *Client) SetShelfCover(ctx context.Context, id int, filename string, image []byte) (*Shelf, error) {
+	var shelf Shelf
+	if err := c.upload(ctx, fmt.Sprintf("shelves/%d", id), nil, "image", filename, image, &shelf); err != nil {
+		return nil, err
+	}
+
+	return &shelf, nil
+}
+
+// DeleteShelf moves the shelf with the ID to the recycle bin. Its books
+// are kept.
+func (c *Client) DeleteShelf(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("shelves/%d", id), nil, nil, nil)
+}
+
+// ListBooks returns a page of books and the total number of books.
+func (c *Client) ListBooks(ctx context.Context, opts *ListOptions) ([]Book, int, error) {
+	var books []Book
+	total, err := c.list(ctx, "books", opts, &books)
+	return books, total, err
+}
+
+// ListAllBooks returns every book matching opts, ignoring its Count and
+// Offset.
+func (c *Client) ListAllBooks(ctx context.Context, opts *ListOptions) ([]Book, error) {
+	var all, page []Book
+	err := c.listAll(ctx, "books", opts,
+		func() interface{} { page = nil; return &page },
+		func() int { all = append(all, page...); return len(page) })
+	return all, err
+}
+
+// GetBook returns the book with the ID.
+func (c *Client) GetBook(ctx context.Context, id int) (*Book, error) {
+	var book Book
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("books/%d", id), nil, nil, &book); err != nil {
+		return nil, err
+	}
+
+	return &book, nil
+}
+
+// CreateBook creates a book.
+func (c *Client) CreateBook(ctx context.Context, req BookRequest) (*Book, error) {
+	var book Book
+	if err := c.do(ctx, http.MethodPost, "books", nil, req, &book); err != nil {
+		return nil, err
+	}
+
+	return &book, nil
+}
+
+// UpdateBook updates the book with the ID.
+func (c *Client) UpdateBook(ctx context.Context, id int, req BookRequest) (*Book, error) {
+	var book Book
+	if err := c.do(ctx, http.MethodPut, fmt.Sprintf("books/%d", id), nil, req, &book); err != nil {
+		return nil, err
+	}
+
+	return &book, nil
+}
+
+// SetBookCover replaces the cover image of the book with the ID.
+func (c *Client) SetBookCover(ctx context.Context, id int, filename string, image []byte) (*Book, error) {
+	var book Book
+	if err := c.upload(ctx, fmt.Sprintf("books/%d", id), nil, "image", filename, image, &book); err != nil {
+		return nil, err
+	}
+
+	return &book, nil
+}
+
+// DeleteBook moves the book with the ID, and its chapters and pages, to
+// the recycle bin.
+func (c *Client) DeleteBook(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("books/%d", id), nil, nil, nil)
+}
+
+// ListChapters returns a page of chapters and the total number of
+// chapters.
+func (c *Client) ListChapters(ctx context.Context, opts *ListOptions) ([]Chapter, int, error) {
+	var chapters []Chapter
+	total, err := c.list(ctx, "chapters", opts, &chapters)
+	return chapters, total, err
+}
+
+// ListAllChapters returns every chapter matching opts, ignoring its Count
+// and Offset.
+func (c *Client) ListAllChapters(ctx context.Context, opts *ListOptions) ([]Chapter, error) {
+	var all, page []Chapter
+	err := c.listAll(ctx, "chapters", opts,
+		func() interface{} { page = nil; return &page },
+		func() int { all = append(all, page...); return len(page) })
+	return all, err
+}
+
+// GetChapter returns the chapter with the ID.
+func (c *Client) GetChapter(ctx context.Context, id int) (*Chapter, error) {
+	var chapter Chapter
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("chapters/%d", id), nil, nil, &chapter); err != nil {
+		return nil, err
+	}
+
+	return &chapter, nil
+}
+
+// CreateChapter creates a chapter.
+func (c *Client) CreateChapter(ctx context.Context, req ChapterRequest) (*Chapter, error) {
+	var chapter Chapter
+	if err := c.do(ctx, http.MethodPost, "chapters", nil, req, &chapter); err != nil {
+		return nil, err
+	}
+
+	return &chapter, nil
+}
+
+// UpdateChapter updates the chapter with the ID.
+func (c *Client) UpdateChapter(ctx context.Context, id int, req ChapterRequest) (*Chapter, error) {
+	var chapter Chapter
+	if err := c.do(ctx, http.MethodPut, fmt.Sprintf("chapters/%d", id), nil, req, &chapter); err != nil {
+		return nil, err
+	}
+
+	return &chapter, nil
+}
+
+// DeleteChapter moves the chapter with the ID, and its pages, to the
+// recycle bin.
+func (c *Client) DeleteChapter(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("chapters/%d", id), nil, nil, nil)
+}
+
+// ListPages returns a page of pages and the total number of pages.
+func (c *Client) ListPages(ctx context.Context, opts *ListOptions) ([]Page, int, error) {
+	var pages []Page
+	total, err := c.list(ctx, "pages", opts, &pages)
+	return pages, total, err
+}
+
+// ListAllPages returns every page matching opts, ignoring its Count and
+// Offset.
+func (c *Client) ListAllPages(ctx context.Context, opts *ListOptions) ([]Page, error) {
+	var all, page []Page
+	err := c.listAll(ctx, "pages", opts,
+		func() interface{} { page = nil; return &page },
+		func() int { all = append(all, page...); return len(page) })
+	return all, err
+}
+
+// GetPage returns the page with the ID, including its content.
+func (c *Client) GetPage(ctx context.Context, id int) (*Page, error) {
+	var page Page
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("pages/%d", id), nil, nil, &page); err != nil {
+		return nil, err
+	}
+
+	return &page, nil
+}
+
+// CreatePage creates a page.
+func (c *Client) CreatePage(ctx context.Context, req PageRequest) (*Page, error) {
+	var page Page
+	if err := c.do(ctx, http.MethodPost, "pages", nil, req, &page); err != nil {
+		return nil, err
+	}
+
+	return &page, nil
+}
+
+// UpdatePage updates the page with the ID, creating a revision if its
+// content changes.
+func (c *Client) UpdatePage(ctx context.Context, id int, req PageRequest) (*Page, error) {
+	var page Page
+	if err := c.do(ctx, http.MethodPut, fmt.Sprintf("pages/%d", id), nil, req, &page); err != nil {
+		return nil, err
+	}
+
+	return &page, nil
+}
+
+// DeletePage moves the page with the ID to the recycle bin.
+func (c *Client) DeletePage(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("pages/%d", id), nil, nil, nil)
+}
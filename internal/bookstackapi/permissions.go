@@ -0,0 +1,95 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bookstackapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// ContentType names a type of content in the content permissions API.
+type ContentType string
+
+const (
+	ContentTypeShelf   ContentType = "bookshelf"
+	ContentTypeBook    ContentType = "book"
+	ContentTypeChapter ContentType = "chapter"
+	ContentTypePage    ContentType = "page"
+)
+
+// PermissionSet grants actions on an item of content.
+type PermissionSet struct {
+	View   bool `json:"view"`
+	Create bool `json:"create"`
+	Update bool `json:"update"`
+	Delete bool `json:"delete"`
+}
+
+// RolePermissions grants the actions to the users of a role.
+type RolePermissions struct {
+	RoleID int `json:"role_id"`
+	PermissionSet
+}
+
+// FallbackPermissions grants the actions to the roles without permissions
+// of their own, unless they inherit the permissions of the parent item.
+type FallbackPermissions struct {
+	Inheriting bool `json:"inheriting"`
+	PermissionSet
+}
+
+// ContentPermissions are the permissions of an item of content.
+type ContentPermissions struct {
+	Owner               *UserRef            `json:"owner,omitempty"`
+	RolePermissions     []RolePermissions   `json:"role_permissions"`
+	FallbackPermissions FallbackPermissions `json:"fallback_permissions"`
+}
+
+// ContentPermissionsRequest replaces the permissions of an item of
+// content.
+type ContentPermissionsRequest struct {
+	// OwnerID is the ID of the user owning the item. The owner is kept
+	// when unset.
+	OwnerID         int               `json:"owner_id,omitempty"`
+	RolePermissions []RolePermissions `json:"role_permissions"`
+	// FallbackPermissions are kept when unset.
+	FallbackPermissions *FallbackPermissions `json:"fallback_permissions,omitempty"`
+}
+
+// GetContentPermissions returns the permissions of the item of the content
+// type with the ID. The content permissions API needs BookStack v23.01 or
+// later.
+func (c *Client) GetContentPermissions(ctx context.Context, contentType ContentType, id int) (*ContentPermissions, error) {
+	var perms ContentPermissions
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("content-permissions/%s/%d", contentType, id), nil, nil, &perms); err != nil {
+		return nil, err
+	}
+
+	return &perms, nil
+}
+
+// UpdateContentPermissions replaces the permissions of the item of the
+// content type with the ID.
+func (c *Client) UpdateContentPermissions(ctx context.Context, contentType ContentType, id int, req ContentPermissionsRequest) (*ContentPermissions, error) {
+	var perms ContentPermissions
+	if err := c.do(ctx, http.MethodPut, fmt.Sprintf("content-permissions/%s/%d", contentType, id), nil, req, &perms); err != nil {
+		return nil, err
+	}
+
+	return &perms, nil
+}
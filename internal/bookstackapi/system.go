@@ -0,0 +1,86 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bookstackapi
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// AuditLogEntry is an activity recorded in the BookStack audit log.
+type AuditLogEntry struct {
+	ID int `json:"id"`
+	// Type is the activity, e.g. page_update or auth_login.
+	Type string `json:"type"`
+	// Detail describes the activity, e.g. the name of the updated item.
+	Detail string `json:"detail"`
+	UserID int    `json:"user_id"`
+	// LoggableID and LoggableType identify the item the activity is about,
+	// e.g. 3 and page.
+	LoggableID   int       `json:"loggable_id"`
+	LoggableType string    `json:"loggable_type"`
+	IP           string    `json:"ip"`
+	CreatedAt    time.Time `json:"created_at"`
+	User         *UserRef  `json:"user,omitempty"`
+}
+
+// UserRef identifies a user, e.g. the author of an audit log entry or the
+// owner of content.
+type UserRef struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
+// SystemInfo describes a BookStack instance.
+type SystemInfo struct {
+	Version    string `json:"version"`
+	InstanceID string `json:"instance_id"`
+	AppName    string `json:"app_name"`
+	BaseURL    string `json:"base_url"`
+}
+
+// ListAuditLog returns a page of the audit log and the total number of
+// entries. Reading the audit log requires a token of a user allowed to
+// manage both users and settings.
+func (c *Client) ListAuditLog(ctx context.Context, opts *ListOptions) ([]AuditLogEntry, int, error) {
+	var entries []AuditLogEntry
+	total, err := c.list(ctx, "audit-log", opts, &entries)
+	return entries, total, err
+}
+
+// ListAllAuditLog returns every audit log entry matching opts, ignoring its
+// Count and Offset.
+func (c *Client) ListAllAuditLog(ctx context.Context, opts *ListOptions) ([]AuditLogEntry, error) {
+	var all, page []AuditLogEntry
+	err := c.listAll(ctx, "audit-log", opts,
+		func() interface{} { page = nil; return &page },
+		func() int { all = append(all, page...); return len(page) })
+	return all, err
+}
+
+// SystemInfo returns the version and identity of the instance. It is the
+// cheapest authenticated request, so it doubles as a health check.
+func (c *Client) SystemInfo(ctx context.Context) (*SystemInfo, error) {
+	var info SystemInfo
+	if err := c.do(ctx, http.MethodGet, "system", nil, nil, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
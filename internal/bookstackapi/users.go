@@ -0,0 +1,194 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bookstackapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// User is a BookStack user.
+type User struct {
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	Slug           string `json:"slug"`
+	Email          string `json:"email"`
+	ExternalAuthID string `json:"external_auth_id"`
+	// Roles is only set when the user is read on its own.
+	Roles     []Role    `json:"roles,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// UserRequest creates or updates a user.
+type UserRequest struct {
+	Name           string `json:"name,omitempty"`
+	Email          string `json:"email,omitempty"`
+	ExternalAuthID string `json:"external_auth_id,omitempty"`
+	Language       string `json:"language,omitempty"`
+	// Password is the password the user logs in with. Leave it unset and
+	// set SendInvite to let the user choose it.
+	Password   string `json:"password,omitempty"`
+	SendInvite bool   `json:"send_invite,omitempty"`
+	// Roles are the IDs of the roles of the user. An update replaces the
+	// roles when set.
+	Roles []int `json:"roles,omitempty"`
+}
+
+// Role is a BookStack role.
+type Role struct {
+	ID             int    `json:"id"`
+	DisplayName    string `json:"display_name"`
+	Description    string `json:"description"`
+	MFAEnforced    bool   `json:"mfa_enforced"`
+	ExternalAuthID string `json:"external_auth_id"`
+	// Permissions is only set when the role is read on its own.
+	Permissions []string  `json:"permissions,omitempty"`
+	UsersCount  int       `json:"users_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// RoleRequest creates or updates a role.
+type RoleRequest struct {
+	DisplayName    string `json:"display_name,omitempty"`
+	Description    string `json:"description,omitempty"`
+	ExternalAuthID string `json:"external_auth_id,omitempty"`
+	// MFAEnforced is always sent, so an update can lift the requirement.
+	MFAEnforced bool `json:"mfa_enforced"`
+	// Permissions are the system permissions of the role, e.g.
+	// "content-export". An update replaces the permissions when set.
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// ListUsers returns a page of users and the total number of users.
+func (c *Client) ListUsers(ctx context.Context, opts *ListOptions) ([]User, int, error) {
+	var users []User
+	total, err := c.list(ctx, "users", opts, &users)
+	return users, total, err
+}
+
+// ListAllUsers returns every user matching opts, ignoring its Count and
+// Offset.
+func (c *Client) ListAllUsers(ctx context.Context, opts *ListOptions) ([]User, error) {
+	var all, page []User
+	err := c.listAll(ctx, "users", opts,
+		func() interface{} { page = nil; return &page },
+		func() int { all = append(all, page...); return len(page) })
+	return all, err
+}
+
+// GetUser returns the user with the ID, including its roles.
+func (c *Client) GetUser(ctx context.Context, id int) (*User, error) {
+	var user User
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("users/%d", id), nil, nil, &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// CreateUser creates a user.
+func (c *Client) CreateUser(ctx context.Context, req UserRequest) (*User, error) {
+	var user User
+	if err := c.do(ctx, http.MethodPost, "users", nil, req, &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// UpdateUser updates the user with the ID.
+func (c *Client) UpdateUser(ctx context.Context, id int, req UserRequest) (*User, error) {
+	var user User
+	if err := c.do(ctx, http.MethodPut, fmt.Sprintf("users/%d", id), nil, req, &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// DeleteUser deletes the user with the ID. The content it owns is moved to
+// the user with the ID migrateOwnershipTo, if set.
+func (c *Client) DeleteUser(ctx context.Context, id, migrateOwnershipTo int) error {
+	var body interface{}
+	if migrateOwnershipTo != 0 {
+		body = map[string]int{"migrate_ownership_id": migrateOwnershipTo}
+	}
+
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("users/%d", id), nil, body, nil)
+}
+
+// ListRoles returns a page of roles and the total number of roles.
+func (c *Client) ListRoles(ctx context.Context, opts *ListOptions) ([]Role, int, error) {
+	var roles []Role
+	total, err := c.list(ctx, "roles", opts, &roles)
+	return roles, total, err
+}
+
+// ListAllRoles returns every role matching opts, ignoring its Count and
+// Offset.
+func (c *Client) ListAllRoles(ctx context.Context, opts *ListOptions) ([]Role, error) {
+	var all, page []Role
+	err := c.listAll(ctx, "roles", opts,
+		func() interface{} { page = nil; return &page },
+		func() int { all = append(all, page...); return len(page) })
+	return all, err
+}
+
+// GetRole returns the role with the ID, including its permissions.
+func (c *Client) GetRole(ctx context.Context, id int) (*Role, error) {
+	var role Role
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("roles/%d", id), nil, nil, &role); err != nil {
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+// CreateRole creates a role.
+func (c *Client) CreateRole(ctx context.Context, req RoleRequest) (*Role, error) {
+	var role Role
+	if err := c.do(ctx, http.MethodPost, "roles", nil, req, &role); err != nil {
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+// UpdateRole updates the role with the ID.
+func (c *Client) UpdateRole(ctx context.Context, id int, req RoleRequest) (*Role, error) {
+	var role Role
+	if err := c.do(ctx, http.MethodPut, fmt.Sprintf("roles/%d", id), nil, req, &role); err != nil {
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+// DeleteRole deletes the role with the ID. Its users are moved to the role
+// with the ID migrateUsersTo, if set.
+func (c *Client) DeleteRole(ctx context.Context, id, migrateUsersTo int) error {
+	var body interface{}
+	if migrateUsersTo != 0 {
+		body = map[string]int{"migrate_role_id": migrateUsersTo}
+	}
+
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("roles/%d", id), nil, body, nil)
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package registry implements the parts of the OCI distribution API the
+// operator uses to resolve image tags to digests and list the tags of a
+// repository. It supports anonymous access, including the bearer token
+// flow used by public registries.
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// dockerHub is the registry of images named without one.
+	dockerHub = "docker.io"
+
+	// dockerHubEndpoint serves the distribution API for docker.io.
+	dockerHubEndpoint = "https://registry-1.docker.io"
+
+	// maxTagPages bounds the pages of tags listed for a repository.
+	maxTagPages = 50
+)
+
+// manifestTypes are the manifest media types accepted when resolving a
+// digest. Indexes are preferred, so that the digest covers all platforms.
+var manifestTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// challengeParam matches a parameter of a WWW-Authenticate challenge.
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// nextLink matches the next page in a Link header.
+var nextLink = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// Reference is a parsed image name.
+type Reference struct {
+	// Registry is the host of the registry, e.g. docker.io.
+	Registry string
+	// Repository is the path of the repository in the registry.
+	Repository string
+	// Tag is the tag of the image, latest when the name has none.
+	Tag string
+}
+
+// ParseReference parses image, e.g. lscr.io/linuxserver/bookstack:latest.
+// A digest in image is ignored.
+func ParseReference(name string) (Reference, error) {
+	image := name
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+
+	ref := Reference{Registry: dockerHub, Tag: "latest"}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		ref.Tag = image[i+1:]
+		image = image[:i]
+	}
+
+	// the first component is a registry if it looks like a host.
+	if i := strings.Index(image, "/"); i >= 0 {
+		if host := image[:i]; strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Registry = host
+			image = image[i+1:]
+		}
+	}
+
+	if image == "" || ref.Tag == "" {
+		return Reference{}, fmt.Errorf("invalid image name %q", name)
+	}
+
+	if ref.Registry == dockerHub && !strings.Contains(image, "/") {
+		image = "library/" + image
+	}
+
+	ref.Repository = image
+	return ref, nil
+}
+
+// Client queries registries over the distribution API.
+type Client struct {
+	// Endpoint is the base URL of the registry queried for every image,
+	// e.g. a mirror. The registry in the image name is queried when unset.
+	Endpoint string
+
+	httpClient *http.Client
+}
+
+// NewClient returns a Client querying endpoint, or the registry in the
+// image name when endpoint is empty. insecure disables the verification
+// of the registry's certificate.
+func NewClient(endpoint string, insecure bool) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+	}
+
+	return &Client{
+		Endpoint:   strings.TrimSuffix(endpoint, "/"),
+		httpClient: &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}
+}
+
+// Digest resolves the tag of ref to the digest of its manifest.
+func (c *Client) Digest(ctx context.Context, ref Reference) (string, error) {
+	path := fmt.Sprintf("/v2/%s/manifests/%s", ref.Repository, ref.Tag)
+
+	resp, err := c.do(ctx, http.MethodHead, ref, path)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	// the digest header is optional, so the manifest is hashed instead.
+	resp, err = c.do(ctx, http.MethodGet, ref, path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, resp.Body); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil)), nil
+}
+
+// Tags lists the tags of the repository of ref.
+func (c *Client) Tags(ctx context.Context, ref Reference) ([]string, error) {
+	var tags []string
+	path := fmt.Sprintf("/v2/%s/tags/list", ref.Repository)
+
+	for page := 0; path != "" && page < maxTagPages; page++ {
+		resp, err := c.do(ctx, http.MethodGet, ref, path)
+		if err != nil {
+			return nil, err
+		}
+
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode the tags of %s: %w", ref.Repository, err)
+		}
+
+		tags = append(tags, list.Tags...)
+
+		path = ""
+		if m := nextLink.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			path = m[1]
+		}
+	}
+
+	return tags, nil
+}
+
+// baseURL returns the base URL of the registry serving ref.
+func (c *Client) baseURL(ref Reference) string {
+	switch {
+	case c.Endpoint != "":
+		return c.Endpoint
+	case ref.Registry == dockerHub:
+		return dockerHubEndpoint
+	}
+
+	return "https://" + ref.Registry
+}
+
+// do sends a request for path to the registry serving ref, fetching an
+// anonymous bearer token if the registry asks for one. The response is
+// returned only if it succeeded.
+func (c *Client) do(ctx context.Context, method string, ref Reference, path string) (*http.Response, error) {
+	u, err := url.Parse(c.baseURL(ref))
+	if err != nil {
+		return nil, err
+	}
+
+	// path may be a link returned by the registry, with a query.
+	target, err := u.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.send(ctx, method, target.String(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+
+		token, err := c.token(ctx, resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err = c.send(ctx, method, target.String(), token)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, target.Redacted(), resp.Status)
+	}
+
+	return resp, nil
+}
+
+// send sends a request, authenticated with token if it is set.
+func (c *Client) send(ctx context.Context, method, target, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return c.httpClient.Do(req)
+}
+
+// token fetches an anonymous token for the bearer challenge.
+func (c *Client) token(ctx context.Context, challenge string) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+
+	params := map[string]string{}
+	for _, m := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid authentication realm in %q", challenge)
+	}
+
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	resp, err := c.send(ctx, http.MethodGet, realm.String(), "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to fetch a token from %s: %s", realm.Host, resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("unable to decode the token from %s: %w", realm.Host, err)
+	}
+
+	if body.Token != "" {
+		return body.Token, nil
+	}
+
+	return body.AccessToken, nil
+}
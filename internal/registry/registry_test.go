@@ -0,0 +1,238 @@
+/*
+Copyright 2022 The OpDev Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// registryStandIn serves the manifests and tags of a single repository
+// over the distribution API, optionally behind the bearer token flow.
+type registryStandIn struct {
+	// manifests maps tags to the manifest served for them.
+	manifests map[string]string
+	// tags are served one page per element.
+	tags [][]string
+	// token, when set, is required and served by /token.
+	token string
+	// withDigest sets the Docker-Content-Digest header.
+	withDigest bool
+
+	server *httptest.Server
+}
+
+func newRegistryStandIn(t *testing.T, r *registryStandIn) *registryStandIn {
+	t.Helper()
+	r.server = httptest.NewServer(r)
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *registryStandIn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		if req.URL.Query().Get("service") != "registry.test" || req.URL.Query().Get("scope") != "repository:linuxserver/bookstack:pull" {
+			http.Error(w, "bad token request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"token":%q}`, r.token)
+		return
+	}
+
+	if r.token != "" && req.Header.Get("Authorization") != "Bearer "+r.token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+			`Bearer realm="%s/token",service="registry.test",scope="repository:linuxserver/bookstack:pull"`, r.server.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	const prefix = "/v2/linuxserver/bookstack/"
+	path := strings.TrimPrefix(req.URL.Path, prefix)
+	switch {
+	case path == req.URL.Path:
+		http.NotFound(w, req)
+	case path == "tags/list":
+		page := 0
+		fmt.Sscanf(req.URL.Query().Get("page"), "%d", &page)
+		if page >= len(r.tags) {
+			http.NotFound(w, req)
+			return
+		}
+		if page+1 < len(r.tags) {
+			w.Header().Set("Link", fmt.Sprintf(`<%stags/list?page=%d>; rel="next"`, prefix, page+1))
+		}
+		fmt.Fprintf(w, `{"tags":["%s"]}`, strings.Join(r.tags[page], `","`))
+	case strings.HasPrefix(path, "manifests/"):
+		manifest, ok := r.manifests[strings.TrimPrefix(path, "manifests/")]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if !strings.Contains(req.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json") {
+			http.Error(w, "manifest index not accepted", http.StatusNotAcceptable)
+			return
+		}
+		if r.withDigest {
+			w.Header().Set("Docker-Content-Digest", digestOf(manifest))
+		}
+		if req.Method == http.MethodGet {
+			fmt.Fprint(w, manifest)
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func digestOf(manifest string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest)))
+}
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Reference
+		wantErr bool
+	}{
+		{
+			name: "lscr.io/linuxserver/bookstack:v23.05.2-ls90",
+			want: Reference{Registry: "lscr.io", Repository: "linuxserver/bookstack", Tag: "v23.05.2-ls90"},
+		},
+		{
+			name: "linuxserver/bookstack",
+			want: Reference{Registry: "docker.io", Repository: "linuxserver/bookstack", Tag: "latest"},
+		},
+		{
+			name: "mariadb:10.6",
+			want: Reference{Registry: "docker.io", Repository: "library/mariadb", Tag: "10.6"},
+		},
+		{
+			name: "localhost:5000/bookstack:v1@sha256:abc",
+			want: Reference{Registry: "localhost:5000", Repository: "bookstack", Tag: "v1"},
+		},
+		{
+			name:    "bookstack:",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseReference(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseReference() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseReference() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDigest(t *testing.T) {
+	const index = `{"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+
+	tests := []struct {
+		name     string
+		registry registryStandIn
+		tag      string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "digest header",
+			registry: registryStandIn{manifests: map[string]string{"v1": index}, withDigest: true},
+			tag:      "v1",
+			want:     digestOf(index),
+		},
+		{
+			name:     "hashed manifest without digest header",
+			registry: registryStandIn{manifests: map[string]string{"v1": index}},
+			tag:      "v1",
+			want:     digestOf(index),
+		},
+		{
+			name:     "bearer challenge",
+			registry: registryStandIn{manifests: map[string]string{"v1": index}, withDigest: true, token: "anonymous"},
+			tag:      "v1",
+			want:     digestOf(index),
+		},
+		{
+			name:     "bearer challenge without digest header",
+			registry: registryStandIn{manifests: map[string]string{"v1": index}, token: "anonymous"},
+			tag:      "v1",
+			want:     digestOf(index),
+		},
+		{
+			name:     "unknown tag",
+			registry: registryStandIn{manifests: map[string]string{"v1": index}, withDigest: true, token: "anonymous"},
+			tag:      "v2",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newRegistryStandIn(t, &tt.registry)
+			ref := Reference{Registry: "registry.test", Repository: "linuxserver/bookstack", Tag: tt.tag}
+
+			got, err := NewClient(registry.server.URL, false).Digest(context.Background(), ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Digest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Digest() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDigestUnsupportedChallenge(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	ref := Reference{Registry: "registry.test", Repository: "linuxserver/bookstack", Tag: "v1"}
+	_, err := NewClient(server.URL, false).Digest(context.Background(), ref)
+	if err == nil || !strings.Contains(err.Error(), "unsupported authentication challenge") {
+		t.Errorf("Digest() error = %v, want an unsupported challenge", err)
+	}
+}
+
+func TestTags(t *testing.T) {
+	registry := newRegistryStandIn(t, &registryStandIn{
+		tags:  [][]string{{"v1", "v2"}, {"v3"}, {"latest"}},
+		token: "anonymous",
+	})
+
+	ref := Reference{Registry: "registry.test", Repository: "linuxserver/bookstack", Tag: "latest"}
+	got, err := NewClient(registry.server.URL, false).Tags(context.Background(), ref)
+	if err != nil {
+		t.Fatalf("Tags() error = %v", err)
+	}
+
+	if want := []string{"v1", "v2", "v3", "latest"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Tags() = %v, want %v", got, want)
+	}
+}